@@ -5,8 +5,10 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/codegangsta/negroni"
+	"github.com/coocood/qbs"
 	"github.com/goincremental/negroni-sessions"
 	"github.com/goincremental/negroni-sessions/cookiestore"
 
@@ -20,33 +22,28 @@ var VERSION = "0.1.0"
 var logger = log.New(os.Stdout, "[api] ", 0)
 
 func main() {
-	// Get the required environment variables
-	port, err := strconv.ParseInt(os.Getenv("PORT"), 10, 64)
+	// Read the settings from CONFIG_FILE, the environment, and etcd if ETCD_HOST is set
+	config := new(be.Config)
+	err := be.NewConfigLoader(config).Load()
 	if err != nil {
-		logger.Panic("No PORT env variable")
+		logger.Panic("Configuration error: " + err.Error())
 		return
 	}
-	staticDir := os.Getenv("STATIC_DIR")
-	if staticDir == "" {
-		logger.Panic("No STATIC_DIR env variable")
-		return
-	}
-	fsDir := os.Getenv("FILE_STORAGE_DIR")
-	if fsDir == "" {
-		logger.Panic("No FILE_STORAGE_DIR env variable")
-		return
-	}
-	sessionSecret := os.Getenv("SESSION_SECRET")
-	if sessionSecret == "" {
-		logger.Panic("No SESSION_SECRET env variable")
-		return
-	}
-	frontEndDir := os.Getenv("FRONT_END_DIR") // Optional
+	config.ConfigureDB()
+	port := config.Port
+	staticDir := config.StaticDir
+	fsDir := config.FileStorageDir
+	sessionSecret := config.SessionSecret
+	frontEndDir := config.FrontEndDir
 
 	logger.Print("PORT:\t\t", port)
 	logger.Print("STATIC_DIR:\t", staticDir)
 	logger.Print("FRONT_END_DIR:\t", frontEndDir)
-	logger.Print("FILE_STORAGE_DIR:\t", fsDir)
+	if config.S3Bucket != "" {
+		logger.Print("S3_BUCKET:\t", config.S3Bucket, " at ", config.S3Endpoint)
+	} else {
+		logger.Print("FILE_STORAGE_DIR:\t", fsDir)
+	}
 	logger.Print("DB host: ", be.DBHost, ":", be.DBPort)
 
 	err = be.InitDB()
@@ -60,11 +57,24 @@ func main() {
 		return
 	}
 
-	fs, err := be.NewLocalFileStorage(fsDir)
+	fs, err := config.NewFileStorage()
 	if err != nil {
-		logger.Panic("Could not open file storage directory: " + fsDir)
+		logger.Panic("Could not open file storage: " + err.Error())
 		return
 	}
+	be.DefaultStorageQuota = config.StorageQuota
+	be.MaxImagePixels = config.MaxImagePixels
+	be.SetMaxImageDecodes(config.MaxImageDecodes)
+	be.PregenerateImagePresets = config.PregenerateImagePresets
+	if len(config.ImagePresets) > 0 {
+		be.DefaultImagePresets, err = be.ParseImagePresets(config.ImagePresets)
+		if err != nil {
+			logger.Panic("Bad image presets: " + err.Error())
+			return
+		}
+	}
+
+	go deleteExpiredUploads(fs)
 
 	server := negroni.New()
 	store := cookiestore.New([]byte(sessionSecret))
@@ -81,15 +91,41 @@ func main() {
 	server.Use(static)
 
 	api := be.NewAPI("/api/"+VERSION, VERSION, fs)
+	if config.FileURLSecret != "" {
+		api.URLSigner.Secret = []byte(config.FileURLSecret)
+	} else {
+		api.URLSigner.Secret = []byte(sessionSecret)
+	}
 	api.AddResource(NewEchoResource(), true)
 	api.AddResource(cms.NewLogsResource(), true)
 	api.AddResource(cms.NewLogResource(), true)
 	api.AddResource(cms.NewLogEntriesResource(), true)
 	api.AddResource(cms.NewEntryResource(), true)
 	api.AddResource(cms.NewEntryImageResource(), false)
+	api.AddResource(cms.NewEntryImageMetadataResource(), true)
 
 	server.UseHandler(api.Mux)
-	server.Run(":" + strconv.FormatInt(port, 10))
+	server.Run(":" + strconv.Itoa(port))
+}
+
+/*
+deleteExpiredUploads removes abandoned resumable uploads once an hour
+*/
+func deleteExpiredUploads(fs be.FileStorage) {
+	for range time.Tick(time.Hour) {
+		db, err := qbs.GetQbs()
+		if err != nil {
+			logger.Print("Could not connect to the DB to delete expired uploads: " + err.Error())
+			continue
+		}
+		count, err := be.DeleteExpiredUploads(fs, db)
+		db.Close()
+		if err != nil {
+			logger.Print("Could not delete expired uploads: " + err.Error())
+		} else if count > 0 {
+			logger.Print("Deleted expired uploads: ", count)
+		}
+	}
 }
 
 type EtcPostgresData struct {
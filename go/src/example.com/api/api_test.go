@@ -123,6 +123,13 @@ func TestLogAPI(t *testing.T) {
 	reader, err := staffClient.GetFile(imageUrl)
 	AssertNil(t, err)
 	AssertNotNil(t, reader)
+	metadata := &be.ImageMetadata{}
+	AssertNil(t, staffClient.GetJSON(imageUrl+"/metadata", metadata))
+	AssertEqual(t, 640, metadata.Width) // TempImage is always 640x480
+	AssertEqual(t, 480, metadata.Height)
+	AssertEqual(t, 28, len(metadata.BlurHash))
+	AssertEqual(t, "#00ffff", metadata.DominantColor)
+	AssertNotNil(t, userClient.GetJSON(imageUrl+"/metadata", metadata), "The entry is not published")
 
 	list, err = userClient.GetList("/log/" + strconv.FormatInt(log5.Id, 10) + "/entries")
 	AssertNil(t, err)
@@ -184,8 +191,14 @@ func TestLogAPI(t *testing.T) {
 	objs = list.Objects.([]interface{})
 	AssertEqual(t, 2, len(objs))
 
+	AssertNotEqual(t, "", entry5.Image)
 	err = staffClient.Delete("/entry/" + strconv.FormatInt(entry5.Id, 10))
 	AssertNil(t, err)
+	exists, err := testApi.API.FileStorage.Exists(entry5.Image, "")
+	AssertNil(t, err)
+	AssertFalse(t, exists, "Deleting an entry deletes its image")
+	_, err = be.FindFileRecord(entry5.Image, db)
+	AssertNotNil(t, err)
 
 	list, err = staffClient.GetList("/log/" + strconv.FormatInt(log5.Id, 10) + "/entries")
 	AssertNil(t, err)
@@ -2,8 +2,24 @@ package cms
 
 import (
 	"github.com/coocood/qbs"
+
+	"podipo.com/skellago/be"
 )
 
+// Migrations is the list of schema changes for the cms package's tables
+var Migrations = []be.Migration{
+	be.Migration{
+		Name: "0001_entry_log_id_index",
+		Up:   []string{"create index entry_log_id_idx on entry (log_id)"},
+		Down: []string{"drop index entry_log_id_idx"},
+	},
+}
+
+func init() {
+	be.RegisterMigrations("cms", Migrations...)
+	be.RegisterFileFields("cms", be.FileField{Table: "entry", Column: "image", Kind: EntryImageReference, IdColumn: "id"})
+}
+
 func MigrateDB() error {
 	migration, err := qbs.GetMigration()
 	if err != nil {
@@ -13,7 +29,14 @@ func MigrateDB() error {
 	migration.CreateTableIfNotExists(new(Log))
 	migration.CreateTableIfNotExists(new(Entry))
 	migration.CreateTableIfNotExists(new(Tag))
-	return nil
+
+	db, err := qbs.GetQbs()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = be.Migrate(db, "cms", false, nil)
+	return err
 }
 
 func WipeDB() error {
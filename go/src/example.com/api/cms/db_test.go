@@ -2,6 +2,8 @@ package cms
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"testing"
 
 	. "github.com/chai2010/assert"
@@ -130,3 +132,44 @@ func TestLog(t *testing.T) {
 	AssertNil(t, err)
 	AssertEqual(t, 2, len(entries))
 }
+
+func TestEntryImageGarbage(t *testing.T) {
+	be.CreateAndInitDB()
+	err := MigrateDB()
+	AssertNil(t, err)
+
+	db, err := qbs.GetQbs()
+	AssertNil(t, err)
+	defer func() {
+		be.WipeDB()
+		WipeDB()
+		db.Close()
+	}()
+
+	fs := be.NewMemoryFileStorage()
+	key, err := fs.Put("image.png", strings.NewReader("image"))
+	AssertNil(t, err)
+	_, err = be.CreateFileRecord(key, "image.png", "image/png", 5, "", 0, db)
+	AssertNil(t, err)
+	log, err := CreateLog("Garbage", "garbage", db)
+	AssertNil(t, err)
+	entry, err := CreateEntry(log, "Title", "title", "Content", db)
+	AssertNil(t, err)
+	entry.Image = key
+	AssertNil(t, UpdateEntry(entry, db))
+	AssertNil(t, be.AddFileReference(key, EntryImageReference, strconv.FormatInt(entry.Id, 10), db))
+
+	report, err := be.CollectGarbage(fs, db, 0, false)
+	AssertNil(t, err)
+	AssertEqual(t, 0, len(report.Orphans))
+
+	// Deleting the entry without releasing its image leaves a reference to a record which is gone
+	_, err = DeleteEntry(entry.Id, db)
+	AssertNil(t, err)
+	report, err = be.CollectGarbage(fs, db, 0, false)
+	AssertNil(t, err)
+	AssertEqual(t, []string{key}, report.Orphans)
+	exists, err := fs.Exists(key, "")
+	AssertNil(t, err)
+	AssertFalse(t, exists, "The deleted entry's image should be collected")
+}
@@ -91,6 +91,9 @@ var LogProperties = []be.Property{
 	},
 }
 
+// EntryImageReference is the FileReference kind for Entry.Image
+const EntryImageReference = "entry.image"
+
 var EntryImageProperties = []be.Property{
 	be.Property{
 		Name:        "image",
@@ -172,7 +175,15 @@ func (resource LogsResource) Post(request *be.APIRequest) (int, interface{}, htt
 	}
 	newLog.Tagline = log.Tagline
 	newLog.Publish = log.Publish
-	UpdateLog(newLog, request.DB)
+	err = UpdateLog(newLog, request.DB)
+	if err != nil {
+		// The transaction is rolled back, so the log created above is not kept
+		return 400, be.APIError{
+			Id:      "log_update_error",
+			Message: "Could not update the log",
+			Error:   err.Error(),
+		}, responseHeader
+	}
 	return 200, newLog, responseHeader
 }
 
@@ -487,6 +498,15 @@ func (resource EntryResource) Delete(request *be.APIRequest) (int, interface{},
 		}, responseHeader
 	}
 
+	entry, err := FindEntry(id, request.DB)
+	if err != nil {
+		return 404, be.APIError{
+			Id:      "no_such_entry",
+			Message: "No such entry: " + strconv.FormatInt(id, 10),
+			Error:   err.Error(),
+		}, responseHeader
+	}
+
 	_, err = DeleteEntry(id, request.DB)
 	if err != nil {
 		return 400, be.APIError{
@@ -495,63 +515,96 @@ func (resource EntryResource) Delete(request *be.APIRequest) (int, interface{},
 			Error:   err.Error(),
 		}, responseHeader
 	}
+	if entry.Image != "" {
+		// The image is deleted once the transaction commits, unless another record references it
+		err = request.ReleaseFile(entry.Image, EntryImageReference, strconv.FormatInt(id, 10))
+		if err != nil {
+			return http.StatusInternalServerError, &be.APIError{
+				Id:      "database_error",
+				Message: "Could not release the entry's image: " + err.Error(),
+			}, responseHeader
+		}
+	}
 
 	return 200, "Deleted", responseHeader
 }
 
 type EntryImageResource struct {
+	Policy      be.UploadPolicy  // Limits the images accepted by PutForm
+	Presets     []be.ImagePreset // The sizes Get may be asked for with ?w=&h=&mode=, the first is served when none is asked for
+	Pregenerate bool             // Makes the derivatives for all Presets in the background after PutForm
 }
 
 func NewEntryImageResource() *EntryImageResource {
-	return &EntryImageResource{}
+	return &EntryImageResource{
+		Policy:      be.DefaultImageUploadPolicy,
+		Presets:     append([]be.ImagePreset{be.ImagePreset{1400, 800, be.ImageModeFill}}, be.DefaultImagePresets...),
+		Pregenerate: be.PregenerateImagePresets,
+	}
 }
 
 func (EntryImageResource) Name() string  { return "entry-image" }
 func (EntryImageResource) Path() string  { return "/entry/{id:[0-9]+}/image" }
 func (EntryImageResource) Title() string { return "Entry Image" }
 func (EntryImageResource) Description() string {
-	return "The main image associated with an entry"
+	return "The main image associated with an entry. GET may ask for an allowed size with ?w=&h=&mode= where the mode is fill, smart, fit, exact, or thumbnail. PUT a form with an image field, or JSON like {\"upload\": uuid} to use a finished resumable upload."
 }
 
 func (resource EntryImageResource) Properties() []be.Property {
 	return EntryImageProperties
 }
 
-func (resource EntryImageResource) Get(request *be.APIRequest) (int, interface{}, http.Header) {
-	responseHeader := map[string][]string{}
+func (resource EntryImageResource) MaxBodySize(method string) int64 {
+	return resource.Policy.MaxBodySize()
+}
 
+/*
+findVisibleImageEntry returns the Entry named by the path unless it is unpublished and this is not a staff request
+*/
+func findVisibleImageEntry(request *be.APIRequest) (*Entry, int, interface{}) {
 	idVal, _ := request.PathValues["id"]
 	id, _ := strconv.ParseInt(idVal, 10, 64)
 	entry, err := FindEntry(id, request.DB)
 	if err != nil {
-		return 404, be.APIError{
+		return nil, 404, be.APIError{
 			Id:      "no_such_entry",
 			Message: "No such entry: " + strconv.FormatInt(id, 10),
 			Error:   err.Error(),
-		}, responseHeader
+		}
 	}
 
 	// Don't show the entry if it isn't published and this isn't a staff request
 	if entry.Log.Publish == false || entry.Publish == false {
 		if request.User == nil {
-			return 403, be.NotLoggedInError, responseHeader
+			return nil, 403, be.NotLoggedInError
 		}
 		if request.User.Staff == false {
-			return 403, be.ForbiddenError, responseHeader
+			return nil, 403, be.ForbiddenError
 		}
 	}
+	return entry, 0, nil
+}
+
+func (resource EntryImageResource) Get(request *be.APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	entry, status, apiError := findVisibleImageEntry(request)
+	if entry == nil {
+		return status, apiError, responseHeader
+	}
 
 	if entry.Image == "" {
 		return 404, be.FileNotFoundError, responseHeader
 	}
 
-	imageFile, err := be.FitCrop(1400, 800, entry.Image, request.FS)
+	preset, apiError := request.RequestedImagePreset(resource.Presets)
+	if apiError != nil {
+		return 400, apiError, responseHeader
+	}
+	imageFile, err := request.ImageDerivative(preset, entry.Image)
 	if err != nil {
-		logger.Print("Error with fit crop ", err.Error())
-		return 500, &be.APIError{
-			Id:      be.InternalServerError.Id,
-			Message: "Error reading image: " + request.User.Image + ": " + err.Error(),
-		}, responseHeader
+		logger.Print("Error with image derivative ", err.Error())
+		status, apiError := be.DerivativeErrorResponse(err)
+		return status, apiError, responseHeader
 	}
 
 	err = request.ServeImage(imageFile)
@@ -566,24 +619,35 @@ func (resource EntryImageResource) Get(request *be.APIRequest) (int, interface{}
 	return be.StatusInternallyHandled, nil, nil
 }
 
-func (resource EntryImageResource) PutForm(request *be.APIRequest) (int, interface{}, http.Header) {
-	responseHeader := map[string][]string{}
+/*
+findImageEntryForStaff returns the Entry named by the path if this is a staff request
+*/
+func findImageEntryForStaff(request *be.APIRequest) (*Entry, int, interface{}) {
 	if request.User == nil {
-		return 403, be.NotLoggedInError, responseHeader
+		return nil, 403, be.NotLoggedInError
 	}
 	if request.User.Staff == false {
-		return 403, be.ForbiddenError, responseHeader
+		return nil, 403, be.ForbiddenError
 	}
 
 	idVal, _ := request.PathValues["id"]
 	id, _ := strconv.ParseInt(idVal, 10, 64)
 	entry, err := FindEntry(id, request.DB)
 	if err != nil {
-		return 404, be.APIError{
+		return nil, 404, be.APIError{
 			Id:      "no_such_entry",
 			Message: "No such entry: " + strconv.FormatInt(id, 10),
 			Error:   err.Error(),
-		}, responseHeader
+		}
+	}
+	return entry, 0, nil
+}
+
+func (resource EntryImageResource) PutForm(request *be.APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	entry, status, apiError := findImageEntryForStaff(request)
+	if entry == nil {
+		return status, apiError, responseHeader
 	}
 
 	file, fileHeader, err := request.Raw.FormFile("image")
@@ -593,16 +657,46 @@ func (resource EntryImageResource) PutForm(request *be.APIRequest) (int, interfa
 			Message: "An `image` field is required",
 		}, responseHeader
 	}
-	fileKey, err := request.FS.Put(fileHeader.Filename, file)
+	defer file.Close()
+	fileRecord, err := request.PutFileWithPolicy(fileHeader.Filename, file, resource.Policy)
+	if err != nil {
+		status, apiError := be.UploadErrorResponse(err)
+		return status, apiError, responseHeader
+	}
+	return resource.setImage(request, entry, fileRecord)
+}
+
+/*
+Put sets the image to the File of a finished upload, with a body like {"upload": "<uuid>"}
+*/
+func (resource EntryImageResource) Put(request *be.APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	entry, status, apiError := findImageEntryForStaff(request)
+	if entry == nil {
+		return status, apiError, responseHeader
+	}
+	fileRecord, status, apiError := request.PutUploadWithPolicy(resource.Policy)
+	if fileRecord == nil {
+		return status, apiError, responseHeader
+	}
+	return resource.setImage(request, entry, fileRecord)
+}
+
+/*
+setImage references the newly stored fileRecord from the entry and releases its old image
+*/
+func (resource EntryImageResource) setImage(request *be.APIRequest, entry *Entry, fileRecord *be.FileRecord) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	err := request.ReferenceFile(fileRecord.Key, EntryImageReference, strconv.FormatInt(entry.Id, 10))
 	if err != nil {
 		return http.StatusInternalServerError, &be.APIError{
-			Id:      "storage_error",
-			Message: "Could not store the file: " + err.Error(),
+			Id:      "database_error",
+			Message: "Could not reference the file: " + err.Error(),
 		}, responseHeader
 	}
 
 	oldFileKey := entry.Image
-	entry.Image = fileKey
+	entry.Image = fileRecord.Key
 	err = UpdateEntry(entry, request.DB)
 	if err != nil {
 		return http.StatusInternalServerError, &be.APIError{
@@ -611,10 +705,48 @@ func (resource EntryImageResource) PutForm(request *be.APIRequest) (int, interfa
 		}, responseHeader
 	}
 	if oldFileKey != "" {
-		err = request.FS.Delete(oldFileKey, "")
+		// The old file is deleted once the transaction commits, unless another record references it
+		err = request.ReleaseFile(oldFileKey, EntryImageReference, strconv.FormatInt(entry.Id, 10))
 		if err != nil {
-			logger.Print("Could not delete old image: " + err.Error())
+			return http.StatusInternalServerError, &be.APIError{
+				Id:      "database_error",
+				Message: "Could not release the old file: " + err.Error(),
+			}, responseHeader
 		}
 	}
+	if resource.Pregenerate {
+		request.PregenerateImageDerivatives(fileRecord.Key, resource.Presets)
+	}
 	return 200, "Ok", responseHeader
 }
+
+/*
+EntryImageMetadataResource describes an entry's image so that a placeholder can be drawn while it loads
+*/
+type EntryImageMetadataResource struct {
+}
+
+func NewEntryImageMetadataResource() *EntryImageMetadataResource {
+	return &EntryImageMetadataResource{}
+}
+
+func (EntryImageMetadataResource) Name() string  { return "entry-image-metadata" }
+func (EntryImageMetadataResource) Path() string  { return "/entry/{id:[0-9]+}/image/metadata" }
+func (EntryImageMetadataResource) Title() string { return "Entry Image Metadata" }
+func (EntryImageMetadataResource) Description() string {
+	return "The size, dominant color, and BlurHash of an entry's image."
+}
+
+func (resource EntryImageMetadataResource) Properties() []be.Property {
+	return be.ImageMetadataProperties
+}
+
+func (resource EntryImageMetadataResource) Get(request *be.APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	entry, status, apiError := findVisibleImageEntry(request)
+	if entry == nil {
+		return status, apiError, responseHeader
+	}
+	status, result := request.ImageMetadataResponse(entry.Image)
+	return status, result, responseHeader
+}
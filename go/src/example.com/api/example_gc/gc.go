@@ -0,0 +1,42 @@
+package main
+
+/*
+	Delete stored files which no record references and abandoned temp files
+
+	example_gc [-dry-run] [-min-age=48h]
+*/
+
+import (
+	"log"
+	"os"
+
+	_ "example.com/api/cms" // Registers the cms file fields
+	"podipo.com/skellago/be"
+)
+
+var logger = log.New(os.Stdout, "[example-gc] ", 0)
+
+func main() {
+	config := new(be.Config)
+	err := be.NewConfigLoader(config).Load()
+	if err != nil {
+		logger.Fatal("Configuration error: ", err)
+		return
+	}
+	config.ConfigureDB()
+	err = be.RegisterDB()
+	if err != nil {
+		logger.Fatal("Could not register the db", err)
+		return
+	}
+	fs, err := config.NewFileStorage()
+	if err != nil {
+		logger.Fatal("Could not open file storage: ", err)
+		return
+	}
+	err = be.GarbageCommand(fs, os.Args[1:], os.Stdout)
+	if err != nil {
+		logger.Fatal(err)
+		return
+	}
+}
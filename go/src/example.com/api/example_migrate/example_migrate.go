@@ -0,0 +1,32 @@
+package main
+
+/*
+	Apply, roll back, and report on the schema migrations of the be and cms packages
+
+	example_migrate up [-dry-run]
+	example_migrate down [steps] [-dry-run]
+	example_migrate status
+*/
+
+import (
+	"log"
+	"os"
+
+	_ "example.com/api/cms" // Registers the cms migrations
+	"podipo.com/skellago/be"
+)
+
+var logger = log.New(os.Stdout, "[example-migrate] ", 0)
+
+func main() {
+	err := be.RegisterDB()
+	if err != nil {
+		logger.Fatal("Could not register the db", err)
+		return
+	}
+	err = be.MigrationCommand(os.Args[1:], os.Stdout)
+	if err != nil {
+		logger.Fatal(err)
+		return
+	}
+}
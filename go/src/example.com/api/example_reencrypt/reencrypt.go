@@ -0,0 +1,35 @@
+package main
+
+/*
+	Encrypt every stored file which is not encrypted with the current file encryption key
+
+	example_reencrypt [-dry-run]
+*/
+
+import (
+	"log"
+	"os"
+
+	"podipo.com/skellago/be"
+)
+
+var logger = log.New(os.Stdout, "[example-reencrypt] ", 0)
+
+func main() {
+	config := new(be.Config)
+	err := be.NewConfigLoader(config).Load()
+	if err != nil {
+		logger.Fatal("Configuration error: ", err)
+		return
+	}
+	fs, err := config.NewFileStorage()
+	if err != nil {
+		logger.Fatal("Could not open file storage: ", err)
+		return
+	}
+	err = be.ReencryptCommand(fs, os.Args[1:], os.Stdout)
+	if err != nil {
+		logger.Fatal(err)
+		return
+	}
+}
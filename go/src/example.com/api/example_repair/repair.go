@@ -0,0 +1,35 @@
+package main
+
+/*
+	Copy the files and derivatives which a file storage replica is missing from the backend which has them
+
+	example_repair [-dry-run]
+*/
+
+import (
+	"log"
+	"os"
+
+	"podipo.com/skellago/be"
+)
+
+var logger = log.New(os.Stdout, "[example-repair] ", 0)
+
+func main() {
+	config := new(be.Config)
+	err := be.NewConfigLoader(config).Load()
+	if err != nil {
+		logger.Fatal("Configuration error: ", err)
+		return
+	}
+	fs, err := config.NewFileStorage()
+	if err != nil {
+		logger.Fatal("Could not open file storage: ", err)
+		return
+	}
+	err = be.RepairCommand(fs, os.Args[1:], os.Stdout)
+	if err != nil {
+		logger.Fatal(err)
+		return
+	}
+}
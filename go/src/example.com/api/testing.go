@@ -20,6 +20,7 @@ func NewTestAPI() (*be.TestAPI, error) {
 	api.API.AddResource(cms.NewLogEntriesResource(), true)
 	api.API.AddResource(cms.NewEntryResource(), true)
 	api.API.AddResource(cms.NewEntryImageResource(), false)
+	api.API.AddResource(cms.NewEntryImageMetadataResource(), true)
 
 	return api, err
 }
@@ -5,12 +5,17 @@ package be
 */
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coocood/qbs"
 	"github.com/goincremental/negroni-sessions"
@@ -19,12 +24,13 @@ import (
 
 // GET and the other HTTP methods
 const (
-	GET    = "GET"
-	POST   = "POST"
-	PUT    = "PUT"
-	DELETE = "DELETE"
-	HEAD   = "HEAD"
-	PATCH  = "PATCH"
+	GET     = "GET"
+	POST    = "POST"
+	PUT     = "PUT"
+	DELETE  = "DELETE"
+	HEAD    = "HEAD"
+	PATCH   = "PATCH"
+	OPTIONS = "OPTIONS"
 )
 
 // AuthCookieName and UserUUID are used by the session mechanism
@@ -117,11 +123,13 @@ type APIRequest struct {
 	PathValues map[string]string
 	DB         *qbs.Qbs
 	FS         FileStorage
+	URLSigner  *URLSigner
 	Session    sessions.Session
 	User       *User
 	Version    string
 	Raw        *http.Request
 	Writer     http.ResponseWriter
+	hooks      *transactionHooks
 }
 
 /*
@@ -165,6 +173,17 @@ type PatchSupported interface {
 type PatchFormSupported interface {
 	PatchForm(request *APIRequest) (int, interface{}, http.Header)
 }
+type OptionsSupported interface {
+	Options(request *APIRequest) (int, interface{}, http.Header)
+}
+
+/*
+BodyLimited can be implemented by a Resource to limit the size of request bodies, which are otherwise unlimited
+A size of 0 means no limit. Requests with larger bodies receive a 413 UploadTooLargeError.
+*/
+type BodyLimited interface {
+	MaxBodySize(method string) int64
+}
 
 /*
 API collects a tree of Resources, manages the mux, and adds the schema resource
@@ -174,7 +193,9 @@ type API struct {
 	Path        string
 	Version     string
 	FileStorage FileStorage
+	URLSigner   *URLSigner // Signs URLs for the signed-file resource, set its Secret to share URLs between API processes
 	resources   []Resource
+	versioned   map[string]bool // Resource.Name() -> whether the resource requires the version Accept header
 }
 
 func NewAPI(path string, version string, fileStorage FileStorage) *API {
@@ -183,21 +204,47 @@ func NewAPI(path string, version string, fileStorage FileStorage) *API {
 		Path:        path,
 		Version:     version,
 		FileStorage: fileStorage,
+		URLSigner:   NewURLSigner(path + "/signed-file"),
 		resources:   make([]Resource, 0),
+		versioned:   make(map[string]bool),
 	}
 	api.AddResource(NewSchemaResource(api), false)
+	api.AddResource(NewBatchResource(api), true)
 	api.AddResource(NewCurrentUserResource(), true)
 	api.AddResource(NewCurrentUserImage(), false)
+	api.AddResource(NewCurrentUserImageMetadataResource(), true)
 	api.AddResource(NewUsersResource(), true)
 	api.AddResource(NewUserResource(), true)
+	api.AddResource(NewUserStorageResource(), true)
+	api.AddResource(NewFilesResource(), true)
+	api.AddResource(NewFileResource(), true)
+	api.AddResource(NewFileContentResource(), false)
+	api.AddResource(NewFileSignedURLResource(), true)
+	api.AddResource(NewFileFocalPointResource(), true)
+	api.AddResource(NewSignedFileResource(), false)
+	api.AddResource(NewUploadsResource(), false)
+	api.AddResource(NewUploadResource(), false)
 	return api
 }
 
 func (api *API) AddResource(resource Resource, versioned bool) {
 	api.resources = append(api.resources, resource)
+	api.versioned[resource.Name()] = versioned
 	api.Mux.HandleFunc(api.Path+resource.Path(), api.createHandlerFunc(resource, versioned)).Name(resource.Name())
 }
 
+/*
+findResource returns the Resource registered under name, or nil if there is none
+*/
+func (api *API) findResource(name string) Resource {
+	for _, resource := range api.resources {
+		if resource.Name() == name {
+			return resource
+		}
+	}
+	return nil
+}
+
 func (api *API) acceptableAcceptHeader(acceptTypes []string) bool {
 	if len(acceptTypes) == 0 {
 		return false
@@ -211,74 +258,114 @@ func (api *API) acceptableAcceptHeader(acceptTypes []string) bool {
 	return false
 }
 
+/*
+requestScope carries state from an enclosing request into a dispatched request.
+The batch resource uses it to run sub-requests with the caller's session and DB.
+*/
+type requestScope struct {
+	PathValues map[string]string
+	Session    sessions.Session
+	DB         *qbs.Qbs          // Not closed by the dispatched request
+	Hooks      *transactionHooks // Set if DB is in a transaction owned by the enclosing request
+}
+
 /*
 	Generate the http.HandlerFunc for a given Resource
 */
 func (api *API) createHandlerFunc(resource Resource, versioned bool) http.HandlerFunc {
-	isMultipart := func(header http.Header) bool {
-		return strings.Index(header.Get("Content-Type"), "multipart/form-data;") == 0
+	return func(rw http.ResponseWriter, request *http.Request) {
+		api.handleRequest(resource, versioned, rw, request, nil)
 	}
+}
 
-	return func(rw http.ResponseWriter, request *http.Request) {
-		if versioned && !api.acceptableAcceptHeader(request.Header["Accept"]) {
-			rw.WriteHeader(http.StatusBadRequest)
-			errorString, _ := json.Marshal(IncorrectVersionError)
-			rw.Write(errorString)
-			return
+func isMultipart(header http.Header) bool {
+	return strings.Index(header.Get("Content-Type"), "multipart/form-data;") == 0
+}
+
+/*
+methodHandlerFor returns the resource's function for the request's HTTP method, or nil if the method is not supported
+*/
+func methodHandlerFor(resource Resource, request *http.Request) func(*APIRequest) (int, interface{}, http.Header) {
+	switch request.Method {
+	case GET:
+		if resource, ok := resource.(GetSupported); ok {
+			return resource.Get
 		}
-		var methodHandler func(*APIRequest) (int, interface{}, http.Header)
-		switch request.Method {
-		case GET:
-			if resource, ok := resource.(GetSupported); ok {
-				methodHandler = resource.Get
+	case POST:
+		if isMultipart(request.Header) {
+			if resource, ok := resource.(PostFormSupported); ok {
+				return resource.PostForm
 			}
-		case POST:
-			if isMultipart(request.Header) {
-				if resource, ok := resource.(PostFormSupported); ok {
-					methodHandler = resource.PostForm
-				}
-			} else {
-				if resource, ok := resource.(PostSupported); ok {
-					methodHandler = resource.Post
-				}
+		} else {
+			if resource, ok := resource.(PostSupported); ok {
+				return resource.Post
 			}
-		case PUT:
-			if isMultipart(request.Header) {
-				if resource, ok := resource.(PutFormSupported); ok {
-					methodHandler = resource.PutForm
-				}
-			} else {
-				if resource, ok := resource.(PutSupported); ok {
-					methodHandler = resource.Put
-				}
+		}
+	case PUT:
+		if isMultipart(request.Header) {
+			if resource, ok := resource.(PutFormSupported); ok {
+				return resource.PutForm
 			}
-		case DELETE:
-			if resource, ok := resource.(DeleteSupported); ok {
-				methodHandler = resource.Delete
+		} else {
+			if resource, ok := resource.(PutSupported); ok {
+				return resource.Put
 			}
-		case HEAD:
-			if resource, ok := resource.(HeadSupported); ok {
-				methodHandler = resource.Head
+		}
+	case DELETE:
+		if resource, ok := resource.(DeleteSupported); ok {
+			return resource.Delete
+		}
+	case HEAD:
+		if resource, ok := resource.(HeadSupported); ok {
+			return resource.Head
+		}
+	case PATCH:
+		if isMultipart(request.Header) {
+			if resource, ok := resource.(PatchFormSupported); ok {
+				return resource.PatchForm
 			}
-		case PATCH:
-			if isMultipart(request.Header) {
-				if resource, ok := resource.(PatchFormSupported); ok {
-					methodHandler = resource.PatchForm
-				}
-			} else {
-				if resource, ok := resource.(PatchSupported); ok {
-					methodHandler = resource.Patch
-				}
+		} else {
+			if resource, ok := resource.(PatchSupported); ok {
+				return resource.Patch
 			}
 		}
-		if methodHandler == nil {
-			rw.WriteHeader(http.StatusMethodNotAllowed)
-			errorString, _ := json.Marshal(MethodNotAllowedError)
-			rw.Write(errorString)
-			return
+	case OPTIONS:
+		if resource, ok := resource.(OptionsSupported); ok {
+			return resource.Options
 		}
+	}
+	return nil
+}
+
+/*
+handleRequest runs a request through a Resource and writes the response to rw
+If scope is nil the session and DB are taken from the request, otherwise from the scope
+*/
+func (api *API) handleRequest(resource Resource, versioned bool, rw http.ResponseWriter, request *http.Request, scope *requestScope) {
+	if versioned && !api.acceptableAcceptHeader(request.Header["Accept"]) {
+		rw.WriteHeader(http.StatusBadRequest)
+		errorString, _ := json.Marshal(IncorrectVersionError)
+		rw.Write(errorString)
+		return
+	}
+	methodHandler := methodHandlerFor(resource, request)
+	if methodHandler == nil {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		errorString, _ := json.Marshal(MethodNotAllowedError)
+		rw.Write(errorString)
+		return
+	}
 
-		db, err := qbs.GetQbs()
+	var db *qbs.Qbs
+	var session sessions.Session
+	var pathValues map[string]string
+	if scope != nil {
+		db = scope.DB
+		session = scope.Session
+		pathValues = scope.PathValues
+	} else {
+		var err error
+		db, err = qbs.GetQbs()
 		if err != nil {
 			rw.WriteHeader(http.StatusInternalServerError)
 			jError := APIError{
@@ -290,102 +377,233 @@ func (api *API) createHandlerFunc(resource Resource, versioned bool) http.Handle
 			return
 		}
 		defer db.Close()
+		session = sessions.GetSession(request)
+		pathValues = mux.Vars(request)
+	}
 
-		session := sessions.GetSession(request)
+	apiRequest := &APIRequest{
+		PathValues: pathValues,
+		DB:         db,
+		FS:         api.FileStorage,
+		URLSigner:  api.URLSigner,
+		Session:    session,
+		Version:    api.Version,
+		Raw:        request,
+		Writer:     rw,
+		hooks:      &transactionHooks{},
+	}
+	if scope != nil && scope.Hooks != nil {
+		apiRequest.hooks = scope.Hooks
+	}
 
-		apiRequest := &APIRequest{
-			PathValues: mux.Vars(request),
-			DB:         db,
-			FS:         api.FileStorage,
-			Session:    sessions.GetSession(request),
-			Version:    api.Version,
-			Raw:        request,
-			Writer:     rw,
+	// Fetch the User from the session
+	if session != nil {
+		sUUID := session.Get(UserUUIDKey)
+		if sUUID != nil {
+			uuid, _ := sUUID.(string)
+			user, err := FindUser(uuid, db)
+			if err == nil {
+				apiRequest.User = user
+			}
 		}
+	}
 
-		// Fetch the User from the session
-		if session != nil {
-			sUUID := session.Get(UserUUIDKey)
-			if sUUID != nil {
-				uuid, _ := sUUID.(string)
-				user, err := FindUser(uuid, db)
-				if err == nil {
-					apiRequest.User = user
-				}
+	// Limit the body before a multipart form is read onto disk
+	if limited, ok := resource.(BodyLimited); ok && request.Body != nil {
+		if maxSize := limited.MaxBodySize(request.Method); maxSize > 0 {
+			if request.ContentLength > maxSize {
+				rw.WriteHeader(http.StatusRequestEntityTooLarge)
+				errorString, _ := json.Marshal(UploadTooLargeError)
+				rw.Write(errorString)
+				return
 			}
+			request.Body = http.MaxBytesReader(rw, request.Body, maxSize)
 		}
+	}
 
-		if isMultipart(request.Header) && request.ParseMultipartForm(1024) != nil {
+	if isMultipart(request.Header) {
+		if err := request.ParseMultipartForm(1024); err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				rw.WriteHeader(http.StatusRequestEntityTooLarge)
+				errorString, _ := json.Marshal(UploadTooLargeError)
+				rw.Write(errorString)
+				return
+			}
 			rw.WriteHeader(http.StatusBadRequest)
 			errorString, _ := json.Marshal(FormParseError)
 			rw.Write(errorString)
 			return
 		}
+	}
 
-		rw.Header().Add("API-Version", api.Version)
-		rw.Header().Add("Request-Id", UUID()) // Useful for tracking requests across the front and back end
-		code, data, header := methodHandler(apiRequest)
-
-		// If the handler signaled that it handled the raw request itself, do nothing more
-		if code == StatusInternallyHandled {
-			return
-		}
-		// Not handled internally, so assume that it's the normal JSON API response
-
-		for name, values := range header {
-			for _, value := range values {
-				rw.Header().Add(name, value)
-			}
-		}
+	rw.Header().Add("API-Version", api.Version)
+	rw.Header().Add("Request-Id", UUID()) // Useful for tracking requests across the front and back end
 
-		content, err := json.Marshal(data)
+	// Mutating requests run in a transaction unless the resource opts out or an enclosing request owns one
+	var txDB *qbs.Qbs
+	if wantsTransaction(resource, request.Method) && (scope == nil || scope.Hooks == nil) {
+		err := db.Begin()
 		if err != nil {
 			rw.WriteHeader(http.StatusInternalServerError)
 			jError := APIError{
-				Id:      "json_serialization_error",
-				Message: "JSON serialization error: " + err.Error(),
+				Id:      "db_error",
+				Message: "Could not begin a transaction: " + err.Error(),
 			}
 			errorString, _ := json.Marshal(jError)
 			rw.Write(errorString)
 			return
 		}
-		rw.Header().Add("Content-Type", "application/json")
+		txDB = db
+		defer func() {
+			if r := recover(); r != nil {
+				txDB.Rollback()
+				apiRequest.hooks.rolledBack()
+				panic(r)
+			}
+		}()
+	}
 
-		// Check whether the client's If-None-Match and the response header's ETag match
-		if rw.Header().Get("Etag") != "" && rw.Header().Get("Etag") == request.Header.Get("If-None-Match") {
-			rw.WriteHeader(http.StatusNotModified)
-			return
+	code, data, header := methodHandler(apiRequest)
+
+	if scope == nil || scope.Hooks == nil {
+		err := finishTransaction(txDB, code, apiRequest.hooks)
+		if err != nil {
+			logger.Print("Could not commit the transaction: " + err.Error())
+			if code == StatusInternallyHandled {
+				return
+			}
+			code = http.StatusInternalServerError
+			data = APIError{
+				Id:      "db_error",
+				Message: "Could not commit the transaction",
+				Error:   err.Error(),
+			}
 		}
+	}
+
+	// If the handler signaled that it handled the raw request itself, do nothing more
+	if code == StatusInternallyHandled {
+		return
+	}
+	// Not handled internally, so assume that it's the normal JSON API response
 
-		rw.WriteHeader(code)
-		rw.Write(content)
+	for name, values := range header {
+		for _, value := range values {
+			rw.Header().Add(name, value)
+		}
 	}
+
+	content, err := json.Marshal(data)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		jError := APIError{
+			Id:      "json_serialization_error",
+			Message: "JSON serialization error: " + err.Error(),
+		}
+		errorString, _ := json.Marshal(jError)
+		rw.Write(errorString)
+		return
+	}
+	rw.Header().Add("Content-Type", "application/json")
+
+	// Check whether the client's If-None-Match and the response header's ETag match
+	if rw.Header().Get("Etag") != "" && rw.Header().Get("Etag") == request.Header.Get("If-None-Match") {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rw.WriteHeader(code)
+	rw.Write(content)
 }
 
 /*
 ServeImage responds to the request with the image in imageFile
+Derivatives are served with the Content-Type of the format in their name, and vary by Accept since APIRequest.ImageDerivative negotiates their format
 
 Callers within API resource method funcs (e.g. Get) should return an internally handled status:
 	return StatusInternallyHandled, nil, nil
 */
 func (request *APIRequest) ServeImage(imageFile File) error {
-	name, err := imageFile.Name()
-	if err != nil {
-		return err
+	options := ServeFileOptions{}
+	// The FileRecord's checksum saves hashing the image on every request
+	record, err := FindFileRecord(imageFile.Key(), request.DB)
+	if err == nil {
+		if imageFile.Derivative() == "" {
+			options.Checksum = record.Checksum
+		} else {
+			options.ETag = record.DerivativeETag(imageFile.Derivative())
+		}
 	}
-	size, err := imageFile.Size()
+	if imageFile.Derivative() != "" {
+		options.ContentType = ImageFormatContentType(ImageFormatFromDerivative(imageFile.Derivative()))
+		request.Writer.Header().Add("Vary", "Accept")
+	}
+	return request.ServeFile(imageFile, options)
+}
+
+/*
+ServeFileOptions adjust how ServeFile responds
+*/
+type ServeFileOptions struct {
+	ContentType string // If empty, the type is found from the name of an original File or the content of a derivative
+	Attachment  bool   // Ask browsers to save the File instead of displaying it
+	Checksum    string // The hex SHA-256 of the content if known (e.g. FileRecord.Checksum), otherwise it is computed
+	ETag        string // Sent instead of the checksum if set, like FileRecord.DerivativeETag
+}
+
+/*
+ServeFile streams the File in response to the request, handling Range, If-Range, and conditional GET headers
+The ETag is the SHA-256 of the content unless options.ETag is set
+
+Callers within API resource method funcs (e.g. Get) should return an internally handled status:
+	return StatusInternallyHandled, nil, nil
+*/
+func (request *APIRequest) ServeFile(file File, options ServeFileOptions) error {
+	name, err := file.Name()
 	if err != nil {
 		return err
 	}
-	reader, err := imageFile.Reader()
+	reader, err := file.Reader()
 	if err != nil {
 		return err
 	}
-	request.Raw.Header.Add("Content-Type", MimeTypeFromFileName(name))
-	request.Raw.Header.Add("Content-Length", strconv.FormatInt(size, 10))
-	_, err = io.Copy(request.Writer, reader)
-	if err != nil {
-		logger.Printf("Error serving an image but too late to recover %v", err)
+	defer reader.Close()
+
+	etag := options.ETag
+	if etag == "" && options.Checksum != "" {
+		etag = `"` + options.Checksum + `"`
 	}
+	if etag == "" {
+		hash := sha256.New()
+		_, err = io.Copy(hash, reader)
+		if err != nil {
+			return err
+		}
+		_, err = reader.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		etag = `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+	}
+
+	header := request.Writer.Header()
+	contentType := options.ContentType
+	if contentType == "" && file.Derivative() == "" {
+		// Derivatives keep the original's name but may have a different type, like a JPEG thumbnail of a PNG
+		contentType = MimeTypeFromFileName(name)
+	}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	disposition := "inline"
+	if options.Attachment {
+		disposition = "attachment"
+	}
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	header.Set("Etag", etag)
+
+	// With no name and no Content-Type, ServeContent sniffs the type from the content
+	http.ServeContent(request.Writer, request.Raw, "", time.Time{}, reader)
 	return nil
 }
@@ -1,5 +1,9 @@
 package be
 
+import (
+	"strconv"
+)
+
 type APIError struct {
 	Id      string `json:"id"`
 	Message string `json:"message"`
@@ -20,6 +24,66 @@ var (
 		Id:      "file_not_found",
 		Message: "File not found",
 	}
+	FileInUseError = APIError{
+		Id:      "file_in_use",
+		Message: "The file is referenced by a record",
+	}
+	InvalidSignedURLError = APIError{
+		Id:      "invalid_signed_url",
+		Message: "The signed URL is invalid or has expired",
+	}
+	UploadNotFoundError = APIError{
+		Id:      "upload_not_found",
+		Message: "Upload not found",
+	}
+	UploadExpiredError = APIError{
+		Id:      "upload_expired",
+		Message: "The upload has expired",
+	}
+	UploadIncompleteError = APIError{
+		Id:      "upload_incomplete",
+		Message: "The upload is not complete",
+	}
+	UploadOffsetMismatchError = APIError{
+		Id:      "upload_offset_mismatch",
+		Message: "Upload-Offset does not match the size of the upload",
+	}
+	UploadLockedError = APIError{
+		Id:      "upload_locked",
+		Message: "Another request is writing to the upload",
+	}
+	UploadTooLargeError = APIError{
+		Id:      "upload_too_large",
+		Message: "The upload is larger than the maximum size",
+	}
+	UnsupportedContentTypeError = APIError{
+		Id:      "unsupported_content_type",
+		Message: "The file's content type is not allowed",
+	}
+	StorageQuotaExceededError = APIError{
+		Id:      "storage_quota_exceeded",
+		Message: "The upload does not fit in the user's storage quota",
+	}
+	ImageTooLargeError = APIError{
+		Id:      "image_too_large",
+		Message: "The image's dimensions are too large",
+	}
+	ImagePresetNotAllowedError = APIError{
+		Id:      "image_preset_not_allowed",
+		Message: "The requested w, h, and mode are not an allowed image size",
+	}
+	ImageTooManyPixelsError = APIError{
+		Id:      "image_too_many_pixels",
+		Message: "The image has too many pixels to be decoded safely",
+	}
+	ChecksumMismatchError = APIError{
+		Id:      "checksum_mismatch",
+		Message: "The chunk does not match Upload-Checksum",
+	}
+	UnsupportedTusVersionError = APIError{
+		Id:      "unsupported_tus_version",
+		Message: "Unsupported Tus-Resumable version, the supported version is " + TusVersion,
+	}
 	JSONParseError = APIError{
 		Id:      "json_parse_error",
 		Message: "JSON parse error",
@@ -48,4 +112,12 @@ var (
 		Id:      "internal_server_error",
 		Message: "Internal server error",
 	}
+	BatchTooLargeError = APIError{
+		Id:      "batch_too_large",
+		Message: "Too many requests in the batch, the maximum is " + strconv.Itoa(MaxBatchSize),
+	}
+	BatchRolledBackError = APIError{
+		Id:      "batch_rolled_back",
+		Message: "Another request in the batch failed so the transaction was rolled back",
+	}
 )
@@ -0,0 +1,280 @@
+package be
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/coocood/qbs"
+	"github.com/gorilla/mux"
+)
+
+// MaxBatchSize is the largest number of sub-requests accepted in one batch
+const MaxBatchSize = 50
+
+var BatchProperties = []Property{
+	Property{
+		Name:        "transaction",
+		Description: "True if the requests should be run in a single database transaction which is rolled back if any request fails",
+		DataType:    "bool",
+		Optional:    true,
+	},
+	Property{
+		Name:        "requests",
+		Description: "The array of requests, each with a method, a path relative to the API, and an optional JSON body",
+		DataType:    "array",
+	},
+}
+
+/*
+BatchRequest is one sub-request of a batch
+The Path is relative to the API path, for example "/user/current"
+*/
+type BatchRequest struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+/*
+BatchData is the JSON posted to the batch resource
+*/
+type BatchData struct {
+	Transaction bool           `json:"transaction"`
+	Requests    []BatchRequest `json:"requests"`
+}
+
+/*
+BatchResult is the response to one BatchRequest
+Body is the JSON returned by the resource or, for non-JSON responses like images, base64 encoded bytes
+*/
+type BatchResult struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   interface{} `json:"body"`
+}
+
+/*
+BatchResource runs an array of requests through the API's resources using the caller's session
+*/
+type BatchResource struct {
+	api *API
+}
+
+func NewBatchResource(api *API) *BatchResource {
+	return &BatchResource{
+		api: api,
+	}
+}
+
+func (BatchResource) Name() string  { return "batch" }
+func (BatchResource) Path() string  { return "/batch" }
+func (BatchResource) Title() string { return "Batch" }
+func (BatchResource) Description() string {
+	return "Post an array of requests to run them in order, optionally in a single all-or-nothing database transaction."
+}
+
+func (resource BatchResource) Properties() []Property {
+	return BatchProperties
+}
+
+/*
+Transactional opts the batch out of the usual per-request transaction because it manages its own
+*/
+func (resource BatchResource) Transactional(method string) bool {
+	return false
+}
+
+func (resource BatchResource) Post(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	var batchData BatchData
+	err := json.NewDecoder(request.Raw.Body).Decode(&batchData)
+	if err != nil {
+		return 400, JSONParseError, responseHeader
+	}
+	if len(batchData.Requests) > MaxBatchSize {
+		return 400, BatchTooLargeError, responseHeader
+	}
+
+	// Use a separate connection for the batch so the transaction does not leak into the outer request's DB
+	db, err := qbs.GetQbs()
+	if err != nil {
+		return 500, APIError{
+			Id:      "db_error",
+			Message: "Database error",
+			Error:   err.Error(),
+		}, responseHeader
+	}
+	defer db.Close()
+	var hooks *transactionHooks
+	if batchData.Transaction {
+		err = db.Begin()
+		if err != nil {
+			return 500, APIError{
+				Id:      "db_error",
+				Message: "Could not begin a transaction",
+				Error:   err.Error(),
+			}, responseHeader
+		}
+		hooks = &transactionHooks{}
+		defer func() {
+			if r := recover(); r != nil {
+				db.Rollback()
+				hooks.rolledBack()
+				panic(r)
+			}
+		}()
+	}
+
+	results := make([]BatchResult, len(batchData.Requests))
+	failedIndex := -1
+	for i, batchRequest := range batchData.Requests {
+		results[i] = resource.dispatch(request, batchRequest, db, hooks)
+		if batchData.Transaction && (results[i].Status < 200 || results[i].Status > 299) {
+			failedIndex = i
+			break
+		}
+	}
+
+	if batchData.Transaction {
+		status := 200
+		if failedIndex != -1 {
+			status = results[failedIndex].Status
+		}
+		err = finishTransaction(db, status, hooks)
+		if err == nil && failedIndex == -1 {
+			return 200, results, responseHeader
+		}
+		if err != nil {
+			logger.Print("Could not commit batch: " + err.Error())
+		}
+		// Nothing was persisted, so mark every result other than the failure as rolled back
+		for i := range results {
+			if i == failedIndex {
+				continue
+			}
+			results[i] = BatchResult{
+				Status: http.StatusFailedDependency,
+				Header: http.Header{},
+				Body:   BatchRolledBackError,
+			}
+		}
+	}
+	return 200, results, responseHeader
+}
+
+/*
+dispatch runs a single BatchRequest through the API's mux and handler pipeline
+*/
+func (resource BatchResource) dispatch(request *APIRequest, batchRequest BatchRequest, db *qbs.Qbs, hooks *transactionHooks) BatchResult {
+	if !strings.HasPrefix(batchRequest.Path, "/") {
+		return batchErrorResult(http.StatusBadRequest, BadRequestError)
+	}
+	var body []byte
+	if len(batchRequest.Body) > 0 {
+		body = batchRequest.Body
+	}
+	subRequest, err := http.NewRequest(strings.ToUpper(batchRequest.Method), resource.api.Path+batchRequest.Path, bytes.NewReader(body))
+	if err != nil {
+		return batchErrorResult(http.StatusBadRequest, BadRequestError)
+	}
+	subRequest.Header.Set("Accept", request.Raw.Header.Get("Accept"))
+	subRequest.Header.Set("Content-Type", "application/json")
+	for _, cookie := range request.Raw.Cookies() {
+		subRequest.AddCookie(cookie)
+	}
+	subRequest.RemoteAddr = request.Raw.RemoteAddr
+
+	var match mux.RouteMatch
+	if !resource.api.Mux.Match(subRequest, &match) || match.Route == nil {
+		return batchErrorResult(http.StatusNotFound, APIError{
+			Id:      "not_found",
+			Message: "No such resource: " + batchRequest.Path,
+		})
+	}
+	subResource := resource.api.findResource(match.Route.GetName())
+	if subResource == nil {
+		return batchErrorResult(http.StatusNotFound, APIError{
+			Id:      "not_found",
+			Message: "No such resource: " + batchRequest.Path,
+		})
+	}
+	if _, isBatch := subResource.(*BatchResource); isBatch {
+		return batchErrorResult(http.StatusBadRequest, APIError{
+			Id:      "nested_batch",
+			Message: "Batches cannot contain other batches",
+		})
+	}
+
+	writer := newBatchResponseWriter()
+	scope := &requestScope{
+		PathValues: match.Vars,
+		Session:    request.Session,
+		DB:         db,
+		Hooks:      hooks,
+	}
+	resource.api.handleRequest(subResource, resource.api.versioned[subResource.Name()], writer, subRequest, scope)
+	return writer.result()
+}
+
+func batchErrorResult(status int, apiError APIError) BatchResult {
+	return BatchResult{
+		Status: status,
+		Header: http.Header{},
+		Body:   apiError,
+	}
+}
+
+/*
+batchResponseWriter is an http.ResponseWriter which records a sub-request's response
+*/
+type batchResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBatchResponseWriter() *batchResponseWriter {
+	return &batchResponseWriter{
+		header: http.Header{},
+	}
+}
+
+func (writer *batchResponseWriter) Header() http.Header {
+	return writer.header
+}
+
+func (writer *batchResponseWriter) Write(data []byte) (int, error) {
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	return writer.body.Write(data)
+}
+
+func (writer *batchResponseWriter) WriteHeader(status int) {
+	if writer.status == 0 {
+		writer.status = status
+	}
+}
+
+func (writer *batchResponseWriter) result() BatchResult {
+	status := writer.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	result := BatchResult{
+		Status: status,
+		Header: writer.header,
+	}
+	data := writer.body.Bytes()
+	if len(data) == 0 {
+		return result
+	}
+	if json.Valid(data) {
+		result.Body = json.RawMessage(data)
+	} else {
+		result.Body = data
+	}
+	return result
+}
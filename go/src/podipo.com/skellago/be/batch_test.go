@@ -0,0 +1,81 @@
+package be
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "github.com/chai2010/assert"
+	"github.com/coocood/qbs"
+)
+
+func TestBatchAPI(t *testing.T) {
+	CreateAndInitDB()
+	db, err := qbs.GetQbs()
+	AssertNil(t, err)
+	defer func() {
+		WipeDB()
+		db.Close()
+	}()
+
+	testApi, err := NewTestAPI()
+	AssertNil(t, err)
+	defer testApi.Stop()
+
+	userClient, staffClient, err := CreateTestUserAndStaffWithClients(testApi, db)
+	AssertNil(t, err)
+
+	results, err := userClient.Batch([]BatchRequest{
+		BatchRequest{Method: "GET", Path: "/user/current"},
+		BatchRequest{Method: "GET", Path: "/user/"},
+		BatchRequest{Method: "GET", Path: "/no/such/thing"},
+	}, false)
+	AssertNil(t, err)
+	AssertEqual(t, 3, len(results))
+	AssertEqual(t, 200, results[0].Status)
+	AssertEqual(t, 403, results[1].Status, "Users list should be staff only, even in a batch")
+	AssertEqual(t, 404, results[2].Status)
+	user := new(User)
+	body, err := json.Marshal(results[0].Body)
+	AssertNil(t, err)
+	AssertNil(t, json.Unmarshal(body, user))
+	AssertEqual(t, userClient.User.UUID, user.UUID, "Sub-requests should use the caller's session")
+
+	results, err = staffClient.Batch([]BatchRequest{
+		BatchRequest{Method: "POST", Path: "/batch", Body: json.RawMessage("{}")},
+	}, false)
+	AssertNil(t, err)
+	AssertEqual(t, 400, results[0].Status, "Nested batches should be refused")
+
+	// Update the staff user and then fail, so the update should be rolled back
+	staff := staffClient.User
+	staff.FirstName = "Rolled"
+	staffData, err := json.Marshal(staff)
+	AssertNil(t, err)
+	results, err = staffClient.Batch([]BatchRequest{
+		BatchRequest{Method: "PUT", Path: "/user/" + staff.UUID, Body: staffData},
+		BatchRequest{Method: "GET", Path: "/user/not-a-uuid"},
+	}, true)
+	AssertNil(t, err)
+	AssertEqual(t, 2, len(results))
+	AssertEqual(t, 424, results[0].Status)
+	AssertEqual(t, 404, results[1].Status)
+	staff2, err := FindUser(staff.UUID, db)
+	AssertNil(t, err)
+	AssertNotEqual(t, "Rolled", staff2.FirstName)
+
+	// Now the same update in a transaction which succeeds
+	results, err = staffClient.Batch([]BatchRequest{
+		BatchRequest{Method: "PUT", Path: "/user/" + staff.UUID, Body: staffData},
+		BatchRequest{Method: "GET", Path: "/user/" + staff.UUID},
+	}, true)
+	AssertNil(t, err)
+	AssertEqual(t, 200, results[0].Status)
+	AssertEqual(t, 200, results[1].Status)
+	staff2, err = FindUser(staff.UUID, db)
+	AssertNil(t, err)
+	AssertEqual(t, "Rolled", staff2.FirstName)
+
+	tooMany := make([]BatchRequest, MaxBatchSize+1)
+	_, err = staffClient.Batch(tooMany, false)
+	AssertNotNil(t, err)
+}
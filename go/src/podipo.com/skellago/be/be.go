@@ -29,39 +29,94 @@ func MimeTypeFromFileName(name string) string {
 	return mime.TypeByExtension(name[lindex:])
 }
 
+/*
+EtcdGet returns the value of the etcd v2 key at path, for example /v2/keys/skella/port
+*/
 func EtcdGet(host string, path string) (string, error) {
-	url := "http://" + host + ":4001" + path
-	resp, err := http.Get(url)
+	node, err := EtcdGetNode(host, path)
 	if err != nil {
-		logger.Print("Error fetching " + url)
 		return "", err
 	}
-	if resp.StatusCode != 200 {
+	return node.Value, nil
+}
+
+/*
+EtcdGetNode returns the etcd v2 node at path, including its children if path ends with ?recursive=true
+*/
+func EtcdGetNode(host string, path string) (*EtcdNode, error) {
+	node, _, err := etcdGetIndexedNode(host, path)
+	return node, err
+}
+
+/*
+etcdGetIndexedNode is EtcdGetNode which also returns the X-Etcd-Index of the response, the index to watch from for changes after it
+*/
+func etcdGetIndexedNode(host string, path string) (*EtcdNode, uint64, error) {
+	url := "http://" + host + ":4001" + path
+	resp, err := http.Get(url)
+	if err != nil {
 		logger.Print("Error fetching " + url)
-		return "", errors.New("Non 200 status code: " + strconv.Itoa(resp.StatusCode))
+		return nil, 0, err
 	}
 	defer resp.Body.Close()
+	node, err := readEtcdResponse(url, resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Etcd-Index"), 10, 64)
+	return node, index, nil
+}
+
+func readEtcdResponse(url string, resp *http.Response) (*EtcdNode, error) {
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		logger.Print("Error fetching " + url)
-		return "", err
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		logger.Print("Error fetching " + url)
+		etcdErr := &EtcdError{}
+		if json.Unmarshal(body, etcdErr) == nil && etcdErr.ErrorCode != 0 {
+			return nil, etcdErr
+		}
+		return nil, errors.New("Non 200 status code: " + strconv.Itoa(resp.StatusCode))
 	}
 
 	var etcdResponse EtcdResponse
 	err = json.NewDecoder(strings.NewReader(string(body))).Decode(&etcdResponse)
 	if err != nil {
 		logger.Print("Could not parse the etcd data: " + string(body))
-		return "", err
+		return nil, err
 	}
-	return etcdResponse.Node.Value, nil
+	return &etcdResponse.Node, nil
 }
 
 type EtcdNode struct {
-	Key   string `json:key`
-	Value string `json:value`
+	Key           string     `json:"key"`
+	Value         string     `json:"value"`
+	Dir           bool       `json:"dir"`
+	Nodes         []EtcdNode `json:"nodes"`
+	ModifiedIndex uint64     `json:"modifiedIndex"`
+}
+
+// EtcdEventIndexCleared is the EtcdError code for a watch from an index older than the events etcd keeps
+const EtcdEventIndexCleared = 401
+
+/*
+EtcdError is the body of an etcd v2 error response
+*/
+type EtcdError struct {
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+	Cause     string `json:"cause"`
+	Index     uint64 `json:"index"`
+}
+
+func (etcdErr *EtcdError) Error() string {
+	return "etcd error " + strconv.Itoa(etcdErr.ErrorCode) + ": " + etcdErr.Message + " (" + etcdErr.Cause + ")"
 }
 
 type EtcdResponse struct {
-	Action string   `json:action`
-	Node   EtcdNode `json:node`
+	Action string   `json:"action"`
+	Node   EtcdNode `json:"node"`
 }
@@ -265,6 +265,23 @@ func (client *Client) UpdateUserImage(imageFile *os.File) error {
 	return nil
 }
 
+/*
+Batch posts requests to the batch resource and returns a result for each request
+If transaction is true then the requests are run in a single all-or-nothing database transaction
+*/
+func (client *Client) Batch(requests []BatchRequest, transaction bool) ([]BatchResult, error) {
+	batchData := BatchData{
+		Transaction: transaction,
+		Requests:    requests,
+	}
+	var results []BatchResult
+	err := client.PostAndReceiveJSON("/batch", batchData, &results)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
 func (client *Client) prepJSONRequest(method string, url string, data []byte) (req *http.Request, err error) {
 	if data == nil {
 		return client.prepRequest(method, url, nil, "application/json")
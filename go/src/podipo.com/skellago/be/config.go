@@ -0,0 +1,569 @@
+package be
+
+/*
+	Typed configuration loaded from defaults, a config file, environment variables, and etcd.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+Config holds the settings used by every Skella back end
+Applications with their own settings can embed Config in their own struct and hand that to a ConfigLoader
+
+Fields are described by struct tags:
+	config:"port"      the key in config files and under the etcd prefix
+	env:"PORT"         the environment variable
+	default:"9000"     the value used if no source sets one
+	required:"true"    Load fails if no source sets a value
+*/
+type Config struct {
+	Port           int    `config:"port" env:"PORT" default:"9000"`
+	StaticDir      string `config:"static_dir" env:"STATIC_DIR" required:"true"`
+	FrontEndDir    string `config:"front_end_dir" env:"FRONT_END_DIR"`
+	FileStorageDir string `config:"file_storage_dir" env:"FILE_STORAGE_DIR"`
+	SessionSecret  string `config:"session_secret" env:"SESSION_SECRET" required:"true"`
+	FileURLSecret  string `config:"file_url_secret" env:"FILE_URL_SECRET"` // Signs file URLs, SessionSecret is used if this is empty
+	StorageQuota   int64  `config:"storage_quota" env:"STORAGE_QUOTA"`     // The bytes each user may upload unless staff change it, 0 for no limit
+
+	// Image sizes like 200x200-thumbnail which the image resources serve with ?w=&h=&mode=, be.DefaultImagePresets if empty
+	ImagePresets []string `config:"image_presets" env:"IMAGE_PRESETS"`
+	// Make the derivatives for every preset in the background after an image is uploaded, see PregenerateImagePresets
+	PregenerateImagePresets bool `config:"pregenerate_image_presets" env:"PREGENERATE_IMAGE_PRESETS"`
+
+	// Limits on decoding images, see MaxImagePixels and SetMaxImageDecodes
+	MaxImagePixels  int64 `config:"max_image_pixels" env:"MAX_IMAGE_PIXELS" default:"40000000"` // 0 for no limit
+	MaxImageDecodes int   `config:"max_image_decodes" env:"MAX_IMAGE_DECODES"`                  // At once, 0 for the number of CPUs
+
+	// If ContentAddressed is set then identical files are stored once, see ContentAddressedFileStorage
+	ContentAddressed bool `config:"file_storage_content_addressed" env:"FILE_STORAGE_CONTENT_ADDRESSED"`
+
+	// If FileStorageReplicaDirs is set then files are also written to a LocalFileStorage in each, see MirroredFileStorage
+	FileStorageReplicaDirs []string `config:"file_storage_replica_dirs" env:"FILE_STORAGE_REPLICA_DIRS"`
+	FileStorageReplication string   `config:"file_storage_replication" env:"FILE_STORAGE_REPLICATION" default:"sync"` // sync or async
+
+	// If FileEncryptionKeys is set then files are encrypted with the key named by FileEncryptionKeyId, see EncryptedFileStorage
+	FileEncryptionKeys  string `config:"file_encryption_keys" env:"FILE_ENCRYPTION_KEYS"` // id1:base64key1,id2:base64key2
+	FileEncryptionKeyId string `config:"file_encryption_key_id" env:"FILE_ENCRYPTION_KEY_ID"`
+
+	// If S3Bucket is set then files are stored in S3 (or an S3 compatible service at S3Endpoint) instead of FileStorageDir
+	S3Endpoint  string `config:"s3_endpoint" env:"S3_ENDPOINT" default:"https://s3.amazonaws.com"`
+	S3Region    string `config:"s3_region" env:"S3_REGION" default:"us-east-1"`
+	S3Bucket    string `config:"s3_bucket" env:"S3_BUCKET"`
+	S3AccessKey string `config:"s3_access_key" env:"S3_ACCESS_KEY"`
+	S3SecretKey string `config:"s3_secret_key" env:"S3_SECRET_KEY"`
+	S3Prefix    string `config:"s3_prefix" env:"S3_PREFIX"`
+	S3PathStyle bool   `config:"s3_path_style" env:"S3_PATH_STYLE"`
+
+	DatabaseURL      string `config:"database_url" env:"DATABASE_URL"`
+	PostgresDBName   string `config:"postgres_db_name" env:"POSTGRES_DB_NAME"`
+	PostgresUser     string `config:"postgres_user" env:"POSTGRES_USER"`
+	PostgresPassword string `config:"postgres_password" env:"POSTGRES_PASSWORD"`
+	PostgresHost     string `config:"postgres_host" env:"POSTGRES_HOST" default:"localhost"`
+	PostgresPort     string `config:"postgres_port" env:"POSTGRES_PORT" default:"5432"`
+}
+
+/*
+ConfigureDB points InitDB and RegisterDB at the database described by the Config
+*/
+func (config *Config) ConfigureDB() {
+	DBURL = config.DatabaseURL
+	DBName = config.PostgresDBName
+	DBUser = config.PostgresUser
+	DBPass = config.PostgresPassword
+	DBHost = config.PostgresHost
+	DBPort = config.PostgresPort
+}
+
+/*
+NewFileStorage returns an S3FileStorage if S3Bucket is set, otherwise a LocalFileStorage in FileStorageDir
+Either is mirrored to LocalFileStorages in FileStorageReplicaDirs if any are set,
+then wrapped in an EncryptedFileStorage if FileEncryptionKeys is set and then in a ContentAddressedFileStorage if ContentAddressed is set
+*/
+func (config *Config) NewFileStorage() (FileStorage, error) {
+	fs, err := config.newBackendFileStorage()
+	if err != nil {
+		return nil, err
+	}
+	if len(config.FileStorageReplicaDirs) > 0 {
+		fs, err = config.newMirroredFileStorage(fs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.FileEncryptionKeys != "" {
+		keys, err := ParseEncryptionKeys(config.FileEncryptionKeys)
+		if err != nil {
+			return nil, err
+		}
+		encrypted, err := NewEncryptedFileStorage(fs, keys, config.FileEncryptionKeyId)
+		if err != nil {
+			return nil, err
+		}
+		fs = encrypted
+	}
+	if !config.ContentAddressed {
+		return fs, nil
+	}
+	cas, err := NewContentAddressedFileStorage(fs)
+	if err != nil {
+		return nil, err
+	}
+	return cas, nil
+}
+
+func (config *Config) newMirroredFileStorage(primary FileStorage) (FileStorage, error) {
+	if config.FileStorageReplication != "sync" && config.FileStorageReplication != "async" {
+		return nil, errors.New("file_storage_replication (FILE_STORAGE_REPLICATION) must be sync or async")
+	}
+	replicas := []FileStorage{}
+	for _, dir := range config.FileStorageReplicaDirs {
+		replica, err := NewLocalFileStorage(dir)
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, replica)
+	}
+	return NewMirroredFileStorage(primary, replicas, config.FileStorageReplication == "async")
+}
+
+func (config *Config) newBackendFileStorage() (FileStorage, error) {
+	if config.S3Bucket != "" {
+		return NewS3FileStorage(S3Config{
+			Endpoint:  config.S3Endpoint,
+			Region:    config.S3Region,
+			Bucket:    config.S3Bucket,
+			AccessKey: config.S3AccessKey,
+			SecretKey: config.S3SecretKey,
+			Prefix:    config.S3Prefix,
+			PathStyle: config.S3PathStyle,
+		})
+	}
+	if config.FileStorageDir == "" {
+		return nil, errors.New("Either file_storage_dir (FILE_STORAGE_DIR) or s3_bucket (S3_BUCKET) is required")
+	}
+	return NewLocalFileStorage(config.FileStorageDir)
+}
+
+/*
+ConfigLoader fills a tagged struct from, in increasing order of precedence:
+defaults, the config file, environment variables, and etcd.
+
+When etcd is being watched, hold the loader's read lock while reading watched fields.
+*/
+type ConfigLoader struct {
+	sync.RWMutex
+	Target     interface{} // A pointer to a tagged struct like *Config
+	FileName   string      // Optional .json, .yaml, .yml, or .toml file
+	EtcdHost   string      // Optional etcd v2 host
+	EtcdPrefix string      // The etcd directory holding the keys, for example /skella
+
+	etcdIndex uint64 // The X-Etcd-Index of the last read of etcd, which Watch waits for changes after
+}
+
+/*
+NewConfigLoader uses the CONFIG_FILE, ETCD_HOST, and ETCD_PREFIX environment variables to find the sources
+*/
+func NewConfigLoader(target interface{}) *ConfigLoader {
+	prefix := os.Getenv("ETCD_PREFIX")
+	if prefix == "" {
+		prefix = "/skella"
+	}
+	return &ConfigLoader{
+		Target:     target,
+		FileName:   os.Getenv("CONFIG_FILE"),
+		EtcdHost:   os.Getenv("ETCD_HOST"),
+		EtcdPrefix: prefix,
+	}
+}
+
+/*
+configField is a settable field of the target struct and its tags
+*/
+type configField struct {
+	Key      string
+	Env      string
+	Default  string
+	Required bool
+	Value    reflect.Value
+}
+
+/*
+Load reads every source into the Target and then checks that required keys were set
+*/
+func (loader *ConfigLoader) Load() error {
+	loader.Lock()
+	defer loader.Unlock()
+	fields, err := configFields(loader.Target)
+	if err != nil {
+		return err
+	}
+	isSet := make(map[string]bool)
+
+	for _, field := range fields {
+		if field.Default != "" {
+			err = setConfigValue(field, field.Default)
+			if err != nil {
+				return err
+			}
+			isSet[field.Key] = true
+		}
+	}
+
+	if loader.FileName != "" {
+		values, err := readConfigFile(loader.FileName)
+		if err != nil {
+			return err
+		}
+		for _, field := range fields {
+			if value, ok := values[field.Key]; ok {
+				err = setConfigValue(field, value)
+				if err != nil {
+					return err
+				}
+				isSet[field.Key] = true
+			}
+		}
+	}
+
+	for _, field := range fields {
+		if field.Env == "" {
+			continue
+		}
+		if value, ok := os.LookupEnv(field.Env); ok && value != "" {
+			err = setConfigValue(field, value)
+			if err != nil {
+				return err
+			}
+			isSet[field.Key] = true
+		}
+	}
+
+	if loader.EtcdHost != "" {
+		values, index, err := loader.readEtcd()
+		if err != nil {
+			return err
+		}
+		loader.etcdIndex = index
+		for _, field := range fields {
+			if value, ok := values[field.Key]; ok {
+				err = setConfigValue(field, value)
+				if err != nil {
+					return err
+				}
+				isSet[field.Key] = true
+			}
+		}
+	}
+
+	missing := []string{}
+	for _, field := range fields {
+		if field.Required && !isSet[field.Key] {
+			name := field.Key
+			if field.Env != "" {
+				name += " (" + field.Env + ")"
+			}
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New("Missing required configuration: " + strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+/*
+Watch long-polls etcd and updates the Target when one of keys changes, then calls onChange
+Changes to keys which are not listed are ignored, since most settings are only read at startup
+Watching starts after the etcd index read by Load, and if etcd has cleared the events since then the keys are read again and onChange is called for each
+Call the returned func to stop watching
+*/
+func (loader *ConfigLoader) Watch(keys []string, onChange func(key string, value string)) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	watched := make(map[string]bool)
+	for _, key := range keys {
+		watched[key] = true
+	}
+	go func() {
+		loader.RLock()
+		waitIndex := etcdWaitIndexAfter(loader.etcdIndex)
+		loader.RUnlock()
+		for {
+			node, err := loader.waitForEtcd(ctx, waitIndex)
+			if ctx.Err() != nil {
+				return
+			}
+			if etcdErr, ok := err.(*EtcdError); ok && etcdErr.ErrorCode == EtcdEventIndexCleared {
+				logger.Print("Reloading the watched keys because etcd cleared the events since index ", waitIndex)
+				index, reloadErr := loader.reloadEtcd(watched, onChange)
+				if reloadErr == nil {
+					waitIndex = etcdWaitIndexAfter(index)
+					continue
+				}
+				err = reloadErr
+			}
+			if err != nil {
+				logger.Print("Error watching etcd: " + err.Error())
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(5 * time.Second):
+				}
+				continue
+			}
+			waitIndex = node.ModifiedIndex + 1
+			key := strings.TrimPrefix(node.Key, loader.EtcdPrefix+"/")
+			if !watched[key] {
+				continue
+			}
+			err = loader.set(key, node.Value)
+			if err != nil {
+				logger.Print("Could not apply etcd change to " + key + ": " + err.Error())
+				continue
+			}
+			if onChange != nil {
+				onChange(key, node.Value)
+			}
+		}
+	}()
+	return cancel
+}
+
+// etcdWaitIndexAfter returns the waitIndex for changes after index, or 0 to wait for the next change if index is unknown
+func etcdWaitIndexAfter(index uint64) uint64 {
+	if index == 0 {
+		return 0
+	}
+	return index + 1
+}
+
+/*
+reloadEtcd sets the watched keys from a fresh read of etcd, calls onChange for each, and returns the index to watch after
+*/
+func (loader *ConfigLoader) reloadEtcd(watched map[string]bool, onChange func(key string, value string)) (uint64, error) {
+	values, index, err := loader.readEtcd()
+	if err != nil {
+		return 0, err
+	}
+	loader.Lock()
+	loader.etcdIndex = index
+	loader.Unlock()
+	for key, value := range values {
+		if !watched[key] {
+			continue
+		}
+		stringValue, _ := value.(string)
+		err = loader.set(key, stringValue)
+		if err != nil {
+			logger.Print("Could not apply etcd change to " + key + ": " + err.Error())
+			continue
+		}
+		if onChange != nil {
+			onChange(key, stringValue)
+		}
+	}
+	return index, nil
+}
+
+func (loader *ConfigLoader) set(key string, value string) error {
+	loader.Lock()
+	defer loader.Unlock()
+	fields, err := configFields(loader.Target)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if field.Key == key {
+			return setConfigValue(field, value)
+		}
+	}
+	return errors.New("No such configuration key: " + key)
+}
+
+/*
+readEtcd returns the values under the prefix and the etcd index they were read at
+*/
+func (loader *ConfigLoader) readEtcd() (map[string]interface{}, uint64, error) {
+	node, index, err := etcdGetIndexedNode(loader.EtcdHost, "/v2/keys"+loader.EtcdPrefix+"?recursive=true")
+	if err != nil {
+		return nil, 0, err
+	}
+	values := make(map[string]interface{})
+	for _, child := range node.Nodes {
+		if child.Dir {
+			continue
+		}
+		values[strings.TrimPrefix(child.Key, loader.EtcdPrefix+"/")] = child.Value
+	}
+	return values, index, nil
+}
+
+func (loader *ConfigLoader) waitForEtcd(ctx context.Context, waitIndex uint64) (*EtcdNode, error) {
+	url := "http://" + loader.EtcdHost + ":4001/v2/keys" + loader.EtcdPrefix + "?wait=true&recursive=true"
+	if waitIndex > 0 {
+		url += "&waitIndex=" + strconv.FormatUint(waitIndex, 10)
+	}
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return readEtcdResponse(url, resp)
+}
+
+/*
+readConfigFile parses a JSON, YAML, or TOML file into a map of keys to values
+*/
+func readConfigFile(fileName string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		err = json.Unmarshal(data, &values)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		_, err = toml.Decode(string(data), &values)
+	default:
+		return nil, errors.New("Unknown config file type: " + fileName)
+	}
+	if err != nil {
+		return nil, errors.New("Could not parse " + fileName + ": " + err.Error())
+	}
+	return values, nil
+}
+
+/*
+configFields finds the tagged fields of target, including those of embedded structs
+*/
+func configFields(target interface{}) ([]configField, error) {
+	value := reflect.ValueOf(target)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return nil, errors.New("Configuration target must be a pointer to a struct")
+	}
+	return structConfigFields(value.Elem()), nil
+}
+
+func structConfigFields(value reflect.Value) []configField {
+	fields := []configField{}
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		structField := valueType.Field(i)
+		if structField.Anonymous && structField.Type.Kind() == reflect.Struct {
+			fields = append(fields, structConfigFields(value.Field(i))...)
+			continue
+		}
+		key := structField.Tag.Get("config")
+		if key == "" || key == "-" {
+			continue
+		}
+		fields = append(fields, configField{
+			Key:      key,
+			Env:      structField.Tag.Get("env"),
+			Default:  structField.Tag.Get("default"),
+			Required: structField.Tag.Get("required") == "true",
+			Value:    value.Field(i),
+		})
+	}
+	return fields
+}
+
+/*
+setConfigValue converts a value from a config source into the field's type
+*/
+func setConfigValue(field configField, value interface{}) error {
+	var text string
+	switch typed := value.(type) {
+	case string:
+		text = typed
+	case []interface{}:
+		parts := make([]string, len(typed))
+		for i, part := range typed {
+			parts[i] = fmt.Sprint(part)
+		}
+		text = strings.Join(parts, ",")
+	case float64:
+		text = strconv.FormatFloat(typed, 'f', -1, 64)
+	default:
+		text = fmt.Sprint(typed)
+	}
+
+	badValue := func(err error) error {
+		return errors.New("Bad value for " + field.Key + ": " + text + ": " + err.Error())
+	}
+	fieldValue := field.Value
+	if fieldValue.Type() == reflect.TypeOf(time.Duration(0)) {
+		duration, err := time.ParseDuration(text)
+		if err != nil {
+			return badValue(err)
+		}
+		fieldValue.SetInt(int64(duration))
+		return nil
+	}
+	switch fieldValue.Kind() {
+	case reflect.String:
+		fieldValue.SetString(text)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(text)
+		if err != nil {
+			return badValue(err)
+		}
+		fieldValue.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return badValue(err)
+		}
+		fieldValue.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(text, 10, 64)
+		if err != nil {
+			return badValue(err)
+		}
+		fieldValue.SetUint(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return badValue(err)
+		}
+		fieldValue.SetFloat(parsed)
+	case reflect.Slice:
+		if fieldValue.Type().Elem().Kind() != reflect.String {
+			return errors.New("Unsupported configuration type for " + field.Key)
+		}
+		parts := []string{}
+		for _, part := range strings.Split(text, ",") {
+			part = strings.TrimSpace(part)
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+		fieldValue.Set(reflect.ValueOf(parts))
+	default:
+		return errors.New("Unsupported configuration type for " + field.Key)
+	}
+	return nil
+}
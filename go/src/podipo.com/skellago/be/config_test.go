@@ -0,0 +1,127 @@
+package be
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/chai2010/assert"
+)
+
+type testConfig struct {
+	Config
+	Greeting string        `config:"greeting" env:"SKELLA_TEST_GREETING" default:"hello"`
+	Retries  int           `config:"retries"`
+	Debug    bool          `config:"debug"`
+	Timeout  time.Duration `config:"timeout" default:"5s"`
+	Hosts    []string      `config:"hosts"`
+	Ignored  string
+}
+
+func TestConfigLoader(t *testing.T) {
+	tempDir, err := ioutil.TempDir(os.TempDir(), "skellago-config")
+	AssertNil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	config := new(testConfig)
+	loader := &ConfigLoader{Target: config}
+	err = loader.Load()
+	AssertNotNil(t, err, "Required keys are not set")
+
+	fileName := path.Join(tempDir, "config.json")
+	err = ioutil.WriteFile(fileName, []byte(`{
+		"static_dir": "/static",
+		"file_storage_dir": "/files",
+		"session_secret": "file-secret",
+		"greeting": "howdy",
+		"retries": 3,
+		"debug": true,
+		"hosts": ["a.example.com", "b.example.com"]
+	}`), 0600)
+	AssertNil(t, err)
+	loader.FileName = fileName
+
+	oldSecret, hadSecret := os.LookupEnv("SESSION_SECRET")
+	os.Setenv("SESSION_SECRET", "env-secret")
+	defer func() {
+		if hadSecret {
+			os.Setenv("SESSION_SECRET", oldSecret)
+		} else {
+			os.Unsetenv("SESSION_SECRET")
+		}
+	}()
+
+	err = loader.Load()
+	AssertNil(t, err)
+	AssertEqual(t, 9000, config.Port, "Defaults should be used when no source sets a value")
+	AssertEqual(t, "/static", config.StaticDir)
+	AssertEqual(t, "env-secret", config.SessionSecret, "The environment should override the file")
+	AssertEqual(t, "howdy", config.Greeting)
+	AssertEqual(t, 3, config.Retries)
+	AssertTrue(t, config.Debug)
+	AssertEqual(t, 5*time.Second, config.Timeout)
+	AssertEqual(t, []string{"a.example.com", "b.example.com"}, config.Hosts)
+	AssertEqual(t, "", config.Ignored)
+
+	_, err = config.NewFileStorage()
+	AssertNotNil(t, err, "/files does not exist")
+	config.S3Bucket = "files"
+	fs, err := config.NewFileStorage()
+	AssertNil(t, err)
+	_, ok := fs.(*S3FileStorage)
+	AssertTrue(t, ok, "Setting a bucket should select S3")
+	config.ContentAddressed = true
+	fs, err = config.NewFileStorage()
+	AssertNil(t, err)
+	_, ok = fs.(*ContentAddressedFileStorage)
+	AssertTrue(t, ok)
+	config.FileEncryptionKeys = "k1:" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+	_, err = config.NewFileStorage()
+	AssertNotNil(t, err, "The current key id is required")
+	config.FileEncryptionKeyId = "k1"
+	fs, err = config.NewFileStorage()
+	AssertNil(t, err)
+	AssertNotNil(t, findEncryptedFileStorage(fs))
+	config.FileStorageReplicaDirs = []string{tempDir}
+	fs, err = config.NewFileStorage()
+	AssertNil(t, err)
+	AssertNotNil(t, findMirroredFileStorage(fs))
+	config.FileStorageReplication = "later"
+	_, err = config.NewFileStorage()
+	AssertNotNil(t, err)
+
+	AssertNil(t, loader.set("retries", "7"))
+	AssertEqual(t, 7, config.Retries)
+	AssertNotNil(t, loader.set("retries", "lots"))
+	AssertNotNil(t, loader.set("bogus", "1"))
+
+	loader.FileName = path.Join(tempDir, "config.ini")
+	AssertNotNil(t, loader.Load(), "Unknown file types should be an error")
+
+	AssertNotNil(t, (&ConfigLoader{Target: *config}).Load(), "The target must be a pointer")
+}
+
+func TestEtcdErrors(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	recorder.WriteHeader(400)
+	recorder.WriteString(`{"errorCode":401,"message":"The event in requested index is outdated and cleared","cause":"the requested history has been cleared [1008/7]","index":2007}`)
+	_, err := readEtcdResponse("/v2/keys/skella", recorder.Result())
+	etcdErr, ok := err.(*EtcdError)
+	AssertTrue(t, ok, "etcd errors should be parsed")
+	AssertEqual(t, EtcdEventIndexCleared, etcdErr.ErrorCode)
+	AssertEqual(t, uint64(2007), etcdErr.Index)
+
+	recorder = httptest.NewRecorder()
+	recorder.WriteHeader(502)
+	_, err = readEtcdResponse("/v2/keys/skella", recorder.Result())
+	AssertNotNil(t, err)
+	_, ok = err.(*EtcdError)
+	AssertFalse(t, ok, "Responses without an etcd error body are still errors")
+
+	AssertEqual(t, uint64(0), etcdWaitIndexAfter(0), "An unknown index waits for the next change")
+	AssertEqual(t, uint64(8), etcdWaitIndexAfter(7))
+}
@@ -0,0 +1,375 @@
+package be
+
+/*
+	Content addressed storage which keeps one copy of identical files.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	contentBlobPrefix     = "sha256-"                   // Blobs are stored under sha256-<hex digest>, which has no keySeparator so the garbage collector never takes them for Files
+	contentRefsDerivative = "refs"                      // The derivative of a blob which holds how many keys point at it
+	contentPointerPrefix  = "content-addressed sha256 " // Followed by the hex digest, this is the original stored under each key
+)
+
+var contentPointerLength = int64(len(contentPointerPrefix) + sha256.Size*2)
+
+/*
+KeyedStorage is implemented by FileStorage backends which can store an original under a key chosen by the caller instead of a generated one
+*/
+type KeyedStorage interface {
+	PutKey(key string, reader io.Reader) error
+}
+
+/*
+ContentAddressedFileStorage wraps a FileStorage so that identical content is stored once
+
+Each Put gets its own key, so names and derivatives stay per key, but the original stored under the key is a small pointer to a blob named by the SHA-256 of its content.
+Blobs count the keys which point at them and are deleted with the last one.
+Keys stored before the wrapper was used hold their content directly and keep working.
+
+The counts are guarded by a mutex, so only one process should write to the wrapped storage.
+*/
+type ContentAddressedFileStorage struct {
+	sync.Mutex
+	Storage  FileStorage
+	SpoolDir string // Where Put keeps content while it is hashed, os.TempDir() if empty
+	keyed    KeyedStorage
+}
+
+/*
+NewContentAddressedFileStorage requires a storage which implements KeyedStorage, like LocalFileStorage, S3FileStorage, and MemoryFileStorage
+*/
+func NewContentAddressedFileStorage(storage FileStorage) (*ContentAddressedFileStorage, error) {
+	keyed, ok := storage.(KeyedStorage)
+	if !ok {
+		return nil, errors.New("Content addressed storage requires a FileStorage which can put keys")
+	}
+	return &ContentAddressedFileStorage{
+		Storage: storage,
+		keyed:   keyed,
+	}, nil
+}
+
+/*
+Put hashes the data while spooling it to a temp file and then stores it only if no other key holds the same content
+*/
+func (fs *ContentAddressedFileStorage) Put(name string, reader io.Reader) (key string, err error) {
+	spool, err := ioutil.TempFile(fs.SpoolDir, "cas")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(spool, hash), reader)
+	if err != nil {
+		return "", err
+	}
+	_, err = spool.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+
+	key = generateFileKey(name)
+	fs.Lock()
+	defer fs.Unlock()
+	err = fs.addReference(digest, spool)
+	if err != nil {
+		return "", err
+	}
+	err = fs.keyed.PutKey(key, strings.NewReader(contentPointerPrefix+digest))
+	if err != nil {
+		fs.removeReference(digest)
+		return "", err
+	}
+	return key, nil
+}
+
+func (fs *ContentAddressedFileStorage) PutDerivative(key string, derivative string, reader io.Reader) error {
+	return fs.Storage.PutDerivative(key, derivative, reader)
+}
+
+/*
+Get returns the blob of an original as a File with the requested key, and derivatives as they are stored
+*/
+func (fs *ContentAddressedFileStorage) Get(key string, derivative string) (File, error) {
+	file, err := fs.Storage.Get(key, derivative)
+	if err != nil || derivative != "" {
+		return file, err
+	}
+	digest, err := readContentPointer(file)
+	if err != nil {
+		return nil, err
+	}
+	if digest == "" {
+		return file, nil
+	}
+	blob, err := fs.Storage.Get(contentBlobPrefix+digest, "")
+	if err != nil {
+		return nil, errors.New("Missing content for " + file.Key() + ": " + err.Error())
+	}
+	return contentAddressedFile{File: blob, fs: fs, key: file.Key()}, nil
+}
+
+func (fs *ContentAddressedFileStorage) Exists(key string, derivative string) (bool, error) {
+	return fs.Storage.Exists(key, derivative)
+}
+
+/*
+Delete removes the key and, if derivative is "", releases its blob, which is deleted if no other key points at it
+*/
+func (fs *ContentAddressedFileStorage) Delete(key string, derivative string) error {
+	if derivative != "" {
+		return fs.Storage.Delete(key, derivative)
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	digest := ""
+	file, err := fs.Storage.Get(key, "")
+	if err == nil {
+		digest, err = readContentPointer(file)
+		if err != nil {
+			return err
+		}
+	}
+	err = fs.Storage.Delete(key, "")
+	if err != nil || digest == "" {
+		return err
+	}
+	return fs.removeReference(digest)
+}
+
+/*
+References returns how many keys point at the blob holding the content with the hex SHA-256 digest
+*/
+func (fs *ContentAddressedFileStorage) References(digest string) (int, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.refCount(contentBlobPrefix + digest)
+}
+
+// addReference stores the blob if no key points at it yet and counts one more key, the caller must hold the lock
+func (fs *ContentAddressedFileStorage) addReference(digest string, content io.Reader) error {
+	blobKey := contentBlobPrefix + digest
+	count, err := fs.refCount(blobKey)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		// A blob without references can be left by a failed Put, and its content is the same
+		exists, err := fs.Storage.Exists(blobKey, "")
+		if err != nil {
+			return err
+		}
+		if !exists {
+			err = fs.keyed.PutKey(blobKey, content)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return fs.Storage.PutDerivative(blobKey, contentRefsDerivative, strings.NewReader(strconv.Itoa(count+1)))
+}
+
+// removeReference counts one less key and deletes the blob when none are left, the caller must hold the lock
+func (fs *ContentAddressedFileStorage) removeReference(digest string) error {
+	blobKey := contentBlobPrefix + digest
+	count, err := fs.refCount(blobKey)
+	if err != nil {
+		return err
+	}
+	if count <= 1 {
+		return fs.Storage.Delete(blobKey, "")
+	}
+	return fs.Storage.PutDerivative(blobKey, contentRefsDerivative, strings.NewReader(strconv.Itoa(count-1)))
+}
+
+// refCount returns 0 if the blob has no count
+func (fs *ContentAddressedFileStorage) refCount(blobKey string) (int, error) {
+	exists, err := fs.Storage.Exists(blobKey, contentRefsDerivative)
+	if err != nil || !exists {
+		return 0, err
+	}
+	file, err := fs.Storage.Get(blobKey, contentRefsDerivative)
+	if err != nil {
+		return 0, err
+	}
+	data, err := readAllFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(data))
+}
+
+/*
+Keys lists the keys of the wrapped storage without the blobs
+*/
+func (fs *ContentAddressedFileStorage) Keys() ([]StoredKey, error) {
+	lister, err := fs.lister()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := lister.Keys()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]StoredKey, 0, len(keys))
+	for _, stored := range keys {
+		if !strings.HasPrefix(stored.Key, contentBlobPrefix) {
+			results = append(results, stored)
+		}
+	}
+	return results, nil
+}
+
+func (fs *ContentAddressedFileStorage) Derivatives(key string) ([]string, error) {
+	lister, err := fs.lister()
+	if err != nil {
+		return nil, err
+	}
+	return lister.Derivatives(key)
+}
+
+func (fs *ContentAddressedFileStorage) TempEntries() ([]TempEntry, error) {
+	lister, err := fs.lister()
+	if err != nil {
+		return nil, err
+	}
+	return lister.TempEntries()
+}
+
+func (fs *ContentAddressedFileStorage) DeleteTemp(name string) error {
+	lister, err := fs.lister()
+	if err != nil {
+		return err
+	}
+	return lister.DeleteTemp(name)
+}
+
+func (fs *ContentAddressedFileStorage) PutChunk(uploadId string, offset int64, reader io.Reader) (int64, error) {
+	stager, err := fs.stager()
+	if err != nil {
+		return 0, err
+	}
+	return stager.PutChunk(uploadId, offset, reader)
+}
+
+func (fs *ContentAddressedFileStorage) DeleteChunk(uploadId string, offset int64) error {
+	stager, err := fs.stager()
+	if err != nil {
+		return err
+	}
+	return stager.DeleteChunk(uploadId, offset)
+}
+
+func (fs *ContentAddressedFileStorage) StagedSize(uploadId string) (int64, error) {
+	stager, err := fs.stager()
+	if err != nil {
+		return 0, err
+	}
+	return stager.StagedSize(uploadId)
+}
+
+func (fs *ContentAddressedFileStorage) StagedReader(uploadId string) (io.ReadCloser, error) {
+	stager, err := fs.stager()
+	if err != nil {
+		return nil, err
+	}
+	return stager.StagedReader(uploadId)
+}
+
+func (fs *ContentAddressedFileStorage) DeleteStaged(uploadId string) error {
+	stager, err := fs.stager()
+	if err != nil {
+		return err
+	}
+	return stager.DeleteStaged(uploadId)
+}
+
+func (fs *ContentAddressedFileStorage) lister() (Lister, error) {
+	lister, ok := fs.Storage.(Lister)
+	if !ok {
+		return nil, errors.New("The wrapped FileStorage can not list its files")
+	}
+	return lister, nil
+}
+
+func (fs *ContentAddressedFileStorage) stager() (Stager, error) {
+	stager, ok := fs.Storage.(Stager)
+	if !ok {
+		return nil, errors.New("The wrapped FileStorage can not stage uploads")
+	}
+	return stager, nil
+}
+
+// readContentPointer returns the digest if the File is a pointer to a blob, or "" if it holds its own content
+func readContentPointer(file File) (string, error) {
+	size, err := file.Size()
+	if err != nil || size != contentPointerLength {
+		return "", err
+	}
+	data, err := readAllFile(file)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(string(data), contentPointerPrefix) {
+		return "", nil
+	}
+	return string(data[len(contentPointerPrefix):]), nil
+}
+
+func readAllFile(file File) ([]byte, error) {
+	reader, err := file.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+/*
+contentAddressedFile is a blob presented under the key which points at it
+*/
+type contentAddressedFile struct {
+	File
+	fs  *ContentAddressedFileStorage
+	key string
+}
+
+func (file contentAddressedFile) Key() string {
+	return file.key
+}
+
+func (file contentAddressedFile) Name() (string, error) {
+	return fileNameFromKey(file.key), nil
+}
+
+/*
+Exists checks the key, since the blob outlives keys which share it
+*/
+func (file contentAddressedFile) Exists() (bool, error) {
+	return file.fs.Storage.Exists(file.key, "")
+}
+
+func (file contentAddressedFile) Reader() (FileReader, error) {
+	exists, err := file.Exists()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("No such File: " + file.key)
+	}
+	return file.File.Reader()
+}
@@ -0,0 +1,75 @@
+package be
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/chai2010/assert"
+)
+
+func TestContentAddressedFileStorage(t *testing.T) {
+	_, err := NewContentAddressedFileStorage(nil)
+	AssertNotNil(t, err, "The wrapped storage must be able to put keys")
+
+	fsDir, err := ioutil.TempDir(os.TempDir(), "skellago-test-cas")
+	AssertNil(t, err)
+	defer os.RemoveAll(fsDir)
+	localFS, err := NewLocalFileStorage(fsDir)
+	AssertNil(t, err)
+	memoryFS := NewMemoryFileStorage()
+
+	for _, backend := range []FileStorage{localFS, memoryFS} {
+		fs, err := NewContentAddressedFileStorage(backend)
+		AssertNil(t, err)
+		AssertFileStorage(t, fs)
+
+		// A key stored without the wrapper still works
+		plainKey, err := backend.Put("plain.txt", strings.NewReader("plain"))
+		AssertNil(t, err)
+		file, err := fs.Get(plainKey, "")
+		AssertNil(t, err)
+		data, err := readAllFile(file)
+		AssertNil(t, err)
+		AssertEqual(t, "plain", string(data))
+		AssertNil(t, fs.Delete(plainKey, ""))
+
+		key1, err := fs.Put("first.txt", strings.NewReader("same content"))
+		AssertNil(t, err)
+		key2, err := fs.Put("second.txt", strings.NewReader("same content"))
+		AssertNil(t, err)
+		AssertNotEqual(t, key1, key2)
+		digest := sha256Hex([]byte("same content"))
+		references, err := fs.References(digest)
+		AssertNil(t, err)
+		AssertEqual(t, 2, references)
+		keys, err := fs.Keys()
+		AssertNil(t, err)
+		AssertEqual(t, 2, len(keys), "Blobs should not be listed")
+
+		file, err = fs.Get(key2, "")
+		AssertNil(t, err)
+		AssertEqual(t, key2, file.Key())
+		name, err := file.Name()
+		AssertNil(t, err)
+		AssertEqual(t, "second.txt", name)
+		size, err := file.Size()
+		AssertNil(t, err)
+		AssertEqual(t, int64(len("same content")), size)
+
+		AssertNil(t, fs.Delete(key1, ""))
+		references, err = fs.References(digest)
+		AssertNil(t, err)
+		AssertEqual(t, 1, references)
+		data, err = readAllFile(file)
+		AssertNil(t, err)
+		AssertEqual(t, "same content", string(data), "Deleting one key should keep content shared by another")
+
+		AssertNil(t, fs.Delete(key2, ""))
+		exists, err := backend.Exists(contentBlobPrefix+digest, "")
+		AssertNil(t, err)
+		AssertFalse(t, exists, "The blob should be deleted with its last key")
+	}
+	AssertEqual(t, 0, len(memoryFS.files), "Nothing should be left behind")
+}
@@ -0,0 +1,632 @@
+package be
+
+/*
+	Encryption at rest of stored files with AES-GCM.
+*/
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	encryptionMagic     = "SKE1"    // Starts every encrypted File, plain Files stored before encryption was enabled do not have it
+	encryptionChunkSize = 64 * 1024 // Plain bytes per sealed chunk, so that Files can be read and seeked without decrypting all of them
+	encryptionSaltSize  = 16
+	encryptionKeySize   = 32
+)
+
+/*
+EncryptedFileStorage wraps a FileStorage so that originals and derivatives are encrypted when they are put and decrypted when they are read
+
+Each File starts with a header holding the id of the key it was encrypted with and a random salt, from which a key for that File alone is derived.
+The content follows in chunks sealed with AES-GCM, each numbered and the last one marked so that chunks can not be reordered or dropped.
+Files are encrypted with the CurrentKeyId and read with whichever of the EncryptionKeys they name, so keys can be rotated by adding a key, making it current, and running Reencrypt.
+
+Staged upload chunks are not encrypted, they are kept only until the upload is stored.
+*/
+type EncryptedFileStorage struct {
+	Storage        FileStorage
+	EncryptionKeys map[string][]byte // Key id -> 32 byte key
+	CurrentKeyId   string
+}
+
+/*
+NewEncryptedFileStorage checks that the keys are 32 bytes and the current key is one of them
+*/
+func NewEncryptedFileStorage(storage FileStorage, keys map[string][]byte, currentKeyId string) (*EncryptedFileStorage, error) {
+	for keyId, key := range keys {
+		if keyId == "" || len(keyId) > 255 {
+			return nil, errors.New("Encryption key ids must be 1 to 255 bytes: " + keyId)
+		}
+		if len(key) != encryptionKeySize {
+			return nil, fmt.Errorf("Encryption key %s is %d bytes instead of %d", keyId, len(key), encryptionKeySize)
+		}
+	}
+	if _, ok := keys[currentKeyId]; !ok {
+		return nil, errors.New("Unknown current encryption key id: " + currentKeyId)
+	}
+	return &EncryptedFileStorage{
+		Storage:        storage,
+		EncryptionKeys: keys,
+		CurrentKeyId:   currentKeyId,
+	}, nil
+}
+
+/*
+ParseEncryptionKeys reads keys of the form id1:base64key1,id2:base64key2
+*/
+func ParseEncryptionKeys(value string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		tokens := strings.SplitN(pair, ":", 2)
+		if len(tokens) != 2 {
+			return nil, errors.New("Encryption keys should look like id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(tokens[1])
+		if err != nil {
+			return nil, errors.New("Encryption key " + tokens[0] + " is not base64: " + err.Error())
+		}
+		keys[tokens[0]] = key
+	}
+	return keys, nil
+}
+
+func (fs *EncryptedFileStorage) Put(name string, reader io.Reader) (key string, err error) {
+	encrypted, err := fs.encrypt(reader)
+	if err != nil {
+		return "", err
+	}
+	return fs.Storage.Put(name, encrypted)
+}
+
+func (fs *EncryptedFileStorage) PutDerivative(key string, derivative string, reader io.Reader) error {
+	encrypted, err := fs.encrypt(reader)
+	if err != nil {
+		return err
+	}
+	return fs.Storage.PutDerivative(key, derivative, encrypted)
+}
+
+/*
+PutKey lets an EncryptedFileStorage be wrapped by a ContentAddressedFileStorage, if the storage it wraps implements KeyedStorage
+*/
+func (fs *EncryptedFileStorage) PutKey(key string, reader io.Reader) error {
+	keyed, ok := fs.Storage.(KeyedStorage)
+	if !ok {
+		return errors.New("The wrapped FileStorage can not put keys")
+	}
+	encrypted, err := fs.encrypt(reader)
+	if err != nil {
+		return err
+	}
+	return keyed.PutKey(key, encrypted)
+}
+
+/*
+Get returns a File which decrypts as it is read, or the stored File if it was stored before encryption was enabled
+*/
+func (fs *EncryptedFileStorage) Get(key string, derivative string) (File, error) {
+	file, err := fs.Storage.Get(key, derivative)
+	if err != nil {
+		return nil, err
+	}
+	header, err := readEncryptionHeader(file)
+	if err != nil || header == nil {
+		return file, err
+	}
+	aead, err := fs.aead(header)
+	if err != nil {
+		return nil, err
+	}
+	return encryptedFile{File: file, aead: aead, headerSize: header.size()}, nil
+}
+
+func (fs *EncryptedFileStorage) Exists(key string, derivative string) (bool, error) {
+	return fs.Storage.Exists(key, derivative)
+}
+
+func (fs *EncryptedFileStorage) Delete(key string, derivative string) error {
+	return fs.Storage.Delete(key, derivative)
+}
+
+/*
+KeyId returns the id of the key a File was encrypted with, or "" if it is not encrypted
+*/
+func (fs *EncryptedFileStorage) KeyId(key string, derivative string) (string, error) {
+	file, err := fs.Storage.Get(key, derivative)
+	if err != nil {
+		return "", err
+	}
+	header, err := readEncryptionHeader(file)
+	if err != nil || header == nil {
+		return "", err
+	}
+	return header.keyId, nil
+}
+
+/*
+Reencrypt encrypts every original and derivative which is not encrypted with the current key, writing a line for each to out
+The wrapped storage must implement Lister and KeyedStorage
+*/
+func (fs *EncryptedFileStorage) Reencrypt(out io.Writer, dryRun bool) (int, error) {
+	lister, ok := fs.Storage.(Lister)
+	if !ok {
+		return 0, errors.New("The wrapped FileStorage can not list its files")
+	}
+	if _, ok := fs.Storage.(KeyedStorage); !ok {
+		return 0, errors.New("The wrapped FileStorage can not put keys")
+	}
+	keys, err := lister.Keys()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, stored := range keys {
+		derivatives, err := lister.Derivatives(stored.Key)
+		if err != nil {
+			return count, err
+		}
+		for _, derivative := range append([]string{""}, derivatives...) {
+			keyId, err := fs.KeyId(stored.Key, derivative)
+			if err != nil {
+				return count, err
+			}
+			if keyId == fs.CurrentKeyId {
+				continue
+			}
+			count++
+			if dryRun {
+				fmt.Fprintf(out, "would reencrypt %s %s from key %q\n", stored.Key, derivative, keyId)
+				continue
+			}
+			err = fs.reencrypt(stored.Key, derivative)
+			if err != nil {
+				return count, errors.New("Could not reencrypt " + stored.Key + " " + derivative + ": " + err.Error())
+			}
+			fmt.Fprintf(out, "reencrypted %s %s from key %q\n", stored.Key, derivative, keyId)
+		}
+	}
+	return count, nil
+}
+
+// reencrypt spools the plain data to a temp file so that nothing reads a File while it is replaced
+func (fs *EncryptedFileStorage) reencrypt(key string, derivative string) error {
+	file, err := fs.Get(key, derivative)
+	if err != nil {
+		return err
+	}
+	reader, err := file.Reader()
+	if err != nil {
+		return err
+	}
+	spool, err := ioutil.TempFile("", "reencrypt")
+	if err != nil {
+		reader.Close()
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	_, err = io.Copy(spool, reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	_, err = spool.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	if derivative == "" {
+		return fs.PutKey(key, spool)
+	}
+	return fs.PutDerivative(key, derivative, spool)
+}
+
+/*
+ReencryptCommand runs Reencrypt for a command line tool on fs or the EncryptedFileStorage it wraps
+
+	reencrypt [-dry-run]
+*/
+func ReencryptCommand(fs FileStorage, args []string, out io.Writer) error {
+	dryRun := false
+	for _, arg := range args {
+		if arg != "-dry-run" && arg != "--dry-run" {
+			return errors.New("Usage: [-dry-run]")
+		}
+		dryRun = true
+	}
+	encrypted := findEncryptedFileStorage(fs)
+	if encrypted == nil {
+		return errors.New("File encryption is not configured")
+	}
+	count, err := encrypted.Reencrypt(out, dryRun)
+	if dryRun {
+		fmt.Fprintf(out, "would reencrypt %d files with key %q\n", count, encrypted.CurrentKeyId)
+	} else {
+		fmt.Fprintf(out, "reencrypted %d files with key %q\n", count, encrypted.CurrentKeyId)
+	}
+	return err
+}
+
+func findEncryptedFileStorage(fs FileStorage) *EncryptedFileStorage {
+	for ; fs != nil; fs = wrappedFileStorage(fs) {
+		if encrypted, ok := fs.(*EncryptedFileStorage); ok {
+			return encrypted
+		}
+	}
+	return nil
+}
+
+func (fs *EncryptedFileStorage) Keys() ([]StoredKey, error) {
+	lister, err := fs.lister()
+	if err != nil {
+		return nil, err
+	}
+	return lister.Keys()
+}
+
+func (fs *EncryptedFileStorage) Derivatives(key string) ([]string, error) {
+	lister, err := fs.lister()
+	if err != nil {
+		return nil, err
+	}
+	return lister.Derivatives(key)
+}
+
+func (fs *EncryptedFileStorage) TempEntries() ([]TempEntry, error) {
+	lister, err := fs.lister()
+	if err != nil {
+		return nil, err
+	}
+	return lister.TempEntries()
+}
+
+func (fs *EncryptedFileStorage) DeleteTemp(name string) error {
+	lister, err := fs.lister()
+	if err != nil {
+		return err
+	}
+	return lister.DeleteTemp(name)
+}
+
+func (fs *EncryptedFileStorage) PutChunk(uploadId string, offset int64, reader io.Reader) (int64, error) {
+	stager, err := fs.stager()
+	if err != nil {
+		return 0, err
+	}
+	return stager.PutChunk(uploadId, offset, reader)
+}
+
+func (fs *EncryptedFileStorage) DeleteChunk(uploadId string, offset int64) error {
+	stager, err := fs.stager()
+	if err != nil {
+		return err
+	}
+	return stager.DeleteChunk(uploadId, offset)
+}
+
+func (fs *EncryptedFileStorage) StagedSize(uploadId string) (int64, error) {
+	stager, err := fs.stager()
+	if err != nil {
+		return 0, err
+	}
+	return stager.StagedSize(uploadId)
+}
+
+func (fs *EncryptedFileStorage) StagedReader(uploadId string) (io.ReadCloser, error) {
+	stager, err := fs.stager()
+	if err != nil {
+		return nil, err
+	}
+	return stager.StagedReader(uploadId)
+}
+
+func (fs *EncryptedFileStorage) DeleteStaged(uploadId string) error {
+	stager, err := fs.stager()
+	if err != nil {
+		return err
+	}
+	return stager.DeleteStaged(uploadId)
+}
+
+func (fs *EncryptedFileStorage) lister() (Lister, error) {
+	lister, ok := fs.Storage.(Lister)
+	if !ok {
+		return nil, errors.New("The wrapped FileStorage can not list its files")
+	}
+	return lister, nil
+}
+
+func (fs *EncryptedFileStorage) stager() (Stager, error) {
+	stager, ok := fs.Storage.(Stager)
+	if !ok {
+		return nil, errors.New("The wrapped FileStorage can not stage uploads")
+	}
+	return stager, nil
+}
+
+// encrypt returns a reader of the header followed by the sealed chunks of the data from reader
+func (fs *EncryptedFileStorage) encrypt(reader io.Reader) (io.Reader, error) {
+	header := &encryptionHeader{
+		keyId: fs.CurrentKeyId,
+		salt:  make([]byte, encryptionSaltSize),
+	}
+	_, err := rand.Read(header.salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := fs.aead(header)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingReader{
+		source:  bufio.NewReader(reader),
+		aead:    aead,
+		pending: header.bytes(),
+		plain:   make([]byte, encryptionChunkSize),
+	}, nil
+}
+
+// aead derives the key of a single File from the key named by its header and its salt
+func (fs *EncryptedFileStorage) aead(header *encryptionHeader) (cipher.AEAD, error) {
+	masterKey, ok := fs.EncryptionKeys[header.keyId]
+	if !ok {
+		return nil, errors.New("Unknown encryption key id: " + header.keyId)
+	}
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write(header.salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/*
+encryptionHeader starts an encrypted File: the magic, the length of the key id, the key id, and the salt
+*/
+type encryptionHeader struct {
+	keyId string
+	salt  []byte
+}
+
+func (header *encryptionHeader) size() int64 {
+	return int64(len(encryptionMagic) + 1 + len(header.keyId) + encryptionSaltSize)
+}
+
+func (header *encryptionHeader) bytes() []byte {
+	result := []byte(encryptionMagic)
+	result = append(result, byte(len(header.keyId)))
+	result = append(result, header.keyId...)
+	return append(result, header.salt...)
+}
+
+// readEncryptionHeader returns nil if the File is not encrypted
+func readEncryptionHeader(file File) (*encryptionHeader, error) {
+	reader, err := file.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	buffered := bufio.NewReader(reader)
+	magic := make([]byte, len(encryptionMagic)+1)
+	_, err = io.ReadFull(buffered, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if string(magic[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, nil
+	}
+	rest := make([]byte, int(magic[len(encryptionMagic)])+encryptionSaltSize)
+	_, err = io.ReadFull(buffered, rest)
+	if err != nil {
+		return nil, errors.New("Truncated encryption header: " + err.Error())
+	}
+	keyIdLength := len(rest) - encryptionSaltSize
+	return &encryptionHeader{
+		keyId: string(rest[:keyIdLength]),
+		salt:  rest[keyIdLength:],
+	}, nil
+}
+
+// chunkNonce numbers the chunks and marks the last so that chunks can not be moved, dropped, or added
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+/*
+encryptingReader reads the header and then seals the data from source a chunk at a time
+*/
+type encryptingReader struct {
+	source  *bufio.Reader
+	aead    cipher.AEAD
+	pending []byte // Encrypted bytes which have not been read
+	plain   []byte
+	index   int64
+	done    bool
+}
+
+func (reader *encryptingReader) Read(p []byte) (int, error) {
+	for len(reader.pending) == 0 {
+		if reader.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(reader.source, reader.plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		last := err != nil
+		if !last {
+			// A full chunk is the last if nothing follows it
+			_, err = reader.source.Peek(1)
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+			last = err == io.EOF
+		}
+		reader.pending = reader.aead.Seal(nil, chunkNonce(reader.index, last), reader.plain[:n], nil)
+		reader.index++
+		reader.done = last
+	}
+	n := copy(p, reader.pending)
+	reader.pending = reader.pending[n:]
+	return n, nil
+}
+
+/*
+encryptedFile is a stored File which is decrypted as it is read
+*/
+type encryptedFile struct {
+	File
+	aead       cipher.AEAD
+	headerSize int64
+}
+
+/*
+Size is the size of the plain data, which is the stored size without the header and the tag of each chunk
+*/
+func (file encryptedFile) Size() (int64, error) {
+	stored, err := file.File.Size()
+	if err != nil {
+		return -1, err
+	}
+	size, _, err := encryptedSize(stored-file.headerSize, file.aead.Overhead())
+	if err != nil {
+		return -1, err
+	}
+	return size, nil
+}
+
+func (file encryptedFile) Reader() (FileReader, error) {
+	stored, err := file.File.Size()
+	if err != nil {
+		return nil, err
+	}
+	size, chunks, err := encryptedSize(stored-file.headerSize, file.aead.Overhead())
+	if err != nil {
+		return nil, err
+	}
+	source, err := file.File.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{
+		source:     source,
+		aead:       file.aead,
+		headerSize: file.headerSize,
+		size:       size,
+		chunks:     chunks,
+		chunkIndex: -1,
+	}, nil
+}
+
+/*
+encryptedSize returns the plain size and number of chunks of sealed data
+Even empty data has a sealed chunk, so sealed data with a chunk too short to hold a tag has been truncated
+*/
+func encryptedSize(sealed int64, overhead int) (int64, int64, error) {
+	sealedChunkSize := int64(encryptionChunkSize + overhead)
+	chunks := (sealed + sealedChunkSize - 1) / sealedChunkSize
+	if sealed < int64(overhead) || sealed-(chunks-1)*sealedChunkSize < int64(overhead) {
+		return 0, 0, errors.New("The encrypted File is truncated")
+	}
+	return sealed - chunks*int64(overhead), chunks, nil
+}
+
+/*
+decryptingReader opens the chunk which holds the position, so it can seek without decrypting what comes before
+*/
+type decryptingReader struct {
+	source     FileReader
+	aead       cipher.AEAD
+	headerSize int64
+	size       int64 // Of the plain data
+	chunks     int64
+	position   int64
+	chunk      []byte // The plain data of the chunk at chunkIndex
+	chunkIndex int64
+}
+
+func (reader *decryptingReader) Read(p []byte) (int, error) {
+	if reader.position >= reader.size {
+		// Empty data is only known to be whole once its one chunk, which is marked as the last, is authenticated
+		if reader.size == 0 && reader.chunkIndex != 0 {
+			err := reader.open(0)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+	index := reader.position / encryptionChunkSize
+	if index != reader.chunkIndex {
+		err := reader.open(index)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, reader.chunk[reader.position-index*encryptionChunkSize:])
+	reader.position += int64(n)
+	return n, nil
+}
+
+func (reader *decryptingReader) open(index int64) error {
+	sealedChunkSize := int64(encryptionChunkSize + reader.aead.Overhead())
+	_, err := reader.source.Seek(reader.headerSize+index*sealedChunkSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	sealed := make([]byte, sealedChunkSize)
+	n, err := io.ReadFull(reader.source, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	reader.chunk, err = reader.aead.Open(nil, chunkNonce(index, index == reader.chunks-1), sealed[:n], nil)
+	if err != nil {
+		return errors.New("Could not decrypt the File, it may have been modified: " + err.Error())
+	}
+	reader.chunkIndex = index
+	return nil
+}
+
+func (reader *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += reader.position
+	case io.SeekEnd:
+		offset += reader.size
+	}
+	if offset < 0 {
+		return reader.position, errors.New("Seek to a negative position")
+	}
+	reader.position = offset
+	return offset, nil
+}
+
+func (reader *decryptingReader) Close() error {
+	return reader.source.Close()
+}
@@ -0,0 +1,154 @@
+package be
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/chai2010/assert"
+)
+
+func TestEncryptedFileStorage(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, encryptionKeySize)
+	newKey := bytes.Repeat([]byte{2}, encryptionKeySize)
+	keys, err := ParseEncryptionKeys("old:" + base64.StdEncoding.EncodeToString(oldKey) + ", new:" + base64.StdEncoding.EncodeToString(newKey))
+	AssertNil(t, err)
+	AssertEqual(t, newKey, keys["new"])
+	_, err = ParseEncryptionKeys("old")
+	AssertNotNil(t, err)
+	_, err = NewEncryptedFileStorage(NewMemoryFileStorage(), map[string][]byte{"short": []byte("short")}, "short")
+	AssertNotNil(t, err, "Keys should be 32 bytes")
+	_, err = NewEncryptedFileStorage(NewMemoryFileStorage(), keys, "bogus")
+	AssertNotNil(t, err, "The current key should be known")
+
+	fsDir, err := ioutil.TempDir(os.TempDir(), "skellago-test-encrypted")
+	AssertNil(t, err)
+	defer os.RemoveAll(fsDir)
+	localFS, err := NewLocalFileStorage(fsDir)
+	AssertNil(t, err)
+	fs, err := NewEncryptedFileStorage(localFS, keys, "old")
+	AssertNil(t, err)
+	AssertFileStorage(t, fs)
+	memoryFS := NewMemoryFileStorage()
+	fs, err = NewEncryptedFileStorage(memoryFS, keys, "old")
+	AssertNil(t, err)
+	AssertFileStorage(t, fs)
+
+	// Several chunks, with a full last chunk
+	data := make([]byte, 3*encryptionChunkSize)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	key, err := fs.Put("big.bin", bytes.NewReader(data))
+	AssertNil(t, err)
+	stored, err := memoryFS.Get(key, "")
+	AssertNil(t, err)
+	storedData, err := readAllFile(stored)
+	AssertNil(t, err)
+	AssertFalse(t, bytes.Contains(storedData, data[:1024]), "Stored data should be encrypted")
+	file, err := fs.Get(key, "")
+	AssertNil(t, err)
+	size, err := file.Size()
+	AssertNil(t, err)
+	AssertEqual(t, int64(len(data)), size)
+	read, err := readAllFile(file)
+	AssertNil(t, err)
+	AssertEqual(t, data, read)
+	reader, err := file.Reader()
+	AssertNil(t, err)
+	_, err = reader.Seek(2*encryptionChunkSize-10, io.SeekStart)
+	AssertNil(t, err)
+	part := make([]byte, 20)
+	_, err = io.ReadFull(reader, part)
+	AssertNil(t, err)
+	AssertEqual(t, data[2*encryptionChunkSize-10:2*encryptionChunkSize+10], part, "Reads should cross chunks after seeking")
+	reader.Close()
+
+	// Tampering is detected
+	storedData[len(storedData)-1] ^= 1
+	AssertNil(t, memoryFS.PutKey(key, bytes.NewReader(storedData)))
+	file, err = fs.Get(key, "")
+	AssertNil(t, err)
+	_, err = readAllFile(file)
+	AssertNotNil(t, err)
+
+	// So is truncation, whether to whole chunks or to just the header
+	headerSize := file.(encryptedFile).headerSize
+	sealedChunkSize := encryptionChunkSize + file.(encryptedFile).aead.Overhead()
+	for _, length := range []int{int(headerSize) + sealedChunkSize, int(headerSize) + 5, int(headerSize)} {
+		AssertNil(t, memoryFS.PutKey(key, bytes.NewReader(storedData[:length])))
+		file, err = fs.Get(key, "")
+		AssertNil(t, err)
+		_, err = readAllFile(file)
+		AssertNotNil(t, err, "A File truncated to "+strconv.Itoa(length)+" bytes should not be read")
+	}
+	_, err = file.Size()
+	AssertNotNil(t, err)
+	AssertNil(t, fs.Delete(key, ""))
+
+	// An empty File is still authenticated
+	key, err = fs.Put("empty.txt", strings.NewReader(""))
+	AssertNil(t, err)
+	file, err = fs.Get(key, "")
+	AssertNil(t, err)
+	read, err = readAllFile(file)
+	AssertNil(t, err)
+	AssertEqual(t, 0, len(read))
+	stored, err = memoryFS.Get(key, "")
+	AssertNil(t, err)
+	storedData, err = readAllFile(stored)
+	AssertNil(t, err)
+	storedData[len(storedData)-1] ^= 1
+	AssertNil(t, memoryFS.PutKey(key, bytes.NewReader(storedData)))
+	file, err = fs.Get(key, "")
+	AssertNil(t, err)
+	_, err = readAllFile(file)
+	AssertNotNil(t, err)
+	AssertNil(t, fs.Delete(key, ""))
+
+	// Rotation reencrypts Files under the old key and Files stored before encryption was enabled
+	plainKey, err := memoryFS.Put("plain.txt", strings.NewReader("plain"))
+	AssertNil(t, err)
+	oldKeyKey, err := fs.Put("old.txt", strings.NewReader("old"))
+	AssertNil(t, err)
+	AssertNil(t, fs.PutDerivative(oldKeyKey, "small", strings.NewReader("o")))
+	fs.CurrentKeyId = "new"
+	var out bytes.Buffer
+	AssertNil(t, ReencryptCommand(fs, []string{"-dry-run"}, &out))
+	Assert(t, strings.Contains(out.String(), "would reencrypt 3 files"), "Bad report: "+out.String())
+	keyId, err := fs.KeyId(oldKeyKey, "")
+	AssertNil(t, err)
+	AssertEqual(t, "old", keyId, "A dry run should not reencrypt")
+	count, err := fs.Reencrypt(&out, false)
+	AssertNil(t, err)
+	AssertEqual(t, 3, count)
+	for _, expected := range []struct{ key, derivative, data string }{
+		{plainKey, "", "plain"},
+		{oldKeyKey, "", "old"},
+		{oldKeyKey, "small", "o"},
+	} {
+		keyId, err = fs.KeyId(expected.key, expected.derivative)
+		AssertNil(t, err)
+		AssertEqual(t, "new", keyId)
+		file, err = fs.Get(expected.key, expected.derivative)
+		AssertNil(t, err)
+		read, err = readAllFile(file)
+		AssertNil(t, err)
+		AssertEqual(t, expected.data, string(read))
+	}
+	delete(fs.EncryptionKeys, "old")
+	count, err = fs.Reencrypt(&out, false)
+	AssertNil(t, err)
+	AssertEqual(t, 0, count, "Nothing should need the old key")
+
+	// Content addressed storage dedupes the plain data
+	cas, err := NewContentAddressedFileStorage(fs)
+	AssertNil(t, err)
+	AssertFileStorage(t, cas)
+	AssertTrue(t, findEncryptedFileStorage(cas) == fs)
+}
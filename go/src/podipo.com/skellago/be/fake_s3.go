@@ -0,0 +1,214 @@
+package be
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+FakeS3 is an in memory stand-in for an S3 bucket which checks request signatures.
+It only handles path style requests and the calls made by S3FileStorage.
+*/
+type FakeS3 struct {
+	sync.Mutex
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	Objects   map[string][]byte
+	Modified  map[string]time.Time // When each object was last put
+	Uploads   map[string]map[int][]byte
+	nextId    int
+}
+
+/*
+NewFakeS3 returns an empty bucket, serve it with httptest.NewServer and use S3Config to connect to it
+*/
+func NewFakeS3() *FakeS3 {
+	return &FakeS3{
+		Bucket:    "test-bucket",
+		AccessKey: "test-access",
+		SecretKey: "test-secret",
+		Region:    "us-test-1",
+		Objects:   make(map[string][]byte),
+		Modified:  make(map[string]time.Time),
+		Uploads:   make(map[string]map[int][]byte),
+	}
+}
+
+/*
+S3Config returns the settings for an S3FileStorage which uses this bucket, served at endpoint
+*/
+func (fake *FakeS3) S3Config(endpoint string) S3Config {
+	return S3Config{
+		Endpoint:  endpoint,
+		Region:    fake.Region,
+		Bucket:    fake.Bucket,
+		AccessKey: fake.AccessKey,
+		SecretKey: fake.SecretKey,
+		PathStyle: true,
+	}
+}
+
+func (fake *FakeS3) writeError(rw http.ResponseWriter, status int, code string) {
+	rw.WriteHeader(status)
+	rw.Write([]byte("<Error><Code>" + code + "</Code><Message>" + code + "</Message></Error>"))
+}
+
+/*
+authorize returns the S3 error code for a request with a bad signature, or "" if the signature is good
+*/
+func (fake *FakeS3) authorize(request *http.Request, body []byte) string {
+	query := request.URL.Query()
+	if query.Get("X-Amz-Signature") != "" {
+		return fake.authorizePresigned(request)
+	}
+	payloadHash := request.Header.Get("x-amz-content-sha256")
+	if payloadHash != sha256Hex(body) {
+		return "XAmzContentSHA256Mismatch"
+	}
+	amzDate := request.Header.Get("x-amz-date")
+	if len(amzDate) < 8 {
+		return "AccessDenied"
+	}
+	signature := s3Signature(request.Method, request.URL.Path, query, request.Host, amzDate, payloadHash, fake.SecretKey, fake.Region)
+	expected := s3SignAlgorithm + " Credential=" + fake.AccessKey + "/" + s3Scope(amzDate, fake.Region) + ", SignedHeaders=" + s3SignedHeaders + ", Signature=" + signature
+	if request.Header.Get("Authorization") != expected {
+		return "SignatureDoesNotMatch"
+	}
+	return ""
+}
+
+func (fake *FakeS3) authorizePresigned(request *http.Request) string {
+	query := request.URL.Query()
+	if request.Method != "GET" && request.Method != "HEAD" {
+		return "AccessDenied"
+	}
+	amzDate := query.Get("X-Amz-Date")
+	date, err := time.Parse(s3TimeFormat, amzDate)
+	if err != nil {
+		return "AccessDenied"
+	}
+	seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || time.Now().After(date.Add(time.Duration(seconds)*time.Second)) {
+		return "AccessDenied"
+	}
+	if query.Get("X-Amz-Credential") != fake.AccessKey+"/"+s3Scope(amzDate, fake.Region) {
+		return "InvalidAccessKeyId"
+	}
+	given := query.Get("X-Amz-Signature")
+	query.Del("X-Amz-Signature")
+	signature := s3SignatureV4(request.Method, request.URL.Path, query, "host:"+request.Host+"\n", "host", s3UnsignedPayload, amzDate, fake.SecretKey, fake.Region)
+	if given != signature {
+		return "SignatureDoesNotMatch"
+	}
+	return ""
+}
+
+func (fake *FakeS3) ServeHTTP(rw http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+	if code := fake.authorize(request, body); code != "" {
+		status := http.StatusForbidden
+		if code == "XAmzContentSHA256Mismatch" {
+			status = http.StatusBadRequest
+		}
+		fake.writeError(rw, status, code)
+		return
+	}
+
+	bucketPrefix := "/" + fake.Bucket
+	if !strings.HasPrefix(request.URL.Path, bucketPrefix) {
+		fake.writeError(rw, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(request.URL.Path, bucketPrefix), "/")
+	query := request.URL.Query()
+
+	fake.Lock()
+	defer fake.Unlock()
+	switch {
+	case name == "" && request.Method == "GET" && query.Get("list-type") == "2":
+		names := []string{}
+		for objectName := range fake.Objects {
+			if strings.HasPrefix(objectName, query.Get("prefix")) {
+				names = append(names, objectName)
+			}
+		}
+		sort.Strings(names)
+		var result s3ListBucketResult
+		for _, objectName := range names {
+			result.Contents = append(result.Contents, s3Object{objectName, int64(len(fake.Objects[objectName])), fake.Modified[objectName]})
+		}
+		data, _ := xml.Marshal(result)
+		rw.Write(data)
+	case request.Method == "POST" && query.Get("uploads") == "" && len(query["uploads"]) > 0:
+		fake.nextId++
+		uploadId := strconv.Itoa(fake.nextId)
+		fake.Uploads[uploadId] = make(map[int][]byte)
+		rw.Write([]byte("<InitiateMultipartUploadResult><UploadId>" + uploadId + "</UploadId></InitiateMultipartUploadResult>"))
+	case request.Method == "PUT" && query.Get("uploadId") != "":
+		parts, ok := fake.Uploads[query.Get("uploadId")]
+		if !ok {
+			fake.writeError(rw, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[partNumber] = body
+		rw.Header().Set("ETag", `"`+sha256Hex(body)+`"`)
+	case request.Method == "POST" && query.Get("uploadId") != "":
+		parts, ok := fake.Uploads[query.Get("uploadId")]
+		if !ok {
+			fake.writeError(rw, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var complete s3CompleteMultipartUpload
+		xml.Unmarshal(body, &complete)
+		var buffer bytes.Buffer
+		for _, part := range complete.Parts {
+			data, ok := parts[part.PartNumber]
+			if !ok || part.ETag != `"`+sha256Hex(data)+`"` {
+				// Like S3, report this failure in a 200 response
+				rw.Write([]byte("<Error><Code>InvalidPart</Code><Message>InvalidPart</Message></Error>"))
+				return
+			}
+			buffer.Write(data)
+		}
+		delete(fake.Uploads, query.Get("uploadId"))
+		fake.Objects[name] = buffer.Bytes()
+		fake.Modified[name] = time.Now().UTC()
+		rw.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
+	case request.Method == "DELETE" && query.Get("uploadId") != "":
+		delete(fake.Uploads, query.Get("uploadId"))
+		rw.WriteHeader(http.StatusNoContent)
+	case request.Method == "PUT":
+		fake.Objects[name] = body
+		fake.Modified[name] = time.Now().UTC()
+	case request.Method == "HEAD" || request.Method == "GET":
+		data, ok := fake.Objects[name]
+		if !ok {
+			fake.writeError(rw, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		// Presigned URLs can override the response headers
+		for name, values := range query {
+			if strings.HasPrefix(name, "response-") {
+				rw.Header().Set(strings.TrimPrefix(name, "response-"), values[0])
+			}
+		}
+		// ServeContent handles Range requests
+		http.ServeContent(rw, request, "", time.Time{}, bytes.NewReader(data))
+	case request.Method == "DELETE":
+		delete(fake.Objects, name)
+		delete(fake.Modified, name)
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		fake.writeError(rw, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
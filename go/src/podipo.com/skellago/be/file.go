@@ -6,12 +6,16 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	keySeparator             = "___"
 	localFileStorageTempName = "t_e_m_p"
+	localStagedDirPrefix     = "upload-" // Staged uploads are in <temp dir>/upload-<upload id>
 )
 
 /*
@@ -21,7 +25,8 @@ A derivate of "" indicates that this is the original file, otherwise it indicate
 For example, a derivative of "fit-crop-200x200" of an image would be a fit-cropped version of maximum size 200x200.
 The key is the same for the original file and its derivatives.
 
-LocalFileStorage implements FileStorage and uses the local file system, but it should also be possible to create FileStorage backed by services like S3.
+LocalFileStorage implements FileStorage and uses the local file system, S3FileStorage uses S3 or a compatible service, and MemoryFileStorage keeps files in memory.
+Implementations should pass AssertFileStorage.
 */
 type FileStorage interface {
 	Put(name string, reader io.Reader) (key string, err error)
@@ -46,7 +51,17 @@ type File interface {
 
 	Size() (int64, error)
 
-	Reader() (io.Reader, error)
+	// Reader returns a new FileReader positioned at the start of the File, which the caller must Close
+	Reader() (FileReader, error)
+}
+
+/*
+FileReader is returned by File.Reader. It is seekable so that it can serve HTTP range requests.
+*/
+type FileReader interface {
+	io.Reader
+	io.Seeker
+	io.Closer
 }
 
 /*
@@ -85,6 +100,17 @@ func (fs LocalFileStorage) Put(name string, reader io.Reader) (key string, err e
 	return key, nil
 }
 
+/*
+PutKey stores an original under key instead of a generated key, replacing anything already stored there
+*/
+func (fs LocalFileStorage) PutKey(key string, reader io.Reader) error {
+	key = fs.clean(key)
+	if key == "" {
+		return errors.New("Empty file key")
+	}
+	return fs.put(key, "", reader)
+}
+
 func (fs LocalFileStorage) PutDerivative(key string, derivative string, reader io.Reader) error {
 	exists, err := fs.Exists(key, "")
 	if err != nil {
@@ -116,6 +142,7 @@ func (fs LocalFileStorage) put(key string, derivative string, reader io.Reader)
 	_, err = io.Copy(tempFile, reader)
 	tempFile.Close()
 	if err != nil {
+		os.Remove(tempFile.Name()) // Readers can fail part way, for example when an upload is too large
 		return err
 	}
 	// the temp file contains the data, now move it into place
@@ -169,6 +196,10 @@ Delete returns an error only if the file exists and there is a problem deleting
 If it doesn't exist or there is no problem deleting the file then Delete returns nil.
 */
 func (fs LocalFileStorage) Delete(key string, derivative string) error {
+	key = fs.clean(key)
+	if key == "" {
+		return errors.New("Empty file key")
+	}
 	derivativeDir, err := fs.derivativeDir(derivative)
 	if err != nil {
 		return err
@@ -178,15 +209,8 @@ func (fs LocalFileStorage) Delete(key string, derivative string) error {
 		derivative: derivative,
 		dir:        derivativeDir,
 	}
-	exists, err := lf.Exists()
-	if err != nil {
-		return err
-	}
-	if !exists {
-		return nil
-	}
 	if derivative == "" {
-		// This is the original, delete all of the derivatives
+		// This is the original, delete all of the derivatives even if the original is already gone
 		dirPaths := fs.derivativeDirPaths()
 		for _, deriv := range dirPaths {
 			ddir, _ := fs.derivativeDir(deriv)
@@ -198,9 +222,106 @@ func (fs LocalFileStorage) Delete(key string, derivative string) error {
 			df.delete()
 		}
 	}
+	exists, err := lf.Exists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
 	return lf.delete()
 }
 
+/*
+Keys lists the files in the root dir and the derivative dirs, so it includes derivatives whose original is gone
+*/
+func (fs LocalFileStorage) Keys() ([]StoredKey, error) {
+	modified := make(map[string]time.Time)
+	dirs := []string{fs.RootDir}
+	for _, derivative := range fs.derivativeDirPaths() {
+		dirs = append(dirs, path.Join(fs.RootDir, derivative))
+	}
+	for _, dir := range dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.IsDir() {
+				continue
+			}
+			if info.ModTime().After(modified[info.Name()]) {
+				modified[info.Name()] = info.ModTime()
+			}
+		}
+	}
+	keys := make([]StoredKey, 0, len(modified))
+	for key, modTime := range modified {
+		keys = append(keys, StoredKey{Key: key, Modified: modTime})
+	}
+	return keys, nil
+}
+
+func (fs LocalFileStorage) Derivatives(key string) ([]string, error) {
+	key = fs.clean(key)
+	if key == "" {
+		return nil, errors.New("Empty file key")
+	}
+	results := []string{}
+	for _, derivative := range fs.derivativeDirPaths() {
+		if _, err := os.Stat(path.Join(fs.RootDir, derivative, key)); err == nil {
+			results = append(results, derivative)
+		}
+	}
+	sort.Strings(results)
+	return results, nil
+}
+
+/*
+TempEntries lists the temp dir, which holds staged uploads and the temp files of Puts which did not finish
+*/
+func (fs LocalFileStorage) TempEntries() ([]TempEntry, error) {
+	tempDir, err := fs.getOrCreateTempDir()
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		return nil, err
+	}
+	entries := []TempEntry{}
+	for _, info := range infos {
+		entry := TempEntry{
+			Name:     info.Name(),
+			Modified: info.ModTime(),
+		}
+		if info.IsDir() && strings.HasPrefix(info.Name(), localStagedDirPrefix) {
+			entry.UploadId = strings.TrimPrefix(info.Name(), localStagedDirPrefix)
+			// Writing to a chunk does not change the dir's modification time
+			chunks, _ := ioutil.ReadDir(path.Join(tempDir, info.Name()))
+			for _, chunk := range chunks {
+				if chunk.ModTime().After(entry.Modified) {
+					entry.Modified = chunk.ModTime()
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (fs LocalFileStorage) DeleteTemp(name string) error {
+	name = fs.clean(name)
+	if name == "" {
+		return errors.New("Empty temp entry name")
+	}
+	tempDir, err := fs.getOrCreateTempDir()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(path.Join(tempDir, name))
+}
+
 func (fs LocalFileStorage) derivativeDirPaths() []string {
 	rf, _ := os.Open(fs.RootDir)
 	results := []string{}
@@ -249,8 +370,118 @@ func (fs LocalFileStorage) getOrCreateTempDir() (dpath string, err error) {
 	return dpath, nil
 }
 
+/*
+PutChunk writes a chunk of a staged upload to the temp dir, keeping whatever was written if reader fails
+*/
+func (fs LocalFileStorage) PutChunk(uploadId string, offset int64, reader io.Reader) (int64, error) {
+	stagedDir, err := fs.stagedDir(uploadId)
+	if err != nil {
+		return 0, err
+	}
+	err = os.MkdirAll(stagedDir, os.ModeSticky|0775)
+	if err != nil {
+		return 0, err
+	}
+	chunk, err := os.Create(path.Join(stagedDir, stagedChunkName(offset)))
+	if err != nil {
+		return 0, err
+	}
+	defer chunk.Close()
+	return io.Copy(chunk, reader)
+}
+
+func (fs LocalFileStorage) DeleteChunk(uploadId string, offset int64) error {
+	stagedDir, err := fs.stagedDir(uploadId)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path.Join(stagedDir, stagedChunkName(offset)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (fs LocalFileStorage) StagedSize(uploadId string) (int64, error) {
+	chunks, err := fs.stagedChunks(uploadId)
+	if err != nil {
+		return 0, err
+	}
+	return stagedSize(chunks)
+}
+
+func (fs LocalFileStorage) StagedReader(uploadId string) (io.ReadCloser, error) {
+	chunks, err := fs.stagedChunks(uploadId)
+	if err != nil {
+		return nil, err
+	}
+	return newChunkReader(chunks)
+}
+
+func (fs LocalFileStorage) DeleteStaged(uploadId string) error {
+	stagedDir, err := fs.stagedDir(uploadId)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(stagedDir)
+}
+
+// stagedDir returns the dir in the temp dir which holds the chunks of an upload
+func (fs LocalFileStorage) stagedDir(uploadId string) (string, error) {
+	uploadId = fs.clean(uploadId)
+	if uploadId == "" {
+		return "", errors.New("Empty upload id")
+	}
+	tempDir, err := fs.getOrCreateTempDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(tempDir, localStagedDirPrefix+uploadId), nil
+}
+
+// stagedChunks returns the chunks of an upload in offset order
+func (fs LocalFileStorage) stagedChunks(uploadId string) ([]stagedChunk, error) {
+	stagedDir, err := fs.stagedDir(uploadId)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(stagedDir) // Sorted by name, so by offset
+	if os.IsNotExist(err) {
+		return []stagedChunk{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	chunks := []stagedChunk{}
+	for _, info := range infos {
+		offset, err := strconv.ParseInt(info.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		chunkPath := path.Join(stagedDir, info.Name())
+		chunks = append(chunks, stagedChunk{
+			offset: offset,
+			size:   info.Size(),
+			open: func() (io.ReadCloser, error) {
+				return os.Open(chunkPath)
+			},
+		})
+	}
+	return chunks, nil
+}
+
 // clean removes any characters which may cause trouble in FS names
 func (fs LocalFileStorage) clean(token string) string {
+	return cleanFileToken(token)
+}
+
+// generateKey returns a FS friendly name which is highly likely to be unique
+func (fs LocalFileStorage) generateKey(name string) string {
+	return generateFileKey(name)
+}
+
+// cleanFileToken removes any characters which may cause trouble in keys and derivative names
+func cleanFileToken(token string) string {
 	token = strings.Replace(token, "/", "-", -1)
 	token = strings.Replace(token, "..", "-", -1)
 	token = strings.Replace(token, "...", "-", -1)
@@ -261,13 +492,18 @@ func (fs LocalFileStorage) clean(token string) string {
 	return token
 }
 
-// generateKey returns a FS friendly name which is highly likely to be unique
-func (fs LocalFileStorage) generateKey(name string) string {
+// generateFileKey returns a key of the form <UUID><keySeparator><name> which is highly likely to be unique
+func generateFileKey(name string) string {
 	slashIndex := strings.Index(name, "/")
 	if slashIndex != -1 {
 		name = strings.Split(name, "/")[0]
 	}
-	return UUID() + keySeparator + fs.clean(name)
+	return UUID() + keySeparator + cleanFileToken(name)
+}
+
+// fileNameFromKey returns the name portion of a key created by generateFileKey
+func fileNameFromKey(key string) string {
+	return key[strings.Index(key, keySeparator)+len(keySeparator):]
 }
 
 /*
@@ -291,7 +527,7 @@ func (lf LocalFile) Derivative() string {
 Name is derived from Key which is <UUID><keySeparator><name>
 */
 func (lf LocalFile) Name() (string, error) {
-	return lf.key[strings.Index(lf.key, keySeparator)+len(keySeparator):], nil
+	return fileNameFromKey(lf.key), nil
 }
 
 /*
@@ -310,7 +546,7 @@ func (lf LocalFile) Size() (int64, error) {
 	return stat.Size(), nil
 }
 
-func (lf LocalFile) Reader() (io.Reader, error) {
+func (lf LocalFile) Reader() (FileReader, error) {
 	return os.OpenFile(lf.path(), os.O_RDONLY, os.ModePerm)
 }
 
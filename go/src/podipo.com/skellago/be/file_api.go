@@ -0,0 +1,491 @@
+package be
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultSignedURLDuration is how long a signed URL lasts if the request does not set expires-in
+const DefaultSignedURLDuration = time.Hour
+
+// MaxSignedURLDuration is the longest a signed URL may last
+const MaxSignedURLDuration = 7 * 24 * time.Hour
+
+var FileProperties = []Property{
+	Property{
+		Name:        "key",
+		Description: "The FileStorage key",
+		DataType:    "string",
+		Protected:   true,
+	},
+	Property{
+		Name:        "name",
+		Description: "The name of the uploaded file",
+		DataType:    "string",
+		Protected:   true,
+	},
+	Property{
+		Name:        "content-type",
+		Description: "The MIME type",
+		DataType:    "string",
+		Protected:   true,
+	},
+	Property{
+		Name:        "size",
+		Description: "The size in bytes",
+		DataType:    "int",
+		Protected:   true,
+	},
+	Property{
+		Name:        "checksum",
+		Description: "The hex encoded SHA-256 of the file",
+		DataType:    "string",
+		Protected:   true,
+	},
+	Property{
+		Name:        "uploader-id",
+		Description: "The id of the User who uploaded the file",
+		DataType:    "int",
+		Protected:   true,
+	},
+	Property{
+		Name:        "has-focal-point",
+		Description: "True if crops of the image keep focal-x and focal-y in view, see the file-focal-point resource",
+		DataType:    "bool",
+		Protected:   true,
+	},
+	Property{
+		Name:        "focal-x",
+		Description: "The fraction of the image's width from the left which crops keep in view",
+		DataType:    "float",
+		Protected:   true,
+	},
+	Property{
+		Name:        "focal-y",
+		Description: "The fraction of the image's height from the top which crops keep in view",
+		DataType:    "float",
+		Protected:   true,
+	},
+	Property{
+		Name:        "image-width",
+		Description: "The displayed width of an image, or 0 for other files",
+		DataType:    "int",
+		Protected:   true,
+	},
+	Property{
+		Name:        "image-height",
+		Description: "The displayed height of an image, or 0 for other files",
+		DataType:    "int",
+		Protected:   true,
+	},
+	Property{
+		Name:        "dominant-color",
+		Description: "The most common color of an image, like #7f6a55",
+		DataType:    "string",
+		Protected:   true,
+	},
+	Property{
+		Name:        "blurhash",
+		Description: "A BlurHash of an image, see blurha.sh",
+		DataType:    "string",
+		Protected:   true,
+	},
+	Property{
+		Name:        "created",
+		Description: "Upload timestamp",
+		DataType:    "date-time",
+		Protected:   true,
+	},
+	Property{
+		Name:         "references",
+		Description:  "The records which point at the file",
+		DataType:     "array",
+		ChildrenType: "file-reference",
+		Optional:     true,
+		Protected:    true,
+	},
+}
+
+var FilesProperties = NewAPIListProperties("file")
+
+/*
+FileDetail is a FileRecord and the records which reference it
+*/
+type FileDetail struct {
+	*FileRecord
+	References []*FileReference `json:"references"`
+}
+
+/*
+findFileDetail returns a 404 APIError if there is no FileRecord for key
+*/
+func findFileDetail(key string, request *APIRequest) (*FileDetail, int, interface{}) {
+	record, err := FindFileRecord(key, request.DB)
+	if err != nil {
+		return nil, 404, APIError{
+			Id:      FileNotFoundError.Id,
+			Message: "No such file: " + key,
+			Error:   err.Error(),
+		}
+	}
+	references, err := FindFileReferences(key, request.DB)
+	if err != nil {
+		return nil, 500, APIError{
+			Id:      "db_error",
+			Message: "Database error",
+			Error:   err.Error(),
+		}
+	}
+	return &FileDetail{record, references}, 200, nil
+}
+
+type FilesResource struct {
+}
+
+func NewFilesResource() *FilesResource {
+	return &FilesResource{}
+}
+
+func (FilesResource) Name() string  { return "files" }
+func (FilesResource) Path() string  { return "/file/" }
+func (FilesResource) Title() string { return "Files" }
+func (FilesResource) Description() string {
+	return "A list of stored files, most recent first."
+}
+
+func (resource FilesResource) Properties() []Property {
+	return FilesProperties
+}
+
+func (resource FilesResource) Get(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	if request.User == nil {
+		return 401, NotLoggedInError, responseHeader
+	}
+	if request.User.Staff != true {
+		return 403, ForbiddenError, responseHeader
+	}
+
+	offset, limit := GetOffsetAndLimit(request.Raw.Form)
+	records, err := FindFileRecords(offset, limit, request.DB)
+	if err != nil {
+		return 500, APIError{
+			Id:      "db_error",
+			Message: "Database error",
+			Error:   err.Error(),
+		}, responseHeader
+	}
+	list := &APIList{
+		Offset:  offset,
+		Limit:   limit,
+		Objects: records,
+	}
+	return 200, list, responseHeader
+}
+
+type FileResource struct {
+}
+
+func NewFileResource() *FileResource {
+	return &FileResource{}
+}
+
+func (FileResource) Name() string  { return "file" }
+func (FileResource) Path() string  { return "/file/{key}" }
+func (FileResource) Title() string { return "File" }
+func (FileResource) Description() string {
+	return "The metadata for a stored file and the records which reference it."
+}
+
+func (resource FileResource) Properties() []Property {
+	return FileProperties
+}
+
+func (resource FileResource) Get(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	if request.User == nil {
+		return 401, NotLoggedInError, responseHeader
+	}
+	if request.User.Staff != true {
+		return 403, ForbiddenError, responseHeader
+	}
+	detail, status, apiError := findFileDetail(request.PathValues["key"], request)
+	if detail == nil {
+		return status, apiError, responseHeader
+	}
+	return 200, detail, responseHeader
+}
+
+/*
+Delete removes the file and its derivatives, unless a record still references it
+*/
+func (resource FileResource) Delete(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	if request.User == nil {
+		return 401, NotLoggedInError, responseHeader
+	}
+	if request.User.Staff != true {
+		return 403, ForbiddenError, responseHeader
+	}
+	detail, status, apiError := findFileDetail(request.PathValues["key"], request)
+	if detail == nil {
+		return status, apiError, responseHeader
+	}
+	if len(detail.References) > 0 {
+		return http.StatusConflict, FileInUseError, responseHeader
+	}
+	err := DeleteFileRecord(detail.Key, request.DB)
+	if err != nil {
+		return 500, APIError{
+			Id:      "db_error",
+			Message: "Database error",
+			Error:   err.Error(),
+		}, responseHeader
+	}
+	request.AfterCommit(func() {
+		err := request.FS.Delete(detail.Key, "")
+		if err != nil {
+			logger.Print("Could not delete file: " + err.Error())
+		}
+	})
+	return 200, "Ok", responseHeader
+}
+
+/*
+FileContentResource downloads the original file
+*/
+type FileContentResource struct {
+}
+
+func NewFileContentResource() *FileContentResource {
+	return &FileContentResource{}
+}
+
+func (FileContentResource) Name() string  { return "file-content" }
+func (FileContentResource) Path() string  { return "/file/{key}/content" }
+func (FileContentResource) Title() string { return "File content" }
+func (FileContentResource) Description() string {
+	return "The contents of a stored file."
+}
+
+func (resource FileContentResource) Properties() []Property {
+	return []Property{}
+}
+
+func (resource FileContentResource) Get(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	if request.User == nil {
+		return 401, NotLoggedInError, responseHeader
+	}
+	if request.User.Staff != true {
+		return 403, ForbiddenError, responseHeader
+	}
+	record, err := FindFileRecord(request.PathValues["key"], request.DB)
+	if err != nil {
+		return 404, FileNotFoundError, responseHeader
+	}
+	file, err := request.FS.Get(record.Key, "")
+	if err != nil {
+		return 404, FileNotFoundError, responseHeader
+	}
+	err = request.ServeFile(file, ServeFileOptions{
+		ContentType: record.ContentType,
+		Attachment:  true,
+		Checksum:    record.Checksum,
+	})
+	if err != nil {
+		return 500, &APIError{
+			Id:      InternalServerError.Id,
+			Message: "Error serving file: " + err.Error(),
+		}, responseHeader
+	}
+	return StatusInternallyHandled, nil, nil
+}
+
+var FileSignedURLProperties = []Property{
+	Property{
+		Name:        "url",
+		Description: "The signed URL, relative to the API host",
+		DataType:    "string",
+		Protected:   true,
+	},
+	Property{
+		Name:        "expires",
+		Description: "When the URL stops working",
+		DataType:    "date-time",
+		Protected:   true,
+	},
+}
+
+/*
+FileSignedURL is returned by the FileSignedURLResource
+*/
+type FileSignedURL struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+/*
+FileSignedURLResource returns signed URLs which fetch a file or derivative without a session
+*/
+type FileSignedURLResource struct {
+}
+
+func NewFileSignedURLResource() *FileSignedURLResource {
+	return &FileSignedURLResource{}
+}
+
+func (FileSignedURLResource) Name() string  { return "file-signed-url" }
+func (FileSignedURLResource) Path() string  { return "/file/{key}/signed-url" }
+func (FileSignedURLResource) Title() string { return "File signed URL" }
+func (FileSignedURLResource) Description() string {
+	return "Signs a URL for a file. Accepts derivative, expires-in (seconds), and bind-user (true or false) URL parameters."
+}
+
+func (resource FileSignedURLResource) Properties() []Property {
+	return FileSignedURLProperties
+}
+
+/*
+Get is allowed for staff and for Users fetching a URL for their own image
+*/
+func (resource FileSignedURLResource) Get(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	if request.User == nil {
+		return 401, NotLoggedInError, responseHeader
+	}
+	key := request.PathValues["key"]
+	if request.User.Staff != true && request.User.Image != key {
+		return 403, ForbiddenError, responseHeader
+	}
+
+	derivative := request.Raw.FormValue("derivative")
+	exists, err := request.FS.Exists(key, derivative)
+	if err != nil || !exists {
+		return 404, FileNotFoundError, responseHeader
+	}
+	duration := DefaultSignedURLDuration
+	if expiresIn := request.Raw.FormValue("expires-in"); expiresIn != "" {
+		seconds, err := strconv.Atoi(expiresIn)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > MaxSignedURLDuration {
+			return 400, BadRequestError, responseHeader
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+	bindUser := request.Raw.FormValue("bind-user") == "true"
+	// Signed URLs expire on a second boundary
+	expires := time.Unix(time.Now().Add(duration).Unix(), 0)
+	signedURL, err := request.SignedFileURL(key, derivative, expires, bindUser)
+	if err != nil {
+		return 500, APIError{
+			Id:      InternalServerError.Id,
+			Message: "Could not sign the URL",
+			Error:   err.Error(),
+		}, responseHeader
+	}
+	return 200, &FileSignedURL{
+		URL:     signedURL,
+		Expires: expires,
+	}, responseHeader
+}
+
+var FileFocalPointProperties = []Property{
+	Property{
+		Name:        "x",
+		Description: "The fraction of the image's width from the left, from 0 to 1",
+		DataType:    "float",
+	},
+	Property{
+		Name:        "y",
+		Description: "The fraction of the image's height from the top, from 0 to 1",
+		DataType:    "float",
+	},
+}
+
+/*
+FileFocalPointResource sets the point which crops of an image keep in view
+*/
+type FileFocalPointResource struct {
+}
+
+func NewFileFocalPointResource() *FileFocalPointResource {
+	return &FileFocalPointResource{}
+}
+
+func (FileFocalPointResource) Name() string  { return "file-focal-point" }
+func (FileFocalPointResource) Path() string  { return "/file/{key}/focal-point" }
+func (FileFocalPointResource) Title() string { return "File focal point" }
+func (FileFocalPointResource) Description() string {
+	return "The point which crops of an image keep in view, null if they are centered. PUT a point to move it, which remakes the crops, and DELETE to center them again."
+}
+
+func (resource FileFocalPointResource) Properties() []Property {
+	return FileFocalPointProperties
+}
+
+// findRecord returns the FileRecord named by the path if the request is from staff or the User whose image it is
+func (resource FileFocalPointResource) findRecord(request *APIRequest) (*FileRecord, int, interface{}) {
+	if request.User == nil {
+		return nil, 401, NotLoggedInError
+	}
+	key := request.PathValues["key"]
+	if request.User.Staff != true && request.User.Image != key {
+		return nil, 403, ForbiddenError
+	}
+	record, err := FindFileRecord(key, request.DB)
+	if err != nil {
+		return nil, 404, FileNotFoundError
+	}
+	return record, 0, nil
+}
+
+func (resource FileFocalPointResource) Get(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	record, status, apiError := resource.findRecord(request)
+	if record == nil {
+		return status, apiError, responseHeader
+	}
+	return 200, record.FocalPoint(), responseHeader
+}
+
+func (resource FileFocalPointResource) Put(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	record, status, apiError := resource.findRecord(request)
+	if record == nil {
+		return status, apiError, responseHeader
+	}
+	var point FocalPoint
+	err := json.NewDecoder(request.Raw.Body).Decode(&point)
+	if err != nil || point.Validate() != nil {
+		return 400, BadRequestError, responseHeader
+	}
+	return resource.set(request, record.Key, &point)
+}
+
+func (resource FileFocalPointResource) Delete(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	record, status, apiError := resource.findRecord(request)
+	if record == nil {
+		return status, apiError, responseHeader
+	}
+	return resource.set(request, record.Key, nil)
+}
+
+func (resource FileFocalPointResource) set(request *APIRequest, key string, point *FocalPoint) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	err := request.SetFocalPoint(key, point)
+	if err != nil {
+		return 500, APIError{
+			Id:      "db_error",
+			Message: "Could not set the focal point",
+			Error:   err.Error(),
+		}, responseHeader
+	}
+	if point != nil {
+		rounded := point.Rounded()
+		point = &rounded
+	}
+	return 200, point, responseHeader
+}
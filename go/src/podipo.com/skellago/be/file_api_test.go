@@ -0,0 +1,186 @@
+package be
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/chai2010/assert"
+	"github.com/coocood/qbs"
+)
+
+func TestFileAPI(t *testing.T) {
+	CreateAndInitDB()
+	db, err := qbs.GetQbs()
+	AssertNil(t, err)
+	defer func() {
+		WipeDB()
+		db.Close()
+	}()
+
+	testApi, err := NewTestAPI()
+	AssertNil(t, err)
+	defer testApi.Stop()
+
+	userClient, staffClient, err := CreateTestUserAndStaffWithClients(testApi, db)
+	AssertNil(t, err)
+
+	AssertStatus(t, 401, "GET", testApi.URL()+"/file/")
+	_, err = userClient.GetList("/file/")
+	AssertNotNil(t, err, "Files API should be staff only")
+	list, err := staffClient.GetList("/file/")
+	AssertNil(t, err)
+	AssertEqual(t, 0, len(list.Objects.([]interface{})))
+
+	imageFile, err := TempImage(os.TempDir(), 100, 100)
+	AssertNil(t, err)
+	defer os.Remove(imageFile.Name())
+	err = userClient.UpdateUserImage(imageFile)
+	AssertNil(t, err)
+	user := new(User)
+	err = userClient.GetJSON("/user/current", user)
+	AssertNil(t, err)
+
+	list, err = staffClient.GetList("/file/")
+	AssertNil(t, err)
+	AssertEqual(t, 1, len(list.Objects.([]interface{})))
+	detail := new(FileDetail)
+	err = staffClient.GetJSON("/file/"+user.Image, detail)
+	AssertNil(t, err)
+	AssertEqual(t, user.Image, detail.Key)
+	AssertEqual(t, "image/png", detail.ContentType)
+	stat, err := imageFile.Stat()
+	AssertNil(t, err)
+	AssertEqual(t, stat.Size(), detail.Size)
+	AssertEqual(t, 64, len(detail.Checksum))
+	AssertEqual(t, user.Id, detail.UploaderId)
+	AssertEqual(t, 1, len(detail.References))
+	AssertEqual(t, UserImageReference, detail.References[0].Kind)
+	AssertEqual(t, user.UUID, detail.References[0].RecordId)
+
+	reader, err := staffClient.GetFile("/file/" + user.Image + "/content")
+	AssertNil(t, err)
+	data, err := ioutil.ReadAll(reader)
+	AssertNil(t, err)
+	AssertEqual(t, stat.Size(), int64(len(data)))
+
+	err = staffClient.Delete("/file/" + user.Image)
+	AssertNotNil(t, err, "Referenced files should not be deleted")
+
+	// Replacing the image should release and delete the old file
+	oldKey := user.Image
+	imageFile.Seek(0, 0)
+	err = userClient.UpdateUserImage(imageFile)
+	AssertNil(t, err)
+	err = userClient.GetJSON("/user/current", user)
+	AssertNil(t, err)
+	AssertNotEqual(t, oldKey, user.Image)
+	_, err = FindFileRecord(oldKey, db)
+	AssertNotNil(t, err, "The old FileRecord should be deleted")
+	exists, err := testApi.API.FileStorage.Exists(oldKey, "")
+	AssertNil(t, err)
+	AssertFalse(t, exists, "The old file should be deleted")
+
+	// Unreferenced files can be deleted
+	_, err = RemoveFileReference(user.Image, UserImageReference, user.UUID, db)
+	AssertNil(t, err)
+	err = staffClient.Delete("/file/" + user.Image)
+	AssertNil(t, err)
+	AssertStatus(t, 404, "GET", testApi.URL()+"/file/"+user.Image+"/content")
+	exists, err = testApi.API.FileStorage.Exists(user.Image, "")
+	AssertNil(t, err)
+	AssertFalse(t, exists)
+}
+
+func TestFileReferences(t *testing.T) {
+	CreateAndInitDB()
+	db, err := qbs.GetQbs()
+	AssertNil(t, err)
+	defer func() {
+		WipeDB()
+		db.Close()
+	}()
+
+	AssertEqual(t, int64(0), CountFileReferences("foo", db))
+	AssertNil(t, AddFileReference("foo", "thing.image", "1", db))
+	AssertNil(t, AddFileReference("foo", "thing.image", "1", db), "Adding a reference twice should be fine")
+	AssertNil(t, AddFileReference("foo", "thing.image", "2", db))
+	AssertEqual(t, int64(2), CountFileReferences("foo", db))
+	remaining, err := RemoveFileReference("foo", "thing.image", "1", db)
+	AssertNil(t, err)
+	AssertEqual(t, int64(1), remaining)
+	remaining, err = RemoveFileReference("foo", "thing.image", "2", db)
+	AssertNil(t, err)
+	AssertEqual(t, int64(0), remaining)
+}
+
+func TestServeFile(t *testing.T) {
+	fs := NewMemoryFileStorage()
+	key, err := fs.Put("foo.txt", strings.NewReader("0123456789"))
+	AssertNil(t, err)
+	file, err := fs.Get(key, "")
+	AssertNil(t, err)
+
+	serve := func(file File, options ServeFileOptions, header map[string]string) *httptest.ResponseRecorder {
+		raw, err := http.NewRequest("GET", "/file", nil)
+		AssertNil(t, err)
+		for name, value := range header {
+			raw.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		request := &APIRequest{Raw: raw, Writer: recorder, FS: fs}
+		AssertNil(t, request.ServeFile(file, options))
+		return recorder
+	}
+
+	resp := serve(file, ServeFileOptions{}, nil)
+	AssertEqual(t, 200, resp.Code)
+	AssertEqual(t, "0123456789", resp.Body.String())
+	AssertEqual(t, "10", resp.Header().Get("Content-Length"))
+	Assert(t, strings.HasPrefix(resp.Header().Get("Content-Type"), "text/plain"), "Wrong type: "+resp.Header().Get("Content-Type"))
+	AssertEqual(t, "inline; filename=foo.txt", resp.Header().Get("Content-Disposition"))
+	etag := resp.Header().Get("Etag")
+	AssertEqual(t, 66, len(etag))
+
+	resp = serve(file, ServeFileOptions{Attachment: true, Checksum: "abc"}, nil)
+	AssertEqual(t, "attachment; filename=foo.txt", resp.Header().Get("Content-Disposition"))
+	AssertEqual(t, `"abc"`, resp.Header().Get("Etag"))
+
+	resp = serve(file, ServeFileOptions{}, map[string]string{"Range": "bytes=2-4"})
+	AssertEqual(t, http.StatusPartialContent, resp.Code)
+	AssertEqual(t, "234", resp.Body.String())
+	AssertEqual(t, "bytes 2-4/10", resp.Header().Get("Content-Range"))
+
+	resp = serve(file, ServeFileOptions{}, map[string]string{"Range": "bytes=2-4", "If-Range": `"stale"`})
+	AssertEqual(t, 200, resp.Code, "A stale If-Range should return the whole file")
+	AssertEqual(t, "0123456789", resp.Body.String())
+
+	resp = serve(file, ServeFileOptions{}, map[string]string{"If-None-Match": etag})
+	AssertEqual(t, http.StatusNotModified, resp.Code)
+	AssertEqual(t, 0, resp.Body.Len())
+
+	// Derivatives of a FileRecord get a weak ETag which changes with the original and its focal point
+	record := &FileRecord{Checksum: "abc"}
+	derivativeETag := record.DerivativeETag("thumbnail")
+	AssertEqual(t, `W/"abc-thumbnail"`, derivativeETag)
+	record.HasFocalPoint = true
+	record.FocalX = 0.25
+	AssertNotEqual(t, derivativeETag, record.DerivativeETag("thumbnail"))
+	resp = serve(file, ServeFileOptions{ETag: derivativeETag}, map[string]string{"If-None-Match": derivativeETag})
+	AssertEqual(t, http.StatusNotModified, resp.Code)
+
+	// Derivatives are sniffed because they may not have the original's type
+	imageFile, err := TempImage(os.TempDir(), 10, 10)
+	AssertNil(t, err)
+	defer os.Remove(imageFile.Name())
+	AssertNil(t, fs.PutDerivative(key, "thumbnail", imageFile))
+	derivative, err := fs.Get(key, "thumbnail")
+	AssertNil(t, err)
+	resp = serve(derivative, ServeFileOptions{}, nil)
+	AssertEqual(t, "image/png", resp.Header().Get("Content-Type"))
+	Assert(t, bytes.HasPrefix(resp.Body.Bytes(), []byte("\x89PNG")), "Should serve the derivative")
+}
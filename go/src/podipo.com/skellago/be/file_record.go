@@ -0,0 +1,326 @@
+package be
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+/*
+FileRecord is the metadata for a File stored in the FileStorage, written by APIRequest.PutFile
+*/
+type FileRecord struct {
+	Id              int64     `json:"id" qbs:"pk"`
+	Key             string    `json:"key" qbs:"unique,index"`
+	Name            string    `json:"name"`
+	ContentType     string    `json:"content-type"`
+	Size            int64     `json:"size"`
+	Checksum        string    `json:"checksum"`         // Hex encoded SHA-256 of the original File
+	UploaderId      int64     `json:"uploader-id"`      // The User.Id of the uploader, or 0 if there was no authenticated User
+	DerivativesSize int64     `json:"derivatives-size"` // The bytes of the derivatives made by APIRequest.ImageDerivative, which count against the uploader's quota
+	HasFocalPoint   bool      `json:"has-focal-point"`  // If false crops of the image are centered or smart, otherwise they keep FocalX and FocalY in view
+	FocalX          float64   `json:"focal-x"`
+	FocalY          float64   `json:"focal-y"`
+	ImageWidth      int       `json:"image-width"` // The displayed size of an image, 0 for other files, see ImageMetadata
+	ImageHeight     int       `json:"image-height"`
+	DominantColor   string    `json:"dominant-color"` // Like #7f6a55
+	BlurHash        string    `json:"blurhash"`
+	Created         time.Time `json:"created"`
+}
+
+/*
+ImageMetadata returns the description of an image made by DescribeImage, or nil if there is none
+*/
+func (record *FileRecord) ImageMetadata() *ImageMetadata {
+	if record.ImageWidth == 0 {
+		return nil
+	}
+	return &ImageMetadata{
+		Width:         record.ImageWidth,
+		Height:        record.ImageHeight,
+		DominantColor: record.DominantColor,
+		BlurHash:      record.BlurHash,
+	}
+}
+
+func (record *FileRecord) setImageMetadata(metadata *ImageMetadata) {
+	record.ImageWidth = metadata.Width
+	record.ImageHeight = metadata.Height
+	record.DominantColor = metadata.DominantColor
+	record.BlurHash = metadata.BlurHash
+}
+
+/*
+DerivativeETag returns a weak ETag for a derivative of the File, which is made from the original and its focal point so changes with them
+*/
+func (record *FileRecord) DerivativeETag(derivative string) string {
+	etag := record.Checksum + "-" + derivative
+	if record.HasFocalPoint {
+		etag += fmt.Sprintf("-%g-%g", record.FocalX, record.FocalY)
+	}
+	return `W/"` + etag + `"`
+}
+
+/*
+FocalPoint returns the point crops of the image keep in view, or nil if it has none
+*/
+func (record *FileRecord) FocalPoint() *FocalPoint {
+	if !record.HasFocalPoint {
+		return nil
+	}
+	return &FocalPoint{record.FocalX, record.FocalY}
+}
+
+/*
+FileReference records that a field of a record points at a File, for example:
+
+	Kind: "user.image", RecordId: user.UUID
+*/
+type FileReference struct {
+	Id       int64     `json:"id" qbs:"pk"`
+	FileKey  string    `json:"file-key" qbs:"index"`
+	Kind     string    `json:"kind"`
+	RecordId string    `json:"record-id"`
+	Created  time.Time `json:"created"`
+}
+
+func (*FileReference) Indexes(indexes *qbs.Indexes) {
+	indexes.AddUnique("file_key", "kind", "record_id")
+}
+
+func CreateFileRecord(key string, name string, contentType string, size int64, checksum string, uploaderId int64, db *qbs.Qbs) (*FileRecord, error) {
+	record := new(FileRecord)
+	record.Key = key
+	record.Name = name
+	record.ContentType = contentType
+	record.Size = size
+	record.Checksum = checksum
+	record.UploaderId = uploaderId
+	record.Created = time.Now()
+	_, err := db.Save(record)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func FindFileRecords(offset int, limit int, q *qbs.Qbs) ([]*FileRecord, error) {
+	var records []*FileRecord
+	err := q.Limit(limit).Offset(offset).OrderByDesc("created").FindAll(&records)
+	return records, err
+}
+
+func FindFileRecord(key string, db *qbs.Qbs) (*FileRecord, error) {
+	record := new(FileRecord)
+	err := db.WhereEqual("key", key).Find(record)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+/*
+SetFileFocalPoint stores the focal point of the File with key, or removes it if point is nil
+*/
+func SetFileFocalPoint(key string, point *FocalPoint, db *qbs.Qbs) error {
+	var err error
+	if point == nil {
+		_, err = db.Exec(`update file_record set has_focal_point = ?, focal_x = 0, focal_y = 0 where "key" = ?`, false, key)
+	} else {
+		_, err = db.Exec(`update file_record set has_focal_point = ?, focal_x = ?, focal_y = ? where "key" = ?`, true, point.X, point.Y, key)
+	}
+	return err
+}
+
+/*
+SetFileImageMetadata stores the description of the image with key
+*/
+func SetFileImageMetadata(key string, metadata *ImageMetadata, db *qbs.Qbs) error {
+	_, err := db.Exec(`update file_record set image_width = ?, image_height = ?, dominant_color = ?, blur_hash = ? where "key" = ?`, metadata.Width, metadata.Height, metadata.DominantColor, metadata.BlurHash, key)
+	return err
+}
+
+/*
+DeleteFileRecord deletes the metadata and references for key, but not the File in the FileStorage
+*/
+func DeleteFileRecord(key string, db *qbs.Qbs) error {
+	_, err := db.Exec("delete from file_reference where file_key = ?", key)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`delete from file_record where "key" = ?`, key)
+	return err
+}
+
+/*
+AddFileReference records that the kind field of the record with recordId points at the File with key
+Adding the same reference twice has no effect
+*/
+func AddFileReference(key string, kind string, recordId string, db *qbs.Qbs) error {
+	var existing []*FileReference
+	err := db.Where("file_key = ? and kind = ? and record_id = ?", key, kind, recordId).FindAll(&existing)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+	reference := &FileReference{
+		FileKey:  key,
+		Kind:     kind,
+		RecordId: recordId,
+		Created:  time.Now(),
+	}
+	_, err = db.Save(reference)
+	return err
+}
+
+/*
+RemoveFileReference deletes a reference added by AddFileReference and returns the number of references which remain
+*/
+func RemoveFileReference(key string, kind string, recordId string, db *qbs.Qbs) (int64, error) {
+	_, err := db.Exec("delete from file_reference where file_key = ? and kind = ? and record_id = ?", key, kind, recordId)
+	if err != nil {
+		return 0, err
+	}
+	return CountFileReferences(key, db), nil
+}
+
+func FindFileReferences(key string, db *qbs.Qbs) ([]*FileReference, error) {
+	var references []*FileReference
+	err := db.WhereEqual("file_key", key).FindAll(&references)
+	return references, err
+}
+
+func CountFileReferences(key string, db *qbs.Qbs) int64 {
+	return db.WhereEqual("file_key", key).Count(new(FileReference))
+}
+
+/*
+PutFile stores the data from reader in request.FS and writes its FileRecord
+If the request's transaction is rolled back then the stored File is deleted
+*/
+func (request *APIRequest) PutFile(name string, reader io.Reader) (*FileRecord, error) {
+	return request.PutFileWithPolicy(name, reader, UploadPolicy{})
+}
+
+/*
+PutFileWithPolicy is PutFile for files which must meet the policy, and returns an *UploadPolicyError for those which do not
+Images are described with DescribeImage so that their FileRecord has an ImageMetadata
+Files uploaded by a User must also fit in what remains of their storage quota
+The content type is sniffed from the data, falling back to the type for the name's extension for plain text and unknown binary data
+*/
+func (request *APIRequest) PutFileWithPolicy(name string, reader io.Reader, policy UploadPolicy) (*FileRecord, error) {
+	var usage *StorageUsage
+	if request.User != nil {
+		var err error
+		usage, err = FindStorageUsage(request.User.Id, request.DB)
+		if err != nil {
+			return nil, err
+		}
+		if usage.Available() == 0 {
+			return nil, storageQuotaExceeded(usage)
+		}
+		if usage.Available() > 0 {
+			reader = &policyReader{Reader: reader, maxSize: usage.Available()}
+		}
+	}
+	quotaReader, _ := reader.(*policyReader)
+	limited, data, contentType, err := policy.checkUpload(reader)
+	if quotaReader != nil && quotaReader.tooBig {
+		return nil, storageQuotaExceeded(usage)
+	}
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	stored := &countingReader{Reader: data} // Fewer bytes than were uploaded if metadata was stripped
+	key, err := request.FS.Put(name, io.TeeReader(stored, hash))
+	if quotaReader != nil && quotaReader.tooBig {
+		if err == nil {
+			request.FS.Delete(key, "")
+		}
+		return nil, storageQuotaExceeded(usage)
+	}
+	if limited.tooBig {
+		if err == nil {
+			request.FS.Delete(key, "")
+		}
+		return nil, uploadTooLarge(policy.MaxSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	request.AfterRollback(func() {
+		err := request.FS.Delete(key, "")
+		if err != nil {
+			logger.Print("Could not delete unused file: " + err.Error())
+		}
+	})
+
+	if contentType == "application/octet-stream" || strings.HasPrefix(contentType, "text/plain") {
+		if nameType := MimeTypeFromFileName(name); nameType != "" {
+			contentType = nameType
+		}
+	}
+	var uploaderId int64
+	if request.User != nil {
+		uploaderId = request.User.Id
+	}
+	record, err := CreateFileRecord(key, fileNameFromKey(key), contentType, stored.count, hex.EncodeToString(hash.Sum(nil)), uploaderId, request.DB)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(contentType, "image/") {
+		request.describeImage(record)
+	}
+	return record, nil
+}
+
+/*
+ReferenceFile records that the kind field of the record with recordId points at the File with key
+*/
+func (request *APIRequest) ReferenceFile(key string, kind string, recordId string) error {
+	return AddFileReference(key, kind, recordId, request.DB)
+}
+
+/*
+ReleaseFile removes a reference added by ReferenceFile
+If nothing else references the File then its FileRecord is deleted and, once the transaction commits, so is the File
+*/
+func (request *APIRequest) ReleaseFile(key string, kind string, recordId string) error {
+	remaining, err := RemoveFileReference(key, kind, recordId, request.DB)
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return nil
+	}
+	err = DeleteFileRecord(key, request.DB)
+	if err != nil {
+		return err
+	}
+	request.AfterCommit(func() {
+		err := request.FS.Delete(key, "")
+		if err != nil {
+			logger.Print("Could not delete released file: " + err.Error())
+		}
+	})
+	return nil
+}
+
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.Reader.Read(p)
+	reader.count += int64(n)
+	return n, err
+}
@@ -100,4 +100,6 @@ func TestLocalFileStorage(t *testing.T) {
 	AssertNil(t, err)
 	AssertFalse(t, exists, "Derivatives should not exist after deleting the original file")
 	AssertNil(t, testFS.Delete(lf2.Key(), ""), "Deleting non-existant keys should not return an error")
+
+	AssertFileStorage(t, testFS)
 }
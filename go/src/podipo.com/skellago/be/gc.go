@@ -0,0 +1,288 @@
+package be
+
+/*
+	Garbage collection of stored files which no record references and of abandoned temp files.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+// DefaultGarbageMinAge is how old a file or temp entry must be before it is collected, so that new uploads survive until they are referenced
+const DefaultGarbageMinAge = 48 * time.Hour
+
+/*
+FileField is a DB column which holds File keys, like the image column of the user table
+Packages register the fields of their models with RegisterFileFields so that the garbage collector does not delete the Files they hold
+A field with a Kind is also the field that FileReferences of that kind point from, and those references only hold their File while the row with the reference's RecordId in IdColumn exists
+*/
+type FileField struct {
+	Package  string // The registering package, for example "be" or "cms"
+	Table    string
+	Column   string
+	Kind     string // The FileReference kind, like "user.image"
+	IdColumn string // The column which holds a FileReference's RecordId
+}
+
+var (
+	fileFields      = make([]FileField, 0)
+	fileFieldsMutex sync.Mutex
+)
+
+/*
+RegisterFileFields adds fields which hold File keys, and registering a field twice has no effect
+*/
+func RegisterFileFields(pkg string, newFields ...FileField) {
+	fileFieldsMutex.Lock()
+	defer fileFieldsMutex.Unlock()
+	for _, field := range newFields {
+		field.Package = pkg
+		registered := false
+		for _, existing := range fileFields {
+			if existing.Table == field.Table && existing.Column == field.Column {
+				registered = true
+				break
+			}
+		}
+		if !registered {
+			fileFields = append(fileFields, field)
+		}
+	}
+}
+
+/*
+RegisteredFileFields returns a copy of the registered fields
+*/
+func RegisteredFileFields() []FileField {
+	fileFieldsMutex.Lock()
+	defer fileFieldsMutex.Unlock()
+	results := make([]FileField, len(fileFields))
+	copy(results, fileFields)
+	return results
+}
+
+/*
+StoredKey is a key in a FileStorage and the last time its original or a derivative changed
+*/
+type StoredKey struct {
+	Key      string
+	Modified time.Time
+}
+
+/*
+TempEntry is something in a FileStorage's temp area, like a staged upload or a file left by a failed Put
+*/
+type TempEntry struct {
+	Name     string
+	UploadId string // Set if the entry holds the chunks of an upload
+	Modified time.Time
+}
+
+/*
+Lister is implemented by FileStorage backends which can list their contents, which garbage collection requires
+*/
+type Lister interface {
+	// Keys returns every key with an original or a derivative, including derivatives whose original is gone
+	Keys() ([]StoredKey, error)
+	// Derivatives returns the derivatives stored under a key, sorted by name
+	Derivatives(key string) ([]string, error)
+	TempEntries() ([]TempEntry, error)
+	DeleteTemp(name string) error
+}
+
+/*
+GarbageReport lists what CollectGarbage deleted or, in a dry run, would have deleted
+*/
+type GarbageReport struct {
+	DryRun    bool
+	Orphans   []string // Keys which no registered field, FileReference, or unexpired Upload holds
+	StaleTemp []string // Temp entries older than the minimum age which are not part of a live Upload
+}
+
+/*
+Write prints the report, one line per key or temp entry
+*/
+func (report *GarbageReport) Write(out io.Writer) {
+	action := "deleted"
+	if report.DryRun {
+		action = "would delete"
+	}
+	for _, key := range report.Orphans {
+		fmt.Fprintf(out, "%s file %s\n", action, key)
+	}
+	for _, name := range report.StaleTemp {
+		fmt.Fprintf(out, "%s temp %s\n", action, name)
+	}
+	fmt.Fprintf(out, "%s %d files and %d temp entries\n", action, len(report.Orphans), len(report.StaleTemp))
+}
+
+/*
+ReferencedFileKeys returns the keys held by registered fields, FileReferences, and unexpired Uploads
+A FileReference of a registered kind whose record has been deleted holds nothing
+*/
+func ReferencedFileKeys(db *qbs.Qbs) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	addRows := func(query string, args ...interface{}) error {
+		rows, err := db.QueryMapSlice(query, args...)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			for _, value := range row {
+				switch value := value.(type) {
+				case string:
+					referenced[value] = true
+				case []byte:
+					referenced[string(value)] = true
+				}
+			}
+		}
+		return nil
+	}
+	kinds := make(map[string]FileField)
+	for _, field := range RegisteredFileFields() {
+		err := addRows(`select "` + field.Column + `" from "` + field.Table + `" where "` + field.Column + `" <> ''`)
+		if err != nil {
+			return nil, errors.New("Could not read " + field.Table + "." + field.Column + ": " + err.Error())
+		}
+		if field.Kind != "" {
+			kinds[field.Kind] = field
+		}
+	}
+	var references []*FileReference
+	err := db.FindAll(&references)
+	if err != nil {
+		return nil, err
+	}
+	for _, reference := range references {
+		if field, ok := kinds[reference.Kind]; ok {
+			rows, err := db.QueryMapSlice(`select "`+field.IdColumn+`" from "`+field.Table+`" where "`+field.IdColumn+`" = ?`, reference.RecordId)
+			if err != nil {
+				return nil, errors.New("Could not find the record of a " + reference.Kind + " reference: " + err.Error())
+			}
+			if len(rows) == 0 {
+				continue // The record was deleted without releasing the File
+			}
+		}
+		referenced[reference.FileKey] = true
+	}
+	err = addRows("select file_key from upload where file_key <> '' and expires > ?", time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return referenced, nil
+}
+
+/*
+CollectGarbage deletes Files which nothing references and stale temp entries, if they are older than minAge
+In a dry run nothing is deleted and the report lists what would have been
+*/
+func CollectGarbage(fs FileStorage, db *qbs.Qbs, minAge time.Duration, dryRun bool) (*GarbageReport, error) {
+	lister, ok := fs.(Lister)
+	if !ok {
+		return nil, errors.New("The FileStorage can not list its files")
+	}
+	report := &GarbageReport{
+		DryRun:    dryRun,
+		Orphans:   []string{},
+		StaleTemp: []string{},
+	}
+	now := time.Now()
+	cutoff := now.Add(-minAge)
+
+	referenced, err := ReferencedFileKeys(db)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := lister.Keys()
+	if err != nil {
+		return nil, err
+	}
+	for _, stored := range keys {
+		// Only keys made by generateFileKey are Files, anything else was put there by someone else
+		if !strings.Contains(stored.Key, keySeparator) || referenced[stored.Key] || stored.Modified.After(cutoff) {
+			continue
+		}
+		report.Orphans = append(report.Orphans, stored.Key)
+		if dryRun {
+			continue
+		}
+		err = DeleteFileRecord(stored.Key, db)
+		if err == nil {
+			err = fs.Delete(stored.Key, "")
+		}
+		if err != nil {
+			return report, errors.New("Could not delete " + stored.Key + ": " + err.Error())
+		}
+	}
+
+	entries, err := lister.TempEntries()
+	if err != nil {
+		return report, err
+	}
+	for _, entry := range entries {
+		if entry.Modified.After(cutoff) {
+			continue
+		}
+		if entry.UploadId != "" {
+			upload, err := FindUpload(entry.UploadId, db)
+			if err == nil && !upload.Expired(now) {
+				continue
+			}
+		}
+		report.StaleTemp = append(report.StaleTemp, entry.Name)
+		if dryRun {
+			continue
+		}
+		err = lister.DeleteTemp(entry.Name)
+		if err == nil && entry.UploadId != "" {
+			err = DeleteUpload(entry.UploadId, db)
+		}
+		if err != nil {
+			return report, errors.New("Could not delete temp entry " + entry.Name + ": " + err.Error())
+		}
+	}
+	return report, nil
+}
+
+/*
+GarbageCommand runs CollectGarbage for a command line tool and writes the report to out
+
+	gc [-dry-run] [-min-age=48h]
+*/
+func GarbageCommand(fs FileStorage, args []string, out io.Writer) error {
+	dryRun := false
+	minAge := DefaultGarbageMinAge
+	for _, arg := range args {
+		switch {
+		case arg == "-dry-run" || arg == "--dry-run":
+			dryRun = true
+		case strings.HasPrefix(arg, "-min-age=") || strings.HasPrefix(arg, "--min-age="):
+			var err error
+			minAge, err = time.ParseDuration(arg[strings.Index(arg, "=")+1:])
+			if err != nil || minAge < 0 {
+				return errors.New("Bogus minimum age: " + arg)
+			}
+		default:
+			return errors.New("Usage: [-dry-run] [-min-age=48h]")
+		}
+	}
+
+	db, err := qbs.GetQbs()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	report, err := CollectGarbage(fs, db, minAge, dryRun)
+	if report != nil {
+		report.Write(out)
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package be
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/chai2010/assert"
+	"github.com/coocood/qbs"
+)
+
+func TestLocalFileStorageLeftovers(t *testing.T) {
+	fsDir, err := ioutil.TempDir(os.TempDir(), "skellago-test-gc")
+	AssertNil(t, err)
+	defer os.RemoveAll(fsDir)
+	fs, err := NewLocalFileStorage(fsDir)
+	AssertNil(t, err)
+
+	// A derivative whose original is gone is still listed and deleted with its key
+	key, err := fs.Put("foo.txt", strings.NewReader("foo"))
+	AssertNil(t, err)
+	AssertNil(t, fs.PutDerivative(key, "fit-crop-10x10", strings.NewReader("f")))
+	AssertNil(t, os.Remove(path.Join(fsDir, key)))
+	keys, err := fs.Keys()
+	AssertNil(t, err)
+	AssertEqual(t, 1, len(keys))
+	AssertEqual(t, key, keys[0].Key)
+	AssertNil(t, fs.Delete(key, ""))
+	keys, err = fs.Keys()
+	AssertNil(t, err)
+	AssertEqual(t, 0, len(keys))
+
+	// Temp files left by Puts which did not finish are listed
+	tempDir, err := fs.getOrCreateTempDir()
+	AssertNil(t, err)
+	AssertNil(t, ioutil.WriteFile(path.Join(tempDir, "lfs12345"), []byte("partial"), 0664))
+	entries, err := fs.TempEntries()
+	AssertNil(t, err)
+	AssertEqual(t, 1, len(entries))
+	AssertEqual(t, "lfs12345", entries[0].Name)
+	AssertEqual(t, "", entries[0].UploadId)
+	AssertNil(t, fs.DeleteTemp(entries[0].Name))
+	entries, err = fs.TempEntries()
+	AssertNil(t, err)
+	AssertEqual(t, 0, len(entries))
+}
+
+func TestCollectGarbage(t *testing.T) {
+	CreateAndInitDB()
+	db, err := qbs.GetQbs()
+	AssertNil(t, err)
+	defer func() {
+		WipeDB()
+		db.Close()
+	}()
+
+	fs := NewMemoryFileStorage()
+	put := func(name string) string {
+		key, err := fs.Put(name, strings.NewReader(name))
+		AssertNil(t, err)
+		_, err = CreateFileRecord(key, name, "text/plain", int64(len(name)), "", 0, db)
+		AssertNil(t, err)
+		return key
+	}
+	imageKey := put("image.png")
+	user, err := CreateUser("gc@example.com", "Garbage", "Collector", false, db)
+	AssertNil(t, err)
+	user.Image = imageKey
+	AssertNil(t, UpdateUser(user, db))
+	AssertNil(t, AddFileReference(imageKey, UserImageReference, user.UUID, db))
+	referencedKey := put("referenced.txt")
+	AssertNil(t, AddFileReference(referencedKey, "thing.file", "1", db))
+	orphanKey := put("orphan.txt")
+
+	upload, err := CreateUpload(10, "live.txt", "", user.Id, db)
+	AssertNil(t, err)
+	_, err = fs.PutChunk(upload.UUID, 0, strings.NewReader("live"))
+	AssertNil(t, err)
+	abandonedId := UUID()
+	_, err = fs.PutChunk(abandonedId, 0, strings.NewReader("abandoned"))
+	AssertNil(t, err)
+
+	report, err := CollectGarbage(fs, db, time.Hour, false)
+	AssertNil(t, err)
+	AssertEqual(t, 0, len(report.Orphans), "New files should not be collected")
+	AssertEqual(t, 0, len(report.StaleTemp))
+
+	report, err = CollectGarbage(fs, db, 0, true)
+	AssertNil(t, err)
+	AssertEqual(t, []string{orphanKey}, report.Orphans)
+	AssertEqual(t, []string{abandonedId}, report.StaleTemp)
+	var out bytes.Buffer
+	report.Write(&out)
+	Assert(t, strings.Contains(out.String(), "would delete file "+orphanKey), "Bad report: "+out.String())
+	exists, err := fs.Exists(orphanKey, "")
+	AssertNil(t, err)
+	AssertTrue(t, exists, "A dry run should not delete anything")
+
+	report, err = CollectGarbage(fs, db, 0, false)
+	AssertNil(t, err)
+	AssertEqual(t, []string{orphanKey}, report.Orphans)
+	exists, err = fs.Exists(orphanKey, "")
+	AssertNil(t, err)
+	AssertFalse(t, exists)
+	_, err = FindFileRecord(orphanKey, db)
+	AssertNotNil(t, err, "The orphan's FileRecord should be deleted")
+	for _, key := range []string{imageKey, referencedKey} {
+		exists, err = fs.Exists(key, "")
+		AssertNil(t, err)
+		AssertTrue(t, exists, "Referenced files should be kept")
+	}
+	size, err := fs.StagedSize(abandonedId)
+	AssertNil(t, err)
+	AssertEqual(t, int64(0), size)
+	size, err = fs.StagedSize(upload.UUID)
+	AssertNil(t, err)
+	AssertEqual(t, int64(4), size, "Live uploads should be kept")
+
+	// The references of a deleted record no longer hold its File
+	_, err = db.Exec(`delete from "user" where id = ?`, user.Id)
+	AssertNil(t, err)
+	report, err = CollectGarbage(fs, db, 0, false)
+	AssertNil(t, err)
+	AssertEqual(t, []string{imageKey}, report.Orphans)
+	exists, err = fs.Exists(imageKey, "")
+	AssertNil(t, err)
+	AssertFalse(t, exists)
+	AssertEqual(t, int64(0), CountFileReferences(imageKey, db))
+	exists, err = fs.Exists(referencedKey, "")
+	AssertNil(t, err)
+	AssertTrue(t, exists, "References of unregistered kinds are always kept")
+}
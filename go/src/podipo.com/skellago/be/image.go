@@ -1,50 +1,79 @@
 package be
 
 import (
-	"bytes"
-	"errors"
-	"fmt"
 	"github.com/nfnt/resize"
 	"image"
 	"image/draw"
 	"math"
 
 	_ "image/gif"
-	"image/jpeg"
+	_ "image/jpeg"
 	_ "image/png"
 )
 
 /*
-FitCrop gets from or creates in fileStorage a fit-cropped derivative of the File with Key key
+DeriveImage is ImagePipeline.Derive for request.FS which counts a new derivative against the quota of the File's uploader
 */
-func FitCrop(maxWidth int, maxHeight int, key string, fileStorage FileStorage) (File, error) {
-	if maxWidth <= 0 || maxHeight <= 0 {
-		return nil, errors.New(fmt.Sprintf("Bogus maxWidth or maxHeight: %dx%d", maxWidth, maxHeight))
-	}
-	// A little sanity checking. (I look forward to when this is not big enough for the web.)
-	if maxWidth > 4000 || maxHeight > 4000 {
-		return nil, errors.New(fmt.Sprintf("Image too large: %dx%d", maxWidth, maxHeight))
-	}
-
-	derivative := fmt.Sprintf("fit-crop-%dx%d", maxWidth, maxHeight)
-
-	// Return any existing derivative
-	dFile, err := fileStorage.Get(key, derivative)
-	if err == nil {
-		return dFile, nil
-	}
-	origFile, err := fileStorage.Get(key, "")
+func (request *APIRequest) DeriveImage(pipeline *ImagePipeline, key string) (File, error) {
+	file, made, err := pipeline.derive(key, request.FS)
 	if err != nil {
 		return nil, err
 	}
-	reader, err := origFile.Reader()
-	if err != nil {
-		return nil, err
+	if made {
+		recordDerivativeSize(key, file, request.DB)
 	}
-	origImage, _, err := image.Decode(reader)
+	return file, nil
+}
+
+/*
+ImageDerivative is the package-level ImageDerivative for request.FS which counts a new derivative against the quota of the File's uploader
+The format is chosen by NegotiateImageFormat from the original's format and the request's Accept header, and crops keep the File's focal point in view
+*/
+func (request *APIRequest) ImageDerivative(preset ImagePreset, key string) (File, error) {
+	sourceFormat, focus := request.imageSource(key)
+	pipeline := preset.FocusedPipeline(focus)
+	pipeline.Format = NegotiateImageFormat(sourceFormat, request.Raw.Header.Get("Accept"))
+	return request.DeriveImage(pipeline, key)
+}
+
+/*
+FitCrop is the package-level FitCrop for request.FS which counts a new derivative against the quota of the File's uploader and keeps its focal point in view
+*/
+func (request *APIRequest) FitCrop(maxWidth int, maxHeight int, key string) (File, error) {
+	_, focus := request.imageSource(key)
+	return request.DeriveImage(ImagePreset{maxWidth, maxHeight, ImageModeFill}.FocusedPipeline(focus), key)
+}
+
+/*
+FitCrop gets from or creates in fileStorage a fit-cropped derivative of the File with Key key
+*/
+func FitCrop(maxWidth int, maxHeight int, key string, fileStorage FileStorage) (File, error) {
+	return NewImagePipeline(FitCropTransform{maxWidth, maxHeight}).Derive(key, fileStorage)
+}
+
+/*
+ImageDerivative gets from or creates in fileStorage the derivative of the File with Key key described by preset
+*/
+func ImageDerivative(preset ImagePreset, key string, fileStorage FileStorage) (File, error) {
+	err := preset.Validate()
 	if err != nil {
 		return nil, err
 	}
+	return preset.Pipeline().Derive(key, fileStorage)
+}
+
+/*
+fitCropImage scales origImage to cover maxWidth by maxHeight and crops the overflow from the center
+*/
+func fitCropImage(maxWidth int, maxHeight int, origImage image.Image) image.Image {
+	return coverCropImage(maxWidth, maxHeight, origImage, nil)
+}
+
+/*
+coverCropImage scales origImage to cover maxWidth by maxHeight and crops the overflow
+place returns the top left of the crop in the scaled image, or if it is nil the crop is from the center
+*/
+func coverCropImage(maxWidth int, maxHeight int, origImage image.Image, place func(scaled image.Image, crop image.Point) image.Point) image.Image {
 	origBounds := origImage.Bounds()
 	targetWidth := float64(origBounds.Dx())
 	targetHeight := float64(origBounds.Dy())
@@ -62,24 +91,27 @@ func FitCrop(maxWidth int, maxHeight int, key string, fileStorage FileStorage) (
 	// Then crop it
 	left := int((targetWidth - maxWidthF) / 2)
 	top := int((targetHeight - maxHeightF) / 2)
+	if place != nil {
+		start := place(targetImage, image.Pt(int(maxWidthF), int(maxHeightF)))
+		left, top = start.X, start.Y
+	}
 	right := left + int(maxWidthF)
 	bottom := top + int(maxHeightF)
 	cropRect := image.Rect(left, top, right, bottom)
 	croppedImage := image.NewRGBA(image.Rect(0, 0, cropRect.Dx(), cropRect.Dy()))
 	draw.Draw(croppedImage, croppedImage.Bounds(), targetImage, cropRect.Min, draw.Src)
+	return croppedImage
+}
 
-	buffer := bytes.NewBuffer(make([]byte, 0))
-	err = jpeg.Encode(buffer, croppedImage, &jpeg.Options{jpeg.DefaultQuality})
-	if err != nil {
-		return nil, err
-	}
-	err = fileStorage.PutDerivative(key, derivative, buffer)
-	if err != nil {
-		return nil, err
-	}
-	dFile, err = fileStorage.Get(key, derivative)
-	if err != nil {
-		return nil, err
+/*
+fitSize returns the largest size with the aspect ratio of bounds which fits inside maxWidth by maxHeight, never larger than bounds unless upscale is true
+*/
+func fitSize(maxWidth int, maxHeight int, bounds image.Rectangle, upscale bool) (uint, uint) {
+	width := float64(bounds.Dx())
+	height := float64(bounds.Dy())
+	scale := math.Min(float64(maxWidth)/width, float64(maxHeight)/height)
+	if scale > 1 && !upscale {
+		scale = 1
 	}
-	return dFile, nil
+	return uint(math.Max(1, math.Floor(width*scale+0.5))), uint(math.Max(1, math.Floor(height*scale+0.5)))
 }
@@ -0,0 +1,292 @@
+package be
+
+/*
+	Crops which keep the interesting part of an image in view, chosen by a focal point or by looking for edges.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// smartCropAnalysisSize is the longest side of the copy of an image which SmartCropTransform looks for edges in
+const smartCropAnalysisSize = 256
+
+// cropTransformPrefixes start the names of the transforms whose output depends on a File's focal point
+var cropTransformPrefixes = []string{"fit-crop-", "smart-crop-"}
+
+/*
+FocalPoint is the part of an image which crops keep in view, as fractions of its width and height from the top left
+*/
+type FocalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+func (point FocalPoint) Validate() error {
+	if point.X < 0 || point.X > 1 || point.Y < 0 || point.Y > 1 || math.IsNaN(point.X) || math.IsNaN(point.Y) {
+		return errors.New(fmt.Sprintf("A focal point is between 0 and 1: %v,%v", point.X, point.Y))
+	}
+	return nil
+}
+
+/*
+Rounded returns the point to a thousandth, so that points which look the same name the same derivatives
+*/
+func (point FocalPoint) Rounded() FocalPoint {
+	return FocalPoint{math.Floor(point.X*1000+0.5) / 1000, math.Floor(point.Y*1000+0.5) / 1000}
+}
+
+/*
+String returns the point in the form used in derivative names, like 0.35x0.2
+*/
+func (point FocalPoint) String() string {
+	return strconv.FormatFloat(point.X, 'f', -1, 64) + "x" + strconv.FormatFloat(point.Y, 'f', -1, 64)
+}
+
+/*
+FocalCropTransform scales to cover the size and crops the overflow with the Focus as close to the center as it can be
+*/
+type FocalCropTransform struct {
+	Width  int
+	Height int
+	Focus  FocalPoint
+}
+
+func (transform FocalCropTransform) Name() string {
+	return fmt.Sprintf("fit-crop-%dx%d-at-%s", transform.Width, transform.Height, transform.Focus)
+}
+func (transform FocalCropTransform) Validate() error {
+	err := validateImageSize(transform.Width, transform.Height)
+	if err != nil {
+		return err
+	}
+	return transform.Focus.Validate()
+}
+func (transform FocalCropTransform) Transform(img image.Image) image.Image {
+	return coverCropImage(transform.Width, transform.Height, img, func(scaled image.Image, crop image.Point) image.Point {
+		bounds := scaled.Bounds()
+		return image.Pt(
+			focalCropStart(transform.Focus.X, bounds.Dx(), crop.X),
+			focalCropStart(transform.Focus.Y, bounds.Dy(), crop.Y),
+		)
+	})
+}
+
+// focalCropStart centers a crop of length on the fraction focus of size, without leaving the image
+func focalCropStart(focus float64, size int, length int) int {
+	start := int(math.Floor(focus*float64(size) - float64(length)/2 + 0.5))
+	return clampInt(start, 0, size-length)
+}
+
+/*
+SmartCropTransform scales to cover the size and crops the overflow where the image has the most edges, which is usually where its subject is
+*/
+type SmartCropTransform struct {
+	Width  int
+	Height int
+}
+
+func (transform SmartCropTransform) Name() string {
+	return fmt.Sprintf("smart-crop-%dx%d", transform.Width, transform.Height)
+}
+func (transform SmartCropTransform) Validate() error {
+	return validateImageSize(transform.Width, transform.Height)
+}
+func (transform SmartCropTransform) Transform(img image.Image) image.Image {
+	return coverCropImage(transform.Width, transform.Height, img, smartCropStart)
+}
+
+/*
+smartCropStart finds the window of size crop with the most edge energy in scaled, which only overflows crop in one direction
+A plain image, where every window has the same energy, is cropped from the center
+*/
+func smartCropStart(scaled image.Image, crop image.Point) image.Point {
+	bounds := scaled.Bounds()
+	horizontal := bounds.Dx() > crop.X
+	if !horizontal && bounds.Dy() <= crop.Y {
+		return image.ZP
+	}
+
+	// Look for edges in a small copy
+	scale := math.Min(1, smartCropAnalysisSize/float64(maxInt(bounds.Dx(), bounds.Dy())))
+	small := resize.Resize(uint(math.Max(1, float64(bounds.Dx())*scale)), uint(math.Max(1, float64(bounds.Dy())*scale)), scaled, resize.Bilinear)
+	energy := edgeEnergy(small)
+	size, length, overflow := bounds.Dx(), crop.X, bounds.Dx()-crop.X
+	if !horizontal {
+		size, length, overflow = bounds.Dy(), crop.Y, bounds.Dy()-crop.Y
+	}
+	profile := make([]float64, len(energy[0]))
+	if !horizontal {
+		profile = make([]float64, len(energy))
+	}
+	for y, row := range energy {
+		for x, value := range row {
+			if horizontal {
+				profile[x] += value
+			} else {
+				profile[y] += value
+			}
+		}
+	}
+
+	// Slide the window along the profile
+	ratio := float64(len(profile)) / float64(size)
+	window := clampInt(int(math.Floor(float64(length)*ratio+0.5)), 1, len(profile))
+	sum := 0.0
+	for _, value := range profile[:window] {
+		sum += value
+	}
+	sums := []float64{sum}
+	bestSum := sum
+	for start := 1; start+window <= len(profile); start++ {
+		sum += profile[start+window-1] - profile[start-1]
+		sums = append(sums, sum)
+		bestSum = math.Max(bestSum, sum)
+	}
+	// Of the windows with the most energy, take the one in the middle so that the subject is centered
+	first, last := -1, 0
+	for start, sum := range sums {
+		if sum >= bestSum-1e-9 {
+			if first == -1 {
+				first = start
+			}
+			last = start
+		}
+	}
+	middle := float64(first+last) / 2
+	best := first
+	for start, sum := range sums {
+		if sum >= bestSum-1e-9 && math.Abs(float64(start)-middle) < math.Abs(float64(best)-middle) {
+			best = start
+		}
+	}
+	start := clampInt(int(math.Floor(float64(best)/ratio+0.5)), 0, overflow)
+	if horizontal {
+		return image.Pt(start, 0)
+	}
+	return image.Pt(0, start)
+}
+
+/*
+edgeEnergy returns the sum of the horizontal and vertical luminance gradients at each pixel of img, indexed by row and column
+*/
+func edgeEnergy(img image.Image) [][]float64 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	luminance := make([][]float64, height)
+	for y := 0; y < height; y++ {
+		luminance[y] = make([]float64, width)
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			luminance[y][x] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 0xffff
+		}
+	}
+	energy := make([][]float64, height)
+	for y := 0; y < height; y++ {
+		energy[y] = make([]float64, width)
+		for x := 0; x < width; x++ {
+			dx := luminance[y][clampInt(x+1, 0, width-1)] - luminance[y][clampInt(x-1, 0, width-1)]
+			dy := luminance[clampInt(y+1, 0, height-1)][x] - luminance[clampInt(y-1, 0, height-1)][x]
+			energy[y][x] = math.Abs(dx) + math.Abs(dy)
+		}
+	}
+	return energy
+}
+
+func clampInt(value int, min int, max int) int {
+	if value > max {
+		value = max
+	}
+	if value < min {
+		value = min
+	}
+	return value
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+/*
+isCropDerivative is true if the derivative was made by a pipeline with a crop which a focal point changes
+*/
+func isCropDerivative(derivative string) bool {
+	for _, name := range strings.Split(derivative, imagePipelineSeparator) {
+		for _, prefix := range cropTransformPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+SetFocalPoint stores the focal point of the File with key, or centers its crops if point is nil
+The crop derivatives made before are deleted once the request's transaction commits and no longer count against the uploader's quota
+*/
+func (request *APIRequest) SetFocalPoint(key string, point *FocalPoint) error {
+	if point != nil {
+		err := point.Validate()
+		if err != nil {
+			return err
+		}
+		rounded := point.Rounded()
+		point = &rounded
+	}
+	err := SetFileFocalPoint(key, point, request.DB)
+	if err != nil {
+		return err
+	}
+	lister, ok := request.FS.(Lister)
+	if !ok {
+		return nil // The old crops are still stored, but their names no longer match
+	}
+	derivatives, err := lister.Derivatives(key)
+	if err != nil {
+		return err
+	}
+	stale := []string{}
+	var size int64
+	for _, derivative := range derivatives {
+		if !isCropDerivative(derivative) {
+			continue
+		}
+		stale = append(stale, derivative)
+		file, err := request.FS.Get(key, derivative)
+		if err != nil {
+			continue
+		}
+		derivativeSize, err := file.Size()
+		if err == nil {
+			size += derivativeSize
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	err = AddDerivativeSize(key, -size, request.DB)
+	if err != nil {
+		return err
+	}
+	fileStorage := request.FS
+	request.AfterCommit(func() {
+		for _, derivative := range stale {
+			err := fileStorage.Delete(key, derivative)
+			if err != nil {
+				logger.Print("Could not delete the crop derivative " + derivative + " of " + key + ": " + err.Error())
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,122 @@
+package be
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"os"
+	"testing"
+
+	. "github.com/chai2010/assert"
+	"github.com/coocood/qbs"
+)
+
+func TestSmartCrop(t *testing.T) {
+	// A tall, plain image with a striped subject at the bottom
+	src := image.NewRGBA(image.Rect(0, 0, 100, 300))
+	gray := color.RGBA{128, 128, 128, 255}
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 100; x++ {
+			src.SetRGBA(x, y, gray)
+			if y >= 220 && y < 280 && x%4 < 2 {
+				src.SetRGBA(x, y, color.RGBA{0, 0, 0, 255})
+			}
+		}
+	}
+	AssertEqual(t, "smart-crop-100x100", SmartCropTransform{100, 100}.Name())
+	cropped := SmartCropTransform{100, 100}.Transform(src).(*image.RGBA)
+	AssertEqual(t, image.Rect(0, 0, 100, 100), cropped.Bounds())
+	start := smartCropStart(src, image.Pt(100, 100))
+	AssertTrue(t, start.X == 0 && start.Y >= 190 && start.Y <= 210, "The stripes should be near the middle of the crop")
+	AssertEqual(t, color.RGBA{0, 0, 0, 255}, cropped.RGBAAt(0, 50), "The stripes should be in view")
+	centered := FitCropTransform{100, 100}.Transform(src).(*image.RGBA)
+	AssertEqual(t, gray, centered.RGBAAt(0, 50))
+
+	// Plain images are cropped from the center
+	AssertEqual(t, image.Pt(0, 100), smartCropStart(image.NewRGBA(image.Rect(0, 0, 100, 300)), image.Pt(100, 100)))
+	AssertEqual(t, image.Pt(100, 0), smartCropStart(image.NewRGBA(image.Rect(0, 0, 300, 100)), image.Pt(100, 100)))
+	AssertEqual(t, image.ZP, smartCropStart(image.NewRGBA(image.Rect(0, 0, 100, 100)), image.Pt(100, 100)))
+
+	// Focal points are kept in view without leaving the image
+	focused := FocalCropTransform{100, 100, FocalPoint{0.5, 0.1}}
+	AssertEqual(t, "fit-crop-100x100-at-0.5x0.1", focused.Name())
+	AssertNil(t, focused.Validate())
+	AssertNotNil(t, FocalCropTransform{100, 100, FocalPoint{1.5, 0.1}}.Validate())
+	AssertEqual(t, 0, focalCropStart(0.1, 300, 100))
+	AssertEqual(t, 130, focalCropStart(0.6, 300, 100))
+	AssertEqual(t, 200, focalCropStart(1, 300, 100))
+	cropped = FocalCropTransform{100, 100, FocalPoint{0.5, 0.8}}.Transform(src).(*image.RGBA)
+	AssertEqual(t, color.RGBA{0, 0, 0, 255}, cropped.RGBAAt(0, 50))
+
+	AssertEqual(t, FocalPoint{0.333, 0.667}, FocalPoint{1.0 / 3, 2.0 / 3}.Rounded())
+	focus := &FocalPoint{0.25, 0.75}
+	AssertEqual(t, "fit-crop-700x700-at-0.25x0.75", ImagePreset{700, 700, ImageModeFill}.FocusedPipeline(focus).Derivative())
+	AssertEqual(t, "fit-crop-700x700-at-0.25x0.75", ImagePreset{700, 700, ImageModeSmart}.FocusedPipeline(focus).Derivative())
+	AssertEqual(t, "smart-crop-700x700", ImagePreset{700, 700, ImageModeSmart}.Pipeline().Derivative())
+	AssertEqual(t, "fit-200x200", ImagePreset{200, 200, ImageModeFit}.FocusedPipeline(focus).Derivative())
+	AssertTrue(t, isCropDerivative("fit-crop-700x700"))
+	AssertTrue(t, isCropDerivative("grayscale_smart-crop-700x700.png"))
+	AssertFalse(t, isCropDerivative("fit-200x200"))
+	preset, err := ParseImagePreset("300x300-smart")
+	AssertNil(t, err)
+	AssertEqual(t, ImageModeSmart, preset.Mode)
+}
+
+func TestFocalPointAPI(t *testing.T) {
+	CreateAndInitDB()
+	db, err := qbs.GetQbs()
+	AssertNil(t, err)
+	defer func() {
+		WipeDB()
+		db.Close()
+	}()
+
+	testApi, err := NewTestAPI()
+	AssertNil(t, err)
+	defer testApi.Stop()
+	userClient, staffClient, err := CreateTestUserAndStaffWithClients(testApi, db)
+	AssertNil(t, err)
+	fs := testApi.API.FileStorage
+
+	imageFile, err := TempImage(os.TempDir(), 800, 600)
+	AssertNil(t, err)
+	defer os.Remove(imageFile.Name())
+	AssertNil(t, userClient.UpdateUserImage(imageFile))
+	current := &CurrentUser{}
+	AssertNil(t, userClient.GetJSON("/user/current", current))
+	url := "/file/" + current.Image + "/focal-point"
+	_, err = userClient.GetFile("/user/current/image")
+	AssertNil(t, err)
+	exists, err := fs.Exists(current.Image, "fit-crop-700x700")
+	AssertNil(t, err)
+	AssertTrue(t, exists)
+
+	var point *FocalPoint
+	AssertNil(t, userClient.GetJSON(url, &point))
+	AssertNil(t, point, "Crops start out centered")
+	point = &FocalPoint{}
+	AssertNil(t, userClient.PutAndReceiveJSON(url, &FocalPoint{0.25, 0.7501}, point))
+	AssertEqual(t, FocalPoint{0.25, 0.75}, *point)
+	exists, err = fs.Exists(current.Image, "fit-crop-700x700")
+	AssertNil(t, err)
+	AssertFalse(t, exists, "Moving the focal point deletes the old crops")
+	_, err = userClient.GetFile("/user/current/image")
+	AssertNil(t, err)
+	exists, err = fs.Exists(current.Image, "fit-crop-700x700-at-0.25x0.75")
+	AssertNil(t, err)
+	AssertTrue(t, exists)
+	record, err := FindFileRecord(current.Image, db)
+	AssertNil(t, err)
+	AssertEqual(t, &FocalPoint{0.25, 0.75}, record.FocalPoint())
+
+	resp, err := userClient.PutJSON(url, &FocalPoint{2, 0})
+	AssertNil(t, err)
+	AssertEqual(t, http.StatusBadRequest, resp.StatusCode)
+	AssertNil(t, staffClient.Delete(url))
+	exists, err = fs.Exists(current.Image, "fit-crop-700x700-at-0.25x0.75")
+	AssertNil(t, err)
+	AssertFalse(t, exists)
+	record, err = FindFileRecord(current.Image, db)
+	AssertNil(t, err)
+	AssertNil(t, record.FocalPoint())
+}
@@ -0,0 +1,202 @@
+package be
+
+/*
+	Image decoding which refuses decompression bombs and limits how many images are decoded at once.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+/*
+MaxImagePixels is the most pixels an uploaded image may have and that will be decoded to make a derivative, or 0 for no limit
+A small file can claim a huge size, and decoding it takes 4 or more bytes per pixel
+The frames of an animated GIF count together
+*/
+var MaxImagePixels int64 = 40 * 1000 * 1000
+
+var imageDecodesMutex sync.Mutex
+var imageDecodes = make(chan struct{}, runtime.NumCPU())
+
+/*
+SetMaxImageDecodes sets how many images may be decoded at once, with 0 for the number of CPUs
+Making a derivative or describing an image holds its turn until the result is encoded, since transforming and encoding cost as much as decoding
+*/
+func SetMaxImageDecodes(count int) {
+	if count <= 0 {
+		count = runtime.NumCPU()
+	}
+	imageDecodesMutex.Lock()
+	defer imageDecodesMutex.Unlock()
+	imageDecodes = make(chan struct{}, count)
+}
+
+/*
+acquireImageDecode waits for a turn to decode and returns the func which ends it
+*/
+func acquireImageDecode() func() {
+	imageDecodesMutex.Lock()
+	semaphore := imageDecodes
+	imageDecodesMutex.Unlock()
+	semaphore <- struct{}{}
+	return func() {
+		<-semaphore
+	}
+}
+
+/*
+imageTooManyPixels is an *UploadPolicyError so that it is surfaced like the other upload errors
+*/
+func imageTooManyPixels(status int, pixels int64) *UploadPolicyError {
+	return &UploadPolicyError{
+		Status: status,
+		APIError: APIError{
+			Id:      ImageTooManyPixelsError.Id,
+			Message: ImageTooManyPixelsError.Message + ": " + strconv.FormatInt(pixels, 10) + " pixels and the maximum is " + strconv.FormatInt(MaxImagePixels, 10),
+		},
+	}
+}
+
+/*
+checkImagePixels returns an error with status if the image in data has more than MaxImagePixels
+*/
+func checkImagePixels(data []byte, config image.Config, format string, status int) error {
+	if MaxImagePixels <= 0 {
+		return nil
+	}
+	pixels := int64(config.Width) * int64(config.Height)
+	if format == ImageFormatGIF && pixels <= MaxImagePixels {
+		frames, err := gifFrameCount(data)
+		if err != nil {
+			return err
+		}
+		pixels *= int64(frames)
+	}
+	if pixels > MaxImagePixels {
+		return imageTooManyPixels(status, pixels)
+	}
+	return nil
+}
+
+/*
+DecodeImage is image.Decode for images which are not too big to decode, waiting its turn with other decodes
+Images with more than MaxImagePixels return an *UploadPolicyError with a 422 status
+*/
+func DecodeImage(data []byte) (image.Image, string, error) {
+	release := acquireImageDecode()
+	defer release()
+	return decodeImage(data)
+}
+
+// decodeImage is DecodeImage for callers which already have a turn
+func decodeImage(data []byte) (image.Image, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	err = checkImagePixels(data, config, format, http.StatusUnprocessableEntity)
+	if err != nil {
+		return nil, "", err
+	}
+	return image.Decode(bytes.NewReader(data))
+}
+
+/*
+DecodeGIFAnimation is gif.DecodeAll for animations which are not too big to decode, like DecodeImage
+*/
+func DecodeGIFAnimation(data []byte) (*gif.GIF, error) {
+	release := acquireImageDecode()
+	defer release()
+	return decodeGIFAnimation(data)
+}
+
+// decodeGIFAnimation is DecodeGIFAnimation for callers which already have a turn
+func decodeGIFAnimation(data []byte) (*gif.GIF, error) {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	err = checkImagePixels(data, config, ImageFormatGIF, http.StatusUnprocessableEntity)
+	if err != nil {
+		return nil, err
+	}
+	return gif.DecodeAll(bytes.NewReader(data))
+}
+
+/*
+gifFrameCount counts the images in a GIF by walking its blocks without decompressing them
+*/
+func gifFrameCount(data []byte) (int, error) {
+	malformed := errors.New("Malformed GIF")
+	if len(data) < 13 {
+		return 0, malformed
+	}
+	position := 13 // The header and logical screen descriptor
+	if data[10]&0x80 != 0 {
+		position += 3 << (uint(data[10]&0x07) + 1) // The global color table
+	}
+	// skipSubBlocks moves past a series of sized sub-blocks ending with an empty one
+	skipSubBlocks := func() error {
+		for {
+			if position >= len(data) {
+				return malformed
+			}
+			size := int(data[position])
+			position += 1 + size
+			if size == 0 {
+				return nil
+			}
+		}
+	}
+	frames := 0
+	for position < len(data) {
+		switch data[position] {
+		case 0x21: // An extension, its label, and sub-blocks
+			position += 2
+			err := skipSubBlocks()
+			if err != nil {
+				return frames, err
+			}
+		case 0x2c: // An image descriptor, local color table, LZW code size, and sub-blocks
+			if position+10 > len(data) {
+				return frames, malformed
+			}
+			flags := data[position+9]
+			position += 10
+			if flags&0x80 != 0 {
+				position += 3 << (uint(flags&0x07) + 1)
+			}
+			position++
+			err := skipSubBlocks()
+			if err != nil {
+				return frames, err
+			}
+			frames++
+		case 0x3b: // The trailer
+			return frames, nil
+		default:
+			return frames, malformed
+		}
+	}
+	return frames, nil
+}
+
+/*
+DerivativeErrorResponse returns the status and APIError for an error from making an image derivative
+*/
+func DerivativeErrorResponse(err error) (int, interface{}) {
+	if policyError, ok := err.(*UploadPolicyError); ok {
+		return policyError.Status, policyError.APIError
+	}
+	return http.StatusInternalServerError, APIError{
+		Id:      InternalServerError.Id,
+		Message: "Could not make the image: " + err.Error(),
+	}
+}
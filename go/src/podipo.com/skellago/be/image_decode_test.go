@@ -0,0 +1,145 @@
+package be
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/chai2010/assert"
+)
+
+// pngBomb returns the start of a PNG which claims to be width by height
+func pngBomb(width uint32, height uint32) []byte {
+	buffer := bytes.NewBuffer(append([]byte{}, pngSignature...))
+	chunk := &bytes.Buffer{}
+	chunk.WriteString("IHDR")
+	binary.Write(chunk, binary.BigEndian, []uint32{width, height})
+	chunk.Write([]byte{8, 6, 0, 0, 0}) // 8 bit RGBA
+	binary.Write(buffer, binary.BigEndian, uint32(chunk.Len()-4))
+	buffer.Write(chunk.Bytes())
+	binary.Write(buffer, binary.BigEndian, crc32.ChecksumIEEE(chunk.Bytes()))
+	return buffer.Bytes()
+}
+
+func TestDecodeImage(t *testing.T) {
+	bomb := pngBomb(50000, 50000)
+	_, _, err := DecodeImage(bomb)
+	AssertNotNil(t, err)
+	status, apiError := DerivativeErrorResponse(err)
+	AssertEqual(t, http.StatusUnprocessableEntity, status)
+	AssertEqual(t, ImageTooManyPixelsError.Id, apiError.(APIError).Id)
+
+	fs := NewMemoryFileStorage()
+	key, err := fs.Put("bomb.png", bytes.NewReader(bomb))
+	AssertNil(t, err)
+	_, err = FitCrop(100, 100, key, fs)
+	_, ok := err.(*UploadPolicyError)
+	AssertTrue(t, ok, "Derivatives should not decode bombs")
+
+	_, _, _, err = (UploadPolicy{}).checkUpload(bytes.NewReader(bomb))
+	status, apiError = UploadErrorResponse(err)
+	AssertEqual(t, http.StatusRequestEntityTooLarge, status)
+	AssertEqual(t, ImageTooManyPixelsError.Id, apiError.(APIError).Id)
+
+	// The frames of an animation count together
+	palette := color.Palette{color.Black, color.White}
+	animation := &gif.GIF{}
+	for index := 0; index < 5; index++ {
+		animation.Image = append(animation.Image, image.NewPaletted(image.Rect(0, 0, 10, 10), palette))
+		animation.Delay = append(animation.Delay, 10)
+	}
+	buffer := &bytes.Buffer{}
+	AssertNil(t, gif.EncodeAll(buffer, animation))
+	frames, err := gifFrameCount(buffer.Bytes())
+	AssertNil(t, err)
+	AssertEqual(t, 5, frames)
+	defer func(max int64) { MaxImagePixels = max }(MaxImagePixels)
+	MaxImagePixels = 400
+	_, err = DecodeGIFAnimation(buffer.Bytes())
+	AssertNotNil(t, err)
+	_, _, _, err = (UploadPolicy{MaxSize: 1024 * 1024}).checkUpload(bytes.NewReader(buffer.Bytes()))
+	AssertNotNil(t, err)
+	MaxImagePixels = 500
+	decoded, err := DecodeGIFAnimation(buffer.Bytes())
+	AssertNil(t, err)
+	AssertEqual(t, 5, len(decoded.Image))
+
+	// Decodes wait their turn
+	SetMaxImageDecodes(1)
+	defer SetMaxImageDecodes(0)
+	release := acquireImageDecode()
+	done := make(chan bool)
+	go func() {
+		acquireImageDecode()()
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatal("The second decode should wait")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	<-done
+
+	// Making derivatives and describing images hold their turn until they have encoded, without waiting on themselves
+	small := &bytes.Buffer{}
+	AssertNil(t, png.Encode(small, image.NewRGBA(image.Rect(0, 0, 20, 20))))
+	release = acquireImageDecode()
+	for _, work := range []func() error{
+		func() error {
+			_, err := DescribeImage(small.Bytes())
+			return err
+		},
+		func() error {
+			_, err := NewImagePipeline(FitTransform{10, 10}).render(small.Bytes())
+			return err
+		},
+	} {
+		finished := make(chan error)
+		go func(work func() error) {
+			finished <- work()
+		}(work)
+		select {
+		case <-finished:
+			t.Fatal("The work should wait for a turn")
+		case <-time.After(20 * time.Millisecond):
+		}
+		release()
+		AssertNil(t, <-finished)
+		release = acquireImageDecode()
+	}
+	release()
+}
+
+func TestUploadStripsLargeImages(t *testing.T) {
+	// Large enough that the stripper reads ahead of what DecodeConfig needs
+	noise := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	random := rand.New(rand.NewSource(1))
+	random.Read(noise.Pix)
+	buffer := &bytes.Buffer{}
+	AssertNil(t, png.Encode(buffer, noise))
+	pngData := buffer.Bytes()
+	chunk := &bytes.Buffer{}
+	text := []byte("Location\x0052.5,13.4")
+	binary.Write(chunk, binary.BigEndian, uint32(len(text)))
+	chunk.WriteString("tEXt")
+	chunk.Write(text)
+	binary.Write(chunk, binary.BigEndian, crc32.ChecksumIEEE(chunk.Bytes()[4:]))
+	withText := append(append(append([]byte{}, pngData[:33]...), chunk.Bytes()...), pngData[33:]...)
+	AssertTrue(t, len(withText) > 16*1024)
+
+	_, reader, _, err := (UploadPolicy{MaxWidth: 200, StripMetadata: true}).checkUpload(bytes.NewReader(withText))
+	AssertNil(t, err)
+	read, err := ioutil.ReadAll(reader)
+	AssertNil(t, err)
+	AssertTrue(t, bytes.Equal(pngData, read))
+}
@@ -0,0 +1,200 @@
+package be
+
+/*
+	The formats image derivatives are encoded in, chosen by the original's format and the request's Accept header.
+*/
+
+import (
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ImageFormatJPEG = "jpeg"
+	ImageFormatPNG  = "png"
+	ImageFormatGIF  = "gif"
+	ImageFormatWebP = "webp" // Only used once an encoder is registered with RegisterImageEncoder
+)
+
+/*
+ImageEncoder writes img in a format, using quality (1 to 100) if the format is lossy
+*/
+type ImageEncoder func(writer io.Writer, img image.Image, quality int) error
+
+type imageFormat struct {
+	contentType string
+	encoder     ImageEncoder
+}
+
+var imageFormatsMutex sync.RWMutex
+var imageFormats = map[string]imageFormat{
+	ImageFormatJPEG: imageFormat{"image/jpeg", func(writer io.Writer, img image.Image, quality int) error {
+		return jpeg.Encode(writer, img, &jpeg.Options{quality})
+	}},
+	ImageFormatPNG: imageFormat{"image/png", func(writer io.Writer, img image.Image, quality int) error {
+		return png.Encode(writer, img)
+	}},
+	ImageFormatGIF: imageFormat{"image/gif", func(writer io.Writer, img image.Image, quality int) error {
+		return gif.Encode(writer, img, &gif.Options{NumColors: 256})
+	}},
+}
+
+/*
+RegisterImageEncoder adds or replaces the encoder for a format, for example WebP:
+
+	be.RegisterImageEncoder(be.ImageFormatWebP, "image/webp", func(writer io.Writer, img image.Image, quality int) error {
+		return webp.Encode(writer, img, &webp.Options{Quality: float32(quality)})
+	})
+*/
+func RegisterImageEncoder(format string, contentType string, encoder ImageEncoder) {
+	imageFormatsMutex.Lock()
+	defer imageFormatsMutex.Unlock()
+	imageFormats[format] = imageFormat{contentType, encoder}
+}
+
+func findImageFormat(format string) (imageFormat, bool) {
+	imageFormatsMutex.RLock()
+	defer imageFormatsMutex.RUnlock()
+	found, ok := imageFormats[format]
+	return found, ok
+}
+
+/*
+EncodeImage writes img in format, which must have an encoder
+*/
+func EncodeImage(writer io.Writer, img image.Image, format string, quality int) error {
+	found, ok := findImageFormat(format)
+	if !ok {
+		return errors.New("No encoder for image format: " + format)
+	}
+	return found.encoder(writer, img, quality)
+}
+
+/*
+ImageFormatContentType returns the MIME type of a format with an encoder, or ""
+*/
+func ImageFormatContentType(format string) string {
+	found, _ := findImageFormat(format)
+	return found.contentType
+}
+
+/*
+ImageFormatFromContentType returns the format with the MIME type, or "" if it has no encoder
+*/
+func ImageFormatFromContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	imageFormatsMutex.RLock()
+	defer imageFormatsMutex.RUnlock()
+	for format, found := range imageFormats {
+		if found.contentType == mediaType {
+			return format
+		}
+	}
+	return ""
+}
+
+/*
+ImageFormatFromDerivative returns the format named at the end of a derivative made by an ImagePipeline, like png for fit-100x100.png
+Derivatives without a format, like fit-crop-700x700, are JPEGs
+*/
+func ImageFormatFromDerivative(derivative string) string {
+	index := strings.LastIndex(derivative, ".")
+	if index == -1 {
+		return ImageFormatJPEG
+	}
+	format := derivative[index+1:]
+	if _, ok := findImageFormat(format); !ok {
+		return ImageFormatJPEG // A dot in a transform's name, like blur-1.5
+	}
+	return format
+}
+
+/*
+NegotiateImageFormat picks the format of a derivative of an original in sourceFormat for a request with the Accept header accept
+WebP is preferred when it has an encoder and is accepted, except for GIFs which may be animated
+Otherwise PNGs and GIFs keep their format so that transparency and animation survive, and everything else is a JPEG
+*/
+func NegotiateImageFormat(sourceFormat string, accept string) string {
+	accepted := parseAccept(accept)
+	candidates := []string{}
+	if sourceFormat != ImageFormatGIF {
+		candidates = append(candidates, ImageFormatWebP)
+	}
+	if sourceFormat == ImageFormatPNG || sourceFormat == ImageFormatGIF {
+		candidates = append(candidates, sourceFormat)
+	}
+	if sourceFormat == ImageFormatGIF {
+		candidates = append(candidates, ImageFormatPNG) // Keeps the transparency of the first frame
+	}
+	candidates = append(candidates, ImageFormatJPEG)
+	for _, format := range candidates {
+		contentType := ImageFormatContentType(format)
+		if contentType != "" && accepted(contentType) {
+			return format
+		}
+	}
+	return ImageFormatJPEG // Like any client which sent an Accept header without images
+}
+
+/*
+parseAccept returns a func which is true if the Accept header accepts contentType
+An empty header accepts everything
+*/
+func parseAccept(accept string) func(contentType string) bool {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if value, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+		}
+		qualities[mediaType] = quality
+	}
+	return func(contentType string) bool {
+		if strings.TrimSpace(accept) == "" {
+			return true
+		}
+		// The most specific match decides
+		candidates := []string{contentType, strings.Split(contentType, "/")[0] + "/*", "*/*"}
+		for _, candidate := range candidates {
+			if quality, ok := qualities[candidate]; ok {
+				return quality > 0
+			}
+		}
+		return false
+	}
+}
+
+/*
+imageSource returns the format of the original File with key, from its FileRecord or else its name, and its focal point if it has one
+*/
+func (request *APIRequest) imageSource(key string) (string, *FocalPoint) {
+	contentType := ""
+	var focus *FocalPoint
+	record, err := FindFileRecord(key, request.DB)
+	if err == nil {
+		contentType = record.ContentType
+		focus = record.FocalPoint()
+	}
+	if contentType == "" {
+		contentType = MimeTypeFromFileName(fileNameFromKey(key))
+	}
+	return ImageFormatFromContentType(contentType), focus
+}
@@ -0,0 +1,87 @@
+package be
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"testing"
+
+	. "github.com/chai2010/assert"
+)
+
+func TestImageFormats(t *testing.T) {
+	AssertEqual(t, ImageFormatJPEG, NegotiateImageFormat(ImageFormatJPEG, ""))
+	AssertEqual(t, ImageFormatPNG, NegotiateImageFormat(ImageFormatPNG, ""))
+	AssertEqual(t, ImageFormatPNG, NegotiateImageFormat(ImageFormatPNG, "image/*"))
+	AssertEqual(t, ImageFormatJPEG, NegotiateImageFormat(ImageFormatPNG, "image/jpeg, image/png;q=0"))
+	AssertEqual(t, ImageFormatGIF, NegotiateImageFormat(ImageFormatGIF, "text/html, */*;q=0.8"))
+	AssertEqual(t, ImageFormatPNG, NegotiateImageFormat(ImageFormatGIF, "image/png"))
+	AssertEqual(t, ImageFormatJPEG, NegotiateImageFormat("", "text/html"))
+	AssertEqual(t, ImageFormatPNG, NegotiateImageFormat(ImageFormatPNG, "image/webp,image/*"), "WebP has no encoder yet")
+
+	AssertEqual(t, ImageFormatPNG, ImageFormatFromContentType("image/png"))
+	AssertEqual(t, "", ImageFormatFromContentType("text/plain"))
+	AssertEqual(t, ImageFormatJPEG, ImageFormatFromDerivative("fit-crop-700x700"))
+	AssertEqual(t, ImageFormatJPEG, ImageFormatFromDerivative("blur-1.5"))
+	AssertEqual(t, ImageFormatGIF, ImageFormatFromDerivative("fit-100x100_blur-1.5.gif"))
+
+	pipeline := NewImagePipeline(FitTransform{2, 2}).WithFormat(ImageFormatPNG)
+	AssertEqual(t, "fit-2x2.png", pipeline.Derivative())
+	AssertEqual(t, "image/png", pipeline.ContentType())
+	AssertNotNil(t, NewImagePipeline(FitTransform{2, 2}).WithFormat("bmp").Validate())
+
+	// PNGs keep their transparency
+	fs := NewMemoryFileStorage()
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	buffer := &bytes.Buffer{}
+	AssertNil(t, png.Encode(buffer, src))
+	key, err := fs.Put("clear.png", buffer)
+	AssertNil(t, err)
+	file, err := pipeline.Derive(key, fs)
+	AssertNil(t, err)
+	data, err := readAllFile(file)
+	AssertNil(t, err)
+	derived, format, err := image.Decode(bytes.NewReader(data))
+	AssertNil(t, err)
+	AssertEqual(t, ImageFormatPNG, format)
+	_, _, _, alpha := derived.At(0, 0).RGBA()
+	AssertEqual(t, uint32(0), alpha)
+
+	// Animated GIFs stay animated
+	palette := color.Palette{color.Black, color.White}
+	animation := &gif.GIF{Delay: []int{10, 10, 10}}
+	for index := 0; index < 3; index++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 8, 8), palette)
+		frame.SetColorIndex(index, index, 1)
+		animation.Image = append(animation.Image, frame)
+	}
+	buffer = &bytes.Buffer{}
+	AssertNil(t, gif.EncodeAll(buffer, animation))
+	key, err = fs.Put("animated.gif", buffer)
+	AssertNil(t, err)
+	file, err = NewImagePipeline(FitTransform{4, 4}).WithFormat(ImageFormatGIF).Derive(key, fs)
+	AssertNil(t, err)
+	data, err = readAllFile(file)
+	AssertNil(t, err)
+	derivedAnimation, err := gif.DecodeAll(bytes.NewReader(data))
+	AssertNil(t, err)
+	AssertEqual(t, 3, len(derivedAnimation.Image))
+	AssertEqual(t, image.Rect(0, 0, 4, 4), derivedAnimation.Image[2].Bounds())
+	AssertEqual(t, []int{10, 10, 10}, derivedAnimation.Delay)
+
+	// Registered encoders are negotiated
+	RegisterImageEncoder(ImageFormatWebP, "image/webp", func(writer io.Writer, img image.Image, quality int) error {
+		return png.Encode(writer, img)
+	})
+	defer func() {
+		imageFormatsMutex.Lock()
+		delete(imageFormats, ImageFormatWebP)
+		imageFormatsMutex.Unlock()
+	}()
+	AssertEqual(t, ImageFormatWebP, NegotiateImageFormat(ImageFormatPNG, "image/webp,image/*"))
+	AssertEqual(t, ImageFormatGIF, NegotiateImageFormat(ImageFormatGIF, "image/webp,image/*"))
+	AssertEqual(t, "image/webp", ImageFormatContentType(ImageFormatFromDerivative("fit-2x2.webp")))
+}
@@ -0,0 +1,114 @@
+package be
+
+/*
+	Making each derivative once when many requests want it at the same time, and making derivatives in the background after an upload.
+*/
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/coocood/qbs"
+)
+
+/*
+PregenerateImagePresets makes the image resources make the derivatives for all of their Presets after an upload instead of when each is first requested
+*/
+var PregenerateImagePresets = false
+
+// pregenerateAccept is the Accept header of a browser without WebP, whose derivatives are made along with those for browsers with it
+const pregenerateAccept = "image/png, image/gif, image/jpeg"
+
+/*
+derivativeFlight is one run of making a derivative, which the calls that arrive while it runs wait for
+*/
+type derivativeFlight struct {
+	done chan struct{}
+	err  error
+}
+
+var derivativeFlightsMutex sync.Mutex
+var derivativeFlights = map[string]*derivativeFlight{}
+
+/*
+coalesceDerivative runs generate unless a run for the same key and derivative is underway, in which case it waits for that run and returns its error
+leader is true for the call which ran generate
+*/
+func coalesceDerivative(key string, derivative string, generate func() error) (leader bool, err error) {
+	flightKey := key + "\x00" + derivative
+	derivativeFlightsMutex.Lock()
+	if flight, ok := derivativeFlights[flightKey]; ok {
+		derivativeFlightsMutex.Unlock()
+		<-flight.done
+		return false, flight.err
+	}
+	flight := &derivativeFlight{
+		done: make(chan struct{}),
+		err:  errors.New("The derivative was not made"), // Unless generate returns
+	}
+	derivativeFlights[flightKey] = flight
+	derivativeFlightsMutex.Unlock()
+	defer func() {
+		derivativeFlightsMutex.Lock()
+		delete(derivativeFlights, flightKey)
+		derivativeFlightsMutex.Unlock()
+		close(flight.done)
+	}()
+	flight.err = generate()
+	return true, flight.err
+}
+
+/*
+PregenerateImageDerivatives makes the derivatives of the image with Key key for presets in the background once the request's transaction commits, so the first requests for them do not wait
+Each is made in the formats NegotiateImageFormat picks for browsers with and without WebP, and counts against the quota of the File's uploader
+*/
+func (request *APIRequest) PregenerateImageDerivatives(key string, presets []ImagePreset) {
+	sourceFormat, focus := request.imageSource(key)
+	fileStorage := request.FS
+	request.AfterCommit(func() {
+		go pregenerateImageDerivatives(key, sourceFormat, focus, presets, fileStorage)
+	})
+}
+
+func pregenerateImageDerivatives(key string, sourceFormat string, focus *FocalPoint, presets []ImagePreset, fileStorage FileStorage) {
+	formats := []string{NegotiateImageFormat(sourceFormat, "")}
+	if format := NegotiateImageFormat(sourceFormat, pregenerateAccept); format != formats[0] {
+		formats = append(formats, format)
+	}
+	var db *qbs.Qbs
+	for _, preset := range presets {
+		for _, format := range formats {
+			pipeline := preset.FocusedPipeline(focus).WithFormat(format)
+			file, made, err := pipeline.derive(key, fileStorage)
+			if err != nil {
+				logger.Print("Could not pregenerate the " + pipeline.Derivative() + " derivative of " + key + ": " + err.Error())
+				continue
+			}
+			if !made {
+				continue
+			}
+			if db == nil {
+				db, err = qbs.GetQbs()
+				if err != nil {
+					logger.Print("Could not connect to the DB to record the derivative size: " + err.Error())
+					continue
+				}
+				defer db.Close()
+			}
+			recordDerivativeSize(key, file, db)
+		}
+	}
+}
+
+/*
+recordDerivativeSize counts a newly made derivative against the quota of the File's uploader, logging any failure
+*/
+func recordDerivativeSize(key string, file File, db *qbs.Qbs) {
+	size, err := file.Size()
+	if err == nil {
+		err = AddDerivativeSize(key, size, db)
+	}
+	if err != nil {
+		logger.Print("Could not record the derivative size: " + err.Error())
+	}
+}
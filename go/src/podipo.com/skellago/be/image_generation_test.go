@@ -0,0 +1,69 @@
+package be
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/chai2010/assert"
+)
+
+// countingFileStorage counts the derivatives put into it
+type countingFileStorage struct {
+	*MemoryFileStorage
+	derivatives int32
+}
+
+func (fs *countingFileStorage) PutDerivative(key string, derivative string, reader io.Reader) error {
+	atomic.AddInt32(&fs.derivatives, 1)
+	time.Sleep(10 * time.Millisecond) // Long enough for the other requests to arrive
+	return fs.MemoryFileStorage.PutDerivative(key, derivative, reader)
+}
+
+func TestDeriveCoalesces(t *testing.T) {
+	fs := &countingFileStorage{MemoryFileStorage: NewMemoryFileStorage()}
+	buffer := &bytes.Buffer{}
+	AssertNil(t, png.Encode(buffer, image.NewRGBA(image.Rect(0, 0, 300, 200))))
+	key, err := fs.Put("popular.png", buffer)
+	AssertNil(t, err)
+
+	pipeline := NewImagePipeline(FitCropTransform{100, 100})
+	var wg sync.WaitGroup
+	var made int32
+	for index := 0; index < 10; index++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			file, didMake, err := pipeline.derive(key, fs)
+			AssertNil(t, err)
+			AssertNotNil(t, file)
+			if didMake {
+				atomic.AddInt32(&made, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	AssertEqual(t, int32(1), fs.derivatives)
+	AssertEqual(t, int32(1), made, "Only one derivative counts against the quota")
+	AssertEqual(t, 0, len(derivativeFlights))
+
+	// A missing original is an error, and leaves no run behind
+	_, _, err = pipeline.derive("missing.png", fs)
+	AssertNotNil(t, err)
+	AssertEqual(t, 0, len(derivativeFlights))
+
+	// Pregeneration makes every preset
+	presets := []ImagePreset{ImagePreset{50, 50, ImageModeFit}, ImagePreset{20, 20, ImageModeThumbnail}}
+	pregenerateImageDerivatives(key, ImageFormatPNG, nil, presets, fs)
+	for _, preset := range presets {
+		exists, err := fs.Exists(key, preset.Pipeline().WithFormat(ImageFormatPNG).Derivative())
+		AssertNil(t, err)
+		AssertTrue(t, exists)
+	}
+	AssertEqual(t, int32(3), fs.derivatives)
+}
@@ -0,0 +1,292 @@
+package be
+
+/*
+	EXIF orientation and the removal of EXIF, XMP, and other metadata from JPEGs and PNGs.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	jpegMarkerSOI   = 0xd8 // Start of image
+	jpegMarkerEOI   = 0xd9 // End of image
+	jpegMarkerSOS   = 0xda // Start of scan, followed by the compressed data
+	jpegMarkerAPP1  = 0xe1 // EXIF and XMP
+	jpegMarkerAPP13 = 0xed // Photoshop and IPTC
+	jpegMarkerCOM   = 0xfe // Comment
+
+	exifOrientationTag = 0x0112
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are dropped by StripImageMetadata, XMP is in an iTXt chunk
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "iTXt": true, "zTXt": true, "tIME": true}
+
+/*
+ExifOrientation returns the EXIF orientation of a JPEG from 1 to 8, or 1 if it has none
+2 through 8 mean the pixels must be flipped or rotated to display as the camera was held
+*/
+func ExifOrientation(reader io.Reader) int {
+	src := bufio.NewReader(reader)
+	soi := make([]byte, 2)
+	_, err := io.ReadFull(src, soi)
+	if err != nil || soi[0] != 0xff || soi[1] != jpegMarkerSOI {
+		return 1
+	}
+	for {
+		marker, payload, err := readJPEGSegment(src)
+		if err != nil || marker == jpegMarkerSOS || marker == jpegMarkerEOI {
+			return 1
+		}
+		if marker == jpegMarkerAPP1 && bytes.HasPrefix(payload, exifHeader) {
+			return parseExifOrientation(payload[len(exifHeader):])
+		}
+	}
+}
+
+/*
+OrientImage flips and rotates img so that an image with the EXIF orientation displays upright
+*/
+func OrientImage(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return FlipTransform{}.Transform(img)
+	case 3:
+		return RotateTransform{180}.Transform(img)
+	case 4:
+		return FlipTransform{Vertical: true}.Transform(img)
+	case 5:
+		return FlipTransform{}.Transform(RotateTransform{90}.Transform(img))
+	case 6:
+		return RotateTransform{90}.Transform(img)
+	case 7:
+		return FlipTransform{}.Transform(RotateTransform{270}.Transform(img))
+	case 8:
+		return RotateTransform{270}.Transform(img)
+	}
+	return img
+}
+
+/*
+StripImageMetadata returns a reader of the JPEG or PNG from reader without EXIF, XMP, IPTC, comments, or text chunks, which can hold locations and other private data
+A JPEG's EXIF orientation is kept, alone, so that it still displays upright
+Data which is not a JPEG or PNG is read unchanged
+*/
+func StripImageMetadata(reader io.Reader) io.Reader {
+	return &metadataStripper{src: bufio.NewReader(reader)}
+}
+
+/*
+metadataStripper copies segments or chunks it keeps into pending, and once it reaches the image data copies the rest of src directly
+*/
+type metadataStripper struct {
+	src       *bufio.Reader
+	started   bool
+	png       bool
+	pending   bytes.Buffer
+	remaining int64 // Bytes to copy directly from src before reading the next segment or chunk, -1 for the rest
+	err       error
+}
+
+func (stripper *metadataStripper) Read(p []byte) (int, error) {
+	for stripper.pending.Len() == 0 && stripper.remaining == 0 && stripper.err == nil {
+		stripper.err = stripper.step()
+	}
+	if stripper.pending.Len() > 0 {
+		return stripper.pending.Read(p)
+	}
+	if stripper.remaining != 0 {
+		if stripper.remaining > 0 && int64(len(p)) > stripper.remaining {
+			p = p[:stripper.remaining]
+		}
+		n, err := stripper.src.Read(p)
+		if stripper.remaining > 0 {
+			stripper.remaining -= int64(n)
+			if err == io.EOF && stripper.remaining > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			if err == io.EOF {
+				err = nil // More chunks may follow
+			}
+		}
+		return n, err
+	}
+	return 0, stripper.err
+}
+
+// step reads the next segment or chunk, returning io.EOF at the end of the data
+func (stripper *metadataStripper) step() error {
+	if !stripper.started {
+		stripper.started = true
+		head, _ := stripper.src.Peek(len(pngSignature))
+		switch {
+		case bytes.Equal(head, pngSignature):
+			stripper.png = true
+			stripper.remaining = int64(len(pngSignature))
+		case len(head) >= 2 && head[0] == 0xff && head[1] == jpegMarkerSOI:
+			stripper.remaining = 2
+		default:
+			stripper.remaining = -1
+		}
+		return nil
+	}
+	if stripper.png {
+		return stripper.stepPNG()
+	}
+	return stripper.stepJPEG()
+}
+
+func (stripper *metadataStripper) stepJPEG() error {
+	marker, payload, err := readJPEGSegment(stripper.src)
+	if err != nil {
+		return err
+	}
+	switch marker {
+	case jpegMarkerSOS:
+		stripper.pending.Write([]byte{0xff, marker})
+		stripper.remaining = -1
+		return nil
+	case jpegMarkerAPP1:
+		if bytes.HasPrefix(payload, exifHeader) {
+			orientation := parseExifOrientation(payload[len(exifHeader):])
+			if orientation != 1 {
+				writeJPEGSegment(&stripper.pending, jpegMarkerAPP1, orientationExif(orientation))
+			}
+		}
+		return nil
+	case jpegMarkerAPP13, jpegMarkerCOM:
+		return nil
+	}
+	if payload == nil {
+		stripper.pending.Write([]byte{0xff, marker})
+	} else {
+		writeJPEGSegment(&stripper.pending, marker, payload)
+	}
+	return nil
+}
+
+func (stripper *metadataStripper) stepPNG() error {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(stripper.src, header)
+	if err == io.EOF {
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+	length := int64(binary.BigEndian.Uint32(header[:4]))
+	if pngMetadataChunks[string(header[4:])] {
+		_, err = io.CopyN(ioutil.Discard, stripper.src, length+4) // The data and the CRC
+		return err
+	}
+	stripper.pending.Write(header)
+	stripper.remaining = length + 4
+	return nil
+}
+
+/*
+readJPEGSegment reads the marker after the start of image and, unless it stands alone or is the start of scan, its payload
+*/
+func readJPEGSegment(src *bufio.Reader) (byte, []byte, error) {
+	first, err := src.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	if first != 0xff {
+		return 0, nil, errors.New("Expected a JPEG marker")
+	}
+	marker := byte(0xff)
+	for marker == 0xff { // Markers may be padded with 0xff
+		marker, err = src.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if marker == jpegMarkerSOS || marker == jpegMarkerEOI || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+		return marker, nil, nil
+	}
+	lengthBytes := make([]byte, 2)
+	_, err = io.ReadFull(src, lengthBytes)
+	if err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint16(lengthBytes))
+	if length < 2 {
+		return 0, nil, errors.New("Bad JPEG segment length")
+	}
+	payload := make([]byte, length-2)
+	_, err = io.ReadFull(src, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	return marker, payload, nil
+}
+
+func writeJPEGSegment(buffer *bytes.Buffer, marker byte, payload []byte) {
+	buffer.Write([]byte{0xff, marker})
+	binary.Write(buffer, binary.BigEndian, uint16(len(payload)+2))
+	buffer.Write(payload)
+}
+
+/*
+parseExifOrientation reads the orientation from the first IFD of the TIFF structure after the EXIF header, returning 1 if it is missing or bogus
+*/
+func parseExifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for index := 0; index < count; index++ {
+		entry := offset + 2 + index*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 1
+		}
+		return orientation
+	}
+	return 1
+}
+
+/*
+orientationExif returns an EXIF payload holding only the orientation
+*/
+func orientationExif(orientation int) []byte {
+	buffer := bytes.NewBuffer(append([]byte{}, exifHeader...))
+	buffer.WriteString("MM\x00\x2a")                                         // Big endian TIFF
+	binary.Write(buffer, binary.BigEndian, uint32(8))                        // The first IFD follows the header
+	binary.Write(buffer, binary.BigEndian, uint16(1))                        // One entry
+	binary.Write(buffer, binary.BigEndian, uint16(exifOrientationTag))       // Tag
+	binary.Write(buffer, binary.BigEndian, uint16(3))                        // SHORT
+	binary.Write(buffer, binary.BigEndian, uint32(1))                        // One value
+	binary.Write(buffer, binary.BigEndian, []uint16{uint16(orientation), 0}) // The value, padded to 4 bytes
+	binary.Write(buffer, binary.BigEndian, uint32(0))                        // No next IFD
+	return buffer.Bytes()
+}
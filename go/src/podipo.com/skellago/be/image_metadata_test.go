@@ -0,0 +1,85 @@
+package be
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"testing"
+
+	. "github.com/chai2010/assert"
+)
+
+// testExifJPEG returns a width by height JPEG with an EXIF orientation, a GPS pointer, and a comment
+func testExifJPEG(t *testing.T, width int, height int, orientation int) []byte {
+	buffer := &bytes.Buffer{}
+	AssertNil(t, jpeg.Encode(buffer, image.NewRGBA(image.Rect(0, 0, width, height)), nil))
+	data := buffer.Bytes()
+
+	tiff := &bytes.Buffer{}
+	tiff.WriteString("II\x2a\x00")
+	binary.Write(tiff, binary.LittleEndian, uint32(8))
+	binary.Write(tiff, binary.LittleEndian, uint16(2))
+	binary.Write(tiff, binary.LittleEndian, []uint16{exifOrientationTag, 3, 1, 0, uint16(orientation), 0})
+	binary.Write(tiff, binary.LittleEndian, []uint16{0x8825, 4, 1, 0, 1234, 0}) // The GPS IFD pointer
+	binary.Write(tiff, binary.LittleEndian, uint32(0))
+	segments := &bytes.Buffer{}
+	writeJPEGSegment(segments, jpegMarkerAPP1, append(append([]byte{}, exifHeader...), tiff.Bytes()...))
+	writeJPEGSegment(segments, jpegMarkerCOM, []byte("Taken at home"))
+	return append(append(append([]byte{}, data[:2]...), segments.Bytes()...), data[2:]...)
+}
+
+func TestImageMetadata(t *testing.T) {
+	data := testExifJPEG(t, 4, 2, 6)
+	AssertEqual(t, 6, ExifOrientation(bytes.NewReader(data)))
+	AssertEqual(t, 1, ExifOrientation(bytes.NewReader([]byte("not a jpeg"))))
+	AssertEqual(t, 1, ExifOrientation(bytes.NewReader(testExifJPEG(t, 4, 2, 9))), "Bogus orientations are ignored")
+
+	stripped, err := ioutil.ReadAll(StripImageMetadata(bytes.NewReader(data)))
+	AssertNil(t, err)
+	AssertTrue(t, len(stripped) < len(data))
+	AssertFalse(t, bytes.Contains(stripped, []byte("Taken at home")))
+	AssertEqual(t, 6, ExifOrientation(bytes.NewReader(stripped)), "The orientation is kept")
+	config, err := jpeg.DecodeConfig(bytes.NewReader(stripped))
+	AssertNil(t, err)
+	AssertEqual(t, 4, config.Width)
+
+	// PNG text chunks are removed
+	buffer := &bytes.Buffer{}
+	AssertNil(t, png.Encode(buffer, image.NewRGBA(image.Rect(0, 0, 3, 3))))
+	pngData := buffer.Bytes()
+	chunk := &bytes.Buffer{}
+	text := []byte("Location\x0052.5,13.4")
+	binary.Write(chunk, binary.BigEndian, uint32(len(text)))
+	chunk.WriteString("tEXt")
+	chunk.Write(text)
+	binary.Write(chunk, binary.BigEndian, crc32.ChecksumIEEE(chunk.Bytes()[4:]))
+	withText := append(append(append([]byte{}, pngData[:33]...), chunk.Bytes()...), pngData[33:]...) // After the signature and IHDR
+	_, err = png.Decode(bytes.NewReader(withText))
+	AssertNil(t, err)
+	stripped, err = ioutil.ReadAll(StripImageMetadata(bytes.NewReader(withText)))
+	AssertNil(t, err)
+	AssertEqual(t, pngData, stripped)
+
+	other := []byte("GIF89a and so on")
+	stripped, err = ioutil.ReadAll(StripImageMetadata(bytes.NewReader(other)))
+	AssertNil(t, err)
+	AssertEqual(t, other, stripped)
+
+	// Derivatives are upright
+	fs := NewMemoryFileStorage()
+	key, err := fs.Put("phone.jpg", bytes.NewReader(data))
+	AssertNil(t, err)
+	file, err := NewImagePipeline(FitTransform{100, 100}).Derive(key, fs)
+	AssertNil(t, err)
+	reader, err := file.Reader()
+	AssertNil(t, err)
+	defer reader.Close()
+	config, err = jpeg.DecodeConfig(reader)
+	AssertNil(t, err)
+	AssertEqual(t, 50, config.Width)
+	AssertEqual(t, 100, config.Height)
+}
@@ -0,0 +1,627 @@
+package be
+
+/*
+	Chains of image transformations whose results are stored as derivatives.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// imagePipelineSeparator joins the names of transformations in a derivative name
+const imagePipelineSeparator = "_"
+
+/*
+ImageTransform is one step of an ImagePipeline
+*/
+type ImageTransform interface {
+	Name() string // Part of the derivative name, like fit-300x200, which must change whenever the output would
+	Validate() error
+	Transform(img image.Image) image.Image
+}
+
+/*
+ImagePipeline transforms an image with each of its Transforms in order and encodes the result in Format
+The derivative name is made from the names of the Transforms, the Quality, and the Format, so the same chain always finds the same derivative
+Animated GIFs stay animated when the Format is GIF
+*/
+type ImagePipeline struct {
+	Transforms []ImageTransform
+	Quality    int    // Quality from 1 to 100 for lossy formats, 0 for jpeg.DefaultQuality
+	Format     string // Like ImageFormatPNG, "" for JPEG
+}
+
+func NewImagePipeline(transforms ...ImageTransform) *ImagePipeline {
+	return &ImagePipeline{
+		Transforms: transforms,
+	}
+}
+
+/*
+Then adds a transform to the end of the pipeline and returns the pipeline
+*/
+func (pipeline *ImagePipeline) Then(transform ImageTransform) *ImagePipeline {
+	pipeline.Transforms = append(pipeline.Transforms, transform)
+	return pipeline
+}
+
+/*
+WithQuality sets the JPEG quality and returns the pipeline
+*/
+func (pipeline *ImagePipeline) WithQuality(quality int) *ImagePipeline {
+	pipeline.Quality = quality
+	return pipeline
+}
+
+/*
+WithFormat sets the output format and returns the pipeline
+*/
+func (pipeline *ImagePipeline) WithFormat(format string) *ImagePipeline {
+	pipeline.Format = format
+	return pipeline
+}
+
+func (pipeline *ImagePipeline) Validate() error {
+	if len(pipeline.Transforms) == 0 {
+		return errors.New("An image pipeline needs at least one transform")
+	}
+	if pipeline.Quality < 0 || pipeline.Quality > 100 {
+		return errors.New(fmt.Sprintf("Bogus image quality: %d", pipeline.Quality))
+	}
+	if ImageFormatContentType(pipeline.format()) == "" {
+		return errors.New("No encoder for image format: " + pipeline.Format)
+	}
+	for _, transform := range pipeline.Transforms {
+		err := transform.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Derivative returns the name of the derivative holding the pipeline's output, like fit-300x200_grayscale_q85.png
+JPEGs have no format at the end, so derivatives made before formats could be chosen are still found
+*/
+func (pipeline *ImagePipeline) Derivative() string {
+	names := make([]string, 0, len(pipeline.Transforms)+1)
+	for _, transform := range pipeline.Transforms {
+		names = append(names, transform.Name())
+	}
+	if pipeline.Quality != 0 && pipeline.Quality != jpeg.DefaultQuality {
+		names = append(names, "q"+strconv.Itoa(pipeline.Quality))
+	}
+	derivative := strings.Join(names, imagePipelineSeparator)
+	if pipeline.format() != ImageFormatJPEG {
+		derivative += "." + pipeline.format()
+	}
+	return derivative
+}
+
+func (pipeline *ImagePipeline) format() string {
+	if pipeline.Format == "" {
+		return ImageFormatJPEG
+	}
+	return pipeline.Format
+}
+
+/*
+ContentType returns the MIME type of the pipeline's output
+*/
+func (pipeline *ImagePipeline) ContentType() string {
+	return ImageFormatContentType(pipeline.format())
+}
+
+func (pipeline *ImagePipeline) Apply(img image.Image) image.Image {
+	for _, transform := range pipeline.Transforms {
+		img = transform.Transform(img)
+	}
+	return img
+}
+
+/*
+Encode writes img in the pipeline's format and quality
+*/
+func (pipeline *ImagePipeline) Encode(writer io.Writer, img image.Image) error {
+	quality := pipeline.Quality
+	if quality == 0 {
+		quality = jpeg.DefaultQuality
+	}
+	return EncodeImage(writer, img, pipeline.format(), quality)
+}
+
+/*
+Derive gets from or creates in fileStorage the pipeline's derivative of the File with Key key
+JPEGs are turned upright by their EXIF orientation before they are transformed
+Originals with more than MaxImagePixels return an *UploadPolicyError, see DerivativeErrorResponse
+Concurrent calls for the same derivative make it once, see coalesceDerivative
+*/
+func (pipeline *ImagePipeline) Derive(key string, fileStorage FileStorage) (File, error) {
+	file, _, err := pipeline.derive(key, fileStorage)
+	return file, err
+}
+
+/*
+derive is Derive which also returns whether this call made the derivative
+*/
+func (pipeline *ImagePipeline) derive(key string, fileStorage FileStorage) (File, bool, error) {
+	err := pipeline.Validate()
+	if err != nil {
+		return nil, false, err
+	}
+	derivative := pipeline.Derivative()
+
+	// Return any existing derivative
+	dFile, err := fileStorage.Get(key, derivative)
+	if err == nil {
+		return dFile, false, nil
+	}
+	made := false
+	leader, err := coalesceDerivative(key, derivative, func() error {
+		// A run which finished since the Get above has already made it
+		exists, err := fileStorage.Exists(key, derivative)
+		if err == nil && exists {
+			return nil
+		}
+		made = true
+		return pipeline.generate(key, derivative, fileStorage)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	dFile, err = fileStorage.Get(key, derivative)
+	if err != nil && !leader {
+		// The run was for another FileStorage with the same keys
+		made = true
+		err = pipeline.generate(key, derivative, fileStorage)
+		if err != nil {
+			return nil, false, err
+		}
+		dFile, err = fileStorage.Get(key, derivative)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return dFile, made, nil
+}
+
+/*
+generate makes the derivative from the original and puts it in fileStorage
+*/
+func (pipeline *ImagePipeline) generate(key string, derivative string, fileStorage FileStorage) error {
+	origFile, err := fileStorage.Get(key, "")
+	if err != nil {
+		return err
+	}
+	data, err := readAllFile(origFile)
+	if err != nil {
+		return err
+	}
+	buffer, err := pipeline.render(data)
+	if err != nil {
+		return err
+	}
+	return fileStorage.PutDerivative(key, derivative, buffer)
+}
+
+/*
+render decodes, transforms, and encodes the image in data, holding a turn with other decodes throughout
+*/
+func (pipeline *ImagePipeline) render(data []byte) (*bytes.Buffer, error) {
+	_, sourceFormat, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	release := acquireImageDecode()
+	defer release()
+
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if sourceFormat == ImageFormatGIF && pipeline.format() == ImageFormatGIF {
+		animation, err := decodeGIFAnimation(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(animation.Image) > 1 {
+			err = gif.EncodeAll(buffer, pipeline.applyAll(animation))
+			if err != nil {
+				return nil, err
+			}
+			return buffer, nil
+		}
+	}
+	origImage, _, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	if sourceFormat == ImageFormatJPEG {
+		origImage = OrientImage(origImage, ExifOrientation(bytes.NewReader(data)))
+	}
+	err = pipeline.Encode(buffer, pipeline.Apply(origImage))
+	if err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+/*
+applyAll transforms each frame of an animated GIF, drawing each over the frames before it as browsers do
+*/
+func (pipeline *ImagePipeline) applyAll(animation *gif.GIF) *gif.GIF {
+	canvasRect := image.Rect(0, 0, animation.Config.Width, animation.Config.Height)
+	for _, frame := range animation.Image {
+		canvasRect = canvasRect.Union(frame.Bounds())
+	}
+	canvas := image.NewRGBA(canvasRect)
+	result := &gif.GIF{
+		Image:     make([]*image.Paletted, len(animation.Image)),
+		Delay:     animation.Delay,
+		LoopCount: animation.LoopCount,
+		Disposal:  make([]byte, len(animation.Image)),
+	}
+	for index, frame := range animation.Image {
+		var previous *image.RGBA
+		disposal := byte(0)
+		if index < len(animation.Disposal) {
+			disposal = animation.Disposal[index]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvasRect)
+			draw.Draw(previous, canvasRect, canvas, canvasRect.Min, draw.Src)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		transformed := pipeline.Apply(canvas)
+		paletted := image.NewPaletted(transformed.Bounds(), frame.Palette)
+		draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), transformed, transformed.Bounds().Min)
+		result.Image[index] = paletted
+		result.Disposal[index] = gif.DisposalNone // Each frame is whole
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	first := result.Image[0].Bounds()
+	result.Config = image.Config{ColorModel: result.Image[0].Palette, Width: first.Dx(), Height: first.Dy()}
+	return result
+}
+
+func validateImageSize(width int, height int) error {
+	if width <= 0 || height <= 0 {
+		return errors.New(fmt.Sprintf("Bogus maxWidth or maxHeight: %dx%d", width, height))
+	}
+	// A little sanity checking. (I look forward to when this is not big enough for the web.)
+	if width > MaxImageDerivativeSize || height > MaxImageDerivativeSize {
+		return errors.New(fmt.Sprintf("Image too large: %dx%d", width, height))
+	}
+	return nil
+}
+
+/*
+FitCropTransform scales to cover the size and crops the overflow from the center
+*/
+type FitCropTransform struct {
+	Width  int
+	Height int
+}
+
+func (transform FitCropTransform) Name() string {
+	return fmt.Sprintf("fit-crop-%dx%d", transform.Width, transform.Height)
+}
+func (transform FitCropTransform) Validate() error {
+	return validateImageSize(transform.Width, transform.Height)
+}
+func (transform FitCropTransform) Transform(img image.Image) image.Image {
+	return fitCropImage(transform.Width, transform.Height, img)
+}
+
+/*
+FitTransform scales to fit inside the size without cropping, keeping the aspect ratio
+*/
+type FitTransform struct {
+	Width  int
+	Height int
+}
+
+func (transform FitTransform) Name() string {
+	return fmt.Sprintf("fit-%dx%d", transform.Width, transform.Height)
+}
+func (transform FitTransform) Validate() error {
+	return validateImageSize(transform.Width, transform.Height)
+}
+func (transform FitTransform) Transform(img image.Image) image.Image {
+	width, height := fitSize(transform.Width, transform.Height, img.Bounds(), true)
+	return resize.Resize(width, height, img, resize.Lanczos3)
+}
+
+/*
+ThumbnailTransform is like FitTransform but never scales up and is quicker
+*/
+type ThumbnailTransform struct {
+	Width  int
+	Height int
+}
+
+func (transform ThumbnailTransform) Name() string {
+	return fmt.Sprintf("thumbnail-%dx%d", transform.Width, transform.Height)
+}
+func (transform ThumbnailTransform) Validate() error {
+	return validateImageSize(transform.Width, transform.Height)
+}
+func (transform ThumbnailTransform) Transform(img image.Image) image.Image {
+	width, height := fitSize(transform.Width, transform.Height, img.Bounds(), false)
+	return resize.Resize(width, height, img, resize.Bilinear) // Faster, and small images hide the difference
+}
+
+/*
+ExactTransform scales to the size, ignoring the aspect ratio
+*/
+type ExactTransform struct {
+	Width  int
+	Height int
+}
+
+func (transform ExactTransform) Name() string {
+	return fmt.Sprintf("exact-%dx%d", transform.Width, transform.Height)
+}
+func (transform ExactTransform) Validate() error {
+	return validateImageSize(transform.Width, transform.Height)
+}
+func (transform ExactTransform) Transform(img image.Image) image.Image {
+	return resize.Resize(uint(transform.Width), uint(transform.Height), img, resize.Lanczos3)
+}
+
+/*
+PadTransform centers the image on a Background of at least the size, usually after a FitTransform
+*/
+type PadTransform struct {
+	Width      int
+	Height     int
+	Background color.RGBA
+}
+
+func (transform PadTransform) Name() string {
+	background := transform.Background
+	name := fmt.Sprintf("pad-%dx%d-%02x%02x%02x", transform.Width, transform.Height, background.R, background.G, background.B)
+	if background.A != 255 {
+		name += fmt.Sprintf("%02x", background.A)
+	}
+	return name
+}
+func (transform PadTransform) Validate() error {
+	return validateImageSize(transform.Width, transform.Height)
+}
+func (transform PadTransform) Transform(img image.Image) image.Image {
+	bounds := img.Bounds()
+	width := int(math.Max(float64(transform.Width), float64(bounds.Dx())))
+	height := int(math.Max(float64(transform.Height), float64(bounds.Dy())))
+	padded := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(padded, padded.Bounds(), &image.Uniform{transform.Background}, image.ZP, draw.Src)
+	offset := image.Pt((width-bounds.Dx())/2, (height-bounds.Dy())/2)
+	draw.Draw(padded, bounds.Sub(bounds.Min).Add(offset), img, bounds.Min, draw.Over)
+	return padded
+}
+
+/*
+RotateTransform turns the image clockwise by 90, 180, or 270 degrees
+*/
+type RotateTransform struct {
+	Degrees int
+}
+
+func (transform RotateTransform) Name() string {
+	return fmt.Sprintf("rotate-%d", transform.Degrees)
+}
+func (transform RotateTransform) Validate() error {
+	if transform.Degrees != 90 && transform.Degrees != 180 && transform.Degrees != 270 {
+		return errors.New(fmt.Sprintf("Images can only be rotated by 90, 180, or 270 degrees, not %d", transform.Degrees))
+	}
+	return nil
+}
+func (transform RotateTransform) Transform(img image.Image) image.Image {
+	src := toRGBA(img)
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	var rotated *image.RGBA
+	if transform.Degrees == 180 {
+		rotated = image.NewRGBA(image.Rect(0, 0, width, height))
+	} else {
+		rotated = image.NewRGBA(image.Rect(0, 0, height, width))
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pixel := src.RGBAAt(x, y)
+			switch transform.Degrees {
+			case 90:
+				rotated.SetRGBA(height-1-y, x, pixel)
+			case 180:
+				rotated.SetRGBA(width-1-x, height-1-y, pixel)
+			case 270:
+				rotated.SetRGBA(y, width-1-x, pixel)
+			}
+		}
+	}
+	return rotated
+}
+
+/*
+FlipTransform mirrors the image left to right, or top to bottom if Vertical is true
+*/
+type FlipTransform struct {
+	Vertical bool
+}
+
+func (transform FlipTransform) Name() string {
+	if transform.Vertical {
+		return "flip-v"
+	}
+	return "flip-h"
+}
+func (transform FlipTransform) Validate() error { return nil }
+func (transform FlipTransform) Transform(img image.Image) image.Image {
+	src := toRGBA(img)
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	flipped := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if transform.Vertical {
+				flipped.SetRGBA(x, height-1-y, src.RGBAAt(x, y))
+			} else {
+				flipped.SetRGBA(width-1-x, y, src.RGBAAt(x, y))
+			}
+		}
+	}
+	return flipped
+}
+
+/*
+GrayscaleTransform removes the color
+*/
+type GrayscaleTransform struct {
+}
+
+func (transform GrayscaleTransform) Name() string    { return "grayscale" }
+func (transform GrayscaleTransform) Validate() error { return nil }
+func (transform GrayscaleTransform) Transform(img image.Image) image.Image {
+	bounds := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(gray, gray.Bounds(), img, bounds.Min, draw.Src)
+	return gray
+}
+
+// maxBlurSigma limits how long a blur or sharpen may take
+const maxBlurSigma = 50
+
+/*
+BlurTransform is a gaussian blur with a standard deviation of Sigma pixels
+*/
+type BlurTransform struct {
+	Sigma float64
+}
+
+func (transform BlurTransform) Name() string {
+	return "blur-" + strconv.FormatFloat(transform.Sigma, 'f', -1, 64)
+}
+func (transform BlurTransform) Validate() error {
+	if transform.Sigma <= 0 || transform.Sigma > maxBlurSigma {
+		return errors.New(fmt.Sprintf("Bogus blur sigma: %v", transform.Sigma))
+	}
+	return nil
+}
+func (transform BlurTransform) Transform(img image.Image) image.Image {
+	return gaussianBlur(toRGBA(img), transform.Sigma)
+}
+
+/*
+SharpenTransform is an unsharp mask, adding Amount times the difference between the image and a blurred copy
+*/
+type SharpenTransform struct {
+	Amount float64
+}
+
+func (transform SharpenTransform) Name() string {
+	return "sharpen-" + strconv.FormatFloat(transform.Amount, 'f', -1, 64)
+}
+func (transform SharpenTransform) Validate() error {
+	if transform.Amount <= 0 || transform.Amount > 10 {
+		return errors.New(fmt.Sprintf("Bogus sharpen amount: %v", transform.Amount))
+	}
+	return nil
+}
+func (transform SharpenTransform) Transform(img image.Image) image.Image {
+	src := toRGBA(img)
+	blurred := gaussianBlur(src, 1)
+	sharpened := image.NewRGBA(src.Bounds())
+	for index := range src.Pix {
+		if index%4 == 3 {
+			sharpened.Pix[index] = src.Pix[index] // Alpha
+			continue
+		}
+		value := float64(src.Pix[index]) + transform.Amount*(float64(src.Pix[index])-float64(blurred.Pix[index]))
+		sharpened.Pix[index] = clampUint8(value)
+	}
+	return sharpened
+}
+
+// toRGBA returns img as an *image.RGBA with bounds starting at 0, 0
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	if rgba, ok := img.(*image.RGBA); ok && bounds.Min == image.ZP {
+		return rgba
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// gaussianBlur blurs horizontally and then vertically, repeating edge pixels past the bounds
+func gaussianBlur(src *image.RGBA, sigma float64) *image.RGBA {
+	radius := int(math.Ceil(sigma * 3))
+	kernel := make([]float64, radius*2+1)
+	total := 0.0
+	for index := range kernel {
+		distance := float64(index - radius)
+		kernel[index] = math.Exp(-distance * distance / (2 * sigma * sigma))
+		total += kernel[index]
+	}
+	for index := range kernel {
+		kernel[index] /= total
+	}
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	horizontal := image.NewRGBA(src.Bounds())
+	blurred := image.NewRGBA(src.Bounds())
+	blurPass(src, horizontal, kernel, width, height, 4, src.Stride)
+	blurPass(horizontal, blurred, kernel, height, width, src.Stride, 4)
+	return blurred
+}
+
+// blurPass convolves each line of length pixels, where step moves along a line and lineStep moves to the next line
+func blurPass(src *image.RGBA, dst *image.RGBA, kernel []float64, length int, lines int, step int, lineStep int) {
+	radius := len(kernel) / 2
+	for line := 0; line < lines; line++ {
+		for position := 0; position < length; position++ {
+			var sums [4]float64
+			for index, weight := range kernel {
+				sample := position + index - radius
+				if sample < 0 {
+					sample = 0
+				} else if sample >= length {
+					sample = length - 1
+				}
+				offset := line*lineStep + sample*step
+				for channel := 0; channel < 4; channel++ {
+					sums[channel] += weight * float64(src.Pix[offset+channel])
+				}
+			}
+			offset := line*lineStep + position*step
+			for channel := 0; channel < 4; channel++ {
+				dst.Pix[offset+channel] = clampUint8(sums[channel])
+			}
+		}
+	}
+}
+
+func clampUint8(value float64) uint8 {
+	if value < 0 {
+		return 0
+	}
+	if value > 255 {
+		return 255
+	}
+	return uint8(value + 0.5)
+}
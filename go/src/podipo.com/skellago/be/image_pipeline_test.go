@@ -0,0 +1,82 @@
+package be
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	. "github.com/chai2010/assert"
+)
+
+func TestImagePipeline(t *testing.T) {
+	pipeline := NewImagePipeline(FitTransform{300, 200}).
+		Then(PadTransform{300, 200, color.RGBA{255, 255, 255, 255}}).
+		Then(RotateTransform{90}).
+		Then(FlipTransform{Vertical: true}).
+		Then(GrayscaleTransform{}).
+		Then(BlurTransform{1.5}).
+		Then(SharpenTransform{0.5}).
+		WithQuality(85)
+	AssertNil(t, pipeline.Validate())
+	AssertEqual(t, "fit-300x200_pad-300x200-ffffff_rotate-90_flip-v_grayscale_blur-1.5_sharpen-0.5_q85", pipeline.Derivative())
+	AssertEqual(t, "fit-crop-200x200", NewImagePipeline(FitCropTransform{200, 200}).WithQuality(75).Derivative(), "The default quality keeps the old derivative names")
+
+	AssertNotNil(t, NewImagePipeline().Validate())
+	AssertNotNil(t, NewImagePipeline(RotateTransform{45}).Validate())
+	AssertNotNil(t, NewImagePipeline(BlurTransform{0}).Validate())
+	AssertNotNil(t, NewImagePipeline(FitTransform{0, 200}).Validate())
+	AssertNotNil(t, NewImagePipeline(GrayscaleTransform{}).WithQuality(101).Validate())
+
+	// A 4x2 image with a red top left pixel
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	red := color.RGBA{255, 0, 0, 255}
+	src.SetRGBA(0, 0, red)
+	rotated := RotateTransform{90}.Transform(src).(*image.RGBA)
+	AssertEqual(t, image.Rect(0, 0, 2, 4), rotated.Bounds())
+	AssertEqual(t, red, rotated.RGBAAt(1, 0))
+	rotated = RotateTransform{180}.Transform(src).(*image.RGBA)
+	AssertEqual(t, red, rotated.RGBAAt(3, 1))
+	rotated = RotateTransform{270}.Transform(src).(*image.RGBA)
+	AssertEqual(t, red, rotated.RGBAAt(0, 3))
+	flipped := FlipTransform{}.Transform(src).(*image.RGBA)
+	AssertEqual(t, red, flipped.RGBAAt(3, 0))
+	flipped = FlipTransform{Vertical: true}.Transform(src).(*image.RGBA)
+	AssertEqual(t, red, flipped.RGBAAt(0, 1))
+	padded := PadTransform{6, 4, color.RGBA{0, 0, 255, 255}}.Transform(src).(*image.RGBA)
+	AssertEqual(t, image.Rect(0, 0, 6, 4), padded.Bounds())
+	AssertEqual(t, red, padded.RGBAAt(1, 1))
+	AssertEqual(t, color.RGBA{0, 0, 255, 255}, padded.RGBAAt(0, 0))
+	gray := GrayscaleTransform{}.Transform(src)
+	r, g, b, _ := gray.At(0, 0).RGBA()
+	AssertTrue(t, r == g && g == b)
+	blurred := BlurTransform{1}.Transform(src).(*image.RGBA)
+	AssertTrue(t, blurred.RGBAAt(0, 0).R < 255, "The red should spread")
+	AssertTrue(t, blurred.RGBAAt(1, 0).R > 0, "The red should spread")
+	sharpened := SharpenTransform{1}.Transform(src).(*image.RGBA)
+	AssertEqual(t, uint8(255), sharpened.RGBAAt(0, 0).R)
+	AssertEqual(t, uint8(0), sharpened.RGBAAt(1, 0).R)
+
+	fs := NewMemoryFileStorage()
+	buffer := &bytes.Buffer{}
+	AssertNil(t, png.Encode(buffer, image.NewRGBA(image.Rect(0, 0, 600, 300))))
+	key, err := fs.Put("image.png", buffer)
+	AssertNil(t, err)
+	file, err := pipeline.Derive(key, fs)
+	AssertNil(t, err)
+	data, err := readAllFile(file)
+	AssertNil(t, err)
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	AssertNil(t, err)
+	AssertEqual(t, 200, config.Width)
+	AssertEqual(t, 300, config.Height)
+	exists, err := fs.Exists(key, pipeline.Derivative())
+	AssertNil(t, err)
+	AssertTrue(t, exists)
+	file, err = pipeline.Derive(key, fs)
+	AssertNil(t, err)
+	cached, err := readAllFile(file)
+	AssertNil(t, err)
+	AssertEqual(t, data, cached)
+}
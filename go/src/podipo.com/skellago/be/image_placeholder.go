@@ -0,0 +1,300 @@
+package be
+
+/*
+	The size, dominant color, and BlurHash of uploaded images, which front ends use to draw placeholders while images load.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// imagePlaceholderSize is the longest side of the copy of an image which the dominant color and BlurHash are computed from
+const imagePlaceholderSize = 64
+
+const blurHashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+var ImageMetadataProperties = []Property{
+	Property{
+		Name:        "width",
+		Description: "The width of the original image as it is displayed, after its EXIF orientation",
+		DataType:    "int",
+		Protected:   true,
+	},
+	Property{
+		Name:        "height",
+		Description: "The height of the original image as it is displayed",
+		DataType:    "int",
+		Protected:   true,
+	},
+	Property{
+		Name:        "dominant-color",
+		Description: "The most common color, like #7f6a55",
+		DataType:    "string",
+		Protected:   true,
+	},
+	Property{
+		Name:        "blurhash",
+		Description: "A BlurHash of the image, see blurha.sh",
+		DataType:    "string",
+		Protected:   true,
+	},
+}
+
+/*
+ImageMetadata describes an uploaded image so that a placeholder the right size and color can be drawn while it loads
+*/
+type ImageMetadata struct {
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+	DominantColor string `json:"dominant-color"`
+	BlurHash      string `json:"blurhash"`
+}
+
+/*
+DescribeImage decodes the image in data, which may have no more than MaxImagePixels, and returns its metadata
+Transparent parts are treated as white, and like DecodeImage it waits its turn with other decodes
+*/
+func DescribeImage(data []byte) (*ImageMetadata, error) {
+	release := acquireImageDecode()
+	defer release()
+	img, format, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	small := resize.Thumbnail(imagePlaceholderSize, imagePlaceholderSize, img, resize.Bilinear)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if format == ImageFormatJPEG {
+		orientation := ExifOrientation(bytes.NewReader(data))
+		small = OrientImage(small, orientation)
+		if orientation >= 5 { // Rotated a quarter turn
+			width, height = height, width
+		}
+	}
+	flattened := image.NewRGBA(image.Rect(0, 0, small.Bounds().Dx(), small.Bounds().Dy()))
+	draw.Draw(flattened, flattened.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(flattened, flattened.Bounds(), small, small.Bounds().Min, draw.Over)
+
+	xComponents, yComponents := 4, 3
+	if height > width {
+		xComponents, yComponents = 3, 4
+	}
+	blurHash, err := BlurHash(flattened, xComponents, yComponents)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageMetadata{
+		Width:         width,
+		Height:        height,
+		DominantColor: DominantColor(flattened),
+		BlurHash:      blurHash,
+	}, nil
+}
+
+/*
+DominantColor returns the most common color of img, like #7f6a55
+Colors are counted in buckets of similar colors and the average of the largest bucket is returned
+*/
+func DominantColor(img image.Image) string {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := map[int]*bucket{}
+	best := -1
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pixel := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			index := int(pixel.R>>4)<<8 | int(pixel.G>>4)<<4 | int(pixel.B>>4)
+			found, ok := buckets[index]
+			if !ok {
+				found = &bucket{}
+				buckets[index] = found
+			}
+			found.count++
+			found.r += int(pixel.R)
+			found.g += int(pixel.G)
+			found.b += int(pixel.B)
+			if best == -1 || found.count > buckets[best].count || (found.count == buckets[best].count && index < best) {
+				best = index
+			}
+		}
+	}
+	if best == -1 {
+		return ""
+	}
+	found := buckets[best]
+	return fmt.Sprintf("#%02x%02x%02x", found.r/found.count, found.g/found.count, found.b/found.count)
+}
+
+/*
+BlurHash encodes img with the BlurHash algorithm from https://blurha.sh using xComponents by yComponents, each from 1 to 9
+*/
+func BlurHash(img image.Image, xComponents int, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", errors.New("BlurHash components are from 1 to 9")
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return "", errors.New("An empty image has no BlurHash")
+	}
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pixel := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			linear[y*width+x] = [3]float64{sRGBToLinear(pixel.R), sRGBToLinear(pixel.G), sRGBToLinear(pixel.B)}
+		}
+	}
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation * math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) * math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					for channel := 0; channel < 3; channel++ {
+						factor[channel] += basis * linear[y*width+x][channel]
+					}
+				}
+			}
+			for channel := 0; channel < 3; channel++ {
+				factor[channel] /= float64(width * height)
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	hash := &strings.Builder{}
+	encodeBase83(hash, (xComponents-1)+(yComponents-1)*9, 1)
+	maximum := 1.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, factor := range factors[1:] {
+			for _, value := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(value))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximum = float64(quantisedMaximum+1) / 166
+		encodeBase83(hash, quantisedMaximum, 1)
+	} else {
+		encodeBase83(hash, 0, 1)
+	}
+	dc := factors[0]
+	encodeBase83(hash, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+	for _, factor := range factors[1:] {
+		quantised := [3]int{}
+		for channel, value := range factor {
+			quantised[channel] = int(math.Max(0, math.Min(18, math.Floor(signedPow(value/maximum, 0.5)*9+9.5))))
+		}
+		encodeBase83(hash, quantised[0]*19*19+quantised[1]*19+quantised[2], 2)
+	}
+	return hash.String(), nil
+}
+
+func encodeBase83(hash *strings.Builder, value int, length int) {
+	for index := 1; index <= length; index++ {
+		digit := (value / int(math.Pow(83, float64(length-index)))) % 83
+		hash.WriteByte(blurHashCharacters[digit])
+	}
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signedPow(value float64, exponent float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exponent), value)
+}
+
+/*
+describeImage stores the ImageMetadata of the image record describes, logging rather than failing if it can not be read
+*/
+func (request *APIRequest) describeImage(record *FileRecord) *ImageMetadata {
+	file, err := request.FS.Get(record.Key, "")
+	if err != nil {
+		logger.Print("Could not read the image to describe: " + err.Error())
+		return nil
+	}
+	data, err := readAllFile(file)
+	if err != nil {
+		logger.Print("Could not read the image to describe: " + err.Error())
+		return nil
+	}
+	metadata, err := DescribeImage(data)
+	if err != nil {
+		logger.Print("Could not describe the image " + record.Key + ": " + err.Error())
+		return nil
+	}
+	err = SetFileImageMetadata(record.Key, metadata, request.DB)
+	if err != nil {
+		logger.Print("Could not record the image metadata: " + err.Error())
+		return nil
+	}
+	record.setImageMetadata(metadata)
+	return metadata
+}
+
+/*
+ImageMetadata returns the metadata of the image with Key key, describing it now if it was uploaded before images were described
+It returns nil if the File is not an image which can be decoded
+*/
+func (request *APIRequest) ImageMetadata(key string) (*ImageMetadata, error) {
+	record, err := FindFileRecord(key, request.DB)
+	if err != nil {
+		return nil, err
+	}
+	if metadata := record.ImageMetadata(); metadata != nil {
+		return metadata, nil
+	}
+	if !strings.HasPrefix(record.ContentType, "image/") {
+		return nil, nil
+	}
+	return request.describeImage(record), nil
+}
+
+/*
+ImageMetadataResponse returns the status and ImageMetadata or APIError for a GET of the metadata of the image with Key key
+*/
+func (request *APIRequest) ImageMetadataResponse(key string) (int, interface{}) {
+	if key == "" {
+		return 404, FileNotFoundError
+	}
+	metadata, err := request.ImageMetadata(key)
+	if err != nil {
+		return 404, FileNotFoundError
+	}
+	if metadata == nil {
+		return 422, APIError{
+			Id:      UnsupportedContentTypeError.Id,
+			Message: "The file is not an image which can be described",
+		}
+	}
+	return 200, metadata
+}
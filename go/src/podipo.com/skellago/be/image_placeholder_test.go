@@ -0,0 +1,73 @@
+package be
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strings"
+	"testing"
+
+	. "github.com/chai2010/assert"
+)
+
+func TestImagePlaceholders(t *testing.T) {
+	black := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	draw.Draw(black, black.Bounds(), image.Black, image.ZP, draw.Src)
+	hash, err := BlurHash(black, 4, 3)
+	AssertNil(t, err)
+	AssertEqual(t, "L00000"+strings.Repeat("fQ", 11), hash)
+	hash, err = BlurHash(black, 1, 1)
+	AssertNil(t, err)
+	AssertEqual(t, "000000", hash)
+	_, err = BlurHash(black, 10, 3)
+	AssertNotNil(t, err)
+
+	// A left to right gradient has a strong horizontal component
+	gradient := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for x := 0; x < 32; x++ {
+		for y := 0; y < 32; y++ {
+			gradient.SetRGBA(x, y, color.RGBA{uint8(x * 8), uint8(x * 8), uint8(x * 8), 255})
+		}
+	}
+	hash, err = BlurHash(gradient, 2, 2)
+	AssertNil(t, err)
+	AssertEqual(t, 1+1+4+2*3, len(hash))
+	AssertEqual(t, "00", hash[6:8], "Dark on the left is the most negative value: "+hash)
+
+	// Mostly red with a little blue
+	picture := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(picture, picture.Bounds(), &image.Uniform{color.RGBA{200, 10, 10, 255}}, image.ZP, draw.Src)
+	draw.Draw(picture, image.Rect(0, 0, 3, 3), &image.Uniform{color.RGBA{0, 0, 255, 255}}, image.ZP, draw.Src)
+	AssertEqual(t, "#c80a0a", DominantColor(picture))
+
+	buffer := &bytes.Buffer{}
+	AssertNil(t, png.Encode(buffer, picture))
+	metadata, err := DescribeImage(buffer.Bytes())
+	AssertNil(t, err)
+	AssertEqual(t, 10, metadata.Width)
+	AssertEqual(t, "#c80a0a", metadata.DominantColor)
+	AssertEqual(t, 28, len(metadata.BlurHash))
+
+	// The displayed size of a photo turned by its EXIF orientation
+	metadata, err = DescribeImage(testExifJPEG(t, 40, 20, 6))
+	AssertNil(t, err)
+	AssertEqual(t, 20, metadata.Width)
+	AssertEqual(t, 40, metadata.Height)
+	AssertEqual(t, 28, len(metadata.BlurHash))
+
+	// Transparent images are described as if they were on white
+	clear := &bytes.Buffer{}
+	AssertNil(t, png.Encode(clear, image.NewNRGBA(image.Rect(0, 0, 4, 4))))
+	metadata, err = DescribeImage(clear.Bytes())
+	AssertNil(t, err)
+	AssertEqual(t, "#ffffff", metadata.DominantColor)
+
+	_, err = DescribeImage([]byte("not an image"))
+	AssertNotNil(t, err)
+	record := &FileRecord{}
+	AssertNil(t, record.ImageMetadata())
+	record.setImageMetadata(metadata)
+	AssertEqual(t, metadata, record.ImageMetadata())
+}
@@ -0,0 +1,180 @@
+package be
+
+/*
+	Image sizes which may be requested from the image resources with ?w=&h=&mode=
+*/
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	ImageModeFill      = "fill"      // Scale to cover the size and crop the overflow from the center or around the focal point, the fit-crop derivatives
+	ImageModeSmart     = "smart"     // Like fill, but without a focal point the crop is where the image has the most edges
+	ImageModeFit       = "fit"       // Scale to fit inside the size, keeping the aspect ratio
+	ImageModeExact     = "exact"     // Scale to the size, ignoring the aspect ratio
+	ImageModeThumbnail = "thumbnail" // Like fit, but never larger than the original and quicker to make
+)
+
+// MaxImageDerivativeSize is the largest width or height of a derivative image
+const MaxImageDerivativeSize = 4000
+
+/*
+DefaultImagePresets are allowed by every image resource along with its own default preset
+*/
+var DefaultImagePresets = []ImagePreset{
+	ImagePreset{200, 200, ImageModeThumbnail},
+}
+
+/*
+ImagePreset is a size and mode of derivative image
+*/
+type ImagePreset struct {
+	Width  int
+	Height int
+	Mode   string
+}
+
+/*
+String returns the form read by ParseImagePreset, like 700x700-fill
+*/
+func (preset ImagePreset) String() string {
+	return fmt.Sprintf("%dx%d-%s", preset.Width, preset.Height, preset.Mode)
+}
+
+/*
+Derivative returns the name under which the preset's image is stored with FileStorage.PutDerivative
+*/
+func (preset ImagePreset) Derivative() string {
+	return preset.Pipeline().Derivative()
+}
+
+/*
+Pipeline returns the ImagePipeline which makes the preset's image of a File without a focal point
+*/
+func (preset ImagePreset) Pipeline() *ImagePipeline {
+	return preset.FocusedPipeline(nil)
+}
+
+/*
+FocusedPipeline returns the ImagePipeline which makes the preset's image, cropping around focus if it is not nil and the mode crops
+*/
+func (preset ImagePreset) FocusedPipeline(focus *FocalPoint) *ImagePipeline {
+	if focus != nil && (preset.Mode == ImageModeFill || preset.Mode == ImageModeSmart) {
+		return NewImagePipeline(FocalCropTransform{preset.Width, preset.Height, *focus})
+	}
+	switch preset.Mode {
+	case ImageModeSmart:
+		return NewImagePipeline(SmartCropTransform{preset.Width, preset.Height})
+	case ImageModeFit:
+		return NewImagePipeline(FitTransform{preset.Width, preset.Height})
+	case ImageModeExact:
+		return NewImagePipeline(ExactTransform{preset.Width, preset.Height})
+	case ImageModeThumbnail:
+		return NewImagePipeline(ThumbnailTransform{preset.Width, preset.Height})
+	}
+	return NewImagePipeline(FitCropTransform{preset.Width, preset.Height})
+}
+
+func (preset ImagePreset) Validate() error {
+	err := validateImageSize(preset.Width, preset.Height)
+	if err != nil {
+		return err
+	}
+	switch preset.Mode {
+	case ImageModeFill, ImageModeSmart, ImageModeFit, ImageModeExact, ImageModeThumbnail:
+		return nil
+	}
+	return errors.New("Unknown image mode: " + preset.Mode)
+}
+
+/*
+ParseImageMode returns the mode named by value, with "crop" for fill and "" for the default of fill
+*/
+func ParseImageMode(value string) (string, error) {
+	switch value {
+	case "", "crop":
+		return ImageModeFill, nil
+	case ImageModeFill, ImageModeSmart, ImageModeFit, ImageModeExact, ImageModeThumbnail:
+		return value, nil
+	}
+	return "", errors.New("Unknown image mode: " + value)
+}
+
+/*
+ParseImagePreset reads a preset like 700x700-fill, or 700x700 for fill
+*/
+func ParseImagePreset(value string) (ImagePreset, error) {
+	preset := ImagePreset{}
+	size := strings.TrimSpace(value)
+	mode := ""
+	if index := strings.Index(size, "-"); index != -1 {
+		size, mode = size[:index], size[index+1:]
+	}
+	dimensions := strings.Split(size, "x")
+	if len(dimensions) != 2 {
+		return preset, errors.New("Image presets look like 700x700-fill: " + value)
+	}
+	var err error
+	preset.Width, err = strconv.Atoi(dimensions[0])
+	if err != nil {
+		return preset, errors.New("Bad image preset width: " + value)
+	}
+	preset.Height, err = strconv.Atoi(dimensions[1])
+	if err != nil {
+		return preset, errors.New("Bad image preset height: " + value)
+	}
+	preset.Mode, err = ParseImageMode(mode)
+	if err != nil {
+		return preset, err
+	}
+	return preset, preset.Validate()
+}
+
+/*
+ParseImagePresets reads presets like those in Config.ImagePresets
+*/
+func ParseImagePresets(values []string) ([]ImagePreset, error) {
+	presets := []ImagePreset{}
+	for _, value := range values {
+		preset, err := ParseImagePreset(value)
+		if err != nil {
+			return nil, err
+		}
+		presets = append(presets, preset)
+	}
+	return presets, nil
+}
+
+/*
+RequestedImagePreset returns the preset named by the w, h, and mode query parameters if it is one of presets, or presets[0] if none are set
+Only allowing presets keeps clients from filling the FileStorage with derivatives of every size
+*/
+func (request *APIRequest) RequestedImagePreset(presets []ImagePreset) (ImagePreset, *APIError) {
+	query := request.Raw.URL.Query()
+	if query.Get("w") == "" && query.Get("h") == "" && query.Get("mode") == "" {
+		return presets[0], nil
+	}
+	width, widthErr := strconv.Atoi(query.Get("w"))
+	height, heightErr := strconv.Atoi(query.Get("h"))
+	mode, modeErr := ParseImageMode(query.Get("mode"))
+	if widthErr == nil && heightErr == nil && modeErr == nil {
+		requested := ImagePreset{width, height, mode}
+		for _, preset := range presets {
+			if preset == requested {
+				return preset, nil
+			}
+		}
+	}
+	allowed := make([]string, len(presets))
+	for index, preset := range presets {
+		allowed[index] = preset.String()
+	}
+	return ImagePreset{}, &APIError{
+		Id:      ImagePresetNotAllowedError.Id,
+		Message: ImagePresetNotAllowedError.Message + ", the allowed sizes are " + strings.Join(allowed, ", "),
+	}
+}
@@ -1,7 +1,9 @@
 package be
 
 import (
+	"image"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"testing"
 
@@ -42,3 +44,76 @@ func TestImageManipulation(t *testing.T) {
 	AssertNil(t, err)
 	Assert(t, CompareReaderData(reader1, reader2))
 }
+
+func TestImagePresets(t *testing.T) {
+	preset, err := ParseImagePreset("300x200-crop")
+	AssertNil(t, err)
+	AssertEqual(t, ImagePreset{300, 200, ImageModeFill}, preset)
+	AssertEqual(t, "fit-crop-300x200", preset.Derivative())
+	preset, err = ParseImagePreset("300x200-thumbnail")
+	AssertNil(t, err)
+	AssertEqual(t, "thumbnail-300x200", preset.Derivative())
+	_, err = ParseImagePreset("300x200-stretch")
+	AssertNotNil(t, err)
+	_, err = ParseImagePreset("5000x200")
+	AssertNotNil(t, err)
+	_, err = ParseImagePresets([]string{"300x200", "big"})
+	AssertNotNil(t, err)
+
+	presets := []ImagePreset{ImagePreset{700, 700, ImageModeFill}, ImagePreset{200, 200, ImageModeFit}}
+	for query, expected := range map[string]*ImagePreset{
+		"":                       &presets[0],
+		"?w=200&h=200&mode=fit":  &presets[1],
+		"?w=700&h=700":           &presets[0],
+		"?w=700&h=700&mode=crop": &presets[0],
+		"?w=200&h=200":           nil,
+		"?w=201&h=200&mode=fit":  nil,
+		"?w=big&h=200&mode=fit":  nil,
+	} {
+		raw, err := http.NewRequest("GET", "/user/current/image"+query, nil)
+		AssertNil(t, err)
+		request := &APIRequest{Raw: raw}
+		preset, apiError := request.RequestedImagePreset(presets)
+		if expected == nil {
+			AssertNotNil(t, apiError, query)
+			AssertEqual(t, ImagePresetNotAllowedError.Id, apiError.Id)
+		} else {
+			AssertNil(t, apiError, query)
+			AssertEqual(t, *expected, preset, query)
+		}
+	}
+
+	fs := NewMemoryFileStorage()
+	tempDir, err := ioutil.TempDir(os.TempDir(), "skellago-temp")
+	AssertNil(t, err)
+	defer os.RemoveAll(tempDir)
+	imageFile, err := TempImage(tempDir, 640, 480)
+	AssertNil(t, err)
+	key, err := fs.Put("image.jpg", imageFile)
+	AssertNil(t, err)
+	for _, test := range []struct {
+		preset ImagePreset
+		width  int
+		height int
+	}{
+		{ImagePreset{200, 100, ImageModeFill}, 200, 100},
+		{ImagePreset{200, 100, ImageModeFit}, 133, 100},
+		{ImagePreset{1000, 1400, ImageModeFit}, 1000, 750},
+		{ImagePreset{200, 100, ImageModeExact}, 200, 100},
+		{ImagePreset{1000, 1400, ImageModeThumbnail}, 640, 480},
+	} {
+		file, err := ImageDerivative(test.preset, key, fs)
+		AssertNil(t, err)
+		AssertEqual(t, key, file.Key())
+		reader, err := file.Reader()
+		AssertNil(t, err)
+		config, _, err := image.DecodeConfig(reader)
+		reader.Close()
+		AssertNil(t, err)
+		AssertEqual(t, test.width, config.Width, test.preset.String())
+		AssertEqual(t, test.height, config.Height, test.preset.String())
+		exists, err := fs.Exists(key, test.preset.Derivative())
+		AssertNil(t, err)
+		AssertTrue(t, exists)
+	}
+}
@@ -0,0 +1,293 @@
+package be
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+MemoryFileStorage is a FileStorage held in memory, for tests and deployments which do not need to keep files
+It is safe for concurrent use and its keys, derivatives, and deletes behave like LocalFileStorage's
+*/
+type MemoryFileStorage struct {
+	sync.RWMutex
+	files    map[string]map[string][]byte // key -> derivative -> data, with "" for the original
+	staged   map[string]map[int64][]byte  // upload id -> offset -> chunk
+	modified map[string]time.Time         // key or upload id -> when it last changed
+}
+
+func NewMemoryFileStorage() *MemoryFileStorage {
+	return &MemoryFileStorage{
+		files:    make(map[string]map[string][]byte),
+		staged:   make(map[string]map[int64][]byte),
+		modified: make(map[string]time.Time),
+	}
+}
+
+func (fs *MemoryFileStorage) Put(name string, reader io.Reader) (key string, err error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	key = generateFileKey(name)
+	fs.Lock()
+	defer fs.Unlock()
+	fs.files[key] = map[string][]byte{"": data}
+	fs.modified[key] = time.Now()
+	return key, nil
+}
+
+/*
+PutKey stores an original under key, replacing the original but not the derivatives already stored there
+*/
+func (fs *MemoryFileStorage) PutKey(key string, reader io.Reader) error {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	key = cleanFileToken(key)
+	if key == "" {
+		return errors.New("Empty file key")
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	derivatives, ok := fs.files[key]
+	if !ok {
+		derivatives = make(map[string][]byte)
+		fs.files[key] = derivatives
+	}
+	derivatives[""] = data
+	fs.modified[key] = time.Now()
+	return nil
+}
+
+func (fs *MemoryFileStorage) PutDerivative(key string, derivative string, reader io.Reader) error {
+	// Read before locking so that slow readers do not block other requests
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	derivatives, ok := fs.files[cleanFileToken(key)]
+	if !ok {
+		return errors.New("Cannot create a derivative for a non-existant key")
+	}
+	derivatives[cleanFileToken(derivative)] = data
+	fs.modified[cleanFileToken(key)] = time.Now()
+	return nil
+}
+
+func (fs *MemoryFileStorage) Get(key string, derivative string) (File, error) {
+	file := MemoryFile{
+		fs:         fs,
+		key:        cleanFileToken(key),
+		derivative: derivative,
+	}
+	exists, _ := file.Exists()
+	if !exists {
+		return nil, errors.New("No such File: " + file.key + " with derivative: " + derivative)
+	}
+	return file, nil
+}
+
+func (fs *MemoryFileStorage) Exists(key string, derivative string) (bool, error) {
+	key = cleanFileToken(key)
+	if key == "" {
+		return false, errors.New("Empty file key")
+	}
+	_, ok := fs.data(key, derivative)
+	return ok, nil
+}
+
+/*
+Delete removes the File and, if derivative is "", all of its derivatives
+Like LocalFileStorage, deleting a File which does not exist is not an error
+*/
+func (fs *MemoryFileStorage) Delete(key string, derivative string) error {
+	key = cleanFileToken(key)
+	fs.Lock()
+	defer fs.Unlock()
+	if derivative == "" {
+		delete(fs.files, key)
+		delete(fs.modified, key)
+		return nil
+	}
+	if derivatives, ok := fs.files[key]; ok {
+		delete(derivatives, cleanFileToken(derivative))
+	}
+	return nil
+}
+
+func (fs *MemoryFileStorage) data(key string, derivative string) ([]byte, bool) {
+	fs.RLock()
+	defer fs.RUnlock()
+	derivatives, ok := fs.files[key]
+	if !ok {
+		return nil, false
+	}
+	data, ok := derivatives[cleanFileToken(derivative)]
+	return data, ok
+}
+
+/*
+PutChunk reads the whole chunk before staging it, so a chunk whose reader fails is not staged
+*/
+func (fs *MemoryFileStorage) PutChunk(uploadId string, offset int64, reader io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return 0, err
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	chunks, ok := fs.staged[uploadId]
+	if !ok {
+		chunks = make(map[int64][]byte)
+		fs.staged[uploadId] = chunks
+	}
+	chunks[offset] = data
+	fs.modified[uploadId] = time.Now()
+	return int64(len(data)), nil
+}
+
+func (fs *MemoryFileStorage) DeleteChunk(uploadId string, offset int64) error {
+	fs.Lock()
+	defer fs.Unlock()
+	if chunks, ok := fs.staged[uploadId]; ok {
+		delete(chunks, offset)
+	}
+	return nil
+}
+
+func (fs *MemoryFileStorage) StagedSize(uploadId string) (int64, error) {
+	return stagedSize(fs.stagedChunks(uploadId))
+}
+
+func (fs *MemoryFileStorage) StagedReader(uploadId string) (io.ReadCloser, error) {
+	return newChunkReader(fs.stagedChunks(uploadId))
+}
+
+func (fs *MemoryFileStorage) DeleteStaged(uploadId string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	delete(fs.staged, uploadId)
+	delete(fs.modified, uploadId)
+	return nil
+}
+
+func (fs *MemoryFileStorage) Keys() ([]StoredKey, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+	keys := make([]StoredKey, 0, len(fs.files))
+	for key := range fs.files {
+		keys = append(keys, StoredKey{Key: key, Modified: fs.modified[key]})
+	}
+	return keys, nil
+}
+
+func (fs *MemoryFileStorage) Derivatives(key string) ([]string, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+	results := []string{}
+	for derivative := range fs.files[cleanFileToken(key)] {
+		if derivative != "" {
+			results = append(results, derivative)
+		}
+	}
+	sort.Strings(results)
+	return results, nil
+}
+
+/*
+TempEntries returns the staged uploads, which are all that MemoryFileStorage keeps in its temp area
+*/
+func (fs *MemoryFileStorage) TempEntries() ([]TempEntry, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+	entries := make([]TempEntry, 0, len(fs.staged))
+	for uploadId := range fs.staged {
+		entries = append(entries, TempEntry{Name: uploadId, UploadId: uploadId, Modified: fs.modified[uploadId]})
+	}
+	return entries, nil
+}
+
+func (fs *MemoryFileStorage) DeleteTemp(name string) error {
+	return fs.DeleteStaged(name)
+}
+
+// stagedChunks returns the chunks of an upload in offset order
+func (fs *MemoryFileStorage) stagedChunks(uploadId string) []stagedChunk {
+	fs.RLock()
+	defer fs.RUnlock()
+	chunks := []stagedChunk{}
+	for offset, data := range fs.staged[uploadId] {
+		data := data
+		chunks = append(chunks, stagedChunk{
+			offset: offset,
+			size:   int64(len(data)),
+			open: func() (io.ReadCloser, error) {
+				return memoryFileReader{bytes.NewReader(data)}, nil
+			},
+		})
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].offset < chunks[j].offset })
+	return chunks
+}
+
+/*
+MemoryFile is a be.File backed by a MemoryFileStorage
+*/
+type MemoryFile struct {
+	fs         *MemoryFileStorage
+	key        string
+	derivative string
+}
+
+func (file MemoryFile) Key() string {
+	return file.key
+}
+
+func (file MemoryFile) Derivative() string {
+	return file.derivative
+}
+
+func (file MemoryFile) Name() (string, error) {
+	return fileNameFromKey(file.key), nil
+}
+
+func (file MemoryFile) Exists() (bool, error) {
+	_, ok := file.fs.data(file.key, file.derivative)
+	return ok, nil
+}
+
+func (file MemoryFile) Size() (int64, error) {
+	data, ok := file.fs.data(file.key, file.derivative)
+	if !ok {
+		return -1, errors.New("No such File: " + file.key + " with derivative: " + file.derivative)
+	}
+	return int64(len(data)), nil
+}
+
+/*
+Reader returns the data as it was when Reader was called; stored data is never modified in place
+*/
+func (file MemoryFile) Reader() (FileReader, error) {
+	data, ok := file.fs.data(file.key, file.derivative)
+	if !ok {
+		return nil, errors.New("No such File: " + file.key + " with derivative: " + file.derivative)
+	}
+	return memoryFileReader{bytes.NewReader(data)}, nil
+}
+
+type memoryFileReader struct {
+	*bytes.Reader
+}
+
+func (memoryFileReader) Close() error {
+	return nil
+}
@@ -0,0 +1,14 @@
+package be
+
+import (
+	"testing"
+
+	. "github.com/chai2010/assert"
+)
+
+func TestMemoryFileStorage(t *testing.T) {
+	testFS := NewMemoryFileStorage()
+	AssertFileStorage(t, testFS)
+	AssertEqual(t, 0, len(testFS.files), "Deleting every original should leave nothing behind")
+
+}
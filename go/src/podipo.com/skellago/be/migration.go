@@ -0,0 +1,336 @@
+package be
+
+/*
+	Versioned schema migrations.
+
+	Tables are created from their structs by qbs's CreateTableIfNotExists, which also adds new columns.
+	Migrations handle everything else: indexes, renames, drops, type changes, and data fixes.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+/*
+Migration is a named, reversible set of SQL statements
+Migrations are applied in the order they are registered and rolled back in reverse order
+*/
+type Migration struct {
+	Package string   // The registering package, for example "be" or "cms"
+	Name    string   // Unique within the package, for example "0001_user_email_index"
+	Up      []string // SQL statements which apply the migration
+	Down    []string // SQL statements which undo Up, empty if the migration cannot be rolled back
+}
+
+func (migration Migration) id() string {
+	return migration.Package + "/" + migration.Name
+}
+
+/*
+MigrationStatus reports whether a registered Migration has been applied to the database
+*/
+type MigrationStatus struct {
+	Package string    `json:"package"`
+	Name    string    `json:"name"`
+	Applied bool      `json:"applied"`
+	Time    time.Time `json:"time"`
+}
+
+/*
+AppliedMigration is a row in the schema_migrations table
+*/
+type AppliedMigration struct {
+	Package string
+	Name    string
+	Applied time.Time
+}
+
+const createSchemaMigrationsSQL = `create table if not exists schema_migrations (
+	package varchar(255) not null,
+	name varchar(255) not null,
+	applied timestamp not null,
+	primary key (package, name)
+)`
+
+var (
+	migrations      = make([]Migration, 0)
+	migrationsMutex sync.Mutex
+)
+
+/*
+RegisterMigrations adds a package's migrations to the end of the list of registered migrations
+Registering a migration with the same package and name a second time replaces the first
+*/
+func RegisterMigrations(pkg string, newMigrations ...Migration) {
+	migrationsMutex.Lock()
+	defer migrationsMutex.Unlock()
+	for _, migration := range newMigrations {
+		migration.Package = pkg
+		replaced := false
+		for i, existing := range migrations {
+			if existing.id() == migration.id() {
+				migrations[i] = migration
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			migrations = append(migrations, migration)
+		}
+	}
+}
+
+/*
+unregisterMigrations removes a package's migrations, so that tests can register throwaway ones
+*/
+func unregisterMigrations(pkg string) {
+	migrationsMutex.Lock()
+	defer migrationsMutex.Unlock()
+	kept := make([]Migration, 0, len(migrations))
+	for _, migration := range migrations {
+		if migration.Package != pkg {
+			kept = append(kept, migration)
+		}
+	}
+	migrations = kept
+}
+
+/*
+RegisteredMigrations returns a copy of the registered migrations in the order they are applied
+*/
+func RegisteredMigrations() []Migration {
+	migrationsMutex.Lock()
+	defer migrationsMutex.Unlock()
+	results := make([]Migration, len(migrations))
+	copy(results, migrations)
+	return results
+}
+
+func createSchemaMigrationsTable(db *qbs.Qbs) error {
+	_, err := db.Exec(createSchemaMigrationsSQL)
+	return err
+}
+
+/*
+FindAppliedMigrations returns the contents of the schema_migrations table, creating it if necessary
+*/
+func FindAppliedMigrations(db *qbs.Qbs) ([]*AppliedMigration, error) {
+	err := createSchemaMigrationsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	var applied []*AppliedMigration
+	err = db.QueryStruct(&applied, "select package, name, applied from schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+func appliedMigrationIds(db *qbs.Qbs) (map[string]time.Time, error) {
+	applied, err := FindAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]time.Time)
+	for _, record := range applied {
+		results[record.Package+"/"+record.Name] = record.Applied
+	}
+	return results, nil
+}
+
+/*
+FindMigrationStatus lists every registered Migration and whether it has been applied
+*/
+func FindMigrationStatus(db *qbs.Qbs) ([]MigrationStatus, error) {
+	applied, err := appliedMigrationIds(db)
+	if err != nil {
+		return nil, err
+	}
+	registered := RegisteredMigrations()
+	results := make([]MigrationStatus, len(registered))
+	for i, migration := range registered {
+		appliedTime, ok := applied[migration.id()]
+		results[i] = MigrationStatus{
+			Package: migration.Package,
+			Name:    migration.Name,
+			Applied: ok,
+			Time:    appliedTime,
+		}
+	}
+	return results, nil
+}
+
+/*
+Migrate applies every pending Migration registered by pkg in registration order, each in its own transaction
+If pkg is "" then pending migrations from every package are applied
+If dryRun is true then the SQL is written to out instead of being executed
+Returns the ids (package/name) of the migrations which were (or in a dry run would be) applied
+*/
+func Migrate(db *qbs.Qbs, pkg string, dryRun bool, out io.Writer) ([]string, error) {
+	applied, err := appliedMigrationIds(db)
+	if err != nil {
+		return nil, err
+	}
+	results := []string{}
+	for _, migration := range RegisteredMigrations() {
+		if pkg != "" && migration.Package != pkg {
+			continue
+		}
+		if _, ok := applied[migration.id()]; ok {
+			continue
+		}
+		err = runMigration(db, migration, true, dryRun, out)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, migration.id())
+	}
+	return results, nil
+}
+
+/*
+RollbackMigrations undoes the last steps applied migrations, in reverse registration order
+If dryRun is true then the SQL is written to out instead of being executed
+*/
+func RollbackMigrations(db *qbs.Qbs, steps int, dryRun bool, out io.Writer) ([]string, error) {
+	applied, err := appliedMigrationIds(db)
+	if err != nil {
+		return nil, err
+	}
+	results := []string{}
+	registered := RegisteredMigrations()
+	for i := len(registered) - 1; i >= 0 && len(results) < steps; i-- {
+		migration := registered[i]
+		if _, ok := applied[migration.id()]; !ok {
+			continue
+		}
+		if len(migration.Down) == 0 {
+			return results, errors.New("Migration cannot be rolled back: " + migration.id())
+		}
+		err = runMigration(db, migration, false, dryRun, out)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, migration.id())
+	}
+	return results, nil
+}
+
+func runMigration(db *qbs.Qbs, migration Migration, up bool, dryRun bool, out io.Writer) (err error) {
+	statements := migration.Up
+	direction := "up"
+	if !up {
+		statements = migration.Down
+		direction = "down"
+	}
+	if dryRun {
+		fmt.Fprintf(out, "-- %s (%s)\n", migration.id(), direction)
+		for _, statement := range statements {
+			fmt.Fprintf(out, "%s;\n", statement)
+		}
+		return nil
+	}
+
+	err = db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			db.Rollback()
+		}
+	}()
+	for i, statement := range statements {
+		_, err = db.Exec(statement)
+		if err != nil {
+			return errors.New("Migration " + migration.id() + " " + direction + " failed on statement " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+	}
+	if up {
+		_, err = db.Exec("insert into schema_migrations (package, name, applied) values (?, ?, ?)", migration.Package, migration.Name, time.Now())
+	} else {
+		_, err = db.Exec("delete from schema_migrations where package = ? and name = ?", migration.Package, migration.Name)
+	}
+	if err != nil {
+		return err
+	}
+	err = db.Commit()
+	if err != nil {
+		return err
+	}
+	logger.Printf("Migrated %s %s", migration.id(), direction)
+	return nil
+}
+
+/*
+MigrationCommand implements a command line tool for migrations.
+The DB must be registered (see RegisterDB) and args are the command line arguments after the program name:
+
+	up [-dry-run]
+	down [steps] [-dry-run]
+	status
+*/
+func MigrationCommand(args []string, out io.Writer) error {
+	dryRun := false
+	params := []string{}
+	for _, arg := range args {
+		if arg == "-dry-run" || arg == "--dry-run" {
+			dryRun = true
+		} else {
+			params = append(params, arg)
+		}
+	}
+	if len(params) == 0 {
+		return errors.New("Usage: up [-dry-run] | down [steps] [-dry-run] | status")
+	}
+
+	db, err := qbs.GetQbs()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch params[0] {
+	case "up":
+		ids, err := Migrate(db, "", dryRun, out)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			fmt.Fprintln(out, "No pending migrations")
+		}
+		return nil
+	case "down":
+		steps := 1
+		if len(params) > 1 {
+			steps, err = strconv.Atoi(params[1])
+			if err != nil || steps < 1 {
+				return errors.New("Bogus number of steps: " + params[1])
+			}
+		}
+		_, err = RollbackMigrations(db, steps, dryRun, out)
+		return err
+	case "status":
+		statuses, err := FindMigrationStatus(db)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			if status.Applied {
+				fmt.Fprintf(out, "applied  %s/%s\t%s\n", status.Package, status.Name, status.Time.Format(time.RFC3339))
+			} else {
+				fmt.Fprintf(out, "pending  %s/%s\n", status.Package, status.Name)
+			}
+		}
+		return nil
+	}
+	return errors.New("Unknown migration command: " + params[0])
+}
@@ -0,0 +1,78 @@
+package be
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/chai2010/assert"
+	"github.com/coocood/qbs"
+)
+
+func TestMigrations(t *testing.T) {
+	CreateAndInitDB()
+	db, err := qbs.GetQbs()
+	AssertNil(t, err)
+	defer func() {
+		unregisterMigrations("be_test")
+		db.Exec("drop table if exists migration_test")
+		db.Exec("delete from schema_migrations where package = ?", "be_test")
+		WipeDB()
+		db.Close()
+	}()
+
+	statuses, err := FindMigrationStatus(db)
+	AssertNil(t, err)
+	for _, status := range statuses {
+		if status.Package == "be" {
+			Assert(t, status.Applied, "InitDB should apply the be migrations: "+status.Name)
+		}
+	}
+
+	RegisterMigrations("be_test",
+		Migration{
+			Name: "0001_create",
+			Up:   []string{"create table migration_test (id integer)"},
+			Down: []string{"drop table migration_test"},
+		},
+		Migration{
+			Name: "0002_add_column",
+			Up:   []string{"alter table migration_test add column name varchar(100)"},
+			Down: []string{"alter table migration_test drop column name"},
+		},
+	)
+
+	var out bytes.Buffer
+	ids, err := Migrate(db, "be_test", true, &out)
+	AssertNil(t, err)
+	AssertEqual(t, []string{"be_test/0001_create", "be_test/0002_add_column"}, ids)
+	Assert(t, strings.Contains(out.String(), "create table migration_test"), "Dry run should print the SQL")
+	_, err = db.Exec("select id from migration_test")
+	AssertNotNil(t, err, "Dry run should not create the table")
+
+	ids, err = Migrate(db, "be_test", false, nil)
+	AssertNil(t, err)
+	AssertEqual(t, 2, len(ids))
+	_, err = db.Exec("select id, name from migration_test")
+	AssertNil(t, err)
+	ids, err = Migrate(db, "be_test", false, nil)
+	AssertNil(t, err)
+	AssertEqual(t, 0, len(ids), "Applied migrations should not run twice")
+
+	ids, err = RollbackMigrations(db, 1, false, nil)
+	AssertNil(t, err)
+	AssertEqual(t, []string{"be_test/0002_add_column"}, ids)
+	_, err = db.Exec("select name from migration_test")
+	AssertNotNil(t, err, "The column should have been dropped")
+	statuses, err = FindMigrationStatus(db)
+	AssertNil(t, err)
+	for _, status := range statuses {
+		if status.Package == "be_test" {
+			AssertEqual(t, status.Name == "0001_create", status.Applied)
+		}
+	}
+
+	ids, err = RollbackMigrations(db, 1, false, nil)
+	AssertNil(t, err)
+	AssertEqual(t, []string{"be_test/0001_create"}, ids)
+}
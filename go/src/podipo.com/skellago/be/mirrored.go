@@ -0,0 +1,655 @@
+package be
+
+/*
+	Mirrored storage which writes to several FileStorages and reads from the first healthy one.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultMirrorRetryAfter is how long reads skip a backend after it fails
+const DefaultMirrorRetryAfter = 30 * time.Second
+
+// mirrorQueueSize is how many replication jobs an asynchronous MirroredFileStorage holds before writes wait
+const mirrorQueueSize = 1024
+
+/*
+Divergence is reported when a backend of a MirroredFileStorage is missing a File which another backend has, or could not be written
+*/
+type Divergence struct {
+	Key        string
+	Derivative string
+	Backend    int    // The index of the backend, 0 for the primary and 1 for the first replica
+	Problem    string // Like "missing" or the error from the backend
+}
+
+func (divergence Divergence) String() string {
+	return fmt.Sprintf("backend %d %s %s: %s", divergence.Backend, divergence.Key, divergence.Derivative, divergence.Problem)
+}
+
+/*
+MirroredFileStorage writes to a primary FileStorage and copies what is written to each replica, either before the write returns or from a background queue
+Reads go to the first backend which has the File, skipping backends which recently failed, and backends missing a File which another has are reported as a Divergence
+Repair copies missing keys and derivatives between the backends
+
+Replicas must implement KeyedStorage so that their keys match the primary's.
+A failed replica does not fail writes, it is reported and can be repaired later.
+*/
+type MirroredFileStorage struct {
+	Primary      FileStorage
+	Replicas     []FileStorage
+	RetryAfter   time.Duration               // How long reads skip a backend after it fails
+	OnDivergence func(divergence Divergence) // Logs by default
+
+	queue      chan mirrorJob // Nil for synchronous replication
+	queueMutex sync.RWMutex   // Read locked while sending to the queue and locked to close it
+	closed     bool           // Set by Close, after which writes replicate synchronously
+	pending    sync.WaitGroup
+	keyLocks   map[string]*mirrorKeyLock // Held while copying a key to or deleting it from replicas, so a queued copy can not outlive a Delete
+	mutex      sync.Mutex
+	failed     map[int]time.Time // Backend index -> when it last failed
+}
+
+/*
+mirrorKeyLock orders the replication of one key, and is dropped from keyLocks once nothing holds or waits for it
+*/
+type mirrorKeyLock struct {
+	sync.Mutex
+	users int // Guarded by the MirroredFileStorage's mutex
+}
+
+type mirrorJob struct {
+	key        string
+	derivative string
+}
+
+/*
+NewMirroredFileStorage replicates synchronously unless async is true, in which case Close should be called to finish replicating
+*/
+func NewMirroredFileStorage(primary FileStorage, replicas []FileStorage, async bool) (*MirroredFileStorage, error) {
+	if _, ok := primary.(KeyedStorage); !ok {
+		return nil, errors.New("The primary FileStorage can not put keys, so it can not be repaired")
+	}
+	for _, replica := range replicas {
+		if _, ok := replica.(KeyedStorage); !ok {
+			return nil, errors.New("Replicas must be FileStorages which can put keys")
+		}
+	}
+	fs := &MirroredFileStorage{
+		Primary:    primary,
+		Replicas:   replicas,
+		RetryAfter: DefaultMirrorRetryAfter,
+		OnDivergence: func(divergence Divergence) {
+			logger.Print("File storage divergence: " + divergence.String())
+		},
+		keyLocks: make(map[string]*mirrorKeyLock),
+		failed:   make(map[int]time.Time),
+	}
+	if async {
+		fs.queue = make(chan mirrorJob, mirrorQueueSize)
+		go fs.replicateQueue()
+	}
+	return fs, nil
+}
+
+/*
+Backends returns the primary followed by the replicas
+*/
+func (fs *MirroredFileStorage) Backends() []FileStorage {
+	return append([]FileStorage{fs.Primary}, fs.Replicas...)
+}
+
+/*
+Wait returns once the queued replication jobs are done
+*/
+func (fs *MirroredFileStorage) Wait() {
+	fs.pending.Wait()
+}
+
+/*
+Close waits for queued replication and stops the background replication
+Writes after Close replicate synchronously
+*/
+func (fs *MirroredFileStorage) Close() {
+	fs.queueMutex.Lock()
+	if fs.queue == nil || fs.closed {
+		fs.queueMutex.Unlock()
+		return
+	}
+	fs.closed = true
+	close(fs.queue) // The queued jobs are still run
+	fs.queueMutex.Unlock()
+	fs.pending.Wait()
+}
+
+func (fs *MirroredFileStorage) Put(name string, reader io.Reader) (key string, err error) {
+	key, err = fs.Primary.Put(name, reader)
+	if err != nil {
+		return "", err
+	}
+	fs.replicate(mirrorJob{key: key})
+	return key, nil
+}
+
+func (fs *MirroredFileStorage) PutKey(key string, reader io.Reader) error {
+	err := fs.Primary.(KeyedStorage).PutKey(key, reader)
+	if err != nil {
+		return err
+	}
+	fs.replicate(mirrorJob{key: key})
+	return nil
+}
+
+func (fs *MirroredFileStorage) PutDerivative(key string, derivative string, reader io.Reader) error {
+	err := fs.Primary.PutDerivative(key, derivative, reader)
+	if err != nil {
+		return err
+	}
+	fs.replicate(mirrorJob{key: key, derivative: derivative})
+	return nil
+}
+
+/*
+Get reads from the first healthy backend which has the File
+A backend which has the File but fails to open it is marked as failed and the next backend is tried
+*/
+func (fs *MirroredFileStorage) Get(key string, derivative string) (File, error) {
+	skip := make(map[int]bool)
+	var getErr error
+	for {
+		index, err := fs.findIndex(key, derivative, skip)
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 {
+			if getErr != nil {
+				return nil, getErr
+			}
+			return nil, errors.New("No such File: " + key + " with derivative: " + derivative)
+		}
+		file, err := fs.Backends()[index].Get(key, derivative)
+		if err == nil {
+			return file, nil
+		}
+		fs.fail(index, key, derivative, err)
+		skip[index] = true
+		getErr = err
+	}
+}
+
+func (fs *MirroredFileStorage) Exists(key string, derivative string) (bool, error) {
+	backend, err := fs.find(key, derivative)
+	return backend != nil, err
+}
+
+/*
+Delete deletes from the primary and then the replicas, returning only the primary's error
+Deletes are never queued, so that reads do not fall back to a replica which still has the File
+*/
+func (fs *MirroredFileStorage) Delete(key string, derivative string) error {
+	defer fs.lockKey(key)()
+	err := fs.Primary.Delete(key, derivative)
+	if err != nil {
+		return err
+	}
+	for index, replica := range fs.Replicas {
+		exists, err := replica.Exists(key, derivative)
+		if err == nil && exists {
+			err = replica.Delete(key, derivative)
+		}
+		if err != nil {
+			fs.fail(index+1, key, derivative, err)
+		}
+	}
+	return nil
+}
+
+// replicate runs the job now or queues it
+func (fs *MirroredFileStorage) replicate(job mirrorJob) {
+	fs.queueMutex.RLock()
+	if fs.queue == nil || fs.closed {
+		fs.queueMutex.RUnlock()
+		fs.runJob(job)
+		return
+	}
+	defer fs.queueMutex.RUnlock()
+	fs.pending.Add(1)
+	fs.queue <- job
+}
+
+func (fs *MirroredFileStorage) replicateQueue() {
+	for job := range fs.queue {
+		fs.runJob(job)
+		fs.pending.Done()
+	}
+}
+
+func (fs *MirroredFileStorage) runJob(job mirrorJob) {
+	defer fs.lockKey(job.key)()
+	exists, err := fs.Primary.Exists(job.key, job.derivative)
+	if err == nil && !exists {
+		return // Deleted since the job was queued
+	}
+	for index, replica := range fs.Replicas {
+		err := copyStoredFile(fs.Primary, replica, job.key, job.derivative)
+		if err != nil {
+			fs.fail(index+1, job.key, job.derivative, err)
+		}
+	}
+}
+
+/*
+lockKey locks replication of key and returns the unlock function
+Locks are per key rather than per derivative because deleting an original deletes its derivatives
+*/
+func (fs *MirroredFileStorage) lockKey(key string) func() {
+	fs.mutex.Lock()
+	lock, ok := fs.keyLocks[key]
+	if !ok {
+		lock = &mirrorKeyLock{}
+		fs.keyLocks[key] = lock
+	}
+	lock.users++
+	fs.mutex.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		fs.mutex.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(fs.keyLocks, key)
+		}
+		fs.mutex.Unlock()
+	}
+}
+
+/*
+find returns the first backend which has the File, trying backends which recently failed last, or nil if none have it
+If every backend returns an error then the request is taken to be bad, like an empty key, and no backend is marked as failed
+*/
+func (fs *MirroredFileStorage) find(key string, derivative string) (FileStorage, error) {
+	index, err := fs.findIndex(key, derivative, nil)
+	if index < 0 {
+		return nil, err
+	}
+	return fs.Backends()[index], nil
+}
+
+// findIndex is find returning the backend's index, or -1, and passing over the backends in skip
+func (fs *MirroredFileStorage) findIndex(key string, derivative string, skip map[int]bool) (int, error) {
+	backends := fs.Backends()
+	errs := make(map[int]error)
+	var lastErr error
+	missing := []int{}
+	for _, index := range fs.readOrder() {
+		if skip[index] {
+			continue
+		}
+		exists, err := backends[index].Exists(key, derivative)
+		if err != nil {
+			errs[index] = err
+			lastErr = err
+			continue
+		}
+		if !exists {
+			missing = append(missing, index)
+			continue
+		}
+		fs.failAll(errs, key, derivative)
+		for _, missingIndex := range missing {
+			fs.report(Divergence{Key: key, Derivative: derivative, Backend: missingIndex, Problem: "missing"})
+		}
+		return index, nil
+	}
+	if len(missing) == 0 {
+		return -1, lastErr
+	}
+	fs.failAll(errs, key, derivative)
+	return -1, nil
+}
+
+func (fs *MirroredFileStorage) failAll(errs map[int]error, key string, derivative string) {
+	for index, err := range errs {
+		fs.fail(index, key, derivative, err)
+	}
+}
+
+// readOrder returns the backend indexes with the healthy backends first
+func (fs *MirroredFileStorage) readOrder() []int {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	healthy := []int{}
+	failing := []int{}
+	for index := 0; index <= len(fs.Replicas); index++ {
+		failedAt, ok := fs.failed[index]
+		if ok && time.Since(failedAt) < fs.RetryAfter {
+			failing = append(failing, index)
+		} else {
+			healthy = append(healthy, index)
+		}
+	}
+	return append(healthy, failing...)
+}
+
+/*
+Healthy returns whether each backend has gone RetryAfter without failing
+*/
+func (fs *MirroredFileStorage) Healthy() []bool {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	results := make([]bool, len(fs.Replicas)+1)
+	for index := range results {
+		failedAt, ok := fs.failed[index]
+		results[index] = !ok || time.Since(failedAt) >= fs.RetryAfter
+	}
+	return results
+}
+
+func (fs *MirroredFileStorage) fail(index int, key string, derivative string, err error) {
+	fs.mutex.Lock()
+	fs.failed[index] = time.Now()
+	fs.mutex.Unlock()
+	fs.report(Divergence{Key: key, Derivative: derivative, Backend: index, Problem: err.Error()})
+}
+
+func (fs *MirroredFileStorage) report(divergence Divergence) {
+	if fs.OnDivergence != nil {
+		fs.OnDivergence(divergence)
+	}
+}
+
+/*
+Repair copies each original and derivative which a backend is missing from a backend which has it, writing a line for each to out
+Every backend must implement Lister
+*/
+func (fs *MirroredFileStorage) Repair(out io.Writer, dryRun bool) (int, error) {
+	backends := fs.Backends()
+	listers := make([]Lister, len(backends))
+	keySet := make(map[string]bool)
+	for index, backend := range backends {
+		lister, ok := backend.(Lister)
+		if !ok {
+			return 0, fmt.Errorf("Backend %d can not list its files", index)
+		}
+		listers[index] = lister
+		stored, err := lister.Keys()
+		if err != nil {
+			return 0, fmt.Errorf("Could not list backend %d: %s", index, err.Error())
+		}
+		for _, storedKey := range stored {
+			keySet[storedKey.Key] = true
+		}
+	}
+	keys := make([]string, 0, len(keySet))
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	count := 0
+	for _, key := range keys {
+		// Derivative -> indexes of the backends which have it, with "" for the original
+		holders := make(map[string][]int)
+		for index, backend := range backends {
+			exists, err := backend.Exists(key, "")
+			if err != nil {
+				return count, err
+			}
+			if exists {
+				holders[""] = append(holders[""], index)
+			}
+			derivatives, err := listers[index].Derivatives(key)
+			if err != nil {
+				return count, err
+			}
+			for _, derivative := range derivatives {
+				holders[derivative] = append(holders[derivative], index)
+			}
+		}
+		if len(holders[""]) == 0 {
+			fmt.Fprintf(out, "skipping %s, no backend has its original\n", key)
+			continue
+		}
+		derivatives := make([]string, 0, len(holders))
+		for derivative := range holders {
+			derivatives = append(derivatives, derivative)
+		}
+		sort.Strings(derivatives) // The original, "", is first
+		for _, derivative := range derivatives {
+			source := holders[derivative][0]
+			for index := range backends {
+				if containsInt(holders[derivative], index) {
+					continue
+				}
+				count++
+				if dryRun {
+					fmt.Fprintf(out, "would copy %s %s from backend %d to %d\n", key, derivative, source, index)
+					continue
+				}
+				err := copyStoredFile(backends[source], backends[index], key, derivative)
+				if err != nil {
+					return count, fmt.Errorf("Could not copy %s %s to backend %d: %s", key, derivative, index, err.Error())
+				}
+				fmt.Fprintf(out, "copied %s %s from backend %d to %d\n", key, derivative, source, index)
+			}
+		}
+	}
+	return count, nil
+}
+
+/*
+RepairCommand runs Repair for a command line tool on fs or the MirroredFileStorage it wraps
+
+	repair [-dry-run]
+*/
+func RepairCommand(fs FileStorage, args []string, out io.Writer) error {
+	dryRun := false
+	for _, arg := range args {
+		if arg != "-dry-run" && arg != "--dry-run" {
+			return errors.New("Usage: [-dry-run]")
+		}
+		dryRun = true
+	}
+	mirrored := findMirroredFileStorage(fs)
+	if mirrored == nil {
+		return errors.New("File storage replicas are not configured")
+	}
+	count, err := mirrored.Repair(out, dryRun)
+	if dryRun {
+		fmt.Fprintf(out, "would copy %d files\n", count)
+	} else {
+		fmt.Fprintf(out, "copied %d files\n", count)
+	}
+	return err
+}
+
+func (fs *MirroredFileStorage) Keys() ([]StoredKey, error) {
+	modified := make(map[string]time.Time)
+	order := []string{}
+	for index, backend := range fs.Backends() {
+		lister, ok := backend.(Lister)
+		if !ok {
+			return nil, fmt.Errorf("Backend %d can not list its files", index)
+		}
+		stored, err := lister.Keys()
+		if err != nil {
+			return nil, err
+		}
+		for _, storedKey := range stored {
+			if _, ok := modified[storedKey.Key]; !ok {
+				order = append(order, storedKey.Key)
+			}
+			if storedKey.Modified.After(modified[storedKey.Key]) {
+				modified[storedKey.Key] = storedKey.Modified
+			}
+		}
+	}
+	keys := make([]StoredKey, 0, len(order))
+	for _, key := range order {
+		keys = append(keys, StoredKey{Key: key, Modified: modified[key]})
+	}
+	return keys, nil
+}
+
+func (fs *MirroredFileStorage) Derivatives(key string) ([]string, error) {
+	derivativeSet := make(map[string]bool)
+	for index, backend := range fs.Backends() {
+		lister, ok := backend.(Lister)
+		if !ok {
+			return nil, fmt.Errorf("Backend %d can not list its files", index)
+		}
+		derivatives, err := lister.Derivatives(key)
+		if err != nil {
+			return nil, err
+		}
+		for _, derivative := range derivatives {
+			derivativeSet[derivative] = true
+		}
+	}
+	results := make([]string, 0, len(derivativeSet))
+	for derivative := range derivativeSet {
+		results = append(results, derivative)
+	}
+	sort.Strings(results)
+	return results, nil
+}
+
+/*
+TempEntries lists the primary's temp area, since uploads are staged only in the primary
+*/
+func (fs *MirroredFileStorage) TempEntries() ([]TempEntry, error) {
+	lister, ok := fs.Primary.(Lister)
+	if !ok {
+		return nil, errors.New("The primary FileStorage can not list its files")
+	}
+	return lister.TempEntries()
+}
+
+func (fs *MirroredFileStorage) DeleteTemp(name string) error {
+	lister, ok := fs.Primary.(Lister)
+	if !ok {
+		return errors.New("The primary FileStorage can not list its files")
+	}
+	return lister.DeleteTemp(name)
+}
+
+func (fs *MirroredFileStorage) PutChunk(uploadId string, offset int64, reader io.Reader) (int64, error) {
+	stager, err := fs.stager()
+	if err != nil {
+		return 0, err
+	}
+	return stager.PutChunk(uploadId, offset, reader)
+}
+
+func (fs *MirroredFileStorage) DeleteChunk(uploadId string, offset int64) error {
+	stager, err := fs.stager()
+	if err != nil {
+		return err
+	}
+	return stager.DeleteChunk(uploadId, offset)
+}
+
+func (fs *MirroredFileStorage) StagedSize(uploadId string) (int64, error) {
+	stager, err := fs.stager()
+	if err != nil {
+		return 0, err
+	}
+	return stager.StagedSize(uploadId)
+}
+
+func (fs *MirroredFileStorage) StagedReader(uploadId string) (io.ReadCloser, error) {
+	stager, err := fs.stager()
+	if err != nil {
+		return nil, err
+	}
+	return stager.StagedReader(uploadId)
+}
+
+func (fs *MirroredFileStorage) DeleteStaged(uploadId string) error {
+	stager, err := fs.stager()
+	if err != nil {
+		return err
+	}
+	return stager.DeleteStaged(uploadId)
+}
+
+func (fs *MirroredFileStorage) stager() (Stager, error) {
+	stager, ok := fs.Primary.(Stager)
+	if !ok {
+		return nil, errors.New("The primary FileStorage can not stage uploads")
+	}
+	return stager, nil
+}
+
+/*
+copyStoredFile copies an original or derivative between FileStorages under the same key, copying the original first if a derivative's destination lacks it
+The destination must implement KeyedStorage
+*/
+func copyStoredFile(from FileStorage, to FileStorage, key string, derivative string) error {
+	if derivative != "" {
+		exists, err := to.Exists(key, "")
+		if err != nil {
+			return err
+		}
+		if !exists {
+			err = copyStoredFile(from, to, key, "")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	file, err := from.Get(key, derivative)
+	if err != nil {
+		return err
+	}
+	reader, err := file.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if derivative != "" {
+		return to.PutDerivative(key, derivative, reader)
+	}
+	keyed, ok := to.(KeyedStorage)
+	if !ok {
+		return errors.New("The destination FileStorage can not put keys")
+	}
+	return keyed.PutKey(key, reader)
+}
+
+func findMirroredFileStorage(fs FileStorage) *MirroredFileStorage {
+	for ; fs != nil; fs = wrappedFileStorage(fs) {
+		if mirrored, ok := fs.(*MirroredFileStorage); ok {
+			return mirrored
+		}
+	}
+	return nil
+}
+
+/*
+wrappedFileStorage returns the FileStorage wrapped by fs, or nil if fs does not wrap another
+*/
+func wrappedFileStorage(fs FileStorage) FileStorage {
+	switch fs := fs.(type) {
+	case *ContentAddressedFileStorage:
+		return fs.Storage
+	case *EncryptedFileStorage:
+		return fs.Storage
+	}
+	return nil
+}
+
+func containsInt(values []int, value int) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
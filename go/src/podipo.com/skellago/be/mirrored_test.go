@@ -0,0 +1,183 @@
+package be
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/chai2010/assert"
+)
+
+/*
+brokenFileStorage fails every call, like an unreachable backend
+*/
+type brokenFileStorage struct {
+	*MemoryFileStorage
+}
+
+func (brokenFileStorage) Exists(key string, derivative string) (bool, error) {
+	return false, errors.New("Unreachable")
+}
+
+func (brokenFileStorage) PutKey(key string, reader io.Reader) error {
+	return errors.New("Unreachable")
+}
+
+/*
+unreadableFileStorage has its Files but fails to open them, like a backend with a corrupt disk
+*/
+type unreadableFileStorage struct {
+	*MemoryFileStorage
+}
+
+func (unreadableFileStorage) Get(key string, derivative string) (File, error) {
+	return nil, errors.New("Unreadable")
+}
+
+/*
+blockingFileStorage holds each PutKey until release is closed
+*/
+type blockingFileStorage struct {
+	*MemoryFileStorage
+	putting chan struct{}
+	release chan struct{}
+}
+
+func (fs blockingFileStorage) PutKey(key string, reader io.Reader) error {
+	fs.putting <- struct{}{}
+	<-fs.release
+	return fs.MemoryFileStorage.PutKey(key, reader)
+}
+
+func TestMirroredFileStorage(t *testing.T) {
+	_, err := NewMirroredFileStorage(NewMemoryFileStorage(), []FileStorage{nil}, false)
+	AssertNotNil(t, err, "Replicas must be able to put keys")
+
+	for _, async := range []bool{false, true} {
+		primary := NewMemoryFileStorage()
+		replica := NewMemoryFileStorage()
+		fs, err := NewMirroredFileStorage(primary, []FileStorage{replica}, async)
+		AssertNil(t, err)
+		divergences := []Divergence{}
+		fs.OnDivergence = func(divergence Divergence) {
+			divergences = append(divergences, divergence)
+		}
+		AssertFileStorage(t, fs)
+
+		key, err := fs.Put("mirrored.txt", strings.NewReader("mirrored"))
+		AssertNil(t, err)
+		AssertNil(t, fs.PutDerivative(key, "thumb", strings.NewReader("small")))
+		fs.Wait()
+		exists, err := replica.Exists(key, "thumb")
+		AssertNil(t, err)
+		AssertTrue(t, exists, "Writes should be copied to the replica")
+
+		// Reads fall back to the replica and report that the primary diverged
+		AssertNil(t, primary.Delete(key, ""))
+		file, err := fs.Get(key, "")
+		AssertNil(t, err)
+		data, err := readAllFile(file)
+		AssertNil(t, err)
+		AssertEqual(t, "mirrored", string(data))
+		AssertEqual(t, 1, len(divergences))
+		AssertEqual(t, 0, divergences[0].Backend)
+		AssertEqual(t, "missing", divergences[0].Problem)
+
+		out := &bytes.Buffer{}
+		count, err := fs.Repair(out, true)
+		AssertNil(t, err)
+		AssertEqual(t, 2, count, "The original and its derivative are missing")
+		exists, err = primary.Exists(key, "")
+		AssertNil(t, err)
+		AssertFalse(t, exists, "A dry run should not copy")
+		AssertNil(t, RepairCommand(fs, []string{}, out))
+		exists, err = primary.Exists(key, "thumb")
+		AssertNil(t, err)
+		AssertTrue(t, exists)
+		count, err = fs.Repair(out, false)
+		AssertNil(t, err)
+		AssertEqual(t, 0, count)
+
+		AssertNil(t, fs.Delete(key, ""))
+		fs.Wait()
+		exists, err = replica.Exists(key, "")
+		AssertNil(t, err)
+		AssertFalse(t, exists, "Deletes should be copied to the replica")
+		fs.Close()
+
+		// Writes after Close are copied before they return
+		key, err = fs.Put("closed.txt", strings.NewReader("closed"))
+		AssertNil(t, err)
+		exists, err = replica.Exists(key, "")
+		AssertNil(t, err)
+		AssertTrue(t, exists)
+		fs.Close()
+	}
+
+	// Closing while writes are being queued neither races nor panics
+	primary := NewMemoryFileStorage()
+	replica := NewMemoryFileStorage()
+	fs, err := NewMirroredFileStorage(primary, []FileStorage{replica}, true)
+	AssertNil(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := fs.Put("racing.txt", strings.NewReader("racing"))
+			AssertNil(t, err)
+			AssertNil(t, fs.PutDerivative(key, "thumb", strings.NewReader("r")))
+		}()
+	}
+	fs.Close()
+	wg.Wait()
+	keys, err := replica.Keys()
+	AssertNil(t, err)
+	AssertEqual(t, 20, len(keys), "Every write should reach the replica")
+
+	// A broken replica does not fail writes or reads
+	primary = NewMemoryFileStorage()
+	fs, err = NewMirroredFileStorage(primary, []FileStorage{brokenFileStorage{NewMemoryFileStorage()}}, false)
+	AssertNil(t, err)
+	divergences := []Divergence{}
+	fs.OnDivergence = func(divergence Divergence) {
+		divergences = append(divergences, divergence)
+	}
+	key, err := fs.Put("broken.txt", strings.NewReader("broken"))
+	AssertNil(t, err)
+	AssertEqual(t, 1, len(divergences))
+	AssertEqual(t, 1, divergences[0].Backend)
+	AssertEqual(t, []bool{true, false}, fs.Healthy())
+	exists, err := fs.Exists(key, "")
+	AssertNil(t, err)
+	AssertTrue(t, exists)
+
+	AssertNotNil(t, RepairCommand(primary, []string{}, &bytes.Buffer{}), "Replicas are not configured")
+
+	// A backend which fails to open a File is marked as failed and the next backend is read
+	primary = NewMemoryFileStorage()
+	fs, err = NewMirroredFileStorage(primary, []FileStorage{NewMemoryFileStorage()}, false)
+	AssertNil(t, err)
+	fs.OnDivergence = func(divergence Divergence) {}
+	key, err = fs.Put("unreadable.txt", strings.NewReader("unreadable"))
+	AssertNil(t, err)
+	fs.Primary = unreadableFileStorage{primary}
+	file, err := fs.Get(key, "")
+	AssertNil(t, err)
+	AssertEqual(t, key, file.Key())
+	AssertEqual(t, []bool{false, true}, fs.Healthy())
+
+	// Replicating one key does not hold up a Delete of another
+	blocking := blockingFileStorage{NewMemoryFileStorage(), make(chan struct{}), make(chan struct{})}
+	fs, err = NewMirroredFileStorage(NewMemoryFileStorage(), []FileStorage{blocking}, true)
+	AssertNil(t, err)
+	_, err = fs.Put("slow.txt", strings.NewReader("slow"))
+	AssertNil(t, err)
+	<-blocking.putting
+	AssertNil(t, fs.Delete("other", ""))
+	close(blocking.release)
+	fs.Close()
+}
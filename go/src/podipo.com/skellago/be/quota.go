@@ -0,0 +1,273 @@
+package be
+
+/*
+	Per User storage quotas, counting the originals a User uploaded and their derivatives.
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+/*
+DefaultStorageQuota is the bytes each User may store unless staff set a StorageQuota for them, or 0 for no limit
+*/
+var DefaultStorageQuota int64 = 0
+
+/*
+StorageQuota overrides DefaultStorageQuota for a User
+*/
+type StorageQuota struct {
+	Id      int64     `json:"id" qbs:"pk"`
+	UserId  int64     `json:"user-id" qbs:"unique,index"`
+	Quota   int64     `json:"quota"` // Bytes, or 0 for no limit
+	Updated time.Time `json:"updated"`
+}
+
+/*
+StorageUsage is what a User stores and may store
+*/
+type StorageUsage struct {
+	Files        int64 `json:"files"`
+	Bytes        int64 `json:"bytes"`         // Originals and their derivatives
+	Quota        int64 `json:"quota"`         // Bytes, or 0 for no limit
+	DefaultQuota bool  `json:"default-quota"` // True unless staff set the quota for this User
+}
+
+/*
+Available returns the bytes the User may still store, or -1 for no limit
+*/
+func (usage *StorageUsage) Available() int64 {
+	if usage.Quota <= 0 {
+		return -1
+	}
+	if usage.Bytes >= usage.Quota {
+		return 0
+	}
+	return usage.Quota - usage.Bytes
+}
+
+func FindStorageQuota(userId int64, db *qbs.Qbs) (*StorageQuota, error) {
+	quota := new(StorageQuota)
+	err := db.WhereEqual("user_id", userId).Find(quota)
+	if err != nil {
+		return nil, err
+	}
+	return quota, nil
+}
+
+/*
+SetStorageQuota sets the quota of a User in bytes, with 0 for no limit
+*/
+func SetStorageQuota(userId int64, bytes int64, db *qbs.Qbs) error {
+	quota, err := FindStorageQuota(userId, db)
+	if err != nil {
+		quota = &StorageQuota{UserId: userId}
+	}
+	quota.Quota = bytes
+	quota.Updated = time.Now()
+	_, err = db.Save(quota)
+	return err
+}
+
+/*
+ResetStorageQuota returns a User to the DefaultStorageQuota
+*/
+func ResetStorageQuota(userId int64, db *qbs.Qbs) error {
+	_, err := db.Exec("delete from storage_quota where user_id = ?", userId)
+	return err
+}
+
+/*
+FindStorageUsage totals the FileRecords uploaded by a User
+*/
+func FindStorageUsage(userId int64, db *qbs.Qbs) (*StorageUsage, error) {
+	rows, err := db.QueryMapSlice("select count(*) as files, coalesce(sum(size + derivatives_size), 0) as bytes from file_record where uploader_id = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+	usage := &StorageUsage{
+		Quota:        DefaultStorageQuota,
+		DefaultQuota: true,
+	}
+	if len(rows) > 0 {
+		usage.Files = queryInt64(rows[0]["files"])
+		usage.Bytes = queryInt64(rows[0]["bytes"])
+	}
+	quota, err := FindStorageQuota(userId, db)
+	if err == nil {
+		usage.Quota = quota.Quota
+		usage.DefaultQuota = false
+	}
+	return usage, nil
+}
+
+/*
+AddDerivativeSize counts a new derivative of the File with key against its uploader's quota
+*/
+func AddDerivativeSize(key string, size int64, db *qbs.Qbs) error {
+	_, err := db.Exec(`update file_record set derivatives_size = derivatives_size + ? where "key" = ?`, size, key)
+	return err
+}
+
+// queryInt64 converts a value from QueryMapSlice, which depends on the driver
+func queryInt64(value interface{}) int64 {
+	switch value := value.(type) {
+	case int64:
+		return value
+	case float64:
+		return int64(value)
+	case []byte:
+		result, _ := strconv.ParseInt(string(value), 10, 64)
+		return result
+	case string:
+		result, _ := strconv.ParseInt(value, 10, 64)
+		return result
+	}
+	return 0
+}
+
+// storageQuotaExceeded is returned when an upload does not fit in what remains of a User's quota
+func storageQuotaExceeded(usage *StorageUsage) *UploadPolicyError {
+	return &UploadPolicyError{
+		Status: http.StatusRequestEntityTooLarge,
+		APIError: APIError{
+			Id:      StorageQuotaExceededError.Id,
+			Message: StorageQuotaExceededError.Message + ": " + strconv.FormatInt(usage.Bytes, 10) + " of " + strconv.FormatInt(usage.Quota, 10) + " bytes are used",
+		},
+	}
+}
+
+var StorageUsageProperties = []Property{
+	Property{
+		Name:        "files",
+		Description: "The number of files uploaded by the user",
+		DataType:    "int",
+		Protected:   true,
+	},
+	Property{
+		Name:        "bytes",
+		Description: "The bytes stored for the files and their derivatives",
+		DataType:    "int",
+		Protected:   true,
+	},
+	Property{
+		Name:        "quota",
+		Description: "The bytes the user may store, or 0 for no limit",
+		DataType:    "int",
+	},
+	Property{
+		Name:        "default-quota",
+		Description: "False if staff set the quota for this user",
+		DataType:    "bool",
+		Protected:   true,
+	},
+}
+
+/*
+UserStorageResource lets staff see what a User stores and set their quota
+*/
+type UserStorageResource struct {
+}
+
+func NewUserStorageResource() *UserStorageResource {
+	return &UserStorageResource{}
+}
+
+func (UserStorageResource) Name() string  { return "user-storage" }
+func (UserStorageResource) Path() string  { return "/user/{uuid:[0-9,a-z,-]+}/storage" }
+func (UserStorageResource) Title() string { return "User storage" }
+func (UserStorageResource) Description() string {
+	return "The storage used by a user and their quota. PUT a quota in bytes, or 0 for no limit, and DELETE to use the default quota."
+}
+
+func (resource UserStorageResource) Properties() []Property {
+	return StorageUsageProperties
+}
+
+// findUser returns the User named by the path if the request is from staff
+func (resource UserStorageResource) findUser(request *APIRequest) (*User, int, interface{}) {
+	if request.User == nil {
+		return nil, 401, NotLoggedInError
+	}
+	if request.User.Staff != true {
+		return nil, 403, ForbiddenError
+	}
+	uuid, _ := request.PathValues["uuid"]
+	user, err := FindUser(uuid, request.DB)
+	if err != nil {
+		return nil, 404, APIError{
+			Id:      "no_such_user",
+			Message: "No such user: " + uuid,
+			Error:   err.Error(),
+		}
+	}
+	return user, 0, nil
+}
+
+func (resource UserStorageResource) usage(user *User, request *APIRequest) (int, interface{}) {
+	usage, err := FindStorageUsage(user.Id, request.DB)
+	if err != nil {
+		return 500, APIError{
+			Id:      "db_error",
+			Message: "Database error",
+			Error:   err.Error(),
+		}
+	}
+	return 200, usage
+}
+
+func (resource UserStorageResource) Get(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	user, status, apiError := resource.findUser(request)
+	if user == nil {
+		return status, apiError, responseHeader
+	}
+	status, result := resource.usage(user, request)
+	return status, result, responseHeader
+}
+
+func (resource UserStorageResource) Put(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	user, status, apiError := resource.findUser(request)
+	if user == nil {
+		return status, apiError, responseHeader
+	}
+	var updated StorageUsage
+	err := json.NewDecoder(request.Raw.Body).Decode(&updated)
+	if err != nil || updated.Quota < 0 {
+		return 400, BadRequestError, responseHeader
+	}
+	err = SetStorageQuota(user.Id, updated.Quota, request.DB)
+	if err != nil {
+		return 500, APIError{
+			Id:      "db_error",
+			Message: "Database error",
+			Error:   err.Error(),
+		}, responseHeader
+	}
+	status, result := resource.usage(user, request)
+	return status, result, responseHeader
+}
+
+func (resource UserStorageResource) Delete(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	user, status, apiError := resource.findUser(request)
+	if user == nil {
+		return status, apiError, responseHeader
+	}
+	err := ResetStorageQuota(user.Id, request.DB)
+	if err != nil {
+		return 500, APIError{
+			Id:      "db_error",
+			Message: "Database error",
+			Error:   err.Error(),
+		}, responseHeader
+	}
+	status, result := resource.usage(user, request)
+	return status, result, responseHeader
+}
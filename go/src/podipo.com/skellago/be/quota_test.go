@@ -0,0 +1,105 @@
+package be
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	. "github.com/chai2010/assert"
+	"github.com/coocood/qbs"
+)
+
+func TestStorageUsageAvailable(t *testing.T) {
+	AssertEqual(t, int64(-1), (&StorageUsage{Bytes: 100}).Available(), "A zero quota is no limit")
+	AssertEqual(t, int64(60), (&StorageUsage{Bytes: 40, Quota: 100}).Available())
+	AssertEqual(t, int64(0), (&StorageUsage{Bytes: 140, Quota: 100}).Available(), "Lowering a quota can leave a user over it")
+	AssertEqual(t, int64(12), queryInt64([]byte("12")))
+	AssertEqual(t, int64(12), queryInt64(float64(12)))
+	AssertEqual(t, int64(0), queryInt64(nil))
+}
+
+func TestStorageQuota(t *testing.T) {
+	CreateAndInitDB()
+	db, err := qbs.GetQbs()
+	AssertNil(t, err)
+	defer func() {
+		WipeDB()
+		db.Close()
+	}()
+
+	testApi, err := NewTestAPI()
+	AssertNil(t, err)
+	defer testApi.Stop()
+	userClient, staffClient, err := CreateTestUserAndStaffWithClients(testApi, db)
+	AssertNil(t, err)
+	user, err := FindUserByEmail("adrian@monk.example.com", db)
+	AssertNil(t, err)
+
+	imageData := encodedPNG(t, 800, 800)
+	DefaultStorageQuota = int64(len(imageData)) + 10
+	defer func() {
+		DefaultStorageQuota = 0
+	}()
+	sendImage := func() *http.Response {
+		file, err := ioutil.TempFile(os.TempDir(), "skella-test-quota*.png")
+		AssertNil(t, err)
+		defer os.Remove(file.Name())
+		defer file.Close()
+		_, err = file.Write(imageData)
+		AssertNil(t, err)
+		file.Seek(0, 0)
+		resp, err := userClient.SendFile("PUT", "/user/current/image", "image", file)
+		AssertNil(t, err)
+		return resp
+	}
+	currentUsage := func() *StorageUsage {
+		current := &CurrentUser{}
+		AssertNil(t, userClient.GetJSON("/user/current", current))
+		AssertEqual(t, user.UUID, current.UUID)
+		return current.Storage
+	}
+
+	usage := currentUsage()
+	AssertEqual(t, int64(0), usage.Bytes)
+	AssertEqual(t, DefaultStorageQuota, usage.Quota)
+	AssertTrue(t, usage.DefaultQuota)
+
+	resp := sendImage()
+	resp.Body.Close()
+	AssertEqual(t, 200, resp.StatusCode)
+	usage = currentUsage()
+	AssertEqual(t, int64(1), usage.Files)
+	AssertEqual(t, int64(len(imageData)), usage.Bytes)
+
+	// Derivatives count against the uploader's quota
+	_, err = userClient.GetFile("/user/current/image")
+	AssertNil(t, err)
+	usage = currentUsage()
+	Assert(t, usage.Bytes > int64(len(imageData)), "The derivative should be counted")
+
+	resp = sendImage()
+	AssertEqual(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	apiError := new(APIError)
+	AssertNil(t, json.NewDecoder(resp.Body).Decode(apiError))
+	resp.Body.Close()
+	AssertEqual(t, StorageQuotaExceededError.Id, apiError.Id)
+
+	storageURL := "/user/" + user.UUID + "/storage"
+	_, err = userClient.PutJSON(storageURL, StorageUsage{Quota: 1 << 30})
+	AssertNotNil(t, err, "Only staff may set quotas")
+	usage = new(StorageUsage)
+	AssertNil(t, staffClient.PutAndReceiveJSON(storageURL, StorageUsage{Quota: 1 << 30}, usage))
+	AssertEqual(t, int64(1<<30), usage.Quota)
+	AssertFalse(t, usage.DefaultQuota)
+	resp = sendImage()
+	resp.Body.Close()
+	AssertEqual(t, 200, resp.StatusCode)
+
+	AssertNil(t, staffClient.Delete(storageURL))
+	usage = new(StorageUsage)
+	AssertNil(t, staffClient.GetJSON(storageURL, usage))
+	AssertTrue(t, usage.DefaultQuota)
+	AssertEqual(t, DefaultStorageQuota, usage.Quota)
+}
@@ -0,0 +1,880 @@
+package be
+
+/*
+	A FileStorage backed by S3 or a service with an S3 compatible API, like MinIO.
+*/
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3DefaultPartSize = 16 * 1024 * 1024
+	s3TimeFormat      = "20060102T150405Z"
+	s3SignAlgorithm   = "AWS4-HMAC-SHA256"
+	s3SignedHeaders   = "host;x-amz-content-sha256;x-amz-date"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD" // The payload hash of presigned URLs
+)
+
+/*
+S3Config locates a bucket in S3 or an S3 compatible service
+*/
+type S3Config struct {
+	Endpoint  string // For example https://s3.us-east-1.amazonaws.com or http://127.0.0.1:9000 for MinIO
+	Region    string // For example us-east-1
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string // Prepended to every object name, for example "skella/"
+	PathStyle bool   // Use endpoint/bucket/object URLs instead of bucket.endpoint/object, as most S3 stand-ins require
+}
+
+/*
+S3FileStorage is a FileStorage persisted in an S3 bucket
+
+The original file is stored at <Prefix><key> and its derivatives under the key, at <Prefix><key>/<derivative>
+*/
+type S3FileStorage struct {
+	Config   S3Config
+	PartSize int64 // Puts larger than this use a multipart upload with parts of this size, which S3 requires be at least 5MB
+	Client   *http.Client
+	endpoint *url.URL
+}
+
+func NewS3FileStorage(config S3Config) (*S3FileStorage, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("S3 bucket is required")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, errors.New("S3 endpoint must be an absolute URL: " + config.Endpoint)
+	}
+	return &S3FileStorage{
+		Config:   config,
+		PartSize: s3DefaultPartSize,
+		Client:   &http.Client{},
+		endpoint: endpoint,
+	}, nil
+}
+
+func (fs *S3FileStorage) Put(name string, reader io.Reader) (key string, err error) {
+	key = generateFileKey(name)
+	err = fs.upload(fs.objectName(key, ""), reader)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func (fs *S3FileStorage) PutKey(key string, reader io.Reader) error {
+	if cleanFileToken(key) == "" {
+		return errors.New("Empty file key")
+	}
+	return fs.upload(fs.objectName(key, ""), reader)
+}
+
+func (fs *S3FileStorage) PutDerivative(key string, derivative string, reader io.Reader) error {
+	exists, err := fs.Exists(key, "")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("Cannot create a derivative for a non-existant key")
+	}
+	return fs.upload(fs.objectName(key, derivative), reader)
+}
+
+func (fs *S3FileStorage) Get(key string, derivative string) (File, error) {
+	file := S3File{
+		fs:         fs,
+		key:        cleanFileToken(key),
+		derivative: derivative,
+	}
+	exists, err := file.Exists()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("No such File: " + file.key + " with derivative: " + derivative)
+	}
+	return file, nil
+}
+
+func (fs *S3FileStorage) Exists(key string, derivative string) (bool, error) {
+	if cleanFileToken(key) == "" {
+		return false, errors.New("Empty file key")
+	}
+	file := S3File{
+		fs:         fs,
+		key:        cleanFileToken(key),
+		derivative: derivative,
+	}
+	return file.Exists()
+}
+
+/*
+Delete removes the object and, if derivative is "", every derivative stored under the key
+Like LocalFileStorage.Delete, deleting a key which does not exist is not an error
+*/
+func (fs *S3FileStorage) Delete(key string, derivative string) error {
+	key = cleanFileToken(key)
+	if derivative == "" {
+		derivatives, err := fs.listObjects(fs.objectName(key, "") + "/")
+		if err != nil {
+			return err
+		}
+		for _, objectName := range derivatives {
+			err = fs.deleteObject(objectName)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return fs.deleteObject(fs.objectName(key, derivative))
+}
+
+func (fs *S3FileStorage) objectName(key string, derivative string) string {
+	if derivative == "" {
+		return fs.Config.Prefix + cleanFileToken(key)
+	}
+	return fs.Config.Prefix + cleanFileToken(key) + "/" + cleanFileToken(derivative)
+}
+
+/*
+PutChunk stores a chunk of a staged upload as an object under <Prefix>t_e_m_p/<uploadId>/
+A chunk whose reader fails is not stored
+*/
+func (fs *S3FileStorage) PutChunk(uploadId string, offset int64, reader io.Reader) (int64, error) {
+	counter := &countingReader{Reader: reader}
+	err := fs.upload(fs.stagedChunkName(uploadId, offset), counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter.count, nil
+}
+
+func (fs *S3FileStorage) DeleteChunk(uploadId string, offset int64) error {
+	return fs.deleteObject(fs.stagedChunkName(uploadId, offset))
+}
+
+func (fs *S3FileStorage) StagedSize(uploadId string) (int64, error) {
+	chunks, err := fs.stagedChunks(uploadId)
+	if err != nil {
+		return 0, err
+	}
+	return stagedSize(chunks)
+}
+
+func (fs *S3FileStorage) StagedReader(uploadId string) (io.ReadCloser, error) {
+	chunks, err := fs.stagedChunks(uploadId)
+	if err != nil {
+		return nil, err
+	}
+	return newChunkReader(chunks)
+}
+
+func (fs *S3FileStorage) DeleteStaged(uploadId string) error {
+	chunks, err := fs.listObjects(fs.stagedPrefix(uploadId))
+	if err != nil {
+		return err
+	}
+	for _, objectName := range chunks {
+		err = fs.deleteObject(objectName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Keys lists the bucket under Prefix, outside of the temp area
+*/
+func (fs *S3FileStorage) Keys() ([]StoredKey, error) {
+	objects, err := fs.listObjectsWithSizes(fs.Config.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	tempPrefix := fs.Config.Prefix + localFileStorageTempName + "/"
+	modified := make(map[string]time.Time)
+	order := []string{}
+	for _, object := range objects {
+		if strings.HasPrefix(object.Key, tempPrefix) {
+			continue
+		}
+		// Derivatives are stored at <Prefix><key>/<derivative>
+		key := strings.SplitN(strings.TrimPrefix(object.Key, fs.Config.Prefix), "/", 2)[0]
+		if _, ok := modified[key]; !ok {
+			order = append(order, key)
+		}
+		if object.LastModified.After(modified[key]) {
+			modified[key] = object.LastModified
+		}
+	}
+	keys := make([]StoredKey, 0, len(order))
+	for _, key := range order {
+		keys = append(keys, StoredKey{Key: key, Modified: modified[key]})
+	}
+	return keys, nil
+}
+
+func (fs *S3FileStorage) Derivatives(key string) ([]string, error) {
+	if cleanFileToken(key) == "" {
+		return nil, errors.New("Empty file key")
+	}
+	prefix := fs.objectName(key, "") + "/"
+	objectNames, err := fs.listObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	results := []string{}
+	for _, objectName := range objectNames {
+		results = append(results, strings.TrimPrefix(objectName, prefix))
+	}
+	return results, nil
+}
+
+/*
+TempEntries returns the staged uploads, which are all that S3FileStorage keeps in its temp area
+*/
+func (fs *S3FileStorage) TempEntries() ([]TempEntry, error) {
+	tempPrefix := fs.Config.Prefix + localFileStorageTempName + "/"
+	objects, err := fs.listObjectsWithSizes(tempPrefix)
+	if err != nil {
+		return nil, err
+	}
+	entries := []TempEntry{}
+	index := make(map[string]int)
+	for _, object := range objects {
+		uploadId := strings.SplitN(strings.TrimPrefix(object.Key, tempPrefix), "/", 2)[0]
+		i, ok := index[uploadId]
+		if !ok {
+			i = len(entries)
+			index[uploadId] = i
+			entries = append(entries, TempEntry{Name: uploadId, UploadId: uploadId})
+		}
+		if object.LastModified.After(entries[i].Modified) {
+			entries[i].Modified = object.LastModified
+		}
+	}
+	return entries, nil
+}
+
+func (fs *S3FileStorage) DeleteTemp(name string) error {
+	return fs.DeleteStaged(name)
+}
+
+func (fs *S3FileStorage) stagedPrefix(uploadId string) string {
+	return fs.Config.Prefix + localFileStorageTempName + "/" + cleanFileToken(uploadId) + "/"
+}
+
+func (fs *S3FileStorage) stagedChunkName(uploadId string, offset int64) string {
+	return fs.stagedPrefix(uploadId) + stagedChunkName(offset)
+}
+
+// stagedChunks returns the chunks of an upload in offset order
+func (fs *S3FileStorage) stagedChunks(uploadId string) ([]stagedChunk, error) {
+	if cleanFileToken(uploadId) == "" {
+		return nil, errors.New("Empty upload id")
+	}
+	prefix := fs.stagedPrefix(uploadId)
+	objects, err := fs.listObjectsWithSizes(prefix)
+	if err != nil {
+		return nil, err
+	}
+	chunks := []stagedChunk{}
+	for _, object := range objects {
+		offset, err := strconv.ParseInt(strings.TrimPrefix(object.Key, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		objectName := object.Key
+		chunks = append(chunks, stagedChunk{
+			offset: offset,
+			size:   object.Size,
+			open: func() (io.ReadCloser, error) {
+				return fs.getObject(objectName, 0)
+			},
+		})
+	}
+	return chunks, nil
+}
+
+/*
+upload stores the data from reader, using a multipart upload if there is more than PartSize of it
+*/
+func (fs *S3FileStorage) upload(objectName string, reader io.Reader) error {
+	partSize := fs.PartSize
+	if partSize <= 0 {
+		partSize = s3DefaultPartSize
+	}
+	firstPart, err := readPart(reader, partSize)
+	if err != nil {
+		return err
+	}
+	if int64(len(firstPart)) < partSize {
+		resp, err := fs.do("PUT", objectName, nil, firstPart)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	uploadId, err := fs.createMultipartUpload(objectName)
+	if err != nil {
+		return err
+	}
+	parts := []s3CompletedPart{}
+	part := firstPart
+	for len(part) > 0 {
+		etag, err := fs.uploadPart(objectName, uploadId, len(parts)+1, part)
+		if err != nil {
+			fs.abortMultipartUpload(objectName, uploadId)
+			return err
+		}
+		parts = append(parts, s3CompletedPart{PartNumber: len(parts) + 1, ETag: etag})
+		part, err = readPart(reader, partSize)
+		if err != nil {
+			fs.abortMultipartUpload(objectName, uploadId)
+			return err
+		}
+	}
+	err = fs.completeMultipartUpload(objectName, uploadId, parts)
+	if err != nil {
+		fs.abortMultipartUpload(objectName, uploadId)
+		return err
+	}
+	return nil
+}
+
+/*
+readPart reads up to size bytes, returning fewer only at the end of reader
+The buffer grows as data arrives, so that small Files do not cost a whole part
+*/
+func readPart(reader io.Reader, size int64) ([]byte, error) {
+	var buffer bytes.Buffer
+	_, err := io.CopyN(&buffer, reader, size)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type s3ListBucketResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (fs *S3FileStorage) createMultipartUpload(objectName string) (string, error) {
+	resp, err := fs.do("POST", objectName, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result s3InitiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", err
+	}
+	if result.UploadId == "" {
+		return "", errors.New("No upload id for the multipart upload of " + objectName)
+	}
+	return result.UploadId, nil
+}
+
+func (fs *S3FileStorage) uploadPart(objectName string, uploadId string, partNumber int, data []byte) (string, error) {
+	query := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadId},
+	}
+	resp, err := fs.do("PUT", objectName, query, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+func (fs *S3FileStorage) completeMultipartUpload(objectName string, uploadId string, parts []s3CompletedPart) error {
+	body, err := xml.Marshal(s3CompleteMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := fs.do("POST", objectName, url.Values{"uploadId": {uploadId}}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// S3 can report a failed completion in the body of a 200 response
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		return readS3Error(resp.StatusCode, bytes.NewReader(data))
+	}
+	return nil
+}
+
+func (fs *S3FileStorage) abortMultipartUpload(objectName string, uploadId string) {
+	resp, err := fs.do("DELETE", objectName, url.Values{"uploadId": {uploadId}}, nil)
+	if err != nil {
+		logger.Print("Could not abort the multipart upload of " + objectName + ": " + err.Error())
+		return
+	}
+	resp.Body.Close()
+}
+
+/*
+listObjects returns the names of every object whose name begins with prefix
+*/
+func (fs *S3FileStorage) listObjects(prefix string) ([]string, error) {
+	objects, err := fs.listObjectsWithSizes(prefix)
+	if err != nil {
+		return nil, err
+	}
+	results := []string{}
+	for _, object := range objects {
+		results = append(results, object.Key)
+	}
+	return results, nil
+}
+
+/*
+listObjectsWithSizes returns every object whose name begins with prefix, sorted by name
+*/
+func (fs *S3FileStorage) listObjectsWithSizes(prefix string) ([]s3Object, error) {
+	results := []s3Object{}
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := fs.do("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return results, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (fs *S3FileStorage) deleteObject(objectName string) error {
+	resp, err := fs.do("DELETE", objectName, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+/*
+getObject returns the object's data from offset to the end
+*/
+func (fs *S3FileStorage) getObject(objectName string, offset int64) (io.ReadCloser, error) {
+	request, err := fs.newRequest("GET", objectName, nil, nil, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		request.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := fs.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		return nil, readS3Error(resp.StatusCode, resp.Body)
+	}
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, errors.New("S3 ignored the range request for " + objectName)
+	}
+	return resp.Body, nil
+}
+
+/*
+head returns the object's size, or -1 if it does not exist
+*/
+func (fs *S3FileStorage) head(objectName string) (int64, error) {
+	resp, err := fs.send("HEAD", objectName, nil, nil)
+	if err != nil {
+		return -1, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return -1, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return -1, errors.New("S3 HEAD " + objectName + " failed with status " + strconv.Itoa(resp.StatusCode))
+	}
+	return resp.ContentLength, nil
+}
+
+/*
+do sends a signed request and turns non-2xx responses into errors
+*/
+func (fs *S3FileStorage) do(method string, objectName string, query url.Values, body []byte) (*http.Response, error) {
+	resp, err := fs.send(method, objectName, query, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, readS3Error(resp.StatusCode, resp.Body)
+	}
+	return resp, nil
+}
+
+func (fs *S3FileStorage) send(method string, objectName string, query url.Values, body []byte) (*http.Response, error) {
+	request, err := fs.newRequest(method, objectName, query, body, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return fs.Client.Do(request)
+}
+
+/*
+objectURL returns the URL of the object in the bucket, with the query in canonical order
+*/
+func (fs *S3FileStorage) objectURL(objectName string, query url.Values) *url.URL {
+	host := fs.endpoint.Host
+	path := "/" + objectName
+	if fs.Config.PathStyle {
+		path = "/" + fs.Config.Bucket + path
+	} else {
+		host = fs.Config.Bucket + "." + host
+	}
+	path = strings.TrimSuffix(fs.endpoint.Path, "/") + path
+	return &url.URL{
+		Scheme:   fs.endpoint.Scheme,
+		Host:     host,
+		Path:     path,
+		RawPath:  s3URIEncode(path, false),
+		RawQuery: s3CanonicalQuery(query),
+	}
+}
+
+func (fs *S3FileStorage) newRequest(method string, objectName string, query url.Values, body []byte, now time.Time) (*http.Request, error) {
+	requestURL := fs.objectURL(objectName, query)
+	host := requestURL.Host
+	path := requestURL.Path
+	request, err := http.NewRequest(method, requestURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = int64(len(body))
+	payloadHash := sha256Hex(body)
+	amzDate := now.UTC().Format(s3TimeFormat)
+	request.Header.Set("x-amz-date", amzDate)
+	request.Header.Set("x-amz-content-sha256", payloadHash)
+	signature := s3Signature(method, path, query, host, amzDate, payloadHash, fs.Config.SecretKey, fs.Config.Region)
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SignAlgorithm, fs.Config.AccessKey, s3Scope(amzDate, fs.Config.Region), s3SignedHeaders, signature))
+	return request, nil
+}
+
+func readS3Error(status int, reader io.Reader) error {
+	var s3Err s3Error
+	data, _ := ioutil.ReadAll(reader)
+	if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+		return errors.New("S3 error " + strconv.Itoa(status) + " " + s3Err.Code + ": " + s3Err.Message)
+	}
+	return errors.New("S3 error " + strconv.Itoa(status))
+}
+
+// s3ResponseHeaders are the headers which a presigned GET can override with response-* parameters
+var s3ResponseHeaders = map[string]bool{
+	"Cache-Control":       true,
+	"Content-Disposition": true,
+	"Content-Encoding":    true,
+	"Content-Language":    true,
+	"Content-Type":        true,
+	"Expires":             true,
+}
+
+/*
+PresignGet returns a URL which anyone can use to GET the File until expires has passed
+S3 limits expires to a week from now, and responds with the values in responseHeader in place of the object's, which only works for the headers in s3ResponseHeaders
+*/
+func (fs *S3FileStorage) PresignGet(key string, derivative string, expires time.Time, responseHeader http.Header) (string, error) {
+	return fs.presignGet(key, derivative, expires, responseHeader, time.Now())
+}
+
+func (fs *S3FileStorage) presignGet(key string, derivative string, expires time.Time, responseHeader http.Header, now time.Time) (string, error) {
+	seconds := int64(expires.Sub(now) / time.Second)
+	if seconds < 1 || seconds > 7*24*60*60 {
+		return "", errors.New("Presigned URLs must expire between one second and one week from now")
+	}
+	overrides := url.Values{}
+	for name, values := range responseHeader {
+		if !s3ResponseHeaders[http.CanonicalHeaderKey(name)] {
+			return "", errors.New("S3 can not override the " + name + " header of a presigned URL")
+		}
+		if len(values) > 0 && values[0] != "" {
+			overrides.Set("response-"+strings.ToLower(name), values[0])
+		}
+	}
+	amzDate := now.UTC().Format(s3TimeFormat)
+	query := url.Values{
+		"X-Amz-Algorithm":     {s3SignAlgorithm},
+		"X-Amz-Credential":    {fs.Config.AccessKey + "/" + s3Scope(amzDate, fs.Config.Region)},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.FormatInt(seconds, 10)},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	for name, values := range overrides {
+		query[name] = values
+	}
+	presignedURL := fs.objectURL(fs.objectName(key, derivative), query)
+	signature := s3SignatureV4("GET", presignedURL.Path, query, "host:"+presignedURL.Host+"\n", "host", s3UnsignedPayload, amzDate, fs.Config.SecretKey, fs.Config.Region)
+	query.Set("X-Amz-Signature", signature)
+	presignedURL.RawQuery = s3CanonicalQuery(query)
+	return presignedURL.String(), nil
+}
+
+/*
+s3Signature computes an AWS Signature Version 4 over the host, x-amz-content-sha256, and x-amz-date headers
+*/
+func s3Signature(method string, path string, query url.Values, host string, amzDate string, payloadHash string, secretKey string, region string) string {
+	canonicalHeaders := "host:" + host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n"
+	return s3SignatureV4(method, path, query, canonicalHeaders, s3SignedHeaders, payloadHash, amzDate, secretKey, region)
+}
+
+/*
+s3SignatureV4 signs a request given its canonical headers, which must end in a newline
+*/
+func s3SignatureV4(method string, path string, query url.Values, canonicalHeaders string, signedHeaders string, payloadHash string, amzDate string, secretKey string, region string) string {
+	canonicalRequest := strings.Join([]string{
+		method,
+		s3URIEncode(path, false),
+		s3CanonicalQuery(query),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		s3SignAlgorithm,
+		amzDate,
+		s3Scope(amzDate, region),
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+secretKey), amzDate[:8])
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func s3Scope(amzDate string, region string) string {
+	return amzDate[:8] + "/" + region + "/s3/aws4_request"
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3URIEncode(key, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+/*
+s3URIEncode escapes everything but unreserved characters, as SigV4 requires
+*/
+func s3URIEncode(value string, encodeSlash bool) string {
+	var buffer bytes.Buffer
+	for _, b := range []byte(value) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			buffer.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buffer, "%%%02X", b)
+		}
+	}
+	return buffer.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+/*
+S3File is a be.File backed by an S3FileStorage
+*/
+type S3File struct {
+	fs         *S3FileStorage
+	key        string
+	derivative string
+}
+
+func (file S3File) Key() string {
+	return file.key
+}
+
+func (file S3File) Derivative() string {
+	return file.derivative
+}
+
+func (file S3File) Name() (string, error) {
+	return fileNameFromKey(file.key), nil
+}
+
+func (file S3File) Exists() (bool, error) {
+	size, err := file.fs.head(file.fs.objectName(file.key, file.derivative))
+	if err != nil {
+		return false, err
+	}
+	return size >= 0, nil
+}
+
+func (file S3File) Size() (int64, error) {
+	size, err := file.fs.head(file.fs.objectName(file.key, file.derivative))
+	if err != nil {
+		return -1, err
+	}
+	if size < 0 {
+		return -1, errors.New("No such File: " + file.key + " with derivative: " + file.derivative)
+	}
+	return size, nil
+}
+
+/*
+Reader streams the object from S3, reopening the download at the new offset after a Seek
+*/
+func (file S3File) Reader() (FileReader, error) {
+	size, err := file.Size()
+	if err != nil {
+		return nil, err
+	}
+	return &s3Reader{
+		fs:         file.fs,
+		objectName: file.fs.objectName(file.key, file.derivative),
+		size:       size,
+	}, nil
+}
+
+type s3Reader struct {
+	fs         *S3FileStorage
+	objectName string
+	size       int64
+	offset     int64
+	body       io.ReadCloser // nil until the first Read after opening or seeking
+}
+
+func (reader *s3Reader) Read(p []byte) (int, error) {
+	if reader.offset >= reader.size {
+		return 0, io.EOF
+	}
+	if reader.body == nil {
+		body, err := reader.fs.getObject(reader.objectName, reader.offset)
+		if err != nil {
+			return 0, err
+		}
+		reader.body = body
+	}
+	n, err := reader.body.Read(p)
+	reader.offset += int64(n)
+	return n, err
+}
+
+func (reader *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += reader.offset
+	case io.SeekEnd:
+		offset += reader.size
+	}
+	if offset < 0 {
+		return reader.offset, errors.New("Seek to a negative offset")
+	}
+	if offset != reader.offset {
+		reader.Close()
+		reader.offset = offset
+	}
+	return offset, nil
+}
+
+func (reader *s3Reader) Close() error {
+	if reader.body == nil {
+		return nil
+	}
+	err := reader.body.Close()
+	reader.body = nil
+	return err
+}
@@ -0,0 +1,142 @@
+package be
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/chai2010/assert"
+)
+
+func TestS3Signature(t *testing.T) {
+	// The GET Bucket Lifecycle example from the AWS Signature Version 4 documentation
+	signature := s3Signature("GET", "/", map[string][]string{"lifecycle": {""}}, "examplebucket.s3.amazonaws.com", "20130524T000000Z", sha256Hex(nil), "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", "us-east-1")
+	AssertEqual(t, "fea454ca298b7da1c68078a5d1bdbfbbe0d65c699e0f91ac7a200a0136783543", signature)
+	AssertEqual(t, "prefix=a%2Fb&uploads=", s3CanonicalQuery(map[string][]string{"uploads": {""}, "prefix": {"a/b"}}))
+	AssertEqual(t, "/bucket/a%20b/c~d", s3URIEncode("/bucket/a b/c~d", false))
+}
+
+func TestS3FileStorage(t *testing.T) {
+	_, err := NewS3FileStorage(S3Config{Endpoint: "http://127.0.0.1"})
+	AssertNotNil(t, err, "A bucket is required")
+	_, err = NewS3FileStorage(S3Config{Bucket: "bucket", Endpoint: "not-a-url"})
+	AssertNotNil(t, err, "The endpoint must be absolute")
+
+	fake := NewFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir(os.TempDir(), "skellago-temp")
+	AssertNil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	config := fake.S3Config(server.URL)
+	config.Prefix = "files/"
+	testFS, err := NewS3FileStorage(config)
+	AssertNil(t, err)
+
+	exists, err := testFS.Exists("bogus-key", "")
+	AssertNil(t, err)
+	AssertFalse(t, exists)
+	_, err = testFS.Get("bogus-key", "")
+	AssertNotNil(t, err)
+
+	f1, err := TempFile(tempDir, 10)
+	AssertNil(t, err)
+	key, err := testFS.Put("foo bar.bin", f1)
+	AssertNil(t, err)
+	_, ok := fake.Objects["files/"+key]
+	AssertTrue(t, ok, "The object should be stored under the prefix")
+	file1, err := testFS.Get(key, "")
+	AssertNil(t, err)
+	name, err := file1.Name()
+	AssertNil(t, err)
+	AssertEqual(t, "foo-bar.bin", name)
+	size, err := file1.Size()
+	AssertNil(t, err)
+	AssertEqual(t, int64(10*1024), size)
+	f1.Seek(0, 0)
+	reader, err := file1.Reader()
+	AssertNil(t, err)
+	AssertTrue(t, CompareReaderData(f1, reader))
+
+	err = testFS.PutDerivative("bogus-key", "bar", f1)
+	AssertNotNil(t, err, "Derivatives require an original")
+	df1, err := TempFile(tempDir, 5)
+	AssertNil(t, err)
+	AssertNil(t, testFS.PutDerivative(key, "bar", df1))
+	dfile1, err := testFS.Get(key, "bar")
+	AssertNil(t, err)
+	dName, err := dfile1.Name()
+	AssertNil(t, err)
+	AssertEqual(t, name, dName)
+	df1.Seek(0, 0)
+	reader, err = dfile1.Reader()
+	AssertNil(t, err)
+	AssertTrue(t, CompareReaderData(df1, reader))
+
+	// Small Files do not allocate a whole part
+	part, err := readPart(strings.NewReader("small"), s3DefaultPartSize)
+	AssertNil(t, err)
+	AssertEqual(t, "small", string(part))
+	AssertTrue(t, cap(part) < 64*1024, "The part buffer should grow with the data")
+
+	// Force a multipart upload of three parts
+	testFS.PartSize = 4 * 1024
+	f2, err := TempFile(tempDir, 10)
+	AssertNil(t, err)
+	key2, err := testFS.Put("big.bin", f2)
+	AssertNil(t, err)
+	AssertEqual(t, 0, len(fake.Uploads), "Completed uploads should be cleaned up")
+	file2, err := testFS.Get(key2, "")
+	AssertNil(t, err)
+	f2.Seek(0, 0)
+	reader, err = file2.Reader()
+	AssertNil(t, err)
+	AssertTrue(t, CompareReaderData(f2, reader))
+
+	presignedURL, err := testFS.PresignGet(key, "bar", time.Now().Add(time.Minute), http.Header{"Content-Type": {"image/png"}})
+	AssertNil(t, err)
+	resp, err := http.Get(presignedURL)
+	AssertNil(t, err)
+	AssertEqual(t, "image/png", resp.Header.Get("Content-Type"), "Presigned URLs should override the response headers")
+	df1.Seek(0, 0)
+	AssertTrue(t, CompareReaderData(df1, resp.Body), "Presigned URLs should fetch the derivative")
+	resp.Body.Close()
+	_, err = testFS.PresignGet(key, "", time.Now().Add(time.Minute), http.Header{"X-Content-Type-Options": {"nosniff"}})
+	AssertNotNil(t, err, "S3 can only override some headers")
+	_, err = testFS.PresignGet(key, "", time.Now().Add(30*24*time.Hour), nil)
+	AssertNotNil(t, err, "S3 limits presigned URLs to a week")
+	presignedURL, err = testFS.presignGet(key, "", time.Now().Add(-time.Minute), nil, time.Now().Add(-2*time.Minute))
+	AssertNil(t, err)
+	resp, err = http.Get(presignedURL)
+	AssertNil(t, err)
+	resp.Body.Close()
+	AssertEqual(t, http.StatusForbidden, resp.StatusCode, "Expired presigned URLs should fail")
+	resp, err = http.Get(strings.Replace(presignedURL, "/files/", "/files/x", 1))
+	AssertNil(t, err)
+	resp.Body.Close()
+	AssertEqual(t, http.StatusForbidden, resp.StatusCode, "Presigned URLs are only good for one object")
+
+	AssertNil(t, testFS.Delete("bogus-key-2", ""), "Deleting non-existant keys should not return an error")
+	AssertNil(t, testFS.Delete(key, ""))
+	exists, err = testFS.Exists(key, "bar")
+	AssertNil(t, err)
+	AssertFalse(t, exists, "Derivatives should not exist after deleting the original file")
+	AssertNil(t, testFS.Delete(key2, ""))
+	AssertEqual(t, 0, len(fake.Objects))
+	AssertFileStorage(t, testFS)
+	AssertEqual(t, 0, len(fake.Objects))
+
+	config.SecretKey = "wrong"
+	badFS, err := NewS3FileStorage(config)
+	AssertNil(t, err)
+	_, err = badFS.Put("foo.bin", bytes.NewReader([]byte("foo")))
+	AssertNotNil(t, err)
+	Assert(t, strings.Contains(err.Error(), "SignatureDoesNotMatch"), "Bad signatures should be reported: "+err.Error())
+}
@@ -0,0 +1,250 @@
+package be
+
+/*
+	HMAC signed, expiring URLs for stored files, so that <img> tags and emailed links can fetch files without a session.
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The URL parameters of a signed file URL
+const (
+	SignedKeyParam        = "key"
+	SignedDerivativeParam = "derivative"
+	SignedExpiresParam    = "expires"
+	SignedUserParam       = "user"
+	SignatureParam        = "signature"
+)
+
+/*
+Presigner is implemented by FileStorage backends which can sign their own download URLs, like S3FileStorage
+SignedFileResource redirects to presigned URLs instead of streaming the File through the API
+*/
+type Presigner interface {
+	// responseHeader sets the Content-Type, Content-Disposition, and Cache-Control which the storage responds with
+	PresignGet(key string, derivative string, expires time.Time, responseHeader http.Header) (string, error)
+}
+
+/*
+SignedFile is the content of a verified signed URL
+*/
+type SignedFile struct {
+	Key        string
+	Derivative string
+	Expires    time.Time
+	UserUUID   string // If not empty, only this User may use the URL
+}
+
+/*
+URLSigner signs and verifies URLs for the SignedFileResource at Path
+*/
+type URLSigner struct {
+	Secret []byte
+	Path   string // For example /api/0.1.0/signed-file
+}
+
+/*
+NewURLSigner returns a URLSigner with a random Secret, so its URLs stop working when the process exits
+Set Secret to a value shared by every API process to make URLs last until they expire
+*/
+func NewURLSigner(path string) *URLSigner {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		panic("Could not generate a URL signing secret: " + err.Error())
+	}
+	return &URLSigner{
+		Secret: secret,
+		Path:   path,
+	}
+}
+
+/*
+Sign returns the path and query of a URL for the File which works until expires
+If userUUID is not empty then the URL only works for requests authenticated as that User
+*/
+func (signer *URLSigner) Sign(key string, derivative string, expires time.Time, userUUID string) string {
+	values := url.Values{}
+	values.Set(SignedKeyParam, key)
+	if derivative != "" {
+		values.Set(SignedDerivativeParam, derivative)
+	}
+	values.Set(SignedExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	if userUUID != "" {
+		values.Set(SignedUserParam, userUUID)
+	}
+	values.Set(SignatureParam, signer.signature(key, derivative, expires.Unix(), userUUID))
+	return signer.Path + "?" + values.Encode()
+}
+
+/*
+Verify checks the signature and expiration of a signed URL's query values
+*/
+func (signer *URLSigner) Verify(values url.Values, now time.Time) (*SignedFile, error) {
+	key := values.Get(SignedKeyParam)
+	if key == "" {
+		return nil, errors.New("No key in the signed URL")
+	}
+	expires, err := strconv.ParseInt(values.Get(SignedExpiresParam), 10, 64)
+	if err != nil {
+		return nil, errors.New("Bad expiration in the signed URL")
+	}
+	signedFile := &SignedFile{
+		Key:        key,
+		Derivative: values.Get(SignedDerivativeParam),
+		Expires:    time.Unix(expires, 0),
+		UserUUID:   values.Get(SignedUserParam),
+	}
+	expected := signer.signature(signedFile.Key, signedFile.Derivative, expires, signedFile.UserUUID)
+	if !hmac.Equal([]byte(expected), []byte(values.Get(SignatureParam))) {
+		return nil, errors.New("Bad signature")
+	}
+	if now.After(signedFile.Expires) {
+		return nil, errors.New("The signed URL has expired")
+	}
+	return signedFile, nil
+}
+
+func (signer *URLSigner) signature(key string, derivative string, expires int64, userUUID string) string {
+	mac := hmac.New(sha256.New, signer.Secret)
+	// Newlines separate the fields so that, for example, moving characters from key to derivative changes the signature
+	mac.Write([]byte(key + "\n" + derivative + "\n" + strconv.FormatInt(expires, 10) + "\n" + userUUID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+SignedFileURL returns a signed URL for the File which works until expires
+If bindUser is true then only the requesting User can use the URL
+*/
+func (request *APIRequest) SignedFileURL(key string, derivative string, expires time.Time, bindUser bool) (string, error) {
+	if request.URLSigner == nil {
+		return "", errors.New("The API has no URLSigner")
+	}
+	userUUID := ""
+	if bindUser {
+		if request.User == nil {
+			return "", errors.New("Cannot bind a signed URL to an anonymous request")
+		}
+		userUUID = request.User.UUID
+	}
+	return request.URLSigner.Sign(key, derivative, expires, userUUID), nil
+}
+
+/*
+SignedFileResource serves the File named by a signed URL
+*/
+type SignedFileResource struct {
+}
+
+func NewSignedFileResource() *SignedFileResource {
+	return &SignedFileResource{}
+}
+
+func (SignedFileResource) Name() string  { return "signed-file" }
+func (SignedFileResource) Path() string  { return "/signed-file" }
+func (SignedFileResource) Title() string { return "Signed file" }
+func (SignedFileResource) Description() string {
+	return "Serves a file given a URL signed by the API, which does not require a session unless it is bound to a user."
+}
+
+func (resource SignedFileResource) Properties() []Property {
+	return []Property{}
+}
+
+func (resource SignedFileResource) Get(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	if request.URLSigner == nil {
+		return 404, FileNotFoundError, responseHeader
+	}
+	signedFile, err := request.URLSigner.Verify(request.Raw.URL.Query(), time.Now())
+	if err != nil {
+		return 403, APIError{
+			Id:      InvalidSignedURLError.Id,
+			Message: InvalidSignedURLError.Message,
+			Error:   err.Error(),
+		}, responseHeader
+	}
+	if signedFile.UserUUID != "" {
+		if request.User == nil {
+			return 401, NotLoggedInError, responseHeader
+		}
+		if request.User.UUID != signedFile.UserUUID {
+			return 403, ForbiddenError, responseHeader
+		}
+	}
+
+	// Originals are served as the type sniffed when they were uploaded, not the type their name suggests
+	options := ServeFileOptions{}
+	name := ""
+	record, err := FindFileRecord(signedFile.Key, request.DB)
+	if signedFile.Derivative == "" {
+		if err != nil {
+			return 404, FileNotFoundError, responseHeader
+		}
+		options.ContentType = record.ContentType
+		options.Checksum = record.Checksum
+	} else if err == nil {
+		options.ETag = record.DerivativeETag(signedFile.Derivative)
+	}
+	if err == nil {
+		name = record.Name
+	}
+	// Caches must not keep the File after the URL expires
+	maxAge := int64(signedFile.Expires.Sub(time.Now()) / time.Second)
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	cacheControl := "private, max-age=" + strconv.FormatInt(maxAge, 10)
+
+	// Anyone with the URL can use a presigned URL, so only redirect to one if the signed URL is not bound to a User
+	if presigner, ok := request.FS.(Presigner); ok && signedFile.UserUUID == "" {
+		exists, err := request.FS.Exists(signedFile.Key, signedFile.Derivative)
+		if err != nil || !exists {
+			return 404, FileNotFoundError, responseHeader
+		}
+		// The storage can not send nosniff, so it is told the type instead of being left to guess
+		contentType := options.ContentType
+		if signedFile.Derivative != "" {
+			contentType = ImageFormatContentType(ImageFormatFromDerivative(signedFile.Derivative))
+		}
+		disposition := "inline"
+		if name != "" {
+			disposition = mime.FormatMediaType(disposition, map[string]string{"filename": name})
+		}
+		presignHeader := http.Header{}
+		presignHeader.Set("Content-Type", contentType)
+		presignHeader.Set("Content-Disposition", disposition)
+		presignHeader.Set("Cache-Control", cacheControl)
+		presignedURL, err := presigner.PresignGet(signedFile.Key, signedFile.Derivative, signedFile.Expires, presignHeader)
+		if err == nil {
+			http.Redirect(request.Writer, request.Raw, presignedURL, http.StatusTemporaryRedirect)
+			return StatusInternallyHandled, nil, nil
+		}
+		logger.Print("Could not presign a URL, serving the file instead: " + err.Error())
+	}
+
+	file, err := request.FS.Get(signedFile.Key, signedFile.Derivative)
+	if err != nil {
+		return 404, FileNotFoundError, responseHeader
+	}
+	request.Writer.Header().Set("Cache-Control", cacheControl)
+	request.Writer.Header().Set("X-Content-Type-Options", "nosniff")
+	err = request.ServeFile(file, options)
+	if err != nil {
+		return 500, &APIError{
+			Id:      InternalServerError.Id,
+			Message: "Error serving file: " + err.Error(),
+		}, responseHeader
+	}
+	return StatusInternallyHandled, nil, nil
+}
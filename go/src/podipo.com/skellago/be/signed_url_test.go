@@ -0,0 +1,130 @@
+package be
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/chai2010/assert"
+	"github.com/coocood/qbs"
+)
+
+func TestURLSigner(t *testing.T) {
+	signer := NewURLSigner("/api/signed-file")
+	now := time.Now()
+	verify := func(signedURL string, now time.Time) (*SignedFile, error) {
+		parsed, err := url.Parse(signedURL)
+		AssertNil(t, err)
+		AssertEqual(t, "/api/signed-file", parsed.Path)
+		return signer.Verify(parsed.Query(), now)
+	}
+
+	signedURL := signer.Sign("a-key", "thumbnail", now.Add(time.Minute), "")
+	signedFile, err := verify(signedURL, now)
+	AssertNil(t, err)
+	AssertEqual(t, "a-key", signedFile.Key)
+	AssertEqual(t, "thumbnail", signedFile.Derivative)
+	AssertEqual(t, "", signedFile.UserUUID)
+	_, err = verify(signedURL, now.Add(2*time.Minute))
+	AssertNotNil(t, err, "Expired URLs should not verify")
+
+	_, err = verify(strings.Replace(signedURL, "thumbnail", "original", 1), now)
+	AssertNotNil(t, err, "Changing the derivative should invalidate the signature")
+	_, err = verify(strings.Replace(signedURL, "a-key", "b-key", 1), now)
+	AssertNotNil(t, err, "Changing the key should invalidate the signature")
+
+	signedURL = signer.Sign("a-key", "", now.Add(time.Minute), "user-1")
+	signedFile, err = verify(signedURL, now)
+	AssertNil(t, err)
+	AssertEqual(t, "user-1", signedFile.UserUUID)
+	_, err = verify(strings.Replace(signedURL, "user=user-1", "user=user-2", 1), now)
+	AssertNotNil(t, err, "Changing the user should invalidate the signature")
+
+	otherSigner := NewURLSigner("/api/signed-file")
+	parsed, _ := url.Parse(signedURL)
+	_, err = otherSigner.Verify(parsed.Query(), now)
+	AssertNotNil(t, err, "Signers with different secrets should not share URLs")
+}
+
+func TestSignedFileResource(t *testing.T) {
+	CreateAndInitDB()
+	db, err := qbs.GetQbs()
+	AssertNil(t, err)
+	defer func() {
+		WipeDB()
+		db.Close()
+	}()
+
+	get := func(fs FileStorage, signer *URLSigner, signedURL string, user *User) *httptest.ResponseRecorder {
+		raw, err := http.NewRequest("GET", signedURL, nil)
+		AssertNil(t, err)
+		recorder := httptest.NewRecorder()
+		request := &APIRequest{Raw: raw, Writer: recorder, DB: db, FS: fs, URLSigner: signer, User: user}
+		code, data, _ := NewSignedFileResource().Get(request)
+		if code != StatusInternallyHandled {
+			recorder.Code = code
+			if apiError, ok := data.(APIError); ok {
+				recorder.Body.WriteString(apiError.Id)
+			}
+		}
+		return recorder
+	}
+
+	fs := NewMemoryFileStorage()
+	key, err := fs.Put("foo.html", strings.NewReader("foo"))
+	AssertNil(t, err)
+	_, err = CreateFileRecord(key, "foo.html", "text/plain; charset=utf-8", 3, "", 0, db)
+	AssertNil(t, err)
+	signer := NewURLSigner("/signed-file")
+	expires := time.Now().Add(time.Minute)
+
+	resp := get(fs, signer, signer.Sign(key, "", expires, ""), nil)
+	AssertEqual(t, 200, resp.Code)
+	AssertEqual(t, "foo", resp.Body.String())
+	Assert(t, strings.HasPrefix(resp.Header().Get("Cache-Control"), "private, max-age="), "Caching should be limited")
+	AssertEqual(t, "text/plain; charset=utf-8", resp.Header().Get("Content-Type"), "The sniffed type should be used, not the name's")
+	AssertEqual(t, "nosniff", resp.Header().Get("X-Content-Type-Options"))
+	unrecordedKey, err := fs.Put("unrecorded.html", strings.NewReader("<html>"))
+	AssertNil(t, err)
+	AssertEqual(t, 404, get(fs, signer, signer.Sign(unrecordedKey, "", expires, ""), nil).Code)
+
+	resp = get(fs, signer, signer.Sign(key, "", time.Now().Add(-time.Minute), ""), nil)
+	AssertEqual(t, 403, resp.Code)
+	AssertEqual(t, InvalidSignedURLError.Id, resp.Body.String())
+	resp = get(fs, signer, signer.Sign(key, "bogus", expires, ""), nil)
+	AssertEqual(t, 404, resp.Code)
+
+	boundURL := signer.Sign(key, "", expires, "user-1")
+	AssertEqual(t, 401, get(fs, signer, boundURL, nil).Code)
+	AssertEqual(t, 403, get(fs, signer, boundURL, &User{UUID: "user-2"}).Code)
+	AssertEqual(t, 200, get(fs, signer, boundURL, &User{UUID: "user-1"}).Code)
+
+	// Storage which can presign URLs is redirected to, unless the URL is bound to a User
+	fake := NewFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s3FS, err := NewS3FileStorage(fake.S3Config(server.URL))
+	AssertNil(t, err)
+	key, err = s3FS.Put("foo.txt", strings.NewReader("foo"))
+	AssertNil(t, err)
+	_, err = CreateFileRecord(key, "foo.txt", "text/plain; charset=utf-8", 3, "", 0, db)
+	AssertNil(t, err)
+	resp = get(s3FS, signer, signer.Sign(key, "", expires, ""), nil)
+	AssertEqual(t, http.StatusTemporaryRedirect, resp.Code)
+	s3Resp, err := http.Get(resp.Header().Get("Location"))
+	AssertNil(t, err)
+	defer s3Resp.Body.Close()
+	AssertEqual(t, 200, s3Resp.StatusCode)
+	AssertEqual(t, "text/plain; charset=utf-8", s3Resp.Header.Get("Content-Type"), "S3 should respond with the sniffed type")
+	AssertEqual(t, "inline; filename=foo.txt", s3Resp.Header.Get("Content-Disposition"))
+	data, err := ioutil.ReadAll(s3Resp.Body)
+	AssertNil(t, err)
+	AssertEqual(t, "foo", string(data))
+	resp = get(s3FS, signer, signer.Sign(key, "", expires, "user-1"), &User{UUID: "user-1"})
+	AssertEqual(t, 200, resp.Code)
+	AssertEqual(t, "foo", resp.Body.String())
+}
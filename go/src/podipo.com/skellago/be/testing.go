@@ -13,7 +13,10 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/codegangsta/negroni"
 	"github.com/coocood/qbs"
@@ -99,15 +102,7 @@ func NewTestAPI() (*TestAPI, error) {
 	negServer := negroni.New() // add negroni.NewLogger() to see all requests
 	store := cookiestore.New([]byte(TestSessionSecret))
 	negServer.Use(sessions.Sessions(TestSessionCookie, store))
-	tempDir, err := ioutil.TempDir(os.TempDir(), "test-api-fs")
-	if err != nil {
-		return nil, err
-	}
-	fs, err := NewLocalFileStorage(tempDir)
-	if err != nil {
-		return nil, err
-	}
-	api := NewAPI("/api/"+TestVersion, TestVersion, fs)
+	api := NewAPI("/api/"+TestVersion, TestVersion, NewMemoryFileStorage())
 	negServer.UseHandler(api.Mux)
 
 	// Set up a stoppable listener so we can clean up afterwards
@@ -238,8 +233,9 @@ func CompareReaderData(file1 io.Reader, file2 io.Reader) bool {
 	buf2 := make([]byte, 1024)
 	n2 := 0
 	for {
-		n1, _ = file1.Read(buf1)
-		n2, _ = file2.Read(buf2)
+		// ReadFull because network readers like http response bodies return short reads
+		n1, _ = io.ReadFull(file1, buf1)
+		n2, _ = io.ReadFull(file2, buf2)
 		if n1 != n2 {
 			logger.Print("Unbalanced read: ", n1, " ", n2)
 			return false
@@ -253,3 +249,351 @@ func CompareReaderData(file1 io.Reader, file2 io.Reader) bool {
 		}
 	}
 }
+
+/*
+AssertFileStorage checks that fs behaves like LocalFileStorage, the reference FileStorage, including its Stager if it has one
+Every FileStorage implementation, including those outside of this package, should pass:
+
+	func TestMyFileStorage(t *testing.T) {
+		be.AssertFileStorage(t, NewMyFileStorage())
+	}
+*/
+func AssertFileStorage(t *testing.T, fs FileStorage) {
+	testData := func(size int, seed byte) []byte {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = seed + byte(i%251)
+		}
+		return data
+	}
+	assertData := func(file File, expected []byte, message string) {
+		reader, err := file.Reader()
+		if err != nil {
+			t.Fatalf("AssertFileStorage %s: Reader failed: %s", message, err.Error())
+		}
+		defer reader.Close()
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("AssertFileStorage %s: read failed: %s", message, err.Error())
+		}
+		if !bytes.Equal(expected, data) {
+			t.Fatalf("AssertFileStorage %s: read %d bytes which do not match the %d bytes written", message, len(data), len(expected))
+		}
+		// Range requests depend on seeking
+		end, err := reader.Seek(0, io.SeekEnd)
+		if err != nil || end != int64(len(expected)) {
+			t.Fatalf("AssertFileStorage %s: seeking to the end returned %d: %v", message, end, err)
+		}
+		middle := int64(len(expected) / 2)
+		_, err = reader.Seek(middle, io.SeekStart)
+		if err != nil {
+			t.Fatalf("AssertFileStorage %s: seek failed: %s", message, err.Error())
+		}
+		data, err = ioutil.ReadAll(reader)
+		if err != nil || !bytes.Equal(expected[middle:], data) {
+			t.Fatalf("AssertFileStorage %s: reading after a seek returned the wrong data: %v", message, err)
+		}
+	}
+
+	if _, err := fs.Exists("", ""); err == nil {
+		t.Fatalf("AssertFileStorage: Exists should return an error for an empty key")
+	}
+	exists, err := fs.Exists("bogus-key", "")
+	if err != nil || exists {
+		t.Fatalf("AssertFileStorage: a bogus key should not exist: %v %v", exists, err)
+	}
+	exists, err = fs.Exists("bogus-key", "blatz")
+	if err != nil || exists {
+		t.Fatalf("AssertFileStorage: a bogus derivative should not exist: %v %v", exists, err)
+	}
+	if _, err = fs.Get("bogus-key", ""); err == nil {
+		t.Fatalf("AssertFileStorage: Get should return an error for a bogus key")
+	}
+
+	data1 := testData(10*1024, 1)
+	key1, err := fs.Put("foo bar.bin", bytes.NewReader(data1))
+	if err != nil {
+		t.Fatalf("AssertFileStorage: Put failed: %s", err.Error())
+	}
+	file1, err := fs.Get(key1, "")
+	if err != nil {
+		t.Fatalf("AssertFileStorage: Get failed: %s", err.Error())
+	}
+	if file1.Key() != key1 || file1.Derivative() != "" {
+		t.Fatalf("AssertFileStorage: Get returned the wrong File: %s %s", file1.Key(), file1.Derivative())
+	}
+	name, err := file1.Name()
+	if err != nil || name != "foo-bar.bin" {
+		t.Fatalf("AssertFileStorage: Name should be the cleaned name: %s %v", name, err)
+	}
+	size, err := file1.Size()
+	if err != nil || size != int64(len(data1)) {
+		t.Fatalf("AssertFileStorage: wrong size: %d %v", size, err)
+	}
+	assertData(file1, data1, "original")
+	assertData(file1, data1, "second read")
+
+	key2, err := fs.Put("foo bar.bin", bytes.NewReader(testData(5, 2)))
+	if err != nil {
+		t.Fatalf("AssertFileStorage: second Put failed: %s", err.Error())
+	}
+	if key1 == key2 {
+		t.Fatalf("AssertFileStorage: Put should generate a unique key for each File")
+	}
+
+	if err = fs.PutDerivative("bogus-key", "bar", bytes.NewReader(data1)); err == nil {
+		t.Fatalf("AssertFileStorage: PutDerivative should require an existing original")
+	}
+	derivativeData := testData(5*1024, 3)
+	err = fs.PutDerivative(key1, "bar", bytes.NewReader(testData(100, 4)))
+	if err == nil {
+		// Putting a derivative again should replace it
+		err = fs.PutDerivative(key1, "bar", bytes.NewReader(derivativeData))
+	}
+	if err != nil {
+		t.Fatalf("AssertFileStorage: PutDerivative failed: %s", err.Error())
+	}
+	derivative, err := fs.Get(key1, "bar")
+	if err != nil {
+		t.Fatalf("AssertFileStorage: Get of a derivative failed: %s", err.Error())
+	}
+	if derivative.Key() != key1 || derivative.Derivative() != "bar" {
+		t.Fatalf("AssertFileStorage: Get returned the wrong derivative: %s %s", derivative.Key(), derivative.Derivative())
+	}
+	derivativeName, err := derivative.Name()
+	if err != nil || derivativeName != name {
+		t.Fatalf("AssertFileStorage: derivatives should have the original's name: %s %v", derivativeName, err)
+	}
+	assertData(derivative, derivativeData, "derivative")
+	assertData(file1, data1, "original after derivative")
+	if _, err = fs.Get(key2, "bar"); err == nil {
+		t.Fatalf("AssertFileStorage: derivatives should belong to one key")
+	}
+
+	err = fs.PutDerivative(key1, "baz", bytes.NewReader(derivativeData))
+	if err != nil {
+		t.Fatalf("AssertFileStorage: PutDerivative failed: %s", err.Error())
+	}
+	if err = fs.Delete(key1, "baz"); err != nil {
+		t.Fatalf("AssertFileStorage: Delete of a derivative failed: %s", err.Error())
+	}
+	exists, err = fs.Exists(key1, "baz")
+	if err != nil || exists {
+		t.Fatalf("AssertFileStorage: a deleted derivative should not exist: %v %v", exists, err)
+	}
+	exists, err = fs.Exists(key1, "")
+	if err != nil || !exists {
+		t.Fatalf("AssertFileStorage: deleting a derivative should not delete the original: %v %v", exists, err)
+	}
+
+	// Concurrent Puts should all succeed with unique keys
+	var wg sync.WaitGroup
+	keys := make([]string, 10)
+	errs := make([]error, len(keys))
+	for i := range keys {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			keys[i], errs[i] = fs.Put("concurrent.bin", bytes.NewReader(testData(1024, byte(i))))
+			if errs[i] == nil {
+				errs[i] = fs.PutDerivative(keys[i], "bar", bytes.NewReader(testData(10, byte(i))))
+			}
+		}(i)
+	}
+	wg.Wait()
+	uniqueKeys := make(map[string]bool)
+	for i, key := range keys {
+		if errs[i] != nil {
+			t.Fatalf("AssertFileStorage: concurrent Put failed: %s", errs[i].Error())
+		}
+		uniqueKeys[key] = true
+		file, err := fs.Get(key, "")
+		if err != nil {
+			t.Fatalf("AssertFileStorage: Get of a concurrent Put failed: %s", err.Error())
+		}
+		assertData(file, testData(1024, byte(i)), "concurrent Put")
+	}
+	if len(uniqueKeys) != len(keys) {
+		t.Fatalf("AssertFileStorage: concurrent Puts should generate unique keys")
+	}
+
+	if err = fs.Delete("bogus-key-2", ""); err != nil {
+		t.Fatalf("AssertFileStorage: deleting a bogus key should not return an error: %s", err.Error())
+	}
+	for _, key := range append(keys, key1, key2) {
+		if err = fs.Delete(key, ""); err != nil {
+			t.Fatalf("AssertFileStorage: Delete failed: %s", err.Error())
+		}
+	}
+	if _, err = file1.Reader(); err == nil {
+		t.Fatalf("AssertFileStorage: reading a deleted File should return an error")
+	}
+	exists, err = fs.Exists(key1, "bar")
+	if err != nil || exists {
+		t.Fatalf("AssertFileStorage: derivatives should not exist after deleting the original: %v %v", exists, err)
+	}
+	if err = fs.Delete(key1, ""); err != nil {
+		t.Fatalf("AssertFileStorage: deleting a deleted key should not return an error: %s", err.Error())
+	}
+	if stager, ok := fs.(Stager); ok {
+		assertStager(t, fs, stager)
+	}
+	if lister, ok := fs.(Lister); ok {
+		assertLister(t, fs, lister)
+	}
+}
+
+/*
+assertLister checks the Lister of a FileStorage which can list its contents
+*/
+func assertLister(t *testing.T, fs FileStorage, lister Lister) {
+	findKey := func(key string) *StoredKey {
+		keys, err := lister.Keys()
+		if err != nil {
+			t.Fatalf("AssertFileStorage: Keys failed: %s", err.Error())
+		}
+		for _, stored := range keys {
+			if stored.Key == key {
+				return &stored
+			}
+		}
+		return nil
+	}
+	before := time.Now().Add(-time.Minute)
+	key, err := fs.Put("listed.txt", strings.NewReader("listed"))
+	if err != nil {
+		t.Fatalf("AssertFileStorage: Put failed: %s", err.Error())
+	}
+	if err = fs.PutDerivative(key, "bar", strings.NewReader("derived")); err != nil {
+		t.Fatalf("AssertFileStorage: PutDerivative failed: %s", err.Error())
+	}
+	derivatives, err := lister.Derivatives(key)
+	if err != nil || len(derivatives) != 1 || derivatives[0] != "bar" {
+		t.Fatalf("AssertFileStorage: Derivatives should list the derivatives of a key: %v %v", derivatives, err)
+	}
+	stored := findKey(key)
+	if stored == nil {
+		t.Fatalf("AssertFileStorage: Keys should list a stored key")
+	}
+	if stored.Modified.Before(before) {
+		t.Fatalf("AssertFileStorage: Keys should return when the key was modified: %s", stored.Modified)
+	}
+	if err = fs.Delete(key, ""); err != nil {
+		t.Fatalf("AssertFileStorage: Delete failed: %s", err.Error())
+	}
+	if findKey(key) != nil {
+		t.Fatalf("AssertFileStorage: Keys should not list a deleted key or its derivatives")
+	}
+
+	stager, ok := fs.(Stager)
+	if !ok {
+		return
+	}
+	uploadId := UUID()
+	if _, err = stager.PutChunk(uploadId, 0, strings.NewReader("staged")); err != nil {
+		t.Fatalf("AssertFileStorage: PutChunk failed: %s", err.Error())
+	}
+	entries, err := lister.TempEntries()
+	if err != nil {
+		t.Fatalf("AssertFileStorage: TempEntries failed: %s", err.Error())
+	}
+	var staged *TempEntry
+	for _, entry := range entries {
+		if entry.UploadId == uploadId {
+			found := entry
+			staged = &found
+		}
+	}
+	if staged == nil || staged.Modified.Before(before) {
+		t.Fatalf("AssertFileStorage: TempEntries should list a staged upload: %v", staged)
+	}
+	if err = lister.DeleteTemp(staged.Name); err != nil {
+		t.Fatalf("AssertFileStorage: DeleteTemp failed: %s", err.Error())
+	}
+	if size, err := stager.StagedSize(uploadId); err != nil || size != 0 {
+		t.Fatalf("AssertFileStorage: DeleteTemp should delete a staged upload: %d %v", size, err)
+	}
+}
+
+/*
+assertStager checks the Stager of a FileStorage which can stage uploads
+*/
+func assertStager(t *testing.T, fs FileStorage, stager Stager) {
+	readStaged := func(uploadId string) []byte {
+		reader, err := stager.StagedReader(uploadId)
+		if err != nil {
+			t.Fatalf("AssertFileStorage: StagedReader failed: %s", err.Error())
+		}
+		defer reader.Close()
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("AssertFileStorage: reading staged data failed: %s", err.Error())
+		}
+		return data
+	}
+	assertSize := func(uploadId string, expected int64) {
+		size, err := stager.StagedSize(uploadId)
+		if err != nil || size != expected {
+			t.Fatalf("AssertFileStorage: staged size should be %d: %d %v", expected, size, err)
+		}
+	}
+
+	uploadId := UUID()
+	assertSize(uploadId, 0)
+	if data := readStaged(uploadId); len(data) != 0 {
+		t.Fatalf("AssertFileStorage: an unknown upload should have no staged data")
+	}
+	chunks := []string{"first chunk, ", "second chunk, ", "", "third chunk"}
+	var offset int64
+	for _, chunk := range chunks {
+		written, err := stager.PutChunk(uploadId, offset, strings.NewReader(chunk))
+		if err != nil || written != int64(len(chunk)) {
+			t.Fatalf("AssertFileStorage: PutChunk wrote %d of %d bytes: %v", written, len(chunk), err)
+		}
+		offset += written
+		assertSize(uploadId, offset)
+	}
+	if data := string(readStaged(uploadId)); data != strings.Join(chunks, "") {
+		t.Fatalf("AssertFileStorage: staged chunks should be read in order: %s", data)
+	}
+
+	// Replacing the last chunk, as a rejected checksum does
+	if err := stager.DeleteChunk(uploadId, offset-int64(len("third chunk"))); err != nil {
+		t.Fatalf("AssertFileStorage: DeleteChunk failed: %s", err.Error())
+	}
+	offset -= int64(len("third chunk"))
+	assertSize(uploadId, offset)
+	if _, err := stager.PutChunk(uploadId, offset, strings.NewReader("last")); err != nil {
+		t.Fatalf("AssertFileStorage: PutChunk failed: %s", err.Error())
+	}
+	if data := string(readStaged(uploadId)); data != "first chunk, second chunk, last" {
+		t.Fatalf("AssertFileStorage: a replaced chunk should be read: %s", data)
+	}
+
+	// Staged data is stored by the usual Put
+	reader, err := stager.StagedReader(uploadId)
+	if err != nil {
+		t.Fatalf("AssertFileStorage: StagedReader failed: %s", err.Error())
+	}
+	key, err := fs.Put("staged.txt", reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("AssertFileStorage: Put of staged data failed: %s", err.Error())
+	}
+	if err = stager.DeleteStaged(uploadId); err != nil {
+		t.Fatalf("AssertFileStorage: DeleteStaged failed: %s", err.Error())
+	}
+	assertSize(uploadId, 0)
+	if err = stager.DeleteStaged(uploadId); err != nil {
+		t.Fatalf("AssertFileStorage: deleting deleted staged data should not return an error: %s", err.Error())
+	}
+	file, err := fs.Get(key, "")
+	if err != nil {
+		t.Fatalf("AssertFileStorage: Get of staged data failed: %s", err.Error())
+	}
+	size, err := file.Size()
+	if err != nil || size != int64(len("first chunk, second chunk, last")) {
+		t.Fatalf("AssertFileStorage: deleting staged data should not affect the stored File: %d %v", size, err)
+	}
+	fs.Delete(key, "")
+}
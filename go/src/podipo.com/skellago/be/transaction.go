@@ -0,0 +1,105 @@
+package be
+
+/*
+	Per-request database transactions.
+*/
+
+import (
+	"github.com/coocood/qbs"
+)
+
+/*
+Transactional can be implemented by a Resource to opt out of the per-request transaction.
+By default requests with mutating methods (POST, PUT, PATCH, DELETE) run in a transaction which is committed if the handler returns a 2xx status and rolled back otherwise.
+*/
+type Transactional interface {
+	Transactional(method string) bool
+}
+
+func isMutatingMethod(method string) bool {
+	return method == POST || method == PUT || method == PATCH || method == DELETE
+}
+
+func isSuccessStatus(code int) bool {
+	return code == StatusInternallyHandled || (code >= 200 && code <= 299)
+}
+
+/*
+transactionHooks collect the side effects to run once the fate of a transaction is known
+*/
+type transactionHooks struct {
+	afterCommit   []func()
+	afterRollback []func()
+}
+
+func (hooks *transactionHooks) committed() {
+	for _, hook := range hooks.afterCommit {
+		hook()
+	}
+	hooks.afterCommit = nil
+	hooks.afterRollback = nil
+}
+
+func (hooks *transactionHooks) rolledBack() {
+	for _, hook := range hooks.afterRollback {
+		hook()
+	}
+	hooks.afterCommit = nil
+	hooks.afterRollback = nil
+}
+
+/*
+AfterCommit registers a func which runs after the request's transaction commits.
+Use it for side effects which cannot be rolled back, like deleting the file a record used to point at.
+If the request does not run in a transaction then the hook runs after a successful response.
+*/
+func (request *APIRequest) AfterCommit(hook func()) {
+	request.hooks.afterCommit = append(request.hooks.afterCommit, hook)
+}
+
+/*
+AfterRollback registers a func which runs if the request's transaction is rolled back, for example to remove a newly stored file.
+If the request does not run in a transaction then the hook runs after an unsuccessful response.
+*/
+func (request *APIRequest) AfterRollback(hook func()) {
+	request.hooks.afterRollback = append(request.hooks.afterRollback, hook)
+}
+
+/*
+wantsTransaction is true if a request with this method to this resource should run in a transaction
+*/
+func wantsTransaction(resource Resource, method string) bool {
+	if !isMutatingMethod(method) {
+		return false
+	}
+	if transactional, ok := resource.(Transactional); ok {
+		return transactional.Transactional(method)
+	}
+	return true
+}
+
+/*
+finishTransaction commits or rolls back db depending on the handler's status code and then runs the hooks
+If db is nil then there is no transaction and only the hooks are run
+*/
+func finishTransaction(db *qbs.Qbs, code int, hooks *transactionHooks) error {
+	if !isSuccessStatus(code) {
+		if db != nil {
+			err := db.Rollback()
+			if err != nil {
+				logger.Print("Could not roll back the transaction: " + err.Error())
+			}
+		}
+		hooks.rolledBack()
+		return nil
+	}
+	if db != nil {
+		err := db.Commit()
+		if err != nil {
+			hooks.rolledBack()
+			return err
+		}
+	}
+	hooks.committed()
+	return nil
+}
@@ -0,0 +1,141 @@
+package be
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	. "github.com/chai2010/assert"
+	"github.com/coocood/qbs"
+)
+
+type optOutResource struct {
+	SchemaResource
+}
+
+func (optOutResource) Transactional(method string) bool { return method != DELETE }
+
+/*
+transactionTestResource writes a FileRecord with the key in its path and then ends the request as the path's outcome says, counting the hooks which run
+*/
+type transactionTestResource struct {
+	mutex      sync.Mutex
+	committed  map[string]int
+	rolledBack map[string]int
+}
+
+func (*transactionTestResource) Name() string  { return "transaction-test" }
+func (*transactionTestResource) Path() string  { return "/transaction-test/{outcome}" }
+func (*transactionTestResource) Title() string { return "Transaction test" }
+func (*transactionTestResource) Description() string {
+	return "Writes a row and then succeeds, fails, or panics."
+}
+func (*transactionTestResource) Properties() []Property { return []Property{} }
+
+func (resource *transactionTestResource) Post(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	outcome := request.PathValues["outcome"]
+	request.AfterCommit(func() { resource.count(resource.committed, outcome) })
+	request.AfterRollback(func() { resource.count(resource.rolledBack, outcome) })
+	_, err := CreateFileRecord("transaction-"+outcome, outcome+".txt", "text/plain", 0, "", 0, request.DB)
+	if err != nil {
+		return 500, InternalServerError, responseHeader
+	}
+	switch outcome {
+	case "fail":
+		return 400, BadRequestError, responseHeader
+	case "panic":
+		panic("Failing mid-transaction")
+	case "handled":
+		request.Writer.WriteHeader(http.StatusOK)
+		return StatusInternallyHandled, nil, nil
+	}
+	return 200, struct{}{}, responseHeader
+}
+
+func (resource *transactionTestResource) count(counts map[string]int, outcome string) {
+	resource.mutex.Lock()
+	defer resource.mutex.Unlock()
+	counts[outcome]++
+}
+
+func (resource *transactionTestResource) counts(outcome string) (int, int) {
+	resource.mutex.Lock()
+	defer resource.mutex.Unlock()
+	return resource.committed[outcome], resource.rolledBack[outcome]
+}
+
+func TestRequestTransactions(t *testing.T) {
+	CreateAndInitDB()
+	db, err := qbs.GetQbs()
+	AssertNil(t, err)
+	defer func() {
+		WipeDB()
+		db.Close()
+	}()
+
+	testApi, err := NewTestAPI()
+	AssertNil(t, err)
+	defer testApi.Stop()
+	resource := &transactionTestResource{committed: map[string]int{}, rolledBack: map[string]int{}}
+	testApi.API.AddResource(resource, false)
+	client, err := NewClient(testApi.URL())
+	AssertNil(t, err)
+
+	for _, outcome := range []string{"succeed", "handled"} {
+		_, err = client.PostJSON("/transaction-test/"+outcome, struct{}{})
+		AssertNil(t, err, outcome)
+		_, err = FindFileRecord("transaction-"+outcome, db)
+		AssertNil(t, err, "The row should be committed: "+outcome)
+		committed, rolledBack := resource.counts(outcome)
+		AssertEqual(t, 1, committed, outcome)
+		AssertEqual(t, 0, rolledBack, outcome)
+	}
+
+	for _, outcome := range []string{"fail", "panic"} {
+		_, err = client.PostJSON("/transaction-test/"+outcome, struct{}{})
+		AssertNotNil(t, err, outcome)
+		_, err = FindFileRecord("transaction-"+outcome, db)
+		AssertNotNil(t, err, "The row should be rolled back: "+outcome)
+		committed, rolledBack := resource.counts(outcome)
+		AssertEqual(t, 0, committed, outcome)
+		AssertEqual(t, 1, rolledBack, outcome)
+	}
+}
+
+func TestWantsTransaction(t *testing.T) {
+	resource := NewCurrentUserResource()
+	AssertFalse(t, wantsTransaction(resource, GET))
+	AssertFalse(t, wantsTransaction(resource, HEAD))
+	AssertTrue(t, wantsTransaction(resource, POST))
+	AssertTrue(t, wantsTransaction(resource, PUT))
+	AssertTrue(t, wantsTransaction(resource, PATCH))
+	AssertTrue(t, wantsTransaction(resource, DELETE))
+
+	optOut := optOutResource{}
+	AssertTrue(t, wantsTransaction(optOut, POST))
+	AssertFalse(t, wantsTransaction(optOut, DELETE), "Resources should be able to opt out per method")
+}
+
+func TestTransactionHooks(t *testing.T) {
+	committed := 0
+	rolledBack := 0
+	request := &APIRequest{hooks: &transactionHooks{}}
+	request.AfterCommit(func() { committed++ })
+	request.AfterRollback(func() { rolledBack++ })
+	AssertNil(t, finishTransaction(nil, 200, request.hooks))
+	AssertEqual(t, 1, committed)
+	AssertEqual(t, 0, rolledBack)
+	AssertNil(t, finishTransaction(nil, 200, request.hooks))
+	AssertEqual(t, 1, committed, "Hooks should only run once")
+
+	request.AfterCommit(func() { committed++ })
+	request.AfterRollback(func() { rolledBack++ })
+	AssertNil(t, finishTransaction(nil, 400, request.hooks))
+	AssertEqual(t, 1, committed)
+	AssertEqual(t, 1, rolledBack)
+
+	request.AfterCommit(func() { committed++ })
+	AssertNil(t, finishTransaction(nil, StatusInternallyHandled, request.hooks))
+	AssertEqual(t, 2, committed, "Internally handled responses should count as successful")
+}
@@ -0,0 +1,213 @@
+package be
+
+/*
+	Resumable uploads, which arrive in chunks that are staged in the FileStorage until the upload is complete.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+// UploadLifetime is how long an incomplete Upload lasts after its last chunk
+const UploadLifetime = 24 * time.Hour
+
+// stagedChunkFormat names a chunk by its offset, zero padded so that chunk names sort in offset order
+const stagedChunkFormat = "%020d"
+
+/*
+Stager is implemented by FileStorage backends which can stage an upload that arrives in chunks.
+Chunks are kept in the backend's temp area, apart from stored Files, until the upload is complete.
+Each chunk is put at the offset where the previous chunk ended, and putting a chunk at the same offset replaces it.
+*/
+type Stager interface {
+	// PutChunk stores the data from reader and returns how much was stored, even if there was an error
+	PutChunk(uploadId string, offset int64, reader io.Reader) (int64, error)
+	DeleteChunk(uploadId string, offset int64) error
+	// StagedSize is the size of the upload's chunks, or 0 if none have been put
+	StagedSize(uploadId string) (int64, error)
+	// StagedReader reads the upload's chunks in order, and the caller must Close it
+	StagedReader(uploadId string) (io.ReadCloser, error)
+	// DeleteStaged deletes all of the upload's chunks, which is not an error if there are none
+	DeleteStaged(uploadId string) error
+}
+
+/*
+stagedChunk is a chunk found by a Stager, with a func to open it
+*/
+type stagedChunk struct {
+	offset int64
+	size   int64
+	open   func() (io.ReadCloser, error)
+}
+
+func stagedChunkName(offset int64) string {
+	return fmt.Sprintf(stagedChunkFormat, offset)
+}
+
+/*
+stagedSize adds up the sizes of chunks sorted by offset, which must leave no gaps
+*/
+func stagedSize(chunks []stagedChunk) (int64, error) {
+	var size int64
+	for _, chunk := range chunks {
+		if chunk.offset != size {
+			return 0, fmt.Errorf("Staged chunk at %d does not follow the data before it, which ends at %d", chunk.offset, size)
+		}
+		size += chunk.size
+	}
+	return size, nil
+}
+
+/*
+chunkReader reads chunks one after another, opening each one when the previous one is used up
+*/
+type chunkReader struct {
+	chunks  []stagedChunk
+	current io.ReadCloser
+}
+
+func newChunkReader(chunks []stagedChunk) (*chunkReader, error) {
+	_, err := stagedSize(chunks)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{chunks: chunks}, nil
+}
+
+func (reader *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if reader.current == nil {
+			if len(reader.chunks) == 0 {
+				return 0, io.EOF
+			}
+			current, err := reader.chunks[0].open()
+			if err != nil {
+				return 0, err
+			}
+			reader.current = current
+			reader.chunks = reader.chunks[1:]
+		}
+		n, err := reader.current.Read(p)
+		if err == io.EOF {
+			reader.current.Close()
+			reader.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (reader *chunkReader) Close() error {
+	if reader.current == nil {
+		return nil
+	}
+	err := reader.current.Close()
+	reader.current = nil
+	return err
+}
+
+/*
+Upload tracks a resumable upload from creation until its staged data is stored as a File
+The staged size, not the Upload, records how much data has arrived
+*/
+type Upload struct {
+	Id       int64     `json:"id" qbs:"pk"`
+	UUID     string    `json:"uuid" qbs:"unique,index"`
+	Length   int64     `json:"length"`
+	Name     string    `json:"name"`
+	Metadata string    `json:"metadata"` // The Upload-Metadata header of the creation request
+	UserId   int64     `json:"user-id" qbs:"index"`
+	FileKey  string    `json:"file-key"` // Empty until the upload is complete
+	Expires  time.Time `json:"expires"`
+	Created  time.Time `json:"created"`
+}
+
+func (upload *Upload) Expired(now time.Time) bool {
+	return now.After(upload.Expires)
+}
+
+func CreateUpload(length int64, name string, metadata string, userId int64, db *qbs.Qbs) (*Upload, error) {
+	upload := new(Upload)
+	upload.UUID = UUID()
+	upload.Length = length
+	upload.Name = name
+	upload.Metadata = metadata
+	upload.UserId = userId
+	upload.Created = time.Now()
+	upload.Expires = upload.Created.Add(UploadLifetime)
+	_, err := db.Save(upload)
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func FindUpload(uuid string, db *qbs.Qbs) (*Upload, error) {
+	upload := new(Upload)
+	err := db.WhereEqual("uuid", uuid).Find(upload)
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func UpdateUpload(upload *Upload, db *qbs.Qbs) error {
+	_, err := db.Save(upload)
+	return err
+}
+
+func DeleteUpload(uuid string, db *qbs.Qbs) error {
+	_, err := db.Exec("delete from upload where uuid = ?", uuid)
+	return err
+}
+
+/*
+claimUpload deletes the Upload with uuid and returns false if there was none, like when a concurrent request deleted it first
+*/
+func claimUpload(uuid string, db *qbs.Qbs) (bool, error) {
+	result, err := db.Exec("delete from upload where uuid = ?", uuid)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+func FindExpiredUploads(now time.Time, db *qbs.Qbs) ([]*Upload, error) {
+	var uploads []*Upload
+	err := db.Where("expires < ?", now).FindAll(&uploads)
+	return uploads, err
+}
+
+/*
+DeleteExpiredUploads deletes expired Uploads and their staged data, and returns how many were deleted
+Run it periodically, since requests for expired uploads only report them as gone
+*/
+func DeleteExpiredUploads(fs FileStorage, db *qbs.Qbs) (int, error) {
+	stager, ok := fs.(Stager)
+	if !ok {
+		return 0, errors.New("The FileStorage can not stage uploads")
+	}
+	uploads, err := FindExpiredUploads(time.Now(), db)
+	if err != nil {
+		return 0, err
+	}
+	for index, upload := range uploads {
+		err = stager.DeleteStaged(upload.UUID)
+		if err == nil {
+			err = DeleteUpload(upload.UUID, db)
+		}
+		if err != nil {
+			return index, err
+		}
+	}
+	return len(uploads), nil
+}
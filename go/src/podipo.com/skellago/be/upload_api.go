@@ -0,0 +1,669 @@
+package be
+
+/*
+	A tus 1.0 (https://tus.io/protocols/resumable-upload.html) endpoint for resumable uploads.
+*/
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TusVersion is the version of the tus protocol which the upload resources speak
+const TusVersion = "1.0.0"
+
+// DefaultMaxUploadSize is the largest Upload-Length accepted by a new UploadsResource
+const DefaultMaxUploadSize = 1024 * 1024 * 1024
+
+// The tus extensions and checksum algorithms supported by the upload resources
+const (
+	TusExtensions         = "creation,expiration,checksum,termination"
+	TusChecksumAlgorithms = "sha1,sha256,md5"
+)
+
+// StatusChecksumMismatch is the tus status for a chunk which does not match its Upload-Checksum
+const StatusChecksumMismatch = 460
+
+// FileKeyHeader is set on responses once an upload is complete, with the key of the stored File
+const FileKeyHeader = "File-Key"
+
+var UploadProperties = []Property{
+	Property{
+		Name:        "uuid",
+		Description: "The id used in the upload URL",
+		DataType:    "string",
+		Protected:   true,
+	},
+	Property{
+		Name:        "length",
+		Description: "The size of the upload in bytes",
+		DataType:    "int",
+		Protected:   true,
+	},
+	Property{
+		Name:        "offset",
+		Description: "The number of bytes received",
+		DataType:    "int",
+		Protected:   true,
+	},
+	Property{
+		Name:        "name",
+		Description: "The filename from the upload metadata",
+		DataType:    "string",
+		Protected:   true,
+	},
+	Property{
+		Name:        "file-key",
+		Description: "The key of the stored file once the upload is complete. Image resources accept a PUT of {\"upload\": uuid} to use it",
+		DataType:    "string",
+		Protected:   true,
+	},
+	Property{
+		Name:        "expires",
+		Description: "When an incomplete upload will be deleted",
+		DataType:    "date-time",
+		Protected:   true,
+	},
+}
+
+/*
+UploadStatus is an Upload and how much of it has arrived
+*/
+type UploadStatus struct {
+	*Upload
+	Offset int64 `json:"offset"`
+}
+
+/*
+uploadLocks keeps two requests in this process from writing to the same Upload at once
+*/
+var uploadLocks = struct {
+	sync.Mutex
+	locked map[string]bool
+}{locked: make(map[string]bool)}
+
+func lockUpload(uuid string) bool {
+	uploadLocks.Lock()
+	defer uploadLocks.Unlock()
+	if uploadLocks.locked[uuid] {
+		return false
+	}
+	uploadLocks.locked[uuid] = true
+	return true
+}
+
+func unlockUpload(uuid string) {
+	uploadLocks.Lock()
+	defer uploadLocks.Unlock()
+	delete(uploadLocks.locked, uuid)
+}
+
+/*
+tusHeader returns a response header with the Tus-Resumable header set
+*/
+func tusHeader() http.Header {
+	responseHeader := map[string][]string{}
+	http.Header(responseHeader).Set("Tus-Resumable", TusVersion)
+	return responseHeader
+}
+
+/*
+checkTusVersion returns a 412 status if the request is not for the supported version of tus, otherwise 0
+*/
+func checkTusVersion(request *APIRequest, responseHeader http.Header) (int, interface{}) {
+	if request.Raw.Header.Get("Tus-Resumable") != TusVersion {
+		responseHeader.Set("Tus-Version", TusVersion)
+		return http.StatusPreconditionFailed, UnsupportedTusVersionError
+	}
+	return 0, nil
+}
+
+/*
+ParseUploadMetadata parses an Upload-Metadata header like "filename d29ybGQuanBn,is_confidential"
+Keys without a value map to ""
+*/
+func ParseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		fields := strings.Fields(pair)
+		if len(fields) > 2 {
+			return nil, errors.New("Bad Upload-Metadata pair: " + pair)
+		}
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, errors.New("Upload-Metadata value is not base64: " + pair)
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata, nil
+}
+
+/*
+parseUploadChecksum parses an Upload-Checksum header like "sha1 Kq5sNclPz7QV2+lfQIuc6R7oRu0="
+*/
+func parseUploadChecksum(header string) (hash.Hash, []byte, error) {
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return nil, nil, errors.New("Upload-Checksum should be an algorithm and a base64 checksum")
+	}
+	expected, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, nil, errors.New("Upload-Checksum is not base64")
+	}
+	switch fields[0] {
+	case "sha1":
+		return sha1.New(), expected, nil
+	case "sha256":
+		return sha256.New(), expected, nil
+	case "md5":
+		return md5.New(), expected, nil
+	}
+	return nil, nil, errors.New("Unsupported Upload-Checksum algorithm: " + fields[0])
+}
+
+/*
+findUpload returns the requesting User's Upload or an error status
+Expired Uploads are reported as gone and left for DeleteExpiredUploads to delete
+*/
+func findUpload(request *APIRequest) (*Upload, int, interface{}) {
+	if request.User == nil {
+		return nil, 401, NotLoggedInError
+	}
+	upload, err := FindUpload(request.PathValues["id"], request.DB)
+	if err != nil || upload.UserId != request.User.Id {
+		return nil, 404, UploadNotFoundError
+	}
+	if upload.FileKey == "" && upload.Expired(time.Now()) {
+		return nil, http.StatusGone, UploadExpiredError
+	}
+	return upload, 200, nil
+}
+
+func requestStager(request *APIRequest) (Stager, int, interface{}) {
+	stager, ok := request.FS.(Stager)
+	if !ok {
+		return nil, http.StatusNotImplemented, APIError{
+			Id:      InternalServerError.Id,
+			Message: "The file storage can not stage uploads",
+		}
+	}
+	return stager, 200, nil
+}
+
+/*
+uploadOffset is how much of the Upload has arrived
+*/
+func uploadOffset(upload *Upload, stager Stager) (int64, error) {
+	if upload.FileKey != "" {
+		return upload.Length, nil
+	}
+	return stager.StagedSize(upload.UUID)
+}
+
+/*
+finishUpload stores the staged data as a File and records its key in the Upload
+The staged data is deleted once the request succeeds
+*/
+func finishUpload(request *APIRequest, stager Stager, upload *Upload) (int, interface{}) {
+	reader, err := stager.StagedReader(upload.UUID)
+	if err != nil {
+		return 500, APIError{
+			Id:      InternalServerError.Id,
+			Message: "Could not read the staged upload",
+			Error:   err.Error(),
+		}
+	}
+	record, err := request.PutFile(upload.Name, reader)
+	reader.Close()
+	if err != nil {
+		return UploadErrorResponse(err)
+	}
+	upload.FileKey = record.Key
+	err = UpdateUpload(upload, request.DB)
+	if err != nil {
+		DeleteFileRecord(record.Key, request.DB)
+		return 500, APIError{
+			Id:      "db_error",
+			Message: "Database error",
+			Error:   err.Error(),
+		}
+	}
+	request.AfterCommit(func() {
+		err := stager.DeleteStaged(upload.UUID)
+		if err != nil {
+			logger.Print("Could not delete a staged upload: " + err.Error())
+		}
+	})
+	return 200, nil
+}
+
+/*
+UploadReference is the JSON body of a PUT which sets a file field, like an image, to the File of a finished Upload
+*/
+type UploadReference struct {
+	Upload string `json:"upload"` // The UUID of the Upload
+}
+
+/*
+PutUploadWithPolicy reads an UploadReference from the request body and stores the File of the requesting User's finished Upload as PutFileWithPolicy would, so that it must meet the policy
+The Upload and the File it made are deleted once the transaction commits, and the returned FileRecord should be referenced with ReferenceFile like any other upload
+*/
+func (request *APIRequest) PutUploadWithPolicy(policy UploadPolicy) (*FileRecord, int, interface{}) {
+	if request.User == nil {
+		return nil, 401, NotLoggedInError
+	}
+	reference := new(UploadReference)
+	err := json.NewDecoder(request.Raw.Body).Decode(reference)
+	if err != nil {
+		return nil, 400, JSONParseError
+	}
+	if reference.Upload == "" {
+		return nil, 400, APIError{
+			Id:      BadRequestError.Id,
+			Message: "An `upload` field with the UUID of a finished upload is required",
+		}
+	}
+	upload, err := FindUpload(reference.Upload, request.DB)
+	if err != nil || upload.UserId != request.User.Id {
+		return nil, 404, UploadNotFoundError
+	}
+	if upload.FileKey == "" {
+		return nil, http.StatusConflict, UploadIncompleteError
+	}
+	file, err := request.FS.Get(upload.FileKey, "")
+	if err != nil {
+		return nil, 404, FileNotFoundError
+	}
+	reader, err := file.Reader()
+	if err != nil {
+		return nil, 404, FileNotFoundError
+	}
+	defer reader.Close()
+
+	// Claiming the Upload first means that of two requests attaching it only one gets past here
+	claimed, err := claimUpload(upload.UUID, request.DB)
+	if err == nil && !claimed {
+		return nil, 404, UploadNotFoundError
+	}
+	// The unchecked File no longer counts against the quota once its checked copy is stored
+	if err == nil {
+		err = DeleteFileRecord(upload.FileKey, request.DB)
+	}
+	if err != nil {
+		return nil, 500, APIError{
+			Id:      "db_error",
+			Message: "Database error",
+			Error:   err.Error(),
+		}
+	}
+	record, err := request.PutFileWithPolicy(upload.Name, reader, policy)
+	if err != nil {
+		status, apiError := UploadErrorResponse(err)
+		return nil, status, apiError
+	}
+	request.AfterCommit(func() {
+		err := request.FS.Delete(upload.FileKey, "")
+		if err != nil {
+			logger.Print("Could not delete the file of an attached upload: " + err.Error())
+		}
+	})
+	return record, 200, nil
+}
+
+/*
+UploadsResource creates tus uploads
+*/
+type UploadsResource struct {
+	MaxSize int64 // The largest Upload-Length accepted, or 0 for no limit
+}
+
+func NewUploadsResource() *UploadsResource {
+	return &UploadsResource{
+		MaxSize: DefaultMaxUploadSize,
+	}
+}
+
+func (UploadsResource) Name() string  { return "uploads" }
+func (UploadsResource) Path() string  { return "/upload/" }
+func (UploadsResource) Title() string { return "Uploads" }
+func (UploadsResource) Description() string {
+	return "Creates resumable uploads using the tus 1.0 protocol with the creation, expiration, checksum, and termination extensions."
+}
+
+func (resource UploadsResource) Properties() []Property {
+	return UploadProperties
+}
+
+/*
+Options describes the tus server and does not require the Tus-Resumable header
+*/
+func (resource UploadsResource) Options(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := tusHeader()
+	responseHeader.Set("Tus-Version", TusVersion)
+	responseHeader.Set("Tus-Extension", TusExtensions)
+	responseHeader.Set("Tus-Checksum-Algorithm", TusChecksumAlgorithms)
+	if resource.MaxSize > 0 {
+		responseHeader.Set("Tus-Max-Size", strconv.FormatInt(resource.MaxSize, 10))
+	}
+	return http.StatusNoContent, nil, responseHeader
+}
+
+/*
+Post creates an Upload from the Upload-Length and Upload-Metadata headers
+The new Upload's URL is in the Location header
+*/
+func (resource UploadsResource) Post(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := tusHeader()
+	if status, apiError := checkTusVersion(request, responseHeader); status != 0 {
+		return status, apiError, responseHeader
+	}
+	if request.User == nil {
+		return 401, NotLoggedInError, responseHeader
+	}
+	length, err := strconv.ParseInt(request.Raw.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return 400, APIError{
+			Id:      BadRequestError.Id,
+			Message: "Upload-Length is required",
+		}, responseHeader
+	}
+	if resource.MaxSize > 0 && length > resource.MaxSize {
+		return http.StatusRequestEntityTooLarge, UploadTooLargeError, responseHeader
+	}
+	usage, err := FindStorageUsage(request.User.Id, request.DB)
+	if err != nil {
+		return 500, APIError{
+			Id:      "db_error",
+			Message: "Database error",
+			Error:   err.Error(),
+		}, responseHeader
+	}
+	if usage.Available() >= 0 && length > usage.Available() {
+		quotaError := storageQuotaExceeded(usage)
+		return quotaError.Status, quotaError.APIError, responseHeader
+	}
+	rawMetadata := request.Raw.Header.Get("Upload-Metadata")
+	metadata, err := ParseUploadMetadata(rawMetadata)
+	if err != nil {
+		return 400, APIError{
+			Id:      BadRequestError.Id,
+			Message: "Bad Upload-Metadata",
+			Error:   err.Error(),
+		}, responseHeader
+	}
+	name := metadata["filename"]
+	if name == "" {
+		name = metadata["name"]
+	}
+	if name == "" {
+		name = "upload"
+	}
+	stager, status, apiError := requestStager(request)
+	if stager == nil {
+		return status, apiError, responseHeader
+	}
+
+	upload, err := CreateUpload(length, name, rawMetadata, request.User.Id, request.DB)
+	if err != nil {
+		return 500, APIError{
+			Id:      "db_error",
+			Message: "Database error",
+			Error:   err.Error(),
+		}, responseHeader
+	}
+	if length == 0 {
+		// There will be no PATCH to complete an empty upload
+		if status, apiError := finishUpload(request, stager, upload); status != 200 {
+			return status, apiError, responseHeader
+		}
+		responseHeader.Set(FileKeyHeader, upload.FileKey)
+	}
+	responseHeader.Set("Location", request.Raw.URL.Path+upload.UUID)
+	responseHeader.Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	return http.StatusCreated, &UploadStatus{upload, 0}, responseHeader
+}
+
+/*
+UploadResource receives the chunks of a tus upload
+*/
+type UploadResource struct {
+}
+
+func NewUploadResource() *UploadResource {
+	return &UploadResource{}
+}
+
+func (UploadResource) Name() string  { return "upload" }
+func (UploadResource) Path() string  { return "/upload/{id}" }
+func (UploadResource) Title() string { return "Upload" }
+func (UploadResource) Description() string {
+	return "A resumable upload. HEAD returns its offset, PATCH appends a chunk, DELETE cancels it, and GET returns its status including the file key once it is complete."
+}
+
+func (resource UploadResource) Properties() []Property {
+	return UploadProperties
+}
+
+/*
+Transactional is false for PATCH so that a chunk which takes minutes to arrive does not hold a transaction open
+*/
+func (resource UploadResource) Transactional(method string) bool {
+	return method != PATCH
+}
+
+func (resource UploadResource) Options(request *APIRequest) (int, interface{}, http.Header) {
+	return NewUploadsResource().Options(request)
+}
+
+func (resource UploadResource) Get(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	upload, status, apiError := findUpload(request)
+	if upload == nil {
+		return status, apiError, responseHeader
+	}
+	stager, status, apiError := requestStager(request)
+	if stager == nil {
+		return status, apiError, responseHeader
+	}
+	offset, err := uploadOffset(upload, stager)
+	if err != nil {
+		return 500, APIError{
+			Id:      InternalServerError.Id,
+			Message: "Could not read the staged upload",
+			Error:   err.Error(),
+		}, responseHeader
+	}
+	return 200, &UploadStatus{upload, offset}, responseHeader
+}
+
+func (resource UploadResource) Head(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := tusHeader()
+	responseHeader.Set("Cache-Control", "no-store")
+	if status, apiError := checkTusVersion(request, responseHeader); status != 0 {
+		return status, apiError, responseHeader
+	}
+	upload, status, apiError := findUpload(request)
+	if upload == nil {
+		return status, apiError, responseHeader
+	}
+	stager, status, apiError := requestStager(request)
+	if stager == nil {
+		return status, apiError, responseHeader
+	}
+	offset, err := uploadOffset(upload, stager)
+	if err != nil {
+		return 500, nil, responseHeader
+	}
+	responseHeader.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	responseHeader.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		responseHeader.Set("Upload-Metadata", upload.Metadata)
+	}
+	if upload.FileKey != "" {
+		responseHeader.Set(FileKeyHeader, upload.FileKey)
+	} else {
+		responseHeader.Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	}
+	return 200, nil, responseHeader
+}
+
+/*
+Patch appends the request body to the Upload at Upload-Offset
+When the last byte arrives the Upload is stored as a File and its key is returned in the File-Key header
+*/
+func (resource UploadResource) Patch(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := tusHeader()
+	if status, apiError := checkTusVersion(request, responseHeader); status != 0 {
+		return status, apiError, responseHeader
+	}
+	upload, status, apiError := findUpload(request)
+	if upload == nil {
+		return status, apiError, responseHeader
+	}
+	if request.Raw.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return http.StatusUnsupportedMediaType, APIError{
+			Id:      BadRequestError.Id,
+			Message: "The Content-Type must be application/offset+octet-stream",
+		}, responseHeader
+	}
+	requestOffset, err := strconv.ParseInt(request.Raw.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || requestOffset < 0 {
+		return 400, APIError{
+			Id:      BadRequestError.Id,
+			Message: "Upload-Offset is required",
+		}, responseHeader
+	}
+	var checksum hash.Hash
+	var expectedChecksum []byte
+	if header := request.Raw.Header.Get("Upload-Checksum"); header != "" {
+		checksum, expectedChecksum, err = parseUploadChecksum(header)
+		if err != nil {
+			return 400, APIError{
+				Id:      BadRequestError.Id,
+				Message: "Bad Upload-Checksum",
+				Error:   err.Error(),
+			}, responseHeader
+		}
+	}
+	stager, status, apiError := requestStager(request)
+	if stager == nil {
+		return status, apiError, responseHeader
+	}
+	if !lockUpload(upload.UUID) {
+		return http.StatusLocked, UploadLockedError, responseHeader
+	}
+	defer unlockUpload(upload.UUID)
+
+	offset, err := uploadOffset(upload, stager)
+	if err != nil {
+		return 500, APIError{
+			Id:      InternalServerError.Id,
+			Message: "Could not read the staged upload",
+			Error:   err.Error(),
+		}, responseHeader
+	}
+	if requestOffset != offset {
+		return http.StatusConflict, UploadOffsetMismatchError, responseHeader
+	}
+
+	if offset < upload.Length {
+		var body io.Reader = io.LimitReader(request.Raw.Body, upload.Length-offset)
+		if checksum != nil {
+			body = io.TeeReader(body, checksum)
+		}
+		written, err := stager.PutChunk(upload.UUID, offset, body)
+		if err != nil {
+			// Without a checksum the data which arrived is kept so that the client can resume after it
+			if checksum != nil {
+				stager.DeleteChunk(upload.UUID, offset)
+			}
+			return 500, APIError{
+				Id:      InternalServerError.Id,
+				Message: "Could not stage the chunk",
+				Error:   err.Error(),
+			}, responseHeader
+		}
+		if checksum != nil && !bytes.Equal(checksum.Sum(nil), expectedChecksum) {
+			stager.DeleteChunk(upload.UUID, offset)
+			return StatusChecksumMismatch, ChecksumMismatchError, responseHeader
+		}
+		offset += written
+		upload.Expires = time.Now().Add(UploadLifetime)
+		err = UpdateUpload(upload, request.DB)
+		if err != nil {
+			return 500, APIError{
+				Id:      "db_error",
+				Message: "Database error",
+				Error:   err.Error(),
+			}, responseHeader
+		}
+	}
+	// An upload which is complete but not yet stored, because storing failed, is retried by a PATCH with an empty body
+	if offset == upload.Length && upload.FileKey == "" {
+		if status, apiError := finishUpload(request, stager, upload); status != 200 {
+			return status, apiError, responseHeader
+		}
+	}
+
+	responseHeader.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if upload.FileKey != "" {
+		responseHeader.Set(FileKeyHeader, upload.FileKey)
+	} else {
+		responseHeader.Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	}
+	return http.StatusNoContent, nil, responseHeader
+}
+
+/*
+Delete implements the tus termination extension, deleting the Upload and its staged data
+The File of a complete Upload is not deleted
+*/
+func (resource UploadResource) Delete(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := tusHeader()
+	if status, apiError := checkTusVersion(request, responseHeader); status != 0 {
+		return status, apiError, responseHeader
+	}
+	upload, status, apiError := findUpload(request)
+	if upload == nil {
+		return status, apiError, responseHeader
+	}
+	stager, status, apiError := requestStager(request)
+	if stager == nil {
+		return status, apiError, responseHeader
+	}
+	err := DeleteUpload(upload.UUID, request.DB)
+	if err != nil {
+		return 500, APIError{
+			Id:      "db_error",
+			Message: "Database error",
+			Error:   err.Error(),
+		}, responseHeader
+	}
+	request.AfterCommit(func() {
+		err := stager.DeleteStaged(upload.UUID)
+		if err != nil {
+			logger.Print("Could not delete a staged upload: " + err.Error())
+		}
+	})
+	return http.StatusNoContent, nil, responseHeader
+}
@@ -0,0 +1,222 @@
+package be
+
+/*
+	Limits on the size, type, and image dimensions of uploaded files.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// multipartOverhead is the room left in a request body for the multipart boundaries and headers around a file
+const multipartOverhead = 64 * 1024
+
+// sniffLength is all that http.DetectContentType considers
+const sniffLength = 512
+
+/*
+UploadPolicy limits the files accepted by a resource
+The zero UploadPolicy accepts anything
+*/
+type UploadPolicy struct {
+	MaxSize      int64    // The largest file in bytes, or 0 for no limit
+	ContentTypes []string // The content types allowed by sniffing the data, like "image/png" or "image/*", or empty to allow any
+	MaxWidth     int      // The widest image in pixels, or 0 for no limit
+	MaxHeight    int      // The tallest image in pixels, or 0 for no limit
+
+	// StripMetadata removes EXIF, XMP, and other metadata like GPS locations from JPEGs and PNGs, see StripImageMetadata
+	StripMetadata bool
+}
+
+/*
+DefaultImageUploadPolicy is used by the image resources, like CurrentUserImageResource
+*/
+var DefaultImageUploadPolicy = UploadPolicy{
+	MaxSize:       10 * 1024 * 1024,
+	ContentTypes:  []string{"image/png", "image/jpeg", "image/gif"},
+	MaxWidth:      8000,
+	MaxHeight:     8000,
+	StripMetadata: true,
+}
+
+/*
+MaxBodySize is the largest multipart request body which can hold a file allowed by the policy, or 0 for no limit
+*/
+func (policy UploadPolicy) MaxBodySize() int64 {
+	if policy.MaxSize <= 0 {
+		return 0
+	}
+	return policy.MaxSize + multipartOverhead
+}
+
+/*
+Allows is true if the policy accepts a file of contentType, ignoring parameters like charset
+*/
+func (policy UploadPolicy) Allows(contentType string) bool {
+	if len(policy.ContentTypes) == 0 {
+		return true
+	}
+	contentType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+	for _, allowed := range policy.ContentTypes {
+		if allowed == contentType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy UploadPolicy) checksDimensions() bool {
+	return policy.MaxWidth > 0 || policy.MaxHeight > 0
+}
+
+/*
+UploadPolicyError is returned when a file breaks an UploadPolicy or an image has more than MaxImagePixels
+*/
+type UploadPolicyError struct {
+	Status   int // 413, 415, or 422
+	APIError APIError
+}
+
+func (err *UploadPolicyError) Error() string {
+	return err.APIError.Message
+}
+
+/*
+UploadErrorResponse returns the status and APIError for an error from APIRequest.PutFileWithPolicy
+*/
+func UploadErrorResponse(err error) (int, interface{}) {
+	if policyError, ok := err.(*UploadPolicyError); ok {
+		return policyError.Status, policyError.APIError
+	}
+	return http.StatusInternalServerError, APIError{
+		Id:      "storage_error",
+		Message: "Could not store the file: " + err.Error(),
+	}
+}
+
+func uploadTooLarge(maxSize int64) *UploadPolicyError {
+	return &UploadPolicyError{
+		Status: http.StatusRequestEntityTooLarge,
+		APIError: APIError{
+			Id:      UploadTooLargeError.Id,
+			Message: UploadTooLargeError.Message + " of " + strconv.FormatInt(maxSize, 10) + " bytes",
+		},
+	}
+}
+
+/*
+policyReader fails once more than maxSize bytes have been read, so that an upload is rejected while it streams in
+*/
+type policyReader struct {
+	io.Reader
+	maxSize int64 // 0 for no limit
+	count   int64
+	tooBig  bool
+}
+
+func (reader *policyReader) Read(p []byte) (int, error) {
+	n, err := reader.Reader.Read(p)
+	reader.count += int64(n)
+	if reader.maxSize > 0 && reader.count > reader.maxSize {
+		reader.tooBig = true
+		return n, errors.New("The file is larger than " + strconv.FormatInt(reader.maxSize, 10) + " bytes")
+	}
+	return n, err
+}
+
+/*
+checkUpload sniffs the start of the data from reader and checks its type and dimensions against the policy
+It returns a reader of all of the data, which enforces the policy's MaxSize and strips metadata if the policy asks, and the sniffed content type
+*/
+func (policy UploadPolicy) checkUpload(reader io.Reader) (*policyReader, io.Reader, string, error) {
+	limited := &policyReader{Reader: reader, maxSize: policy.MaxSize}
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(limited, head)
+	if limited.tooBig {
+		return nil, nil, "", uploadTooLarge(policy.MaxSize)
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, "", err
+	}
+	head = head[:n]
+	contentType := http.DetectContentType(head)
+	if !policy.Allows(contentType) {
+		return nil, nil, "", &UploadPolicyError{
+			Status: http.StatusUnsupportedMediaType,
+			APIError: APIError{
+				Id:      UnsupportedContentTypeError.Id,
+				Message: UnsupportedContentTypeError.Message + ": " + contentType + ", allowed types are " + strings.Join(policy.ContentTypes, ", "),
+			},
+		}
+	}
+	data := io.MultiReader(bytes.NewReader(head), limited)
+	if policy.StripMetadata && (contentType == "image/jpeg" || contentType == "image/png") {
+		data = StripImageMetadata(data)
+	}
+	if (!policy.checksDimensions() && MaxImagePixels <= 0) || !strings.HasPrefix(contentType, "image/") {
+		return limited, data, contentType, nil
+	}
+
+	// Keep what DecodeConfig reads, which is usually only the image header, so that it can be read again
+	var decoded bytes.Buffer
+	config, format, err := image.DecodeConfig(io.TeeReader(data, &decoded))
+	if limited.tooBig {
+		return nil, nil, "", uploadTooLarge(policy.MaxSize)
+	}
+	if err != nil && !policy.checksDimensions() {
+		// Only checking MaxImagePixels, and an image which can not be decoded will not be
+		return limited, io.MultiReader(&decoded, data), contentType, nil
+	}
+	if err != nil {
+		return nil, nil, "", &UploadPolicyError{
+			Status: http.StatusUnsupportedMediaType,
+			APIError: APIError{
+				Id:      UnsupportedContentTypeError.Id,
+				Message: "Could not read the " + contentType + " image",
+				Error:   err.Error(),
+			},
+		}
+	}
+	if (policy.MaxWidth > 0 && config.Width > policy.MaxWidth) || (policy.MaxHeight > 0 && config.Height > policy.MaxHeight) {
+		return nil, nil, "", &UploadPolicyError{
+			Status: http.StatusRequestEntityTooLarge,
+			APIError: APIError{
+				Id:      ImageTooLargeError.Id,
+				Message: ImageTooLargeError.Message + ": the image is " + strconv.Itoa(config.Width) + "x" + strconv.Itoa(config.Height) + " and the maximum is " + strconv.Itoa(policy.MaxWidth) + "x" + strconv.Itoa(policy.MaxHeight),
+			},
+		}
+	}
+	data = io.MultiReader(&decoded, data)
+	if MaxImagePixels > 0 {
+		pixels := int64(config.Width) * int64(config.Height)
+		if pixels > MaxImagePixels {
+			return nil, nil, "", imageTooManyPixels(http.StatusRequestEntityTooLarge, pixels)
+		}
+		if format == ImageFormatGIF && policy.MaxSize > 0 {
+			// Counting the frames of an animation means reading all of it, which MaxSize limits
+			all, err := ioutil.ReadAll(data)
+			if limited.tooBig {
+				return nil, nil, "", uploadTooLarge(policy.MaxSize)
+			}
+			if err != nil {
+				return nil, nil, "", err
+			}
+			err = checkImagePixels(all, config, format, http.StatusRequestEntityTooLarge)
+			if _, ok := err.(*UploadPolicyError); ok {
+				return nil, nil, "", err
+			}
+			data = bytes.NewReader(all)
+		}
+	}
+	return limited, data, contentType, nil
+}
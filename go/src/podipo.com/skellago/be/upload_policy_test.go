@@ -0,0 +1,128 @@
+package be
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/chai2010/assert"
+	"github.com/coocood/qbs"
+)
+
+func encodedPNG(t *testing.T, width int, height int) []byte {
+	var buffer bytes.Buffer
+	AssertNil(t, png.Encode(&buffer, image.NewRGBA(image.Rect(0, 0, width, height))))
+	return buffer.Bytes()
+}
+
+func TestUploadPolicy(t *testing.T) {
+	policy := UploadPolicy{
+		MaxSize:      2048,
+		ContentTypes: []string{"image/png", "text/*"},
+		MaxWidth:     100,
+		MaxHeight:    50,
+	}
+	AssertTrue(t, policy.Allows("image/png"))
+	AssertTrue(t, policy.Allows("text/plain; charset=utf-8"))
+	AssertFalse(t, policy.Allows("image/jpeg"))
+	AssertTrue(t, UploadPolicy{}.Allows("application/octet-stream"))
+	AssertEqual(t, int64(0), UploadPolicy{}.MaxBodySize())
+
+	check := func(data []byte) (string, []byte, error) {
+		_, reader, contentType, err := policy.checkUpload(bytes.NewReader(data))
+		if err != nil {
+			return "", nil, err
+		}
+		read, err := ioutil.ReadAll(reader)
+		return contentType, read, err
+	}
+	statusOf := func(err error) int {
+		AssertNotNil(t, err)
+		status, _ := UploadErrorResponse(err)
+		return status
+	}
+
+	imageData := encodedPNG(t, 100, 50)
+	contentType, read, err := check(imageData)
+	AssertNil(t, err)
+	AssertEqual(t, "image/png", contentType)
+	AssertEqual(t, imageData, read, "The data read for sniffing and decoding should be read again")
+
+	text := []byte(strings.Repeat("some text ", 10))
+	contentType, read, err = check(text)
+	AssertNil(t, err)
+	Assert(t, strings.HasPrefix(contentType, "text/plain"), "Wrong type: "+contentType)
+	AssertEqual(t, text, read)
+
+	_, _, err = check(encodedPNG(t, 101, 50))
+	AssertEqual(t, http.StatusRequestEntityTooLarge, statusOf(err), "Images should be limited by width")
+	_, _, err = check(encodedPNG(t, 100, 51))
+	AssertEqual(t, http.StatusRequestEntityTooLarge, statusOf(err), "Images should be limited by height")
+	_, _, err = check([]byte("GIF89a not really"))
+	AssertEqual(t, http.StatusUnsupportedMediaType, statusOf(err), "Types should be sniffed, not trusted")
+
+	// Size is enforced while the data streams in
+	_, read, err = check(bytes.Repeat([]byte("a"), 2048))
+	AssertNil(t, err)
+	AssertEqual(t, 2048, len(read))
+	_, _, err = check(bytes.Repeat([]byte("a"), 2049))
+	AssertNotNil(t, err, "Reading past MaxSize should fail")
+
+	// Metadata is stripped after the dimensions are checked
+	policy = UploadPolicy{MaxWidth: 4, StripMetadata: true}
+	photo := testExifJPEG(t, 4, 2, 6)
+	contentType, read, err = check(photo)
+	AssertNil(t, err)
+	AssertEqual(t, "image/jpeg", contentType)
+	AssertTrue(t, len(read) < len(photo))
+	AssertFalse(t, bytes.Contains(read, []byte("Taken at home")))
+}
+
+func TestImageUploadPolicy(t *testing.T) {
+	CreateAndInitDB()
+	db, err := qbs.GetQbs()
+	AssertNil(t, err)
+	defer func() {
+		WipeDB()
+		db.Close()
+	}()
+
+	testApi, err := NewTestAPI()
+	AssertNil(t, err)
+	defer testApi.Stop()
+
+	userClient, _, err := CreateTestUserAndStaffWithClients(testApi, db)
+	AssertNil(t, err)
+
+	sendImage := func(data []byte) int {
+		// The .png extension should not be trusted
+		file, err := ioutil.TempFile(os.TempDir(), "skella-test-policy*.png")
+		AssertNil(t, err)
+		defer os.Remove(file.Name())
+		defer file.Close()
+		_, err = file.Write(data)
+		AssertNil(t, err)
+		file.Seek(0, 0)
+		resp, err := userClient.SendFile("PUT", "/user/current/image", "image", file)
+		AssertNil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	AssertEqual(t, 200, sendImage(encodedPNG(t, 10, 10)))
+	AssertEqual(t, http.StatusUnsupportedMediaType, sendImage([]byte("not an image")))
+	AssertEqual(t, http.StatusRequestEntityTooLarge, sendImage(encodedPNG(t, DefaultImageUploadPolicy.MaxWidth+1, 1)))
+	tooBig := make([]byte, DefaultImageUploadPolicy.MaxBodySize()+1)
+	copy(tooBig, encodedPNG(t, 10, 10))
+	AssertEqual(t, http.StatusRequestEntityTooLarge, sendImage(tooBig))
+
+	list, err := FindFileRecords(0, 100, db)
+	AssertNil(t, err)
+	AssertEqual(t, 1, len(list), "Rejected images should not be recorded")
+	AssertEqual(t, "image/png", list[0].ContentType)
+}
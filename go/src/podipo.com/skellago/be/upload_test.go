@@ -0,0 +1,239 @@
+package be
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/chai2010/assert"
+	"github.com/coocood/qbs"
+)
+
+func TestParseUploadMetadata(t *testing.T) {
+	metadata, err := ParseUploadMetadata("filename d29ybGQuanBn, is_confidential")
+	AssertNil(t, err)
+	AssertEqual(t, "world.jpg", metadata["filename"])
+	value, ok := metadata["is_confidential"]
+	AssertTrue(t, ok)
+	AssertEqual(t, "", value)
+	metadata, err = ParseUploadMetadata("")
+	AssertNil(t, err)
+	AssertEqual(t, 0, len(metadata))
+	_, err = ParseUploadMetadata("filename not-base64!")
+	AssertNotNil(t, err)
+
+	_, _, err = parseUploadChecksum("crc32 AAAA")
+	AssertNotNil(t, err, "Unsupported algorithms should be rejected")
+	checksum, expected, err := parseUploadChecksum("sha1 Kq5sNclPz7QV2+lfQIuc6R7oRu0=")
+	AssertNil(t, err)
+	checksum.Write([]byte("hello world"))
+	AssertEqual(t, expected, checksum.Sum(nil))
+}
+
+func TestUploadAPI(t *testing.T) {
+	CreateAndInitDB()
+	db, err := qbs.GetQbs()
+	AssertNil(t, err)
+	defer func() {
+		WipeDB()
+		db.Close()
+	}()
+
+	testApi, err := NewTestAPI()
+	AssertNil(t, err)
+	defer testApi.Stop()
+
+	userClient, staffClient, err := CreateTestUserAndStaffWithClients(testApi, db)
+	AssertNil(t, err)
+
+	send := func(client *Client, method string, url string, body string, header map[string]string) *http.Response {
+		req, err := client.prepRequest(method, testApi.URL()+url, strings.NewReader(body), "")
+		AssertNil(t, err)
+		req.Header.Set("Tus-Resumable", TusVersion)
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		AssertNil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	patch := func(url string, offset int, chunk string, checksum string) *http.Response {
+		header := map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		}
+		if checksum != "" {
+			header["Upload-Checksum"] = checksum
+		}
+		return send(userClient, "PATCH", url, chunk, header)
+	}
+
+	resp := send(userClient, "OPTIONS", "/upload/", "", nil)
+	AssertEqual(t, http.StatusNoContent, resp.StatusCode)
+	AssertEqual(t, TusExtensions, resp.Header.Get("Tus-Extension"))
+
+	uploadHeader := map[string]string{
+		"Upload-Length":   "22",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("notes.txt")),
+	}
+	anonymous := &Client{Schema: userClient.Schema}
+	AssertEqual(t, 401, send(anonymous, "POST", "/upload/", "", uploadHeader).StatusCode)
+	resp = send(userClient, "POST", "/upload/", "", map[string]string{"Upload-Length": "-1"})
+	AssertEqual(t, 400, resp.StatusCode)
+	resp = send(userClient, "POST", "/upload/", "", map[string]string{"Upload-Length": strconv.Itoa(DefaultMaxUploadSize + 1)})
+	AssertEqual(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp = send(userClient, "POST", "/upload/", "", uploadHeader)
+	AssertEqual(t, http.StatusCreated, resp.StatusCode)
+	AssertEqual(t, TusVersion, resp.Header.Get("Tus-Resumable"))
+	AssertNotEqual(t, "", resp.Header.Get("Upload-Expires"))
+	location := resp.Header.Get("Location")
+	Assert(t, strings.HasPrefix(location, "/api/"+TestVersion+"/upload/"), "Bad location: "+location)
+	uploadURL := location[len("/api/"+TestVersion):]
+
+	resp = send(userClient, "HEAD", uploadURL, "", nil)
+	AssertEqual(t, 200, resp.StatusCode)
+	AssertEqual(t, "0", resp.Header.Get("Upload-Offset"))
+	AssertEqual(t, "22", resp.Header.Get("Upload-Length"))
+	AssertEqual(t, "no-store", resp.Header.Get("Cache-Control"))
+	AssertEqual(t, 404, send(staffClient, "HEAD", uploadURL, "", nil).StatusCode, "Uploads belong to their User")
+	resp = send(userClient, "HEAD", uploadURL, "", map[string]string{"Tus-Resumable": "0.2.2"})
+	AssertEqual(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	AssertEqual(t, http.StatusNoContent, patch(uploadURL, 0, "first chunk, ", "").StatusCode)
+	AssertEqual(t, http.StatusConflict, patch(uploadURL, 0, "first chunk, ", "").StatusCode, "The offset should be checked")
+	resp = send(userClient, "HEAD", uploadURL, "", nil)
+	AssertEqual(t, "13", resp.Header.Get("Upload-Offset"))
+
+	sum := sha1.Sum([]byte("the rest"))
+	resp = patch(uploadURL, 13, "the REST!", "sha1 "+base64.StdEncoding.EncodeToString(sum[:]))
+	AssertEqual(t, StatusChecksumMismatch, resp.StatusCode)
+	resp = send(userClient, "HEAD", uploadURL, "", nil)
+	AssertEqual(t, "13", resp.Header.Get("Upload-Offset"), "A chunk with a bad checksum should be discarded")
+
+	resp = patch(uploadURL, 13, "the rest!", "")
+	AssertEqual(t, http.StatusNoContent, resp.StatusCode)
+	AssertEqual(t, "22", resp.Header.Get("Upload-Offset"))
+	key := resp.Header.Get(FileKeyHeader)
+	AssertNotEqual(t, "", key)
+
+	status := new(UploadStatus)
+	err = userClient.GetJSON(uploadURL, status)
+	AssertNil(t, err)
+	AssertEqual(t, key, status.FileKey)
+	AssertEqual(t, int64(22), status.Offset)
+	record, err := FindFileRecord(key, db)
+	AssertNil(t, err)
+	AssertEqual(t, "notes.txt", record.Name)
+	AssertEqual(t, int64(22), record.Size)
+	reader, err := staffClient.GetFile("/file/" + key + "/content")
+	AssertNil(t, err)
+	data, err := ioutil.ReadAll(reader)
+	AssertNil(t, err)
+	AssertEqual(t, "first chunk, the rest!", string(data))
+	stagedSize, err := testApi.API.FileStorage.(Stager).StagedSize(status.UUID)
+	AssertNil(t, err)
+	AssertEqual(t, int64(0), stagedSize, "Staged data should be deleted once it is stored")
+
+	// Termination
+	resp = send(userClient, "POST", "/upload/", "", uploadHeader)
+	AssertEqual(t, http.StatusCreated, resp.StatusCode)
+	uploadURL = resp.Header.Get("Location")[len("/api/"+TestVersion):]
+	AssertEqual(t, http.StatusNoContent, patch(uploadURL, 0, "partial", "").StatusCode)
+	AssertEqual(t, http.StatusNoContent, send(userClient, "DELETE", uploadURL, "", nil).StatusCode)
+	AssertEqual(t, 404, send(userClient, "HEAD", uploadURL, "", nil).StatusCode)
+}
+
+func TestAttachUpload(t *testing.T) {
+	CreateAndInitDB()
+	db, err := qbs.GetQbs()
+	AssertNil(t, err)
+	defer func() {
+		WipeDB()
+		db.Close()
+	}()
+
+	testApi, err := NewTestAPI()
+	AssertNil(t, err)
+	defer testApi.Stop()
+	userClient, staffClient, err := CreateTestUserAndStaffWithClients(testApi, db)
+	AssertNil(t, err)
+	fs := testApi.API.FileStorage
+
+	// upload sends data as a resumable upload and returns its UUID and the key of the File it made
+	upload := func(name string, data []byte) (string, string) {
+		req, err := userClient.prepRequest("POST", testApi.URL()+"/upload/", nil, "")
+		AssertNil(t, err)
+		req.Header.Set("Tus-Resumable", TusVersion)
+		req.Header.Set("Upload-Length", strconv.Itoa(len(data)))
+		req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(name)))
+		resp, err := http.DefaultClient.Do(req)
+		AssertNil(t, err)
+		resp.Body.Close()
+		AssertEqual(t, http.StatusCreated, resp.StatusCode)
+		uuid := resp.Header.Get("Location")[len("/api/"+TestVersion+"/upload/"):]
+		req, err = userClient.prepRequest("PATCH", testApi.URL()+"/upload/"+uuid, bytes.NewReader(data), "application/offset+octet-stream")
+		AssertNil(t, err)
+		req.Header.Set("Tus-Resumable", TusVersion)
+		req.Header.Set("Upload-Offset", "0")
+		resp, err = http.DefaultClient.Do(req)
+		AssertNil(t, err)
+		resp.Body.Close()
+		AssertEqual(t, http.StatusNoContent, resp.StatusCode)
+		return uuid, resp.Header.Get(FileKeyHeader)
+	}
+
+	textId, _ := upload("notes.txt", []byte("not an image"))
+	resp, err := userClient.PutJSON("/user/current/image", &UploadReference{textId})
+	AssertNil(t, err)
+	AssertEqual(t, http.StatusUnsupportedMediaType, resp.StatusCode, "The image policy applies to uploads")
+	resp, err = staffClient.PutJSON("/user/current/image", &UploadReference{textId})
+	AssertNil(t, err)
+	AssertEqual(t, 404, resp.StatusCode, "Uploads belong to their User")
+	resp, err = userClient.PutJSON("/user/current/image", &UploadReference{})
+	AssertNil(t, err)
+	AssertEqual(t, 400, resp.StatusCode)
+
+	var buffer bytes.Buffer
+	AssertNil(t, png.Encode(&buffer, image.NewRGBA(image.Rect(0, 0, 40, 30))))
+	imageId, uploadedKey := upload("avatar.png", buffer.Bytes())
+	resp, err = userClient.PutJSON("/user/current/image", &UploadReference{imageId})
+	AssertNil(t, err)
+	AssertEqual(t, 200, resp.StatusCode)
+	current := &CurrentUser{}
+	AssertNil(t, userClient.GetJSON("/user/current", current))
+	AssertNotEqual(t, "", current.Image)
+	references, err := FindFileReferences(current.Image, db)
+	AssertNil(t, err)
+	AssertEqual(t, 1, len(references))
+	AssertEqual(t, UserImageReference, references[0].Kind)
+	record, err := FindFileRecord(current.Image, db)
+	AssertNil(t, err)
+	AssertEqual(t, "image/png", record.ContentType)
+	AssertEqual(t, 40, record.ImageWidth)
+	_, err = userClient.GetFile("/user/current/image")
+	AssertNil(t, err)
+
+	// The unchecked File and the Upload are gone, so the image is the only copy
+	exists, err := fs.Exists(uploadedKey, "")
+	AssertNil(t, err)
+	AssertFalse(t, exists)
+	_, err = FindUpload(imageId, db)
+	AssertNotNil(t, err)
+	resp, err = userClient.PutJSON("/user/current/image", &UploadReference{imageId})
+	AssertNil(t, err)
+	AssertEqual(t, 404, resp.StatusCode, "An upload can be used once")
+	report, err := CollectGarbage(fs, db, 0, true)
+	AssertNil(t, err)
+	for _, key := range report.Orphans {
+		AssertNotEqual(t, current.Image, key, "The attached image should not be collected")
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"net/http"
 )
 
+// UserImageReference is the FileReference kind for User.Image
+const UserImageReference = "user.image"
+
 var UserProperties = []Property{
 	Property{
 		Name:        "uuid",
@@ -47,6 +50,14 @@ var UserProperties = []Property{
 	},
 }
 
+var CurrentUserProperties = append(append([]Property{}, UserProperties...), Property{
+	Name:        "storage",
+	Description: "The user's storage usage and quota",
+	DataType:    "object",
+	Optional:    true,
+	Protected:   true,
+})
+
 var UsersProperties = NewAPIListProperties("user")
 
 var UserImageProperties = []Property{
@@ -66,18 +77,32 @@ type LoginData struct {
 /*
 CurrentUserImageResource returns a image the authenticated request.User has a non-empty `image` field
 */
-type CurrentUserImageResource struct{}
+type CurrentUserImageResource struct {
+	Policy      UploadPolicy  // Limits the images accepted by PutForm
+	Presets     []ImagePreset // The sizes Get may be asked for with ?w=&h=&mode=, the first is served when none is asked for
+	Pregenerate bool          // Makes the derivatives for all Presets in the background after PutForm
+}
 
 func NewCurrentUserImage() *CurrentUserImageResource {
-	return &CurrentUserImageResource{}
+	return &CurrentUserImageResource{
+		Policy:      DefaultImageUploadPolicy,
+		Presets:     append([]ImagePreset{ImagePreset{700, 700, ImageModeFill}}, DefaultImagePresets...),
+		Pregenerate: PregenerateImagePresets,
+	}
 }
 
-func (CurrentUserImageResource) Name() string                    { return "current-user-image" }
-func (CurrentUserImageResource) Path() string                    { return "/user/current/image" }
-func (CurrentUserImageResource) Title() string                   { return "User image" }
-func (CurrentUserImageResource) Description() string             { return "The image for the authenticated user." }
+func (CurrentUserImageResource) Name() string  { return "current-user-image" }
+func (CurrentUserImageResource) Path() string  { return "/user/current/image" }
+func (CurrentUserImageResource) Title() string { return "User image" }
+func (CurrentUserImageResource) Description() string {
+	return "The image for the authenticated user. GET may ask for an allowed size with ?w=&h=&mode= where the mode is fill, smart, fit, exact, or thumbnail. PUT a form with an image field, or JSON like {\"upload\": uuid} to use a finished resumable upload."
+}
 func (resource CurrentUserImageResource) Properties() []Property { return UserImageProperties }
 
+func (resource CurrentUserImageResource) MaxBodySize(method string) int64 {
+	return resource.Policy.MaxBodySize()
+}
+
 func (resource CurrentUserImageResource) Get(request *APIRequest) (int, interface{}, http.Header) {
 	responseHeader := map[string][]string{}
 	if request.User == nil {
@@ -86,14 +111,15 @@ func (resource CurrentUserImageResource) Get(request *APIRequest) (int, interfac
 	if request.User.Image == "" {
 		return 404, FileNotFoundError, responseHeader
 	}
-	// TODO This size should be set via URL params
-	imageFile, err := FitCrop(700, 700, request.User.Image, request.FS)
+	preset, apiError := request.RequestedImagePreset(resource.Presets)
+	if apiError != nil {
+		return 400, apiError, responseHeader
+	}
+	imageFile, err := request.ImageDerivative(preset, request.User.Image)
 	if err != nil {
-		logger.Print("Error with fit crop ", err.Error())
-		return 500, &APIError{
-			Id:      InternalServerError.Id,
-			Message: "Error reading user image: " + request.User.Image + ": " + err.Error(),
-		}, responseHeader
+		logger.Print("Error with image derivative ", err.Error())
+		status, apiError := DerivativeErrorResponse(err)
+		return status, apiError, responseHeader
 	}
 	err = request.ServeImage(imageFile)
 	if err != nil {
@@ -120,16 +146,42 @@ func (resource CurrentUserImageResource) PutForm(request *APIRequest) (int, inte
 			Message: "An `image` field is required up update your user image",
 		}, responseHeader
 	}
-	fileKey, err := request.FS.Put(fileHeader.Filename, file)
+	defer file.Close()
+	fileRecord, err := request.PutFileWithPolicy(fileHeader.Filename, file, resource.Policy)
+	if err != nil {
+		status, apiError := UploadErrorResponse(err)
+		return status, apiError, responseHeader
+	}
+	return resource.setImage(request, fileRecord)
+}
+
+/*
+Put sets the image to the File of a finished upload, with a body like {"upload": "<uuid>"}
+*/
+func (resource CurrentUserImageResource) Put(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	fileRecord, status, apiError := request.PutUploadWithPolicy(resource.Policy)
+	if fileRecord == nil {
+		return status, apiError, responseHeader
+	}
+	return resource.setImage(request, fileRecord)
+}
+
+/*
+setImage references the newly stored fileRecord from the User and releases their old image
+*/
+func (resource CurrentUserImageResource) setImage(request *APIRequest, fileRecord *FileRecord) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	err := request.ReferenceFile(fileRecord.Key, UserImageReference, request.User.UUID)
 	if err != nil {
 		return http.StatusInternalServerError, &APIError{
-			Id:      "storage_error",
-			Message: "Could not store the file: " + err.Error(),
+			Id:      "database_error",
+			Message: "Could not reference the file: " + err.Error(),
 		}, responseHeader
 	}
 
 	oldFileKey := request.User.Image
-	request.User.Image = fileKey
+	request.User.Image = fileRecord.Key
 	err = UpdateUser(request.User, request.DB)
 	if err != nil {
 		return http.StatusInternalServerError, &APIError{
@@ -138,14 +190,58 @@ func (resource CurrentUserImageResource) PutForm(request *APIRequest) (int, inte
 		}, responseHeader
 	}
 	if oldFileKey != "" {
-		err = request.FS.Delete(oldFileKey, "")
+		// The old file is deleted once the transaction commits, unless another record references it
+		err = request.ReleaseFile(oldFileKey, UserImageReference, request.User.UUID)
 		if err != nil {
-			logger.Print("Could not delete old image: " + err.Error())
+			return http.StatusInternalServerError, &APIError{
+				Id:      "database_error",
+				Message: "Could not release the old file: " + err.Error(),
+			}, responseHeader
 		}
 	}
+	if resource.Pregenerate {
+		request.PregenerateImageDerivatives(fileRecord.Key, resource.Presets)
+	}
 	return 200, "Ok", responseHeader
 }
 
+/*
+CurrentUserImageMetadataResource describes the authenticated request.User's image so that a placeholder can be drawn while it loads
+*/
+type CurrentUserImageMetadataResource struct {
+}
+
+func NewCurrentUserImageMetadataResource() *CurrentUserImageMetadataResource {
+	return &CurrentUserImageMetadataResource{}
+}
+
+func (CurrentUserImageMetadataResource) Name() string  { return "current-user-image-metadata" }
+func (CurrentUserImageMetadataResource) Path() string  { return "/user/current/image/metadata" }
+func (CurrentUserImageMetadataResource) Title() string { return "User image metadata" }
+func (CurrentUserImageMetadataResource) Description() string {
+	return "The size, dominant color, and BlurHash of the authenticated user's image."
+}
+func (resource CurrentUserImageMetadataResource) Properties() []Property {
+	return ImageMetadataProperties
+}
+
+func (resource CurrentUserImageMetadataResource) Get(request *APIRequest) (int, interface{}, http.Header) {
+	responseHeader := map[string][]string{}
+	if request.User == nil {
+		return 401, NotLoggedInError, responseHeader
+	}
+	status, result := request.ImageMetadataResponse(request.User.Image)
+	return status, result, responseHeader
+}
+
+/*
+CurrentUser is the authenticated User with their StorageUsage
+*/
+type CurrentUser struct {
+	*User
+	Storage *StorageUsage `json:"storage"`
+}
+
 /*
 CurrentUserResource returns a user if the GET request is authenticated, otherwise a 404 NotLoggedInError
 */
@@ -164,7 +260,7 @@ func (CurrentUserResource) Description() string {
 }
 
 func (resource CurrentUserResource) Properties() []Property {
-	return UserProperties
+	return CurrentUserProperties
 }
 
 func etagForUser(user *User, version string) []string {
@@ -176,8 +272,18 @@ func (resource CurrentUserResource) Get(request *APIRequest) (int, interface{},
 	if request.User == nil {
 		return 404, NotLoggedInError, responseHeader
 	}
-	responseHeader["Etag"] = etagForUser(request.User, request.Version)
-	return 200, request.User, responseHeader
+	usage, err := FindStorageUsage(request.User.Id, request.DB)
+	if err != nil {
+		return 500, APIError{
+			Id:      "db_error",
+			Message: "Database error",
+			Error:   err.Error(),
+		}, responseHeader
+	}
+	// The usage changes without the User being updated
+	etag := etagForUser(request.User, request.Version)[0] + fmt.Sprintf("-%d-%d", usage.Bytes, usage.Quota)
+	responseHeader["Etag"] = []string{etag}
+	return 200, CurrentUser{User: request.User, Storage: usage}, responseHeader
 }
 
 func (resource CurrentUserResource) Delete(request *APIRequest) (int, interface{}, http.Header) {